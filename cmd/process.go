@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/gojek/darkroom/pkg/service"
+	"github.com/spf13/cobra"
+)
+
+// processFlags are the params of the most common operations, each has a flag of the same name like --fit, the
+// width and height also have the shorthands -w and -h
+var processFlags = []struct {
+	name      string
+	shorthand string
+	usage     string
+}{
+	{"w", "w", "width of the output"},
+	{"h", "h", "height of the output"},
+	{"fit", "", "fit mode: crop, cover, contain, scale, fill, scale-down or auto"},
+	{"crop", "", "crop position like top,left or focal point like 25,75"},
+	{"bg", "", "6 digit hex background color"},
+	{"mono", "", "000000 for a grayscale output"},
+	{"blur", "", "blur radius"},
+	{"rot", "", "rotation in degrees"},
+	{"flip", "", "h, v or hv"},
+	{"q", "", "encoding quality (1-100)"},
+	{"fm", "", "output format: jpg, jpeg, png or webp, taken from the output filename if not set"},
+	{"auto", "", "compress and/or format"},
+}
+
+func newProcessCmd() *cobra.Command {
+	args := struct {
+		input  string
+		output string
+		flags  map[string]*string
+		params map[string]string
+	}{flags: make(map[string]*string, len(processFlags))}
+	cmd := &cobra.Command{
+		Use:   "process",
+		Short: "Process an image file with the image params",
+		Long: `Process an image file, or stdin, with the same params as the server and write the result to a file,
+or stdout. Any param can be given with --param, e.g. --param desat=0.5.`,
+		Example: `  darkroom process -i photo.jpg -o thumb.webp --w 300 --h 300 --fit crop
+  cat photo.jpg | darkroom process --mono 000000 --param desat=1 > gray.jpg`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			params := make(map[string]string, len(args.params)+len(args.flags))
+			for k, v := range args.params {
+				params[k] = v
+			}
+			for name, v := range args.flags {
+				if cmd.Flags().Changed(name) {
+					params[name] = *v
+				}
+			}
+			if params["fm"] == "" && args.output != "" && args.output != "-" && filepath.Ext(args.output) != "" {
+				f, err := service.GetFormatFromFilename(args.output)
+				if err != nil {
+					return err
+				}
+				params["fm"] = f
+			}
+
+			img, err := readProcessInput(cmd, args.input)
+			if err != nil {
+				return err
+			}
+			m := service.NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{},
+				service.WithStrictParams(true))
+			spec := service.NewSpecBuilder().WithImageData(img).WithParams(params).Build()
+			if err := m.Validate(spec); err != nil {
+				return err
+			}
+			out, err := m.Process(spec)
+			if err != nil {
+				return err
+			}
+			return writeProcessOutput(cmd, args.output, out)
+		},
+	}
+	// The help flag is only given its long name, so that -h can't be taken for the height
+	cmd.Flags().Bool("help", false, "help for process")
+	cmd.Flags().StringVarP(&args.input, "input", "i", "-", "image file to process, - for stdin")
+	cmd.Flags().StringVarP(&args.output, "output", "o", "-", "file to write the processed image to, - for stdout")
+	for _, f := range processFlags {
+		args.flags[f.name] = cmd.Flags().StringP(f.name, f.shorthand, "", f.usage)
+	}
+	cmd.Flags().StringToStringVar(&args.params, "param", nil, "any param as key=value, can be repeated")
+	return cmd
+}
+
+func readProcessInput(cmd *cobra.Command, input string) ([]byte, error) {
+	if input == "-" {
+		return ioutil.ReadAll(cmd.InOrStdin())
+	}
+	return ioutil.ReadFile(input)
+}
+
+func writeProcessOutput(cmd *cobra.Command, output string, data []byte) error {
+	if output != "-" {
+		return ioutil.WriteFile(output, data, 0644)
+	}
+	_, err := cmd.OutOrStdout().Write(data)
+	return err
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessCmdSuite struct {
+	suite.Suite
+	rootCmd *cobra.Command
+	buf     *bytes.Buffer
+	img     []byte
+}
+
+func TestProcessCmd(t *testing.T) {
+	suite.Run(t, new(ProcessCmdSuite))
+}
+
+func (s *ProcessCmdSuite) SetupSuite() {
+	img, err := ioutil.ReadFile("../pkg/processor/native/_testdata/test.jpg")
+	s.NoError(err)
+	s.img = img
+}
+
+func (s *ProcessCmdSuite) SetupTest() {
+	s.rootCmd = &cobra.Command{
+		Use: "app",
+	}
+	s.rootCmd.AddCommand(newProcessCmd())
+	s.buf = &bytes.Buffer{}
+	s.rootCmd.SetOut(s.buf)
+	s.rootCmd.SetIn(bytes.NewReader(s.img))
+}
+
+func (s *ProcessCmdSuite) TestProcessStdinToStdout() {
+	s.rootCmd.SetArgs([]string{"process", "-w", "100", "-h", "50", "--fit", "crop"})
+	err := s.rootCmd.Execute()
+	s.NoError(err)
+	cfg, f, err := image.DecodeConfig(s.buf)
+	s.NoError(err)
+	s.Equal("jpeg", f)
+	s.Equal(100, cfg.Width)
+	s.Equal(50, cfg.Height)
+}
+
+func (s *ProcessCmdSuite) TestProcessFileToFile() {
+	dir := s.T().TempDir()
+	in, out := filepath.Join(dir, "in.jpg"), filepath.Join(dir, "out.webp")
+	s.NoError(ioutil.WriteFile(in, s.img, 0644))
+	s.rootCmd.SetArgs([]string{"process", "-i", in, "-o", out, "--param", "desat=0.5", "--w", "200"})
+	err := s.rootCmd.Execute()
+	s.NoError(err)
+	data, err := ioutil.ReadFile(out)
+	s.NoError(err)
+	s.Equal(processor.ContentTypeWebP, processor.DetectContentType(data))
+}
+
+func (s *ProcessCmdSuite) TestProcessRejectsInvalidParams() {
+	s.rootCmd.SetArgs([]string{"process", "-w", "abc", "--param", "widht=200"})
+	err := s.rootCmd.Execute()
+	s.EqualError(err, `invalid params: widht is not a known param; w="abc" must be an integer between 1 and 9999`)
+
+	s.rootCmd.SetArgs([]string{"process", "-o", filepath.Join(s.T().TempDir(), "out.gif")})
+	err = s.rootCmd.Execute()
+	s.Error(err)
+}
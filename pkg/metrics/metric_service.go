@@ -8,4 +8,23 @@ type MetricService interface {
 	TrackDuration(imageProcess string, start time.Time, ImageData []byte)
 
 	CountImageHandlerErrors(kind string)
+
+	CountImageProcessErrors(imageProcess, scope, format string)
+
+	CountFormatChanges(scope, from, to string)
+}
+
+// ParallelismTracker is implemented by a MetricService which tracks the parallelism of processing, the manipulator
+// only reports it to a MetricService implementing it
+type ParallelismTracker interface {
+	// TrackParallelism records the largest number of goroutines an operation on a processed image of the scope
+	// could run at once
+	TrackParallelism(scope string, workers int)
+}
+
+// PixelCounter is implemented by a MetricService which counts the pixels of the processed source images, the
+// manipulator only reports them to a MetricService implementing it
+type PixelCounter interface {
+	// CountProcessedPixels adds the number of pixels, width times height, of a processed source image to the scope
+	CountProcessedPixels(scope string, pixels int)
 }
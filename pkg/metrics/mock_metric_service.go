@@ -17,3 +17,19 @@ func (m *MockMetricService) TrackDuration(imageProcess string, start time.Time,
 func (m *MockMetricService) CountImageHandlerErrors(kind string) {
 	m.Called(kind)
 }
+
+func (m *MockMetricService) CountImageProcessErrors(imageProcess, scope, format string) {
+	m.Called(imageProcess, scope, format)
+}
+
+func (m *MockMetricService) CountFormatChanges(scope, from, to string) {
+	m.Called(scope, from, to)
+}
+
+func (m *MockMetricService) TrackParallelism(scope string, workers int) {
+	m.Called(scope, workers)
+}
+
+func (m *MockMetricService) CountProcessedPixels(scope string, pixels int) {
+	m.Called(scope, pixels)
+}
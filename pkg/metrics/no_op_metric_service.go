@@ -11,3 +11,15 @@ func (NoOpMetricService) TrackDuration(string, time.Time, []byte) {
 
 func (NoOpMetricService) CountImageHandlerErrors(string) {
 }
+
+func (NoOpMetricService) CountImageProcessErrors(string, string, string) {
+}
+
+func (NoOpMetricService) CountFormatChanges(string, string, string) {
+}
+
+func (NoOpMetricService) TrackParallelism(string, int) {
+}
+
+func (NoOpMetricService) CountProcessedPixels(string, int) {
+}
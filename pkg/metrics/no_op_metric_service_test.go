@@ -9,4 +9,7 @@ func TestNoOpMetricService(t *testing.T) {
 	ms := NoOpMetricService{}
 	ms.CountImageHandlerErrors("handler_error")
 	ms.TrackDuration("error", time.Now(), []byte(nil))
+	ms.CountImageProcessErrors("decodeError", "default", "png")
+	ms.CountFormatChanges("default", "png", "jpeg")
+	ms.TrackParallelism("default", 2)
 }
@@ -2,8 +2,6 @@ package metrics
 
 import (
 	"fmt"
-	"net/http"
-	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,6 +10,10 @@ import (
 type prometheusService struct {
 	imageProcessDuration     *prometheus.HistogramVec
 	imageHandlerErrorCounter *prometheus.CounterVec
+	imageProcessErrorCounter *prometheus.CounterVec
+	formatChangeCounter      *prometheus.CounterVec
+	parallelismGauge         *prometheus.GaugeVec
+	processedPixelsCounter   *prometheus.CounterVec
 	reg                      *prometheus.Registry
 }
 
@@ -27,6 +29,26 @@ func NewPrometheus(reg *prometheus.Registry) MetricService {
 				Name: "image_handler_errors",
 				Help: "The total number of errors for each storage and processor",
 			}, []string{"error_type"}),
+		imageProcessErrorCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "image_process_errors",
+				Help: "The total number of errors for each stage to process requested image",
+			}, []string{"process", "scope", "format"}),
+		formatChangeCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "image_format_changes",
+				Help: "The total number of processed images encoded to a different format than their source",
+			}, []string{"scope", "from", "to"}),
+		parallelismGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "image_process_parallelism",
+				Help: "The largest number of goroutines an operation of the last processed image could use",
+			}, []string{"scope"}),
+		processedPixelsCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "image_processed_pixels",
+				Help: "The total number of pixels of the source images processed",
+			}, []string{"scope"}),
 
 		reg: reg,
 	}
@@ -39,6 +61,10 @@ func (p prometheusService) registerMetrics() {
 	p.reg.MustRegister(
 		p.imageProcessDuration,
 		p.imageHandlerErrorCounter,
+		p.imageProcessErrorCounter,
+		p.formatChangeCounter,
+		p.parallelismGauge,
+		p.processedPixelsCounter,
 	)
 }
 
@@ -51,8 +77,23 @@ func (p prometheusService) CountImageHandlerErrors(kind string) {
 	p.imageHandlerErrorCounter.WithLabelValues(kind).Inc()
 }
 
+func (p prometheusService) CountImageProcessErrors(imageProcess, scope, format string) {
+	p.imageProcessErrorCounter.WithLabelValues(imageProcess, getScope(scope), format).Inc()
+}
+
+func (p prometheusService) CountFormatChanges(scope, from, to string) {
+	p.formatChangeCounter.WithLabelValues(getScope(scope), from, to).Inc()
+}
+
+func (p prometheusService) TrackParallelism(scope string, workers int) {
+	p.parallelismGauge.WithLabelValues(getScope(scope)).Set(float64(workers))
+}
+
+func (p prometheusService) CountProcessedPixels(scope string, pixels int) {
+	p.processedPixelsCounter.WithLabelValues(getScope(scope)).Add(float64(pixels))
+}
+
 func (p prometheusService) getImageType(ImageData []byte) string {
-	ext := strings.Split(http.DetectContentType(ImageData), "/")[1]
-	labelValue := fmt.Sprintf("%s.%s", GetImageSizeCluster(ImageData), ext)
+	labelValue := fmt.Sprintf("%s.%s", GetImageSizeCluster(ImageData), GetImageFormat(ImageData))
 	return labelValue
 }
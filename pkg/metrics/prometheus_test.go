@@ -57,6 +57,54 @@ func TestPrometheusMetrics(t *testing.T) {
 			},
 			expCode: 200,
 		},
+		{
+			name: "Measuring decode and encode errors should expose metrics on prometheus endpoint.",
+			addMetrics: func(s MetricService) {
+				s.CountImageProcessErrors("decodeError", "", "octet-stream")
+				s.CountImageProcessErrors("decodeError", "", "octet-stream")
+				s.CountImageProcessErrors("encodeError", "thumbnails", "webp")
+			},
+			expMetrics: []string{
+				`image_process_errors{format="octet-stream",process="decodeError",scope="default"} 2`,
+				`image_process_errors{format="webp",process="encodeError",scope="thumbnails"} 1`,
+			},
+			expCode: 200,
+		},
+		{
+			name: "Measuring format changes should expose metrics on prometheus endpoint.",
+			addMetrics: func(s MetricService) {
+				s.CountFormatChanges("", "png", "jpeg")
+				s.CountFormatChanges("avatar", "jpeg", "webp")
+			},
+			expMetrics: []string{
+				`image_format_changes{from="png",scope="default",to="jpeg"} 1`,
+				`image_format_changes{from="jpeg",scope="avatar",to="webp"} 1`,
+			},
+			expCode: 200,
+		},
+		{
+			name: "Tracking parallelism should expose metrics on prometheus endpoint.",
+			addMetrics: func(s MetricService) {
+				s.(ParallelismTracker).TrackParallelism("", 4)
+				s.(ParallelismTracker).TrackParallelism("avatar", 2)
+			},
+			expMetrics: []string{
+				`image_process_parallelism{scope="default"} 4`,
+				`image_process_parallelism{scope="avatar"} 2`,
+			},
+			expCode: 200,
+		},
+		{
+			name: "Counting processed pixels should expose metrics on prometheus endpoint.",
+			addMetrics: func(s MetricService) {
+				s.(PixelCounter).CountProcessedPixels("", 1500)
+				s.(PixelCounter).CountProcessedPixels("", 500)
+			},
+			expMetrics: []string{
+				`image_processed_pixels{scope="default"} 2000`,
+			},
+			expCode: 200,
+		},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stat holds the aggregate of the updates of a metric key, Total, Min and Max are only set for durations. Count is
+// the number of updates, except for processedPixels where it is the sum of the counted pixels.
+type Stat struct {
+	Count int64         `json:"count"`
+	Total time.Duration `json:"total_ns,omitempty"`
+	Min   time.Duration `json:"min_ns,omitempty"`
+	Max   time.Duration `json:"max_ns,omitempty"`
+}
+
+// Mean returns the average duration of the Stat, 0 for counters
+func (s Stat) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// SnapshotService is a MetricService accumulating the updates it receives in memory, so that their current
+// aggregates can be read with Snapshot, e.g. to serialize them to JSON in a debug handler. Every update is
+// also forwarded to the wrapped MetricService, it is safe for concurrent use.
+type SnapshotService struct {
+	next  MetricService
+	mu    sync.Mutex
+	stats map[string]Stat
+}
+
+// NewSnapshotService returns a new SnapshotService forwarding the updates to next, nil only accumulates them
+func NewSnapshotService(next MetricService) *SnapshotService {
+	if next == nil {
+		next = NoOpMetricService{}
+	}
+	return &SnapshotService{next: next, stats: make(map[string]Stat)}
+}
+
+// Snapshot returns a copy of the accumulated Stat per key, the keys are the names the statsd collector uses,
+// e.g. "decodeDuration.<=128KB.jpeg" for durations and "decodeError.default.png" for errors
+func (s *SnapshotService) Snapshot() map[string]Stat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]Stat, len(s.stats))
+	for k, v := range s.stats {
+		stats[k] = v
+	}
+	return stats
+}
+
+// Reset clears the accumulated stats
+func (s *SnapshotService) Reset() {
+	s.mu.Lock()
+	s.stats = make(map[string]Stat)
+	s.mu.Unlock()
+}
+
+func (s *SnapshotService) TrackDuration(imageProcess string, start time.Time, ImageData []byte) {
+	d := time.Since(start)
+	key := fmt.Sprintf("%s.%s.%s", imageProcess, GetImageSizeCluster(ImageData), GetImageFormat(ImageData))
+	s.mu.Lock()
+	st := s.stats[key]
+	if st.Count == 0 || d < st.Min {
+		st.Min = d
+	}
+	if d > st.Max {
+		st.Max = d
+	}
+	st.Count++
+	st.Total += d
+	s.stats[key] = st
+	s.mu.Unlock()
+	s.next.TrackDuration(imageProcess, start, ImageData)
+}
+
+func (s *SnapshotService) CountImageHandlerErrors(kind string) {
+	s.count(kind)
+	s.next.CountImageHandlerErrors(kind)
+}
+
+func (s *SnapshotService) CountImageProcessErrors(imageProcess, scope, format string) {
+	s.count(fmt.Sprintf("%s.%s.%s", imageProcess, getScope(scope), format))
+	s.next.CountImageProcessErrors(imageProcess, scope, format)
+}
+
+func (s *SnapshotService) CountFormatChanges(scope, from, to string) {
+	s.count(fmt.Sprintf("formatChange.%s.%s.%s", getScope(scope), from, to))
+	s.next.CountFormatChanges(scope, from, to)
+}
+
+func (s *SnapshotService) TrackParallelism(scope string, workers int) {
+	s.count(fmt.Sprintf("parallelism.%s.%d", getScope(scope), workers))
+	if t, ok := s.next.(ParallelismTracker); ok {
+		t.TrackParallelism(scope, workers)
+	}
+}
+
+func (s *SnapshotService) CountProcessedPixels(scope string, pixels int) {
+	s.add(fmt.Sprintf("processedPixels.%s", getScope(scope)), int64(pixels))
+	if c, ok := s.next.(PixelCounter); ok {
+		c.CountProcessedPixels(scope, pixels)
+	}
+}
+
+func (s *SnapshotService) count(key string) {
+	s.add(key, 1)
+}
+
+func (s *SnapshotService) add(key string, n int64) {
+	s.mu.Lock()
+	st := s.stats[key]
+	st.Count += n
+	s.stats[key] = st
+	s.mu.Unlock()
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSnapshotService(t *testing.T) {
+	next := &MockMetricService{}
+	next.On("TrackDuration", "decodeDuration", mock.Anything, []byte(nil))
+	next.On("CountImageHandlerErrors", "storage_get_error")
+	next.On("CountImageProcessErrors", "decodeError", "", "png")
+	next.On("CountFormatChanges", "product", "png", "jpeg")
+	next.On("TrackParallelism", "", 2)
+	next.On("CountProcessedPixels", "", 1500)
+	s := NewSnapshotService(next)
+
+	s.TrackDuration("decodeDuration", time.Now().Add(-2*time.Second), nil)
+	s.TrackDuration("decodeDuration", time.Now().Add(-1*time.Second), nil)
+	s.CountImageHandlerErrors("storage_get_error")
+	s.CountImageProcessErrors("decodeError", "", "png")
+	s.CountImageProcessErrors("decodeError", "", "png")
+	s.CountFormatChanges("product", "png", "jpeg")
+	s.TrackParallelism("", 2)
+	s.CountProcessedPixels("", 1500)
+	s.CountProcessedPixels("", 1500)
+
+	snapshot := s.Snapshot()
+	assert.Len(t, snapshot, 6)
+	d := snapshot["decodeDuration.<=128KB.plain"]
+	assert.Equal(t, int64(2), d.Count)
+	assert.InDelta(t, float64(time.Second), float64(d.Min), float64(100*time.Millisecond))
+	assert.InDelta(t, float64(2*time.Second), float64(d.Max), float64(100*time.Millisecond))
+	assert.InDelta(t, float64(1500*time.Millisecond), float64(d.Mean()), float64(100*time.Millisecond))
+	assert.Equal(t, Stat{Count: 1}, snapshot["storage_get_error"])
+	assert.Equal(t, Stat{Count: 2}, snapshot["decodeError.default.png"])
+	assert.Equal(t, Stat{Count: 1}, snapshot["formatChange.product.png.jpeg"])
+	assert.Equal(t, Stat{Count: 1}, snapshot["parallelism.default.2"])
+	// The pixels are summed up
+	assert.Equal(t, Stat{Count: 3000}, snapshot["processedPixels.default"])
+	next.AssertNumberOfCalls(t, "CountProcessedPixels", 2)
+	next.AssertNumberOfCalls(t, "TrackDuration", 2)
+	next.AssertNumberOfCalls(t, "CountImageProcessErrors", 2)
+
+	// The snapshot is a copy
+	snapshot["storage_get_error"] = Stat{}
+	assert.Equal(t, Stat{Count: 1}, s.Snapshot()["storage_get_error"])
+
+	s.Reset()
+	assert.Empty(t, s.Snapshot())
+	assert.Equal(t, time.Duration(0), Stat{}.Mean())
+}
+
+func TestSnapshotService_Concurrent(t *testing.T) {
+	s := NewSnapshotService(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				s.TrackDuration("cropDuration", time.Now(), nil)
+				s.CountImageHandlerErrors("error")
+				_ = s.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1000), s.Snapshot()["cropDuration.<=128KB.plain"].Count)
+	assert.Equal(t, int64(1000), s.Snapshot()["error"].Count)
+}
@@ -2,8 +2,6 @@ package metrics
 
 import (
 	"fmt"
-	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gojek/darkroom/pkg/config"
@@ -78,8 +76,35 @@ func (s statsdClient) CountImageHandlerErrors(kind string) {
 	}
 }
 
+func (s statsdClient) CountImageProcessErrors(imageProcess, scope, format string) {
+	err := s.client.Inc(fmt.Sprintf("%s.%s.%s", imageProcess, getScope(scope), format), 1, s.sampleRate)
+	if err != nil {
+		logger.Errorf("MetricService.CountImageProcessErrors got an error: %s", err)
+	}
+}
+
+func (s statsdClient) CountFormatChanges(scope, from, to string) {
+	err := s.client.Inc(fmt.Sprintf("formatChange.%s.%s.%s", getScope(scope), from, to), 1, s.sampleRate)
+	if err != nil {
+		logger.Errorf("MetricService.CountFormatChanges got an error: %s", err)
+	}
+}
+
+func (s statsdClient) TrackParallelism(scope string, workers int) {
+	err := s.client.Gauge(fmt.Sprintf("parallelism.%s", getScope(scope)), int64(workers), s.sampleRate)
+	if err != nil {
+		logger.Errorf("MetricService.TrackParallelism got an error: %s", err)
+	}
+}
+
+func (s statsdClient) CountProcessedPixels(scope string, pixels int) {
+	err := s.client.Inc(fmt.Sprintf("processedPixels.%s", getScope(scope)), int64(pixels), s.sampleRate)
+	if err != nil {
+		logger.Errorf("MetricService.CountProcessedPixels got an error: %s", err)
+	}
+}
+
 func (s statsdClient) getMetricTag(imageProcess string, ImageData []byte) string {
-	ext := strings.Split(http.DetectContentType(ImageData), "/")[1]
-	tag := fmt.Sprintf("%s.%s.%s", imageProcess, GetImageSizeCluster(ImageData), ext)
+	tag := fmt.Sprintf("%s.%s.%s", imageProcess, GetImageSizeCluster(ImageData), GetImageFormat(ImageData))
 	return tag
 }
@@ -57,6 +57,15 @@ func TestStatsDMetricsUpdate(t *testing.T) {
 		mock.AnythingOfType("float32")).Return(nil)
 	instance.CountImageHandlerErrors("")
 
+	mc.On("Inc", "decodeError.default.png", int64(1), float32(1)).Return(nil)
+	instance.CountImageProcessErrors("decodeError", "", "png")
+
+	mc.On("Inc", "formatChange.avatar.png.jpeg", int64(1), float32(1)).Return(nil)
+	instance.CountFormatChanges("avatar", "png", "jpeg")
+
+	mc.On("Gauge", "parallelism.default", int64(2), float32(1)).Return(nil)
+	instance.TrackParallelism("", 2)
+
 	mc.AssertExpectations(t)
 }
 
@@ -1,5 +1,10 @@
 package metrics
 
+import (
+	"net/http"
+	"strings"
+)
+
 // GetImageSizeCluster takes in byte array and return the size cluster for tracking purpose
 func GetImageSizeCluster(imageData []byte) string {
 	switch sz := len(imageData); {
@@ -17,3 +22,16 @@ func GetImageSizeCluster(imageData []byte) string {
 		return ">2MB"
 	}
 }
+
+// GetImageFormat takes in byte array and returns the sniffed format (e.g. "png", "jpeg") for tracking purpose
+func GetImageFormat(imageData []byte) string {
+	mediaType := strings.Split(http.DetectContentType(imageData), ";")[0]
+	return strings.Split(mediaType, "/")[1]
+}
+
+func getScope(scope string) string {
+	if scope == "" {
+		return DefaultScope
+	}
+	return scope
+}
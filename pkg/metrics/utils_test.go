@@ -14,3 +14,10 @@ func TestGetImageSizeCluster(t *testing.T) {
 	assert.Equal(t, "<=2MB", GetImageSizeCluster(make([]byte, 2048*1024)), "<=500KB")
 	assert.Equal(t, ">2MB", GetImageSizeCluster(make([]byte, 2049*1024)), "<=500KB")
 }
+
+func TestGetImageFormat(t *testing.T) {
+	assert.Equal(t, "png", GetImageFormat([]byte("\x89PNG\x0D\x0A\x1A\x0A")))
+	assert.Equal(t, "jpeg", GetImageFormat([]byte("\xFF\xD8\xFF")))
+	assert.Equal(t, "octet-stream", GetImageFormat([]byte{0x00, 0x01}))
+	assert.Equal(t, "plain", GetImageFormat(nil))
+}
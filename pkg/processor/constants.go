@@ -27,4 +27,54 @@ const (
 	ExtensionPNG  = "png"
 	ExtensionJPG  = "jpg"
 	ExtensionJPEG = "jpeg"
+	ExtensionSVG  = "svg"
+)
+
+// Compression specifies the trade-off between encoding speed and output size for lossless formats
+type Compression int
+
+const (
+	// CompressionDefault uses the compression level of the configured encoder
+	CompressionDefault Compression = iota
+	// CompressionSpeed favours encoding speed over output size
+	CompressionSpeed
+	// CompressionBest favours output size over encoding speed
+	CompressionBest
+)
+
+// Filter specifies the interpolation used when resampling an image
+type Filter int
+
+const (
+	// FilterLinear interpolates linearly (bilinear), it is the default for all resampling
+	FilterLinear Filter = iota
+	// FilterNearestNeighbor picks the nearest pixel, keeping hard edges but aliasing diagonals
+	FilterNearestNeighbor
+	// FilterCatmullRom is a sharp cubic filter
+	FilterCatmullRom
+	// FilterLanczos is the sharpest and slowest filter
+	FilterLanczos
+)
+
+// Oversize specifies how a watermark whose overlay ends up larger than the base is handled
+type Oversize int
+
+const (
+	// OversizeFit scales the overlay down, keeping its aspect ratio, until it fits within the base. It is the default.
+	OversizeFit Oversize = iota
+	// OversizeCrop crops the overlay to the size of the base around its center
+	OversizeCrop
+	// OversizeError fails the watermark with an error instead of compositing it
+	OversizeError
+)
+
+// Dither specifies how the error of mapping a pixel to the nearest color of a palette is hidden
+type Dither int
+
+const (
+	// DitherNone maps every pixel to its nearest palette color, gradients show bands
+	DitherNone Dither = iota
+	// DitherFloydSteinberg diffuses the error of each pixel onto its unvisited neighbours, the pixels are visited
+	// row by row from the top-left so the output is the same for the same input
+	DitherFloydSteinberg
 )
@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+)
+
+const (
+	// ContentTypeJPEG is the MIME type of JPEG images
+	ContentTypeJPEG = "image/jpeg"
+	// ContentTypePNG is the MIME type of PNG images
+	ContentTypePNG = "image/png"
+	// ContentTypeWebP is the MIME type of WebP images
+	ContentTypeWebP = "image/webp"
+	// ContentTypeSVG is the MIME type of SVG images
+	ContentTypeSVG = "image/svg+xml"
+
+	// svgSniffLen is the number of bytes looked at for the root svg element, leaving room for an XML
+	// declaration and comments before it
+	svgSniffLen = 1024
+
+	pngSignature = "\x89PNG\r\n\x1a\n"
+)
+
+// DetectContentType takes an input byte array and returns its MIME type by sniffing the content,
+// independent of any file extension. It uses http.DetectContentType and additionally recognises
+// the image formats it misses that Decode accepts, so formats darkroom can't decode, like AVIF, aren't
+// reported as images. "application/octet-stream" is returned if the type is unknown.
+func DetectContentType(data []byte) string {
+	switch {
+	case isWebP(data):
+		return ContentTypeWebP
+	case isSVG(data):
+		return ContentTypeSVG
+	}
+	return http.DetectContentType(data)
+}
+
+// isWebP checks for the RIFF container with the WEBP form type
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+// isSVG checks for an svg element at the start of a text document, optionally preceded by an XML
+// declaration, a doctype or comments
+func isSVG(data []byte) bool {
+	if len(data) > svgSniffLen {
+		data = data[:svgSniffLen]
+	}
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if !bytes.HasPrefix(data, []byte("<")) {
+		return false
+	}
+	if bytes.HasPrefix(data, []byte("<svg")) {
+		return true
+	}
+	return (bytes.HasPrefix(data, []byte("<?xml")) || bytes.HasPrefix(data, []byte("<!"))) && bytes.Contains(data, []byte("<svg"))
+}
+
+// IsAnimatedPNG returns true if data is an APNG with more than one frame, i.e. a PNG with an acTL chunk
+// before its image data. Other decoders only see the default image of an APNG.
+func IsAnimatedPNG(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return false
+	}
+	for i := len(pngSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		switch string(data[i+4 : i+8]) {
+		case "acTL":
+			return length >= 8 && i+12 <= len(data) && binary.BigEndian.Uint32(data[i+8:i+12]) > 1
+		case "IDAT", "IEND":
+			return false
+		}
+		// Length, type and CRC take 12 bytes on top of the chunk data
+		if length < 0 || length > len(data) {
+			return false
+		}
+		i += length + 12
+	}
+	return false
+}
+
+// IsAnimatedWebP returns true if data is a WebP with the animation flag set in its extended header, the
+// VP8X chunk, which has to be the first chunk. Other decoders only see the first frame or fail.
+func IsAnimatedWebP(data []byte) bool {
+	return isWebP(data) && len(data) >= 21 && bytes.Equal(data[12:16], []byte("VP8X")) && data[20]&0x02 != 0
+}
+
+// IsAnimatedGIF returns true if data is a GIF with more than one image, the decoders of the image package
+// only return the first one
+func IsAnimatedGIF(data []byte) bool {
+	if len(data) < 13 || !(bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return false
+	}
+	// The logical screen descriptor is followed by the global color table, if any
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	images := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21:
+			// Extensions have a label byte followed by data sub-blocks
+			i = skipGIFSubBlocks(data, i+2)
+		case 0x2c:
+			if images++; images > 1 {
+				return true
+			}
+			if i+10 > len(data) {
+				return false
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			// The LZW minimum code size precedes the sub-blocks of the image data
+			i = skipGIFSubBlocks(data, i+1)
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// skipGIFSubBlocks returns the index after the data sub-blocks starting at i, i.e. after their zero-length
+// terminator, or len(data) if they are cut off
+func skipGIFSubBlocks(data []byte, i int) int {
+	for i < len(data) {
+		n := int(data[i])
+		i++
+		if n == 0 {
+			return i
+		}
+		i += n
+	}
+	return len(data)
+}
+
+// IsAnimated returns true if data is an APNG, a WebP or a GIF with more than one frame
+func IsAnimated(data []byte) bool {
+	return IsAnimatedPNG(data) || IsAnimatedWebP(data) || IsAnimatedGIF(data)
+}
@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectContentType(t *testing.T) {
+	cases := []struct {
+		file     string
+		expected string
+	}{
+		{file: "native/_testdata/test.jpg", expected: ContentTypeJPEG},
+		{file: "native/_testdata/test.png", expected: ContentTypePNG},
+		{file: "native/_testdata/test.webp", expected: ContentTypeWebP},
+	}
+	for _, c := range cases {
+		data, err := ioutil.ReadFile(c.file)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, DetectContentType(data))
+	}
+}
+
+func TestDetectContentTypeWithAVIF(t *testing.T) {
+	// AVIF can't be decoded, so it isn't reported as an image
+	header := []byte{0x00, 0x00, 0x00, 0x1c, 'f', 't', 'y', 'p', 'a', 'v', 'i', 'f', 0x00, 0x00, 0x00, 0x00}
+	assert.NotContains(t, DetectContentType(header), "image/")
+}
+
+func TestDetectContentTypeWithSVG(t *testing.T) {
+	cases := []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"></svg>`,
+		"\n  <svg viewBox=\"0 0 10 10\"/>",
+		`<?xml version="1.0" encoding="UTF-8"?><svg viewBox="0 0 10 10"/>`,
+		`<!-- icon --><svg viewBox="0 0 10 10"/>`,
+		"\xef\xbb\xbf<svg viewBox=\"0 0 10 10\"/>",
+	}
+	for _, c := range cases {
+		assert.Equal(t, ContentTypeSVG, DetectContentType([]byte(c)))
+	}
+
+	assert.NotEqual(t, ContentTypeSVG, DetectContentType([]byte(`<?xml version="1.0"?><html></html>`)))
+	assert.NotEqual(t, ContentTypeSVG, DetectContentType([]byte(`text mentioning <svg>`)))
+}
+
+func TestDetectContentTypeWithUnknownData(t *testing.T) {
+	assert.Equal(t, "application/octet-stream", DetectContentType([]byte{0x00, 0x01, 0x02}))
+	assert.Equal(t, "text/plain; charset=utf-8", DetectContentType([]byte("badImage.ext")))
+	assert.Equal(t, "text/plain; charset=utf-8", DetectContentType(nil))
+}
+
+func TestIsAnimatedPNG(t *testing.T) {
+	chunk := func(typ string, data ...byte) []byte {
+		c := []byte{0, 0, 0, byte(len(data))}
+		c = append(c, typ...)
+		c = append(c, data...)
+		// The checksum is not verified when sniffing
+		return append(c, 0, 0, 0, 0)
+	}
+	ihdr := chunk("IHDR", make([]byte, 13)...)
+	png := func(chunks ...[]byte) []byte {
+		data := []byte(pngSignature)
+		for _, c := range chunks {
+			data = append(data, c...)
+		}
+		return data
+	}
+
+	assert.True(t, IsAnimatedPNG(png(ihdr, chunk("acTL", 0, 0, 0, 2, 0, 0, 0, 0), chunk("IDAT"))))
+	assert.False(t, IsAnimatedPNG(png(ihdr, chunk("acTL", 0, 0, 0, 1, 0, 0, 0, 0), chunk("IDAT"))))
+	assert.False(t, IsAnimatedPNG(png(ihdr, chunk("IDAT"), chunk("acTL", 0, 0, 0, 2, 0, 0, 0, 0))))
+	assert.False(t, IsAnimatedPNG(png(ihdr, chunk("IEND"))))
+	assert.False(t, IsAnimatedPNG(png(ihdr)[:20]))
+
+	data, _ := ioutil.ReadFile("native/_testdata/test.png")
+	assert.False(t, IsAnimatedPNG(data))
+	data, _ = ioutil.ReadFile("native/_testdata/test.jpg")
+	assert.False(t, IsAnimatedPNG(data))
+}
+
+func TestIsAnimatedWebP(t *testing.T) {
+	webp := func(fourCC string, flags byte) []byte {
+		data := append([]byte("RIFF\x00\x00\x00\x00WEBP"), fourCC...)
+		return append(data, 10, 0, 0, 0, flags, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+
+	assert.True(t, IsAnimatedWebP(webp("VP8X", 0x12)))
+	assert.False(t, IsAnimatedWebP(webp("VP8X", 0x10)))
+	assert.False(t, IsAnimatedWebP(webp("VP8L", 0x02)))
+	assert.False(t, IsAnimatedWebP(webp("VP8X", 0x02)[:20]))
+
+	data, _ := ioutil.ReadFile("native/_testdata/test.webp")
+	assert.False(t, IsAnimatedWebP(data))
+	data, _ = ioutil.ReadFile("native/_testdata/test.png")
+	assert.False(t, IsAnimatedWebP(data))
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	encode := func(frames int) []byte {
+		g := &gif.GIF{}
+		for i := 0; i < frames; i++ {
+			g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9))
+			g.Delay = append(g.Delay, 10)
+		}
+		var buf bytes.Buffer
+		_ = gif.EncodeAll(&buf, g)
+		return buf.Bytes()
+	}
+
+	assert.True(t, IsAnimatedGIF(encode(2)))
+	assert.False(t, IsAnimatedGIF(encode(1)))
+	assert.False(t, IsAnimatedGIF(encode(2)[:20]))
+
+	data, _ := ioutil.ReadFile("native/_testdata/test.png")
+	assert.False(t, IsAnimatedGIF(data))
+	assert.True(t, IsAnimated(encode(3)))
+	assert.False(t, IsAnimated(data))
+}
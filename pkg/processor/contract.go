@@ -1,8 +1,183 @@
 package processor
 
+import (
+	"image"
+	"image/color"
+	"time"
+)
+
 type OverlayAttrs struct {
 	Img              []byte
 	Point            Point
 	WidthPercentage  float64
 	HeightPercentage float64
+	// Position centers the overlay on a point given as fractions of the base width and height instead of
+	// anchoring it to Point, the overlay is moved as needed to stay within the base
+	Position *FocalPoint
+	// Margin keeps an overlay anchored to Point this many pixels away from the edges of the base, it is ignored
+	// with Position
+	Margin int
+}
+
+// FocalPoint specifies the focus point of a crop as fractions (0 to 1) of the image width and height,
+// measured from the top-left corner
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+// EncodeOptions holds the options for encoding a single image, zero values fall back to the
+// options of the configured encoders
+type EncodeOptions struct {
+	// Quality is the lossy encoding quality (1-100) used for JPEG and WebP
+	Quality int
+	// Compression is the compression level used for PNG
+	Compression Compression
+	// Background is the color transparent pixels are flattened onto when encoding to JPEG
+	Background color.Color
+	// DPI is the pixel density in dots per inch written to JPEG (JFIF) and PNG (pHYs) outputs for print
+	// layouts, 0 writes none
+	DPI int
+	// KeepPNG encodes an opaque image requested as PNG as PNG instead of downgrading it to JPEG
+	KeepPNG bool
+}
+
+// CropOptions holds the options for cropping a single image
+type CropOptions struct {
+	// Offset moves the crop window from where the Point anchors it by a number of pixels of the resized image,
+	// e.g. {Y: 20} 20 pixels down, the window is kept within the image
+	Offset image.Point
+}
+
+// SmartCropOptions holds the options for picking the crop window of a single image from its content
+type SmartCropOptions struct {
+	// Faces are the bounds of the faces found in the image, in its pixels. The crop window is centered on them and
+	// tightened around them as far as the output size allows, without faces the window with the most detail is kept.
+	Faces []image.Rectangle
+	// FacePadding grows the bounds of the faces by a fraction of their width and height on every side, e.g. 0.2
+	// keeps some of the hair and shoulders around a face
+	FacePadding float64
+}
+
+// QuantizeOptions holds the options for reducing the colors of a single image to a palette
+type QuantizeOptions struct {
+	// Dither hides the banding of the reduced colors, the zero value maps each pixel to its nearest color
+	Dither Dither
+}
+
+// RotateOptions holds the options for rotating a single image
+type RotateOptions struct {
+	// Expand grows the bounds to fit the whole rotated image, otherwise the original bounds are kept
+	// and the corners outside of them are cropped
+	Expand bool
+	// Background fills the area not covered by the rotated image, nil leaves it transparent
+	Background color.Color
+}
+
+// PadOptions holds the options for padding a single image
+type PadOptions struct {
+	// Blur fills the padding with a copy of the image covering the whole canvas, blurred by this radius in
+	// pixels of the canvas, instead of leaving the background visible. 0 pads with the background only.
+	Blur float64
+}
+
+// GrayScaleOptions holds the options for grayscaling a single image
+type GrayScaleOptions struct {
+	// SingleChannel returns an *image.Gray that is encoded as a grayscale PNG or JPEG, the alpha channel is
+	// dropped and transparent pixels become black. Otherwise an RGBA image with equal channels is returned.
+	SingleChannel bool
+}
+
+// WatermarkOptions holds the options for watermarking a single image
+type WatermarkOptions struct {
+	// Filter is the interpolation used to resize the overlay
+	Filter Filter
+	// Position centers the overlay on a point given as fractions of the base width and height, e.g. {X: 0.9, Y: 0.1}
+	// near the top-right corner, the overlay is moved as needed to stay within the base. nil centers it on the base.
+	Position *FocalPoint
+	// Anchor places the overlay at an edge or corner of the base, e.g. PointBottomRight, Margin pixels away from
+	// the edges. It is ignored if Position is set, the zero value centers the overlay.
+	Anchor Point
+	// Margin is the distance in pixels between the overlay and the edges of the base, which stays the same for any
+	// size of the base, e.g. 16 for a logo always 16 pixels from the bottom-right corner
+	Margin int
+	// Width resizes the overlay to a fixed width in pixels instead of half of the base width, keeping its aspect
+	// ratio. 0 uses half of the base width.
+	Width int
+	// MaxWidth limits the width of the overlay in pixels, e.g. to keep it at half of the base width on small bases
+	// without growing past its design size on large ones. 0 doesn't limit it.
+	MaxWidth int
+	// MinSize skips the watermark when the smaller dimension of the base is below it, e.g. for thumbnails
+	// where the overlay would cover most of the image. 0 always applies the watermark.
+	MinSize int
+	// Color recolors the overlay before it is composited, keeping its alpha and its shading relative to white,
+	// e.g. a white logo becomes exactly this color. nil keeps the colors of the overlay.
+	Color color.Color
+	// AutoContrast recolors the overlay to black on a light region of the base and to white on a dark one,
+	// the region covered by the overlay is sampled. On a region of medium brightness Color is used instead.
+	AutoContrast bool
+	// Shadow draws a drop shadow behind the overlay for legibility on busy bases, nil draws none
+	Shadow *WatermarkShadow
+	// Oversize handles an overlay that is larger than the base after it is resized, e.g. a tall logo on a wide
+	// banner, which would otherwise be clipped. The zero value OversizeFit scales it down to fit.
+	Oversize Oversize
+}
+
+// WatermarkShadow describes the drop shadow of a watermark, a blurred copy of the overlay in a single color
+type WatermarkShadow struct {
+	// Offset moves the shadow relative to the overlay in pixels, e.g. {X: 2, Y: 2} down and to the right
+	Offset image.Point
+	// Blur is the radius of the gaussian blur softening the shadow, 0 keeps the edges of the overlay
+	Blur float64
+	// Opacity of the shadow, it is multiplied with the opacity of the watermark. 0 draws no shadow.
+	Opacity uint8
+	// Color of the shadow, nil is black
+	Color color.Color
+}
+
+// Histogram holds the number of pixels with each 8-bit value per channel, the colors are not alpha-premultiplied
+// and fully transparent pixels are not counted
+type Histogram struct {
+	R    [256]int
+	G    [256]int
+	B    [256]int
+	Luma [256]int
+	// Total is the number of counted pixels, large images are sampled so it can be lower than their area
+	Total int
+}
+
+// CaptureInfo holds the capture metadata of a photo read from its EXIF
+type CaptureInfo struct {
+	// Time is the DateTimeOriginal, in the zone of the OffsetTimeOriginal if there is one and in UTC otherwise.
+	// It is the zero time if the EXIF has no valid DateTimeOriginal.
+	Time time.Time
+	// Make is the manufacturer of the camera, empty if unknown
+	Make string
+	// Model is the model of the camera, empty if unknown
+	Model string
+}
+
+// SpriteLayout describes the grid of a sprite sheet
+type SpriteLayout struct {
+	Columns     int
+	Rows        int
+	FrameWidth  int
+	FrameHeight int
+	// Frames holds the rectangle of each frame within the sheet, in the order of the frames
+	Frames []image.Rectangle
+}
+
+// Animation holds the frames of an animated image, every frame is a full canvas of the same size
+// with the disposal and blending of the source already applied
+type Animation struct {
+	Frames []image.Image
+	// Delays holds how long each of the Frames is shown
+	Delays []time.Duration
+	// LoopCount is the number of times the animation is played, 0 loops forever
+	LoopCount int
+	// Format is the extension the animation is encoded to, ExtensionWebP for animated WebP and animated
+	// PNG otherwise
+	Format string
+	// Quality is the quality (1-100) animated WebPs are encoded with, 0 for the default quality of the processor
+	Quality int
 }
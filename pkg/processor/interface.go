@@ -1,11 +1,32 @@
 package processor
 
-import "image"
+import (
+	"image"
+	"image/color"
+)
 
 // Processor interface for performing operations on image bytes
 type Processor interface {
 	// Crop takes an image.Image, width, height and a Point and returns the cropped image
 	Crop(image image.Image, width, height int, point Point) image.Image
+	// CropWithOptions takes an image.Image, width, height, a Point and CropOptions and returns the image cropped
+	// like Crop, with the crop window moved by CropOptions
+	CropWithOptions(image image.Image, width, height int, point Point, opts CropOptions) image.Image
+	// Cover takes an image.Image, width, height and a Point and returns the image scaled by the minimal factor
+	// covering width x height with its overflow cropped from the Point
+	Cover(image image.Image, width, height int, point Point) image.Image
+	// FocalCrop takes an image.Image, width, height and a FocalPoint and returns the cropped image
+	// with the crop window centered on the focal point as far as the image bounds allow
+	FocalCrop(image image.Image, width, height int, point FocalPoint) image.Image
+	// SmartCrop takes an image.Image, width, height and SmartCropOptions and returns the image cropped to the faces
+	// of SmartCropOptions, or to its most detailed region without faces
+	SmartCrop(image image.Image, width, height int, opts SmartCropOptions) image.Image
+	// Pad takes an image.Image, width, height, a Point and a background color and returns a width x height
+	// image filled with the background color and the input image anchored at the Point
+	Pad(image image.Image, width, height int, point Point, background color.Color) image.Image
+	// PadWithOptions takes an image.Image, width, height, a Point, a background color and PadOptions and
+	// returns the padded image like Pad, with the padding controlled by PadOptions
+	PadWithOptions(image image.Image, width, height int, point Point, background color.Color, opts PadOptions) image.Image
 	// Resize takes an image.Image, width and height and returns the re-sized image
 	Resize(image image.Image, width, height int) image.Image
 	// Scale takes an input image, width and height and returns the re-sized
@@ -13,12 +34,59 @@ type Processor interface {
 	Scale(image image.Image, width, height int) image.Image
 	// GrayScale takes an input byte array and returns the grayscaled byte array or error
 	GrayScale(image image.Image) image.Image
+	// GrayScaleWithOptions takes an input image and returns the grayscaled image with
+	// the color model controlled by GrayScaleOptions
+	GrayScaleWithOptions(image image.Image, opts GrayScaleOptions) image.Image
+	// Desaturate takes an input image and an amount (0 to 1) and returns the image blended with its grayscale
+	// by that amount, 0 keeps the image and 1 is the same as GrayScale
+	Desaturate(image image.Image, amount float64) image.Image
+	// ExtractChannel takes an input image and a channel ("r", "g", "b" or "a") and returns a grayscale
+	// image of the values of that channel
+	ExtractChannel(image image.Image, channel string) image.Image
+	// SwapChannels takes an input image and an order of the color channels like "bgr" and returns the image
+	// with its red, green and blue channels rearranged in that order, keeping the alpha channel
+	SwapChannels(image image.Image, order string) image.Image
 	// Blur takes an input byte array and returns the blurred byte array by the specified
 	// radius(<=1000) or error radius must be larger than 0
 	Blur(image image.Image, radius float64) image.Image
+	// Denoise takes an input image and returns the image with its noise reduced using a median
+	// filter of the specified radius, the cost grows with the square of the radius
+	Denoise(image image.Image, radius int) image.Image
+	// Sharpen takes an input image and an amount and returns the image with a light unsharp mask applied, the
+	// difference to a slightly blurred copy is added amount times, 0 returns the image as is
+	Sharpen(image image.Image, amount float64) image.Image
+	// Duotone takes an input image, a dark and a light color and returns the image with
+	// its shadows mapped to the dark color and its highlights mapped to the light color
+	Duotone(image image.Image, dark, light color.Color) image.Image
+	// Recolor takes an input image, the color to replace, the replacement color and a tolerance and returns
+	// the image with the pixels within tolerance of from (on every channel) mapped to to, shifting them by
+	// their difference in luminance to from so that shading and anti-aliasing are kept
+	Recolor(image image.Image, from, to color.Color, tolerance uint8) image.Image
+	// Solarize takes an input image and a threshold and returns the image with the pixels whose luma is above
+	// the threshold inverted, keeping the alpha channel
+	Solarize(image image.Image, threshold uint8) image.Image
+	// ColorWash takes an input image, a color and an opacity value and returns the image with the color blended over
+	// every pixel at that opacity, keeping the alpha channel
+	ColorWash(image image.Image, c color.Color, opacity uint8) image.Image
+	// Splash takes an input image, the color to keep and a tolerance in degrees of hue and returns the image
+	// grayscaled except for the pixels whose hue is within tolerance of the hue of the color to keep
+	Splash(image image.Image, keep color.Color, tolerance uint8) image.Image
+	// Quantize takes an input image, a number of colors (2 to 256) and QuantizeOptions and returns a paletted
+	// image of at most that many colors, chosen deterministically from the colors of the image
+	Quantize(image image.Image, colors int, opts QuantizeOptions) image.Image
+	// ChromaKey takes an input image, a key color and a tolerance and returns the image with the pixels within
+	// tolerance of the key color (on every channel) made transparent, pixels within twice the tolerance are faded
+	// out proportionally to soften anti-aliased edges
+	ChromaKey(image image.Image, key color.Color, tolerance uint8) image.Image
 	// Watermark takes an input byte array, overlay byte array and opacity value
-	// and returns the watermarked image bytes or error
+	// and returns the watermarked image bytes or error, an opacity of 0 returns the input unchanged
 	Watermark(base []byte, overlay []byte, opacity uint8) ([]byte, error)
+	// WatermarkWithOptions takes an input byte array, overlay byte array, opacity value and WatermarkOptions
+	// and returns the watermarked image bytes or error
+	WatermarkWithOptions(base []byte, overlay []byte, opacity uint8, opts WatermarkOptions) ([]byte, error)
+	// WatermarkImage takes a base image, an overlay image, opacity value and WatermarkOptions and returns the base
+	// with the overlay composited like WatermarkWithOptions, or error
+	WatermarkImage(base, overlay image.Image, opacity uint8, opts WatermarkOptions) (image.Image, error)
 	// Flip takes an input image and returns the image flipped. The direction of flip
 	// is determined by the specified mode - 'v' for a vertical flip, 'h' for a horizontal flip and
 	// 'vh'(or 'hv') for both.
@@ -26,14 +94,57 @@ type Processor interface {
 	// Rotate takes an input image and returns a image rotated by the specified degrees.
 	// The rotation is applied clockwise, and fractional angles are supported.
 	Rotate(image image.Image, angle float64) image.Image
+	// RotateWithOptions takes an input image and returns the image rotated clockwise by the specified
+	// degrees with the bounds and background controlled by RotateOptions
+	RotateWithOptions(image image.Image, angle float64, opts RotateOptions) image.Image
+	// Perspective takes an input image and the corners of a quadrilateral (top-left, top-right, bottom-right,
+	// bottom-left) and returns the image with its corners mapped onto the quadrilateral
+	Perspective(image image.Image, corners [4]image.Point) image.Image
+	// Histogram takes an input image and returns the 256 bin histograms of its red, green, blue and Rec. 601 luma
+	// values, images larger than a megapixel are sampled on an evenly spaced grid
+	Histogram(image image.Image) Histogram
 	// Decode takes a byte array and returns the image, extension, and error
 	Decode(data []byte) (img image.Image, format string, err error)
+	// Rasterize takes an SVG byte array, width and height and returns the image rendered at the
+	// smallest size covering width x height while preserving its aspect ratio, or error
+	Rasterize(data []byte, width, height int) (image.Image, error)
+	// DecodeAnimation takes an animated PNG byte array and returns its frames composited onto full canvases, or error
+	DecodeAnimation(data []byte) (*Animation, error)
+	// EncodeAnimation takes an Animation and returns it encoded as an animated PNG, or error
+	EncodeAnimation(a *Animation) ([]byte, error)
 	// Encode takes an image and extension and return the encoded byte array or error
 	Encode(img image.Image, format string) ([]byte, error)
+	// EncodeWithOptions takes an image, extension and EncodeOptions and return the encoded byte array or error
+	EncodeWithOptions(img image.Image, format string, opts EncodeOptions) ([]byte, error)
+	// Convert takes an input byte array, the target extension and EncodeOptions and returns the decoded image
+	// re-encoded to exactly the target format with only its pixels carried over, or error
+	Convert(input []byte, format string, opts EncodeOptions) ([]byte, error)
 	// FixOrientation takes an image and it's EXIF orientation (if exist)
 	// and returns the image with its EXIF orientation fixed
 	FixOrientation(img image.Image, orientation int) image.Image
 	// Overlay takes an input byte array as the base image and
 	// an array of OverlayAttrs to be placed as overlays to the base image
 	Overlay(base []byte, overlays []*OverlayAttrs) ([]byte, error)
+	// SpriteSheet takes the input byte arrays of equally sized frames and the number of columns and
+	// returns the frames packed into a grid and the SpriteLayout describing it, or error
+	SpriteSheet(frames [][]byte, cols int) ([]byte, SpriteLayout, error)
+}
+
+// FaceDetector finds the faces of an image for the auto crop, darkroom doesn't ship a detector so that the model
+// and its dependencies can be chosen by the caller
+type FaceDetector interface {
+	// DetectFaces takes an image.Image and returns the bounds of the faces found in it, in its pixels
+	DetectFaces(image image.Image) []image.Rectangle
+}
+
+// BufferReleaser is implemented by a Processor which reuses the pixel buffers of the images it creates
+type BufferReleaser interface {
+	// Release hands the buffer of an image back for reuse once it is no longer used, e.g. after it was encoded
+	Release(img image.Image)
+}
+
+// ParallelismLimiter is implemented by a Processor whose operations run on a limited number of goroutines
+type ParallelismLimiter interface {
+	// MaxParallelism returns the largest number of goroutines a single operation uses, 0 if it is not limited
+	MaxParallelism() int
 }
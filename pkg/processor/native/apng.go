@@ -0,0 +1,377 @@
+package native
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	// maxAnimationFrames is the largest number of frames decoded from an animation
+	maxAnimationFrames = 1000
+	// maxAnimationPixels caps the canvas area times the number of frames, every frame is kept as a full canvas
+	maxAnimationPixels = 50 * 1000 * 1000
+
+	apngSignature = "\x89PNG\r\n\x1a\n"
+
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendSource       = 0
+)
+
+var (
+	errAPNGNotAnimated   = errors.New("png has no animation control chunk")
+	errAnimationTooLarge = errors.New("animation exceeds the maximum number of frames or pixels")
+	errAnimationNoFrames = errors.New("animation has no frames")
+)
+
+// apngFrame holds the frame control of an APNG frame and its compressed image data
+type apngFrame struct {
+	rect    image.Rectangle
+	delay   time.Duration
+	dispose byte
+	blend   byte
+	data    []byte
+}
+
+// DecodeAnimation takes an animated PNG or WebP byte array and returns its frames composited onto full
+// canvases according to their dispose and blend operations, or error. A default image of an APNG that is
+// not part of the animation is skipped.
+func (bp *BildProcessor) DecodeAnimation(data []byte) (*processor.Animation, error) {
+	var a *processor.Animation
+	var err error
+	if timeoutErr := bp.awaitDecode(func() {
+		if processor.IsAnimatedWebP(data) {
+			a, err = decodeAnimatedWebP(data)
+			return
+		}
+		a, err = decodeAPNG(data)
+	}); timeoutErr != nil {
+		return nil, timeoutErr
+	}
+	return a, err
+}
+
+// EncodeAnimation takes an Animation and returns it encoded in its Format, every frame is stored as a full
+// canvas, or error. Animated WebP frames are encoded with the options of the WebPEncoder.
+func (bp *BildProcessor) EncodeAnimation(a *processor.Animation) ([]byte, error) {
+	if a != nil && a.Format == processor.ExtensionWebP {
+		enc := bp.encoders.webPEncoder
+		if a.Quality > 0 && a.Quality <= 100 {
+			enc = enc.withQuality(float32(a.Quality))
+		} else if q := bp.getDefaultQuality(processor.ExtensionWebP); q > 0 {
+			enc = enc.withQuality(float32(q))
+		}
+		return encodeAnimatedWebP(a, enc.Option)
+	}
+	return encodeAPNG(a)
+}
+
+func decodeAPNG(data []byte) (*processor.Animation, error) {
+	if !bytes.HasPrefix(data, []byte(apngSignature)) {
+		return nil, errors.New("not a png")
+	}
+
+	var ihdr, plte, trns []byte
+	var frames []*apngFrame
+	var current *apngFrame
+	anim := &processor.Animation{}
+	animated := false
+	for rest := data[len(apngSignature):]; ; {
+		typ, chunk, next, err := readPNGChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = next
+		switch typ {
+		case "IHDR":
+			if len(chunk) != 13 {
+				return nil, errors.New("invalid png header")
+			}
+			ihdr = chunk
+		case "PLTE":
+			plte = chunk
+		case "tRNS":
+			trns = chunk
+		case "acTL":
+			if len(chunk) != 8 || ihdr == nil {
+				return nil, errors.New("invalid animation control chunk")
+			}
+			animated = true
+			anim.LoopCount = int(binary.BigEndian.Uint32(chunk[4:8]))
+		case "fcTL":
+			if current, err = parseFrameControl(chunk, ihdr); err != nil {
+				return nil, err
+			}
+			frames = append(frames, current)
+			if err := checkAnimationSize(ihdr, len(frames)); err != nil {
+				return nil, err
+			}
+		case "IDAT":
+			// Without a preceding fcTL the default image is not part of the animation
+			if current != nil {
+				current.data = append(current.data, chunk...)
+			}
+		case "fdAT":
+			if current == nil || len(chunk) < 4 {
+				return nil, errors.New("frame data without frame control")
+			}
+			current.data = append(current.data, chunk[4:]...)
+		case "IEND":
+			if !animated {
+				return nil, errAPNGNotAnimated
+			}
+			return composeAPNG(anim, ihdr, plte, trns, frames)
+		}
+	}
+}
+
+// readPNGChunk returns the type and data of the first chunk in b and the bytes after it
+func readPNGChunk(b []byte) (string, []byte, []byte, error) {
+	if len(b) < 12 {
+		return "", nil, nil, errors.New("unexpected end of png")
+	}
+	length := binary.BigEndian.Uint32(b[:4])
+	if uint64(length) > uint64(len(b)-12) {
+		return "", nil, nil, errors.New("unexpected end of png")
+	}
+	end := 8 + int(length)
+	if crc32.ChecksumIEEE(b[4:end]) != binary.BigEndian.Uint32(b[end:end+4]) {
+		return "", nil, nil, fmt.Errorf("invalid checksum of png chunk %q", b[4:8])
+	}
+	return string(b[4:8]), b[8:end], b[end+4:], nil
+}
+
+func parseFrameControl(chunk, ihdr []byte) (*apngFrame, error) {
+	if len(chunk) != 26 || ihdr == nil {
+		return nil, errors.New("invalid frame control chunk")
+	}
+	w, h := binary.BigEndian.Uint32(chunk[4:8]), binary.BigEndian.Uint32(chunk[8:12])
+	x, y := binary.BigEndian.Uint32(chunk[12:16]), binary.BigEndian.Uint32(chunk[16:20])
+	cw, ch := binary.BigEndian.Uint32(ihdr[0:4]), binary.BigEndian.Uint32(ihdr[4:8])
+	if w == 0 || h == 0 || uint64(x)+uint64(w) > uint64(cw) || uint64(y)+uint64(h) > uint64(ch) {
+		return nil, errors.New("animation frame exceeds the canvas")
+	}
+	num, den := binary.BigEndian.Uint16(chunk[20:22]), binary.BigEndian.Uint16(chunk[22:24])
+	if den == 0 {
+		den = 100
+	}
+	return &apngFrame{
+		rect:    image.Rect(int(x), int(y), int(x+w), int(y+h)),
+		delay:   time.Duration(num) * time.Second / time.Duration(den),
+		dispose: chunk[24],
+		blend:   chunk[25],
+	}, nil
+}
+
+func checkAnimationSize(ihdr []byte, frames int) error {
+	area := uint64(binary.BigEndian.Uint32(ihdr[0:4])) * uint64(binary.BigEndian.Uint32(ihdr[4:8]))
+	if frames > maxAnimationFrames || area*uint64(frames) > maxAnimationPixels {
+		return errAnimationTooLarge
+	}
+	return nil
+}
+
+// composeAPNG decodes every frame as a standalone PNG and draws it onto the canvas
+func composeAPNG(anim *processor.Animation, ihdr, plte, trns []byte, frames []*apngFrame) (*processor.Animation, error) {
+	if len(frames) == 0 {
+		return nil, errAnimationNoFrames
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, int(binary.BigEndian.Uint32(ihdr[0:4])), int(binary.BigEndian.Uint32(ihdr[4:8]))))
+	for _, f := range frames {
+		img, err := png.Decode(bytes.NewReader(getFramePNG(ihdr, plte, trns, f)))
+		if err != nil {
+			return nil, err
+		}
+		var previous []uint8
+		if f.dispose == apngDisposePrevious {
+			previous = append(previous, canvas.Pix...)
+		}
+		op := draw.Over
+		if f.blend == apngBlendSource {
+			op = draw.Src
+		}
+		draw.Draw(canvas, f.rect, img, img.Bounds().Min, op)
+
+		out := image.NewRGBA(canvas.Rect)
+		copy(out.Pix, canvas.Pix)
+		anim.Frames = append(anim.Frames, out)
+		anim.Delays = append(anim.Delays, f.delay)
+
+		switch f.dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return anim, nil
+}
+
+// getFramePNG returns a standalone PNG of the frame f, made of the header with the frame dimensions,
+// the palette and transparency chunks of the animation and the frame data
+func getFramePNG(ihdr, plte, trns []byte, f *apngFrame) []byte {
+	header := append([]byte(nil), ihdr...)
+	binary.BigEndian.PutUint32(header[0:4], uint32(f.rect.Dx()))
+	binary.BigEndian.PutUint32(header[4:8], uint32(f.rect.Dy()))
+
+	b := bytes.NewBufferString(apngSignature)
+	writePNGChunk(b, "IHDR", header)
+	if plte != nil {
+		writePNGChunk(b, "PLTE", plte)
+	}
+	if trns != nil {
+		writePNGChunk(b, "tRNS", trns)
+	}
+	writePNGChunk(b, "IDAT", f.data)
+	writePNGChunk(b, "IEND", nil)
+	return b.Bytes()
+}
+
+func writePNGChunk(b *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	b.Write(n[:])
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write([]byte(typ))
+	_, _ = crc.Write(data)
+	b.WriteString(typ)
+	b.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	b.Write(n[:])
+}
+
+func encodeAPNG(a *processor.Animation) ([]byte, error) {
+	if a == nil || len(a.Frames) == 0 {
+		return nil, errAnimationNoFrames
+	}
+	size := a.Frames[0].Bounds().Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, errors.New("animation frames have no pixels")
+	}
+
+	b := bytes.NewBufferString(apngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(size.X))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(size.Y))
+	// 8-bit truecolor with alpha, no interlacing
+	ihdr[8], ihdr[9] = 8, 6
+	writePNGChunk(b, "IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], uint32(len(a.Frames)))
+	binary.BigEndian.PutUint32(actl[4:8], uint32(a.LoopCount))
+	writePNGChunk(b, "acTL", actl)
+
+	seq := uint32(0)
+	for i, frame := range a.Frames {
+		if frame.Bounds().Size() != size {
+			return nil, errors.New("animation frames differ in size")
+		}
+		var delay time.Duration
+		if i < len(a.Delays) {
+			delay = a.Delays[i]
+		}
+		writePNGChunk(b, "fcTL", getFrameControl(seq, size, delay))
+		seq++
+
+		data, err := compressFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			writePNGChunk(b, "IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, seq)
+		seq++
+		writePNGChunk(b, "fdAT", append(fdat, data...))
+	}
+	writePNGChunk(b, "IEND", nil)
+	return b.Bytes(), nil
+}
+
+// getFrameControl returns a full canvas frame control replacing the previous frame, the delay is stored in
+// milliseconds or in hundredths of a second if it doesn't fit
+func getFrameControl(seq uint32, size image.Point, delay time.Duration) []byte {
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:4], seq)
+	binary.BigEndian.PutUint32(fctl[4:8], uint32(size.X))
+	binary.BigEndian.PutUint32(fctl[8:12], uint32(size.Y))
+	num, den := delay.Milliseconds(), int64(1000)
+	if num > 0xffff {
+		num, den = delay.Milliseconds()/10, 100
+		if num > 0xffff {
+			num = 0xffff
+		}
+	}
+	binary.BigEndian.PutUint16(fctl[20:22], uint16(num))
+	binary.BigEndian.PutUint16(fctl[22:24], uint16(den))
+	// The x and y offset, dispose op none and blend op source are all 0
+	return fctl
+}
+
+// compressFrame returns the zlib compressed scanlines of img as 8-bit non-premultiplied RGBA, each row
+// uses the filter with the smallest sum of absolute residuals
+func compressFrame(img image.Image) ([]byte, error) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	b := &bytes.Buffer{}
+	zw := zlib.NewWriter(b)
+	rowLen := nrgba.Rect.Dx() * 4
+	prev := make([]uint8, rowLen)
+	filtered := [3][]uint8{make([]uint8, rowLen+1), make([]uint8, rowLen+1), make([]uint8, rowLen+1)}
+	for y := 0; y < nrgba.Rect.Dy(); y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+rowLen]
+		best := filterRow(row, prev, filtered)
+		if _, err := zw.Write(best); err != nil {
+			return nil, err
+		}
+		prev = row
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// filterRow fills out with the row filtered with none (0), sub (1) and up (2) and returns the one with the
+// smallest sum of absolute residuals, prefixed with its filter type
+func filterRow(row, prev []uint8, out [3][]uint8) []uint8 {
+	best, bestSum := 0, -1
+	for f := range out {
+		out[f][0] = uint8(f)
+		sum := 0
+		for i, v := range row {
+			switch f {
+			case 1:
+				if i >= 4 {
+					v -= row[i-4]
+				}
+			case 2:
+				v -= prev[i]
+			}
+			out[f][i+1] = v
+			if d := int(int8(v)); d < 0 {
+				sum -= d
+			} else {
+				sum += d
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return out[best]
+}
@@ -0,0 +1,197 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	apngRed   = color.RGBA{R: 0xff, A: 0xff}
+	apngGreen = color.RGBA{G: 0xff, A: 0xff}
+	apngBlue  = color.RGBA{B: 0xff, A: 0xff}
+)
+
+func newUniformImage(r image.Rectangle, c color.Color) *image.RGBA {
+	img := image.NewRGBA(r)
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestBildProcessor_EncodeAndDecodeAnimation(t *testing.T) {
+	bp := NewBildProcessor()
+	anim := &processor.Animation{
+		Frames: []image.Image{
+			newUniformImage(image.Rect(0, 0, 8, 4), apngRed),
+			newUniformImage(image.Rect(0, 0, 8, 4), apngGreen),
+			newUniformImage(image.Rect(0, 0, 8, 4), color.RGBA{B: 0x80, A: 0x80}),
+		},
+		Delays:    []time.Duration{100 * time.Millisecond, 1500 * time.Millisecond, 70 * time.Second},
+		LoopCount: 3,
+	}
+
+	data, err := bp.EncodeAnimation(anim)
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedPNG(data))
+	// Other decoders see the first frame as a still image
+	still, f, err := bp.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionPNG, f)
+	assert.Equal(t, apngRed, color.RGBAModel.Convert(still.At(3, 3)))
+
+	decoded, err := bp.DecodeAnimation(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, decoded.LoopCount)
+	assert.Equal(t, anim.Delays, decoded.Delays)
+	assert.Len(t, decoded.Frames, 3)
+	for i, frame := range decoded.Frames {
+		assert.Equal(t, image.Rect(0, 0, 8, 4), frame.Bounds())
+		assert.Equal(t, anim.Frames[i].At(5, 2), color.RGBAModel.Convert(frame.At(5, 2)))
+	}
+
+	_, err = bp.EncodeAnimation(&processor.Animation{})
+	assert.Equal(t, errAnimationNoFrames, err)
+	_, err = bp.EncodeAnimation(&processor.Animation{Frames: []image.Image{anim.Frames[0], image.NewRGBA(image.Rect(0, 0, 2, 2))}})
+	assert.Error(t, err)
+}
+
+// apngBuilder writes APNG chunks for frames that don't cover the whole canvas
+type apngBuilder struct {
+	b   *bytes.Buffer
+	seq uint32
+}
+
+func newAPNGBuilder(w, h, frames int) *apngBuilder {
+	ab := &apngBuilder{b: bytes.NewBufferString(apngSignature)}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(w))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(h))
+	ihdr[8], ihdr[9] = 8, 6
+	writePNGChunk(ab.b, "IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], uint32(frames))
+	writePNGChunk(ab.b, "acTL", actl)
+	return ab
+}
+
+func (ab *apngBuilder) defaultImage(t *testing.T, img image.Image) {
+	data, err := compressFrame(img)
+	assert.NoError(t, err)
+	writePNGChunk(ab.b, "IDAT", data)
+}
+
+func (ab *apngBuilder) frame(t *testing.T, img image.Image, dispose, blend byte, first bool) {
+	fctl := getFrameControl(ab.seq, img.Bounds().Size(), 10*time.Millisecond)
+	ab.seq++
+	binary.BigEndian.PutUint32(fctl[12:16], uint32(img.Bounds().Min.X))
+	binary.BigEndian.PutUint32(fctl[16:20], uint32(img.Bounds().Min.Y))
+	fctl[24], fctl[25] = dispose, blend
+	writePNGChunk(ab.b, "fcTL", fctl)
+
+	data, err := compressFrame(img)
+	assert.NoError(t, err)
+	if first {
+		writePNGChunk(ab.b, "IDAT", data)
+		return
+	}
+	fdat := make([]byte, 4)
+	binary.BigEndian.PutUint32(fdat, ab.seq)
+	ab.seq++
+	writePNGChunk(ab.b, "fdAT", append(fdat, data...))
+}
+
+func (ab *apngBuilder) bytes() []byte {
+	writePNGChunk(ab.b, "IEND", nil)
+	return ab.b.Bytes()
+}
+
+func TestBildProcessor_DecodeAnimationAppliesDisposeAndBlend(t *testing.T) {
+	ab := newAPNGBuilder(4, 4, 4)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 4, 4), apngRed), 0, apngBlendSource, true)
+	ab.frame(t, newUniformImage(image.Rect(1, 1, 3, 3), apngBlue), apngDisposeBackground, 1, false)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 1, 1), apngGreen), apngDisposePrevious, apngBlendSource, false)
+	ab.frame(t, newUniformImage(image.Rect(3, 3, 4, 4), color.Transparent), 0, 1, false)
+
+	anim, err := NewBildProcessor().DecodeAnimation(ab.bytes())
+	assert.NoError(t, err)
+	assert.Len(t, anim.Frames, 4)
+	at := func(frame, x, y int) color.Color {
+		return color.RGBAModel.Convert(anim.Frames[frame].At(x, y))
+	}
+	assert.Equal(t, apngRed, at(0, 1, 1))
+	assert.Equal(t, apngBlue, at(1, 1, 1))
+	assert.Equal(t, apngRed, at(1, 0, 0))
+	// The blue frame is disposed to transparency before the green one is drawn
+	assert.Equal(t, apngGreen, at(2, 0, 0))
+	assert.Equal(t, color.RGBA{}, at(2, 1, 1))
+	// The green frame is disposed to the previous canvas and the transparent frame is blended over it
+	assert.Equal(t, apngRed, at(3, 0, 0))
+	assert.Equal(t, color.RGBA{}, at(3, 2, 2))
+	assert.Equal(t, apngRed, at(3, 3, 3))
+}
+
+func TestBildProcessor_DecodeAnimationSkipsDefaultImage(t *testing.T) {
+	ab := newAPNGBuilder(2, 2, 2)
+	ab.defaultImage(t, newUniformImage(image.Rect(0, 0, 2, 2), apngRed))
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 2, 2), apngGreen), 0, apngBlendSource, false)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 2, 2), apngBlue), 0, apngBlendSource, false)
+
+	anim, err := NewBildProcessor().DecodeAnimation(ab.bytes())
+	assert.NoError(t, err)
+	assert.Len(t, anim.Frames, 2)
+	assert.Equal(t, apngGreen, color.RGBAModel.Convert(anim.Frames[0].At(0, 0)))
+	assert.Equal(t, apngBlue, color.RGBAModel.Convert(anim.Frames[1].At(0, 0)))
+}
+
+func TestBildProcessor_DecodeAnimationWithInvalidData(t *testing.T) {
+	bp := NewBildProcessor()
+	still := &bytes.Buffer{}
+	writePNGChunk(still, "IHDR", make([]byte, 13))
+	_, err := bp.DecodeAnimation(append([]byte(apngSignature), still.Bytes()...))
+	assert.Error(t, err)
+
+	_, err = bp.DecodeAnimation([]byte("badImage.ext"))
+	assert.Error(t, err)
+
+	// A frame outside of the canvas
+	ab := newAPNGBuilder(2, 2, 1)
+	ab.frame(t, newUniformImage(image.Rect(1, 1, 3, 3), apngRed), 0, apngBlendSource, true)
+	_, err = bp.DecodeAnimation(ab.bytes())
+	assert.EqualError(t, err, "animation frame exceeds the canvas")
+
+	// A corrupted checksum
+	ab = newAPNGBuilder(2, 2, 1)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 2, 2), apngRed), 0, apngBlendSource, true)
+	data := ab.bytes()
+	data[len(data)-1] ^= 0xff
+	_, err = bp.DecodeAnimation(data)
+	assert.Error(t, err)
+
+	// More frames than allowed for the canvas size
+	ab = newAPNGBuilder(5000, 5000, 3)
+	for i := 0; i < 3; i++ {
+		ab.frame(t, newUniformImage(image.Rect(0, 0, 1, 1), apngRed), 0, apngBlendSource, i == 0)
+	}
+	_, err = bp.DecodeAnimation(ab.bytes())
+	assert.Equal(t, errAnimationTooLarge, err)
+}
+
+func Test_getFrameControlDelay(t *testing.T) {
+	delay := func(d time.Duration) (uint16, uint16) {
+		fctl := getFrameControl(0, image.Pt(1, 1), d)
+		return binary.BigEndian.Uint16(fctl[20:22]), binary.BigEndian.Uint16(fctl[22:24])
+	}
+	num, den := delay(40 * time.Millisecond)
+	assert.Equal(t, []uint16{40, 1000}, []uint16{num, den})
+	num, den = delay(70 * time.Second)
+	assert.Equal(t, []uint16{7000, 100}, []uint16{num, den})
+	num, den = delay(time.Hour)
+	assert.Equal(t, []uint16{0xffff, 100}, []uint16{num, den})
+}
@@ -0,0 +1,324 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"time"
+
+	"github.com/chai2010/webp"
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	webpFlagAnimation = 0x02
+	webpFlagAlpha     = 0x10
+
+	webpDisposeBackground = 0x01
+	webpNoBlend           = 0x02
+
+	// webpMaxDuration is the largest frame duration in milliseconds that fits the 24 bits of an ANMF chunk
+	webpMaxDuration = 1<<24 - 1
+)
+
+var errAWebPNotAnimated = errors.New("webp has no animation chunk")
+
+// awebpFrame holds the header of an ANMF chunk of an animated WebP and the chunks holding its image data
+type awebpFrame struct {
+	rect    image.Rectangle
+	delay   time.Duration
+	dispose bool
+	blend   bool
+	alpha   []byte
+	data    []byte
+	lossy   bool
+}
+
+// readWebPChunk returns the FourCC and payload of the first chunk in b and the bytes after it, the payload
+// is padded to an even size
+func readWebPChunk(b []byte) (string, []byte, []byte, error) {
+	if len(b) < 8 {
+		return "", nil, nil, errors.New("unexpected end of webp")
+	}
+	size := binary.LittleEndian.Uint32(b[4:8])
+	if uint64(size) > uint64(len(b)-8) {
+		return "", nil, nil, errors.New("unexpected end of webp")
+	}
+	end := 8 + int(size)
+	next := end + int(size&1)
+	if next > len(b) {
+		next = len(b)
+	}
+	return string(b[:4]), b[8:end], b[next:], nil
+}
+
+func writeWebPChunk(b *bytes.Buffer, fourCC string, data []byte) {
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(data)))
+	b.WriteString(fourCC)
+	b.Write(n[:])
+	b.Write(data)
+	if len(data)&1 == 1 {
+		b.WriteByte(0)
+	}
+}
+
+func getUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// getRIFF returns the chunks wrapped into a WebP RIFF container
+func getRIFF(chunks []byte) []byte {
+	b := &bytes.Buffer{}
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(4+len(chunks)))
+	b.WriteString("RIFF")
+	b.Write(n[:])
+	b.WriteString("WEBP")
+	b.Write(chunks)
+	return b.Bytes()
+}
+
+// getWebPChunks returns the chunks of a WebP RIFF container, or error
+func getWebPChunks(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp")
+	}
+	chunks := data[12:]
+	if size := int(binary.LittleEndian.Uint32(data[4:8])); size >= 4 && size-4 < len(chunks) {
+		chunks = chunks[:size-4]
+	}
+	return chunks, nil
+}
+
+func decodeAnimatedWebP(data []byte) (*processor.Animation, error) {
+	rest, err := getWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var canvas image.Rectangle
+	var frames []*awebpFrame
+	anim := &processor.Animation{Format: processor.ExtensionWebP}
+	animated := false
+	for len(rest) > 0 {
+		fourCC, chunk, next, err := readWebPChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = next
+		switch fourCC {
+		case "VP8X":
+			if len(chunk) < 10 {
+				return nil, errors.New("invalid webp header")
+			}
+			canvas = image.Rect(0, 0, getUint24(chunk[4:7])+1, getUint24(chunk[7:10])+1)
+		case "ANIM":
+			if len(chunk) < 6 || canvas.Empty() {
+				return nil, errors.New("invalid animation chunk")
+			}
+			animated = true
+			anim.LoopCount = int(binary.LittleEndian.Uint16(chunk[4:6]))
+		case "ANMF":
+			if !animated {
+				return nil, errors.New("frame without animation chunk")
+			}
+			f, err := parseWebPFrame(chunk, canvas)
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, f)
+			area := uint64(canvas.Dx()) * uint64(canvas.Dy())
+			if len(frames) > maxAnimationFrames || area*uint64(len(frames)) > maxAnimationPixels {
+				return nil, errAnimationTooLarge
+			}
+		}
+	}
+	if !animated {
+		return nil, errAWebPNotAnimated
+	}
+	return composeAnimatedWebP(anim, canvas, frames)
+}
+
+// parseWebPFrame parses the header of an ANMF chunk and picks the ALPH and VP8 or VP8L chunks following it
+func parseWebPFrame(chunk []byte, canvas image.Rectangle) (*awebpFrame, error) {
+	if len(chunk) < 16 {
+		return nil, errors.New("invalid animation frame chunk")
+	}
+	x, y := getUint24(chunk[0:3])*2, getUint24(chunk[3:6])*2
+	r := image.Rect(x, y, x+getUint24(chunk[6:9])+1, y+getUint24(chunk[9:12])+1)
+	if !r.In(canvas) {
+		return nil, errors.New("animation frame exceeds the canvas")
+	}
+	f := &awebpFrame{
+		rect:    r,
+		delay:   time.Duration(getUint24(chunk[12:15])) * time.Millisecond,
+		dispose: chunk[15]&webpDisposeBackground != 0,
+		blend:   chunk[15]&webpNoBlend == 0,
+	}
+	for rest := chunk[16:]; len(rest) > 0; {
+		fourCC, data, next, err := readWebPChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = next
+		switch fourCC {
+		case "ALPH":
+			f.alpha = data
+		case "VP8 ", "VP8L":
+			f.data, f.lossy = data, fourCC == "VP8 "
+		}
+	}
+	if f.data == nil {
+		return nil, errors.New("animation frame has no image data")
+	}
+	return f, nil
+}
+
+// getFrameWebP returns a standalone WebP of the frame f, lossy frames with an alpha channel need an extended
+// header for their ALPH chunk
+func getFrameWebP(f *awebpFrame) []byte {
+	b := &bytes.Buffer{}
+	if !f.lossy {
+		writeWebPChunk(b, "VP8L", f.data)
+		return getRIFF(b.Bytes())
+	}
+	if f.alpha != nil {
+		vp8x := make([]byte, 10)
+		vp8x[0] = webpFlagAlpha
+		putUint24(vp8x[4:7], f.rect.Dx()-1)
+		putUint24(vp8x[7:10], f.rect.Dy()-1)
+		writeWebPChunk(b, "VP8X", vp8x)
+		writeWebPChunk(b, "ALPH", f.alpha)
+	}
+	writeWebPChunk(b, "VP8 ", f.data)
+	return getRIFF(b.Bytes())
+}
+
+// composeAnimatedWebP decodes every frame as a standalone WebP and draws it onto the canvas. Disposed frames
+// are cleared to transparency like browsers do, ignoring the background color of the ANIM chunk.
+func composeAnimatedWebP(anim *processor.Animation, rect image.Rectangle, frames []*awebpFrame) (*processor.Animation, error) {
+	if len(frames) == 0 {
+		return nil, errAnimationNoFrames
+	}
+	canvas := image.NewRGBA(rect)
+	for _, f := range frames {
+		decoded, err := webp.DecodeRGBA(getFrameWebP(f))
+		if err != nil {
+			return nil, err
+		}
+		// libwebp returns straight alpha in the RGBA image
+		img := &image.NRGBA{Pix: decoded.Pix, Stride: decoded.Stride, Rect: decoded.Rect}
+		op := draw.Src
+		if f.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, f.rect, img, img.Bounds().Min, op)
+
+		out := image.NewRGBA(canvas.Rect)
+		copy(out.Pix, canvas.Pix)
+		anim.Frames = append(anim.Frames, out)
+		anim.Delays = append(anim.Delays, f.delay)
+
+		if f.dispose {
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return anim, nil
+}
+
+// encodeAnimatedWebP encodes every frame as a full canvas replacing the previous one with the options of the
+// WebPEncoder, the delays are stored in milliseconds
+func encodeAnimatedWebP(a *processor.Animation, opt *webp.Options) ([]byte, error) {
+	if a == nil || len(a.Frames) == 0 {
+		return nil, errAnimationNoFrames
+	}
+	size := a.Frames[0].Bounds().Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, errors.New("animation frames have no pixels")
+	}
+
+	frames := &bytes.Buffer{}
+	flags := byte(webpFlagAnimation)
+	for i, frame := range a.Frames {
+		if frame.Bounds().Size() != size {
+			return nil, errors.New("animation frames differ in size")
+		}
+		var delay time.Duration
+		if i < len(a.Delays) {
+			delay = a.Delays[i]
+		}
+		anmf, alpha, err := getWebPFrameChunk(frame, delay, opt)
+		if err != nil {
+			return nil, err
+		}
+		if alpha {
+			flags |= webpFlagAlpha
+		}
+		writeWebPChunk(frames, "ANMF", anmf)
+	}
+
+	b := &bytes.Buffer{}
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24(vp8x[4:7], size.X-1)
+	putUint24(vp8x[7:10], size.Y-1)
+	writeWebPChunk(b, "VP8X", vp8x)
+	anim := make([]byte, 6)
+	// A transparent background and the loop count
+	binary.LittleEndian.PutUint16(anim[4:6], uint16(a.LoopCount))
+	writeWebPChunk(b, "ANIM", anim)
+	b.Write(frames.Bytes())
+	return getRIFF(b.Bytes()), nil
+}
+
+// getWebPFrameChunk returns the payload of the ANMF chunk of frame and whether it has an alpha channel
+func getWebPFrameChunk(frame image.Image, delay time.Duration, opt *webp.Options) ([]byte, bool, error) {
+	straight := image.NewNRGBA(image.Rect(0, 0, frame.Bounds().Dx(), frame.Bounds().Dy()))
+	draw.Draw(straight, straight.Bounds(), frame, frame.Bounds().Min, draw.Src)
+	buff := &bytes.Buffer{}
+	// libwebp expects straight alpha in the RGBA image
+	if err := webp.Encode(buff, &image.RGBA{Pix: straight.Pix, Stride: straight.Stride, Rect: straight.Rect}, opt); err != nil {
+		return nil, false, err
+	}
+	chunks, err := getWebPChunks(buff.Bytes())
+	if err != nil {
+		return nil, false, err
+	}
+
+	anmf := make([]byte, 16)
+	putUint24(anmf[6:9], straight.Rect.Dx()-1)
+	putUint24(anmf[9:12], straight.Rect.Dy()-1)
+	d := delay.Milliseconds()
+	if d > webpMaxDuration {
+		d = webpMaxDuration
+	}
+	putUint24(anmf[12:15], int(d))
+	anmf[15] = webpNoBlend
+	alpha := false
+	for rest := chunks; len(rest) > 0; {
+		fourCC, data, next, err := readWebPChunk(rest)
+		if err != nil {
+			return nil, false, err
+		}
+		rest = next
+		switch fourCC {
+		case "VP8X":
+			alpha = len(data) > 0 && data[0]&webpFlagAlpha != 0
+		case "VP8L":
+			// The alpha of a lossless frame is part of its bitstream
+			alpha = true
+			fallthrough
+		case "ALPH", "VP8 ":
+			b := bytes.NewBuffer(anmf)
+			writeWebPChunk(b, fourCC, data)
+			anmf = b.Bytes()
+		}
+	}
+	return anmf, alpha, nil
+}
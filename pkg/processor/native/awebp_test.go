@@ -0,0 +1,165 @@
+package native
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/chai2010/webp"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBildProcessor_EncodeAndDecodeAnimatedWebP(t *testing.T) {
+	bp := NewBildProcessor(WithEncoders(NewEncoders(WithWebPEncoder(&WebPEncoder{Option: &webp.Options{Lossless: true}}))))
+	anim := &processor.Animation{
+		Frames: []image.Image{
+			newUniformImage(image.Rect(0, 0, 8, 4), apngRed),
+			newUniformImage(image.Rect(0, 0, 8, 4), apngGreen),
+			newUniformImage(image.Rect(0, 0, 8, 4), color.RGBA{B: 0x80, A: 0x80}),
+		},
+		Delays:    []time.Duration{100 * time.Millisecond, 1500 * time.Millisecond, 70 * time.Second},
+		LoopCount: 3,
+		Format:    processor.ExtensionWebP,
+	}
+
+	data, err := bp.EncodeAnimation(anim)
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedWebP(data))
+	assert.False(t, processor.IsAnimatedPNG(data))
+
+	decoded, err := bp.DecodeAnimation(data)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionWebP, decoded.Format)
+	assert.Equal(t, 3, decoded.LoopCount)
+	assert.Equal(t, anim.Delays, decoded.Delays)
+	assert.Len(t, decoded.Frames, 3)
+	for i, frame := range decoded.Frames {
+		assert.Equal(t, image.Rect(0, 0, 8, 4), frame.Bounds())
+		assert.Equal(t, anim.Frames[i].At(5, 2), color.RGBAModel.Convert(frame.At(5, 2)))
+	}
+
+	// A default quality keeps the other options of the encoder
+	data, err = NewBildProcessor(WithEncoders(NewEncoders(WithWebPEncoder(&WebPEncoder{Option: &webp.Options{Lossless: true}}))),
+		WithDefaultQualities(map[string]int{processor.ExtensionWebP: 40})).EncodeAnimation(anim)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(data, []byte("VP8L")))
+
+	// The quality of the animation takes precedence over the default quality
+	noisy := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range noisy.Pix {
+		noisy.Pix[i] = uint8(i * 7919 % 251)
+	}
+	lossy := NewBildProcessor(WithDefaultQualities(map[string]int{processor.ExtensionWebP: 95}))
+	high, err := lossy.EncodeAnimation(&processor.Animation{Frames: []image.Image{noisy}, Format: processor.ExtensionWebP})
+	assert.NoError(t, err)
+	low, err := lossy.EncodeAnimation(&processor.Animation{Frames: []image.Image{noisy}, Format: processor.ExtensionWebP,
+		Quality: 10})
+	assert.NoError(t, err)
+	assert.Less(t, len(low), len(high))
+
+	// Lossy frames keep their alpha in an ALPH chunk
+	data, err = NewBildProcessor().EncodeAnimation(anim)
+	assert.NoError(t, err)
+	decoded, err = bp.DecodeAnimation(data)
+	assert.NoError(t, err)
+	assert.Len(t, decoded.Frames, 3)
+	assert.Equal(t, uint8(0x80), decoded.Frames[2].(*image.RGBA).RGBAAt(5, 2).A)
+
+	_, err = bp.EncodeAnimation(&processor.Animation{Format: processor.ExtensionWebP})
+	assert.Equal(t, errAnimationNoFrames, err)
+	_, err = bp.EncodeAnimation(&processor.Animation{
+		Frames: []image.Image{anim.Frames[0], image.NewRGBA(image.Rect(0, 0, 2, 2))},
+		Format: processor.ExtensionWebP,
+	})
+	assert.Error(t, err)
+}
+
+// awebpBuilder writes an animated WebP with frames that don't cover the whole canvas
+type awebpBuilder struct {
+	b *bytes.Buffer
+}
+
+func newAWebPBuilder(w, h int) *awebpBuilder {
+	ab := &awebpBuilder{b: &bytes.Buffer{}}
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagAnimation | webpFlagAlpha
+	putUint24(vp8x[4:7], w-1)
+	putUint24(vp8x[7:10], h-1)
+	writeWebPChunk(ab.b, "VP8X", vp8x)
+	writeWebPChunk(ab.b, "ANIM", make([]byte, 6))
+	return ab
+}
+
+func (ab *awebpBuilder) frame(t *testing.T, img image.Image, flags byte) {
+	anmf, _, err := getWebPFrameChunk(img, 10*time.Millisecond, &webp.Options{Lossless: true})
+	assert.NoError(t, err)
+	putUint24(anmf[0:3], img.Bounds().Min.X/2)
+	putUint24(anmf[3:6], img.Bounds().Min.Y/2)
+	anmf[15] = flags
+	writeWebPChunk(ab.b, "ANMF", anmf)
+}
+
+func (ab *awebpBuilder) bytes() []byte {
+	return getRIFF(ab.b.Bytes())
+}
+
+func TestBildProcessor_DecodeAnimatedWebPAppliesDisposeAndBlend(t *testing.T) {
+	ab := newAWebPBuilder(4, 4)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 4, 4), apngRed), webpNoBlend)
+	ab.frame(t, newUniformImage(image.Rect(2, 2, 4, 4), apngBlue), webpDisposeBackground)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 2, 2), color.Transparent), 0)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 2, 2), color.Transparent), webpNoBlend)
+
+	anim, err := NewBildProcessor().DecodeAnimation(ab.bytes())
+	assert.NoError(t, err)
+	assert.Len(t, anim.Frames, 4)
+	at := func(frame, x, y int) color.Color {
+		return color.RGBAModel.Convert(anim.Frames[frame].At(x, y))
+	}
+	assert.Equal(t, apngRed, at(0, 3, 3))
+	assert.Equal(t, apngBlue, at(1, 3, 3))
+	assert.Equal(t, apngRed, at(1, 0, 0))
+	// The blue frame is disposed to transparency and the transparent frame is blended over the canvas
+	assert.Equal(t, color.RGBA{}, at(2, 3, 3))
+	assert.Equal(t, apngRed, at(2, 0, 0))
+	// Without blending the transparent frame replaces the canvas
+	assert.Equal(t, color.RGBA{}, at(3, 0, 0))
+	assert.Equal(t, apngRed, at(3, 2, 0))
+}
+
+func TestBildProcessor_DecodeAnimatedWebPWithInvalidData(t *testing.T) {
+	bp := NewBildProcessor()
+	_, err := decodeAnimatedWebP(getRIFF(nil))
+	assert.Equal(t, errAWebPNotAnimated, err)
+
+	_, err = decodeAnimatedWebP([]byte("badImage.ext"))
+	assert.Error(t, err)
+
+	// A frame outside of the canvas
+	ab := newAWebPBuilder(2, 2)
+	ab.frame(t, newUniformImage(image.Rect(2, 2, 4, 4), apngRed), 0)
+	_, err = bp.DecodeAnimation(ab.bytes())
+	assert.EqualError(t, err, "animation frame exceeds the canvas")
+
+	// A truncated frame
+	ab = newAWebPBuilder(2, 2)
+	ab.frame(t, newUniformImage(image.Rect(0, 0, 2, 2), apngRed), 0)
+	data := ab.bytes()
+	_, err = bp.DecodeAnimation(data[:len(data)-4])
+	assert.Error(t, err)
+
+	// No frames
+	_, err = bp.DecodeAnimation(newAWebPBuilder(2, 2).bytes())
+	assert.Equal(t, errAnimationNoFrames, err)
+
+	// More frames than allowed for the canvas size
+	ab = newAWebPBuilder(5000, 5000)
+	for i := 0; i < 3; i++ {
+		ab.frame(t, newUniformImage(image.Rect(0, 0, 1, 1), apngRed), 0)
+	}
+	_, err = bp.DecodeAnimation(ab.bytes())
+	assert.Equal(t, errAnimationTooLarge, err)
+}
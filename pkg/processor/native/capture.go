@@ -0,0 +1,117 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	exifTagMake               = 0x010f
+	exifTagModel              = 0x0110
+	exifTagExifIFD            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTypeASCII             = 2
+	exifTypeLong              = 4
+	exifTimeLayout            = "2006:01:02 15:04:05"
+)
+
+// GetCaptureInfo returns the capture time and the camera make and model of a JPEG image read from its EXIF
+// segment, the returned bool is false if data isn't a JPEG or its EXIF has none of them. Only the metadata
+// segments are read, the pixels are not decoded.
+func GetCaptureInfo(data []byte) (processor.CaptureInfo, bool) {
+	for _, s := range GetJPEGMetadata(data) {
+		if s[1] != markerAPP1 || len(s) < 18 || !bytes.Equal(s[4:10], []byte("Exif\x00\x00")) {
+			continue
+		}
+		t := tiffReader{data: s[10:]}
+		switch string(t.data[:2]) {
+		case "II":
+			t.order = binary.LittleEndian
+		case "MM":
+			t.order = binary.BigEndian
+		default:
+			continue
+		}
+		ifd0 := t.ifd(t.order.Uint32(t.data[4:]))
+		info := processor.CaptureInfo{Make: t.ascii(ifd0[exifTagMake]), Model: t.ascii(ifd0[exifTagModel])}
+		if offset, ok := t.long(ifd0[exifTagExifIFD]); ok {
+			exif := t.ifd(offset)
+			info.Time = parseEXIFTime(t.ascii(exif[exifTagDateTimeOriginal]), t.ascii(exif[exifTagOffsetTimeOriginal]))
+		}
+		return info, !info.Time.IsZero() || info.Make != "" || info.Model != ""
+	}
+	return processor.CaptureInfo{}, false
+}
+
+// parseEXIFTime returns the EXIF date and time like "2021:06:30 14:05:09" in the zone of the EXIF offset like
+// "+07:00", in UTC without an offset. It returns the zero time if the date and time can't be parsed.
+func parseEXIFTime(value, offset string) time.Time {
+	loc := time.UTC
+	if o, err := time.Parse("-07:00", offset); err == nil {
+		loc = o.Location()
+	}
+	t, err := time.ParseInLocation(exifTimeLayout, value, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// tiffReader reads the tags of the TIFF structure of an EXIF segment, every read is checked against the bounds
+// of data so that damaged metadata is skipped instead of failing
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifd returns the 12 byte entries of the IFD at offset by their tag, nil if offset is out of bounds
+func (t tiffReader) ifd(offset uint32) map[uint16][]byte {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	entries := make(map[uint16][]byte, n)
+	for i := 0; i < n; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(t.data) {
+			break
+		}
+		entries[t.order.Uint16(t.data[start:])] = t.data[start : start+12]
+	}
+	return entries
+}
+
+// ascii returns the trimmed value of an ASCII entry, empty for a missing entry or one of another type
+func (t tiffReader) ascii(entry []byte) string {
+	if entry == nil || t.order.Uint16(entry[2:]) != exifTypeASCII {
+		return ""
+	}
+	count := t.order.Uint32(entry[4:])
+	value := entry[8:12]
+	if count > 4 {
+		offset := t.order.Uint32(entry[8:])
+		if uint64(offset)+uint64(count) > uint64(len(t.data)) {
+			return ""
+		}
+		value = t.data[offset : offset+count]
+	} else {
+		value = value[:count]
+	}
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// long returns the value of a LONG entry, the returned bool is false for a missing entry or one of another type
+func (t tiffReader) long(entry []byte) (uint32, bool) {
+	if entry == nil || t.order.Uint16(entry[2:]) != exifTypeLong {
+		return 0, false
+	}
+	return t.order.Uint32(entry[8:]), true
+}
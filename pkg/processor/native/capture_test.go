@@ -0,0 +1,113 @@
+package native
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+// newEXIFSegment returns an EXIF APP1 segment with the ASCII tags of ifd0 and of the Exif IFD it points to
+func newEXIFSegment(order binary.ByteOrder, ifd0, exif map[uint16]string) []byte {
+	exifOffset := 8 + 2 + 12*(len(ifd0)+1) + 4
+	dataOffset := exifOffset + 2 + 12*len(exif) + 4
+	var data []byte
+	writeIFD := func(tags map[uint16]string, pointer uint32) []byte {
+		var keys []int
+		for k := range tags {
+			keys = append(keys, int(k))
+		}
+		sort.Ints(keys)
+		n := len(keys)
+		if pointer > 0 {
+			n++
+		}
+		ifd := make([]byte, 2, 2+12*n+4)
+		order.PutUint16(ifd, uint16(n))
+		for _, k := range keys {
+			entry := make([]byte, 12)
+			value := append([]byte(tags[uint16(k)]), 0)
+			order.PutUint16(entry, uint16(k))
+			order.PutUint16(entry[2:], exifTypeASCII)
+			order.PutUint32(entry[4:], uint32(len(value)))
+			if len(value) <= 4 {
+				copy(entry[8:], value)
+			} else {
+				order.PutUint32(entry[8:], uint32(dataOffset+len(data)))
+				data = append(data, value...)
+			}
+			ifd = append(ifd, entry...)
+		}
+		if pointer > 0 {
+			entry := make([]byte, 12)
+			order.PutUint16(entry, exifTagExifIFD)
+			order.PutUint16(entry[2:], exifTypeLong)
+			order.PutUint32(entry[4:], 1)
+			order.PutUint32(entry[8:], pointer)
+			ifd = append(ifd, entry...)
+		}
+		return append(ifd, 0, 0, 0, 0)
+	}
+
+	tiff := []byte("II")
+	if order == binary.BigEndian {
+		tiff = []byte("MM")
+	}
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	tiff = append(tiff, writeIFD(ifd0, uint32(exifOffset))...)
+	tiff = append(tiff, writeIFD(exif, 0)...)
+	tiff = append(tiff, data...)
+
+	segment := []byte{0xff, markerAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+6+len(tiff)))
+	segment = append(segment, "Exif\x00\x00"...)
+	return append(segment, tiff...)
+}
+
+func TestGetCaptureInfo(t *testing.T) {
+	src, _ := ioutil.ReadFile("_testdata/test.jpg")
+	tags := map[uint16]string{exifTagMake: "Canon", exifTagModel: "Canon EOS 5D Mark IV "}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := map[uint16]string{exifTagDateTimeOriginal: "2021:06:30 14:05:09", exifTagOffsetTimeOriginal: "+07:00"}
+		data, err := SetJPEGMetadata(src, [][]byte{newEXIFSegment(order, tags, exif)})
+		assert.Nil(t, err)
+
+		info, ok := GetCaptureInfo(data)
+		assert.True(t, ok)
+		assert.Equal(t, "Canon", info.Make)
+		assert.Equal(t, "Canon EOS 5D Mark IV", info.Model)
+		assert.True(t, time.Date(2021, 6, 30, 7, 5, 9, 0, time.UTC).Equal(info.Time))
+		_, offset := info.Time.Zone()
+		assert.Equal(t, 7*60*60, offset)
+	}
+
+	// Without an offset the time is taken as UTC, an invalid one is left out
+	exif := map[uint16]string{exifTagDateTimeOriginal: "2021:06:30 14:05:09"}
+	data, _ := SetJPEGMetadata(src, [][]byte{newEXIFSegment(binary.LittleEndian, nil, exif)})
+	info, ok := GetCaptureInfo(data)
+	assert.True(t, ok)
+	assert.Equal(t, processor.CaptureInfo{Time: time.Date(2021, 6, 30, 14, 5, 9, 0, time.UTC)}, info)
+
+	exif = map[uint16]string{exifTagDateTimeOriginal: "0000:00:00 00:00:00"}
+	data, _ = SetJPEGMetadata(src, [][]byte{newEXIFSegment(binary.LittleEndian, map[uint16]string{exifTagMake: "GP"}, exif)})
+	info, ok = GetCaptureInfo(data)
+	assert.True(t, ok)
+	assert.Equal(t, processor.CaptureInfo{Make: "GP"}, info)
+
+	// An EXIF with only the orientation, no EXIF and damaged EXIF have no capture info
+	for _, f := range []string{"_testdata/exif_orientation/f6t.jpg", "_testdata/test.jpg", "_testdata/test.png"} {
+		data, _ = ioutil.ReadFile(f)
+		_, ok = GetCaptureInfo(data)
+		assert.False(t, ok, f)
+	}
+	segment := newEXIFSegment(binary.BigEndian, tags, exif)
+	data, _ = SetJPEGMetadata(src, [][]byte{segment[:len(segment)-20]})
+	assert.NotPanics(t, func() { GetCaptureInfo(data) })
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"image"
+	"image/color"
 	"image/jpeg"
 	"image/png"
 
@@ -19,6 +20,10 @@ type Encoder interface {
 // JpegEncoder is an object to encode image to byte array with jpeg format
 type JpegEncoder struct {
 	Option *jpeg.Options
+	// Background is the color transparent pixels are flattened onto as JPEG has no alpha channel, nil keeps
+	// the alpha-premultiplied colors which flattens onto black. The BildProcessor falls back to the flatten
+	// background of its Encoders instead.
+	Background color.Color
 }
 
 // PngEncoder is an object to encode image to byte array with png format
@@ -41,6 +46,15 @@ func (e *PngEncoder) Encode(img image.Image) ([]byte, error) {
 }
 
 func (e *JpegEncoder) Encode(img image.Image) ([]byte, error) {
+	return e.encode(img, e.Background)
+}
+
+// encode encodes img like Encode but flattens it onto bg instead of the Background of e, img is only scanned
+// for transparent pixels if bg is set
+func (e *JpegEncoder) encode(img image.Image, bg color.Color) ([]byte, error) {
+	if bg != nil && !isOpaque(img) {
+		img = flatten(img, bg)
+	}
 	buff := &bytes.Buffer{}
 	err := jpeg.Encode(buff, img, e.Option)
 	return buff.Bytes(), err
@@ -52,6 +66,36 @@ func (e *WebPEncoder) Encode(img image.Image) ([]byte, error) {
 	return buff.Bytes(), err
 }
 
+// withQuality returns a JpegEncoder with the options and background of e and the quality q
+func (e *JpegEncoder) withQuality(q int) *JpegEncoder {
+	opt := jpeg.Options{}
+	if e.Option != nil {
+		opt = *e.Option
+	}
+	opt.Quality = q
+	return &JpegEncoder{Option: &opt, Background: e.Background}
+}
+
+// withQuality returns a WebPEncoder with the options of e and the quality q
+func (e *WebPEncoder) withQuality(q float32) *WebPEncoder {
+	opt := webp.Options{}
+	if e.Option != nil {
+		opt = *e.Option
+	}
+	opt.Quality = q
+	return &WebPEncoder{Option: &opt}
+}
+
+// lossless returns a WebPEncoder with the options of e encoding losslessly
+func (e *WebPEncoder) lossless() *WebPEncoder {
+	opt := webp.Options{}
+	if e.Option != nil {
+		opt = *e.Option
+	}
+	opt.Lossless = true
+	return &WebPEncoder{Option: &opt}
+}
+
 func (e *NopEncoder) Encode(img image.Image) ([]byte, error) {
 	return nil, errors.New("unknown format: failed to encode image")
 }
@@ -62,6 +106,13 @@ type Encoders struct {
 	pngEncoder  *PngEncoder
 	noOpEncoder *NopEncoder
 	webPEncoder *WebPEncoder
+	// alphaThreshold is the largest fraction of partially transparent pixels a PNG may have to be
+	// downgraded to JPEG, a negative value only downgrades fully opaque PNGs
+	alphaThreshold float64
+	// background is the color transparent pixels are flattened onto when encoding to JPEG
+	background color.Color
+	// graphicColors is the largest number of colors of an image detected as a graphic, 0 disables the detection
+	graphicColors int
 }
 
 // EncodersOption represents builder function for Encoders
@@ -69,21 +120,97 @@ type EncodersOption func(*Encoders)
 
 // GetEncoder takes an input of image and extension and return the appropriate Encoder for encoding the image
 func (e *Encoders) GetEncoder(img image.Image, ext string) Encoder {
+	return e.GetEncoderWithOptions(img, ext, processor.EncodeOptions{})
+}
+
+// GetEncoderWithOptions takes an input of image, extension and EncodeOptions and return the appropriate
+// Encoder for encoding the image, options which are not set fall back to the configured encoders
+func (e *Encoders) GetEncoderWithOptions(img image.Image, ext string, opts processor.EncodeOptions) Encoder {
+	jpegEncoder, pngEncoder, webPEncoder := e.withOptions(opts)
 	switch ext {
 	case processor.ExtensionJPG, processor.ExtensionJPEG:
-		return e.jpegEncoder
+		return jpegEncoder
 	case processor.ExtensionPNG:
-		if e.jpegEncoder.Option.Quality != 100 && isOpaque(img) {
-			return e.jpegEncoder
+		// A paletted image was reduced for a small PNG, JPEG would undo that
+		if _, ok := img.(*image.Paletted); !ok && !opts.KeepPNG && jpegEncoder.Option.Quality != 100 && e.canFlatten(img) &&
+			!e.isGraphic(img) {
+			return jpegEncoder
+		}
+		return pngEncoder
+	case processor.ExtensionWebP:
+		if e.isGraphic(img) {
+			return webPEncoder.lossless()
 		}
-		return e.pngEncoder
+		return webPEncoder
+	default:
+		return e.noOpEncoder
+	}
+}
+
+// isGraphic returns true if the graphic detection is enabled and img looks like a graphic
+func (e *Encoders) isGraphic(img image.Image) bool {
+	return e.graphicColors > 0 && isGraphic(img, e.graphicColors)
+}
+
+// canFlatten returns true if the alpha channel of img can be dropped without visible loss for the
+// configured alphaThreshold
+func (e *Encoders) canFlatten(img image.Image) bool {
+	if e.alphaThreshold < 0 {
+		return isOpaque(img)
+	}
+	return getPartialAlphaFraction(img) <= e.alphaThreshold
+}
+
+// getEncoderForFormat takes an extension and EncodeOptions and return the Encoder of exactly that format,
+// unlike GetEncoderWithOptions opaque images are never downgraded from PNG to JPEG
+func (e *Encoders) getEncoderForFormat(ext string, opts processor.EncodeOptions) Encoder {
+	jpegEncoder, pngEncoder, webPEncoder := e.withOptions(opts)
+	switch ext {
+	case processor.ExtensionJPG, processor.ExtensionJPEG:
+		return jpegEncoder
+	case processor.ExtensionPNG:
+		return pngEncoder
 	case processor.ExtensionWebP:
-		return e.webPEncoder
+		return webPEncoder
 	default:
 		return e.noOpEncoder
 	}
 }
 
+// encodeWithOptions encodes img with enc, a JpegEncoder flattens transparent pixels onto the background of opts,
+// which takes precedence over the one of the encoder and the Encoders. The opacity of img is checked only once.
+func (e *Encoders) encodeWithOptions(img image.Image, enc Encoder, opts processor.EncodeOptions) ([]byte, error) {
+	jpegEncoder, ok := enc.(*JpegEncoder)
+	if !ok {
+		return enc.Encode(img)
+	}
+	bg := opts.Background
+	if bg == nil {
+		bg = jpegEncoder.Background
+	}
+	if bg == nil {
+		bg = e.background
+	}
+	return jpegEncoder.encode(img, bg)
+}
+
+// withOptions returns the jpeg, png and webp encoders with opts applied over the configured encoders
+func (e *Encoders) withOptions(opts processor.EncodeOptions) (*JpegEncoder, *PngEncoder, *WebPEncoder) {
+	jpegEncoder, pngEncoder, webPEncoder := e.jpegEncoder, e.pngEncoder, e.webPEncoder
+	if opts.Quality > 0 {
+		// Only the quality is overridden, the other options of the configured encoders are kept
+		jpegEncoder = jpegEncoder.withQuality(opts.Quality)
+		webPEncoder = webPEncoder.withQuality(float32(opts.Quality))
+	}
+	switch opts.Compression {
+	case processor.CompressionSpeed:
+		pngEncoder = &PngEncoder{Encoder: &png.Encoder{CompressionLevel: png.BestSpeed}}
+	case processor.CompressionBest:
+		pngEncoder = &PngEncoder{Encoder: &png.Encoder{CompressionLevel: png.BestCompression}}
+	}
+	return jpegEncoder, pngEncoder, webPEncoder
+}
+
 // WithJpegEncoder is a builder function for setting custom JpegEncoder
 func WithJpegEncoder(jpegEncoder *JpegEncoder) EncodersOption {
 	return func(e *Encoders) {
@@ -105,6 +232,36 @@ func WithWebPEncoder(webPEncoder *WebPEncoder) EncodersOption {
 	}
 }
 
+// WithAlphaThreshold is a builder function for setting the largest fraction (0 to 1) of partially transparent
+// pixels a PNG may have to be downgraded to JPEG. Fully opaque and fully transparent pixels are not counted,
+// so hard edged cut-outs are downgraded while soft edged images like stickers stay PNG.
+func WithAlphaThreshold(threshold float64) EncodersOption {
+	return func(e *Encoders) {
+		e.alphaThreshold = threshold
+	}
+}
+
+// WithFlattenBackground is a builder function for setting the color transparent pixels are flattened onto
+// whenever the BildProcessor encodes an image with transparent pixels to JPEG, e.g. a PNG downgraded with
+// WithAlphaThreshold or the transparent padding of fit=contain. The default nil flattens onto black.
+// The Background of a JpegEncoder takes precedence and EncodeOptions.Background overrides both per call.
+func WithFlattenBackground(c color.Color) EncodersOption {
+	return func(e *Encoders) {
+		e.background = c
+	}
+}
+
+// WithGraphicDetection is a builder function for keeping graphics like logos, icons and UI screenshots lossless,
+// JPEG and lossy WebP produce ringing around their sharp edges. An image is detected as a graphic if it has
+// at most maxColors distinct colors or is made of flat areas and hard edges. Graphics are not downgraded from
+// PNG to JPEG even if opaque and are encoded to lossless WebP, explicit JPEG output is left as is.
+// The detection is disabled by default or with a maxColors of 0.
+func WithGraphicDetection(maxColors int) EncodersOption {
+	return func(e *Encoders) {
+		e.graphicColors = maxColors
+	}
+}
+
 // NewEncoders creates a new Encoders, if called without parameter (builder), all encoders option will be default
 func NewEncoders(opts ...EncodersOption) *Encoders {
 	e := &Encoders{
@@ -112,8 +269,9 @@ func NewEncoders(opts ...EncodersOption) *Encoders {
 		pngEncoder: &PngEncoder{
 			Encoder: &png.Encoder{CompressionLevel: png.BestCompression},
 		},
-		noOpEncoder: &NopEncoder{},
-		webPEncoder: &WebPEncoder{},
+		noOpEncoder:    &NopEncoder{},
+		webPEncoder:    &WebPEncoder{},
+		alphaThreshold: -1,
 	}
 	for _, opt := range opts {
 		opt(e)
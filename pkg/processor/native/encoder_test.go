@@ -3,12 +3,14 @@ package native
 import (
 	"bytes"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"io/ioutil"
 	"testing"
 
+	"github.com/chai2010/webp"
 	"github.com/gojek/darkroom/pkg/processor"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -82,10 +84,81 @@ func (s *EncoderSuite) TestEncoders_GetEncoder_GivenOpaqueImageAndPngExtensionSh
 	assert.IsType(s.T(), &PngEncoder{}, s.encoders.GetEncoder(s.opaqueImage, "png"))
 }
 
+func (s *EncoderSuite) TestEncoders_GetEncoderWithOptions_GivenOpaqueImageAndKeepPNGShouldReturnPngEncoder() {
+	opts := processor.EncodeOptions{KeepPNG: true}
+	assert.IsType(s.T(), &PngEncoder{}, s.encoders.GetEncoderWithOptions(s.opaqueImage, "png", opts))
+	assert.IsType(s.T(), &JpegEncoder{}, s.encoders.GetEncoderWithOptions(s.opaqueImage, "jpg", opts))
+}
+
 func (s *EncoderSuite) TestEncoders_GetEncoder_GivenTransparentImageAndPngExtensionShouldReturnPngEncoder() {
 	assert.IsType(s.T(), &PngEncoder{}, s.encoders.GetEncoder(s.transparentImage, "png"))
 }
 
+func (s *EncoderSuite) TestEncoders_GetEncoder_WithAlphaThreshold() {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, img.Bounds(), image.Opaque, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 10, 5), image.Transparent, image.ZP, draw.Src)
+
+	// Without a threshold only fully opaque images are downgraded
+	assert.IsType(s.T(), &PngEncoder{}, NewEncoders().GetEncoder(img, "png"))
+
+	e := NewEncoders(WithAlphaThreshold(0.1))
+	assert.Equal(s.T(), 0.1, e.alphaThreshold)
+	assert.IsType(s.T(), &JpegEncoder{}, e.GetEncoder(img, "png"))
+	assert.IsType(s.T(), &JpegEncoder{}, e.GetEncoder(s.opaqueImage, "png"))
+
+	draw.Draw(img, image.Rect(0, 0, 10, 1), image.NewUniform(color.NRGBA{A: 128}), image.ZP, draw.Src)
+	assert.IsType(s.T(), &JpegEncoder{}, e.GetEncoder(img, "png"))
+	draw.Draw(img, image.Rect(0, 0, 10, 2), image.NewUniform(color.NRGBA{A: 128}), image.ZP, draw.Src)
+	assert.IsType(s.T(), &PngEncoder{}, e.GetEncoder(img, "png"))
+}
+
+func (s *EncoderSuite) TestEncoders_GetEncoder_WithGraphicDetection() {
+	// Flat blocks of many colors with hard edges between them
+	graphic := image.NewNRGBA(image.Rect(0, 0, 80, 80))
+	for x := 0; x < 80; x++ {
+		for y := 0; y < 80; y++ {
+			graphic.Set(x, y, color.NRGBA{R: uint8(x / 8 * 97), G: uint8(y / 8 * 97), B: 0x80, A: 0xff})
+		}
+	}
+	photo, err := ioutil.ReadFile("_testdata/test.jpg")
+	s.NoError(err)
+	photoImage, _, err := image.Decode(bytes.NewReader(photo))
+	s.NoError(err)
+
+	assert.IsType(s.T(), &JpegEncoder{}, NewEncoders().GetEncoder(graphic, "png"))
+
+	e := NewEncoders(WithGraphicDetection(16))
+	assert.IsType(s.T(), &PngEncoder{}, e.GetEncoder(graphic, "png"))
+	assert.True(s.T(), e.GetEncoder(graphic, "webp").(*WebPEncoder).Option.Lossless)
+	assert.IsType(s.T(), &JpegEncoder{}, e.GetEncoder(graphic, "jpg"))
+	assert.IsType(s.T(), &JpegEncoder{}, e.GetEncoder(photoImage, "png"))
+	assert.Equal(s.T(), e.webPEncoder, e.GetEncoder(photoImage, "webp"))
+
+	// The lossless encoder keeps the other options of the configured one
+	e = NewEncoders(WithGraphicDetection(16), WithWebPEncoder(&WebPEncoder{Option: &webp.Options{Quality: 60, Exact: true}}))
+	assert.Equal(s.T(), &webp.Options{Lossless: true, Quality: 60, Exact: true}, e.GetEncoder(graphic, "webp").(*WebPEncoder).Option)
+	assert.Equal(s.T(), &webp.Options{Lossless: true, Quality: 80, Exact: true},
+		e.GetEncoderWithOptions(graphic, "webp", processor.EncodeOptions{Quality: 80}).(*WebPEncoder).Option)
+
+	// A few colors are enough regardless of the edges
+	assert.True(s.T(), isGraphic(newUniformImage(image.Rect(0, 0, 4, 4), color.White), 1))
+	assert.False(s.T(), isGraphic(photoImage, 16))
+	assert.False(s.T(), isGraphic(image.NewNRGBA(image.Rect(0, 0, 0, 0)), 16))
+
+	// A product shot on a white background is a photo, although most of its pixels are flat
+	product := image.NewNRGBA(image.Rect(0, 0, 2000, 1500))
+	draw.Draw(product, product.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(product, photoImage.Bounds().Add(image.Pt(750, 560)), photoImage, image.ZP, draw.Src)
+	assert.False(s.T(), isGraphic(product, 16))
+	assert.IsType(s.T(), &JpegEncoder{}, e.GetEncoder(product, "png"))
+}
+
+func (s *EncoderSuite) TestEncoders_GetEncoder_GivenOpaquePalettedImageShouldReturnPngEncoder() {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	assert.IsType(s.T(), &PngEncoder{}, s.encoders.GetEncoder(img, "png"))
+}
+
 func (s *EncoderSuite) TestEncoders_GetEncoder_GivenUnknownExtensionShouldReturnNopEncoder() {
 	assert.IsType(s.T(), &NopEncoder{}, s.encoders.GetEncoder(image.Black, "unknown"))
 }
@@ -94,6 +167,42 @@ func (s *EncoderSuite) TestEncoders_GetEncoder_GivenWebPExtensionShouldReturnWeb
 	assert.IsType(s.T(), &WebPEncoder{}, s.encoders.GetEncoder(s.transparentImage, "webp"))
 }
 
+func (s *EncoderSuite) TestEncoders_GetEncoderWithOptions_WithoutOptionsShouldReturnConfiguredEncoders() {
+	opts := processor.EncodeOptions{}
+	assert.Equal(s.T(), s.encoders.jpegEncoder, s.encoders.GetEncoderWithOptions(s.opaqueImage, "jpg", opts))
+	assert.Equal(s.T(), s.encoders.pngEncoder, s.encoders.GetEncoderWithOptions(s.transparentImage, "png", opts))
+	assert.Equal(s.T(), s.encoders.webPEncoder, s.encoders.GetEncoderWithOptions(s.opaqueImage, "webp", opts))
+}
+
+func (s *EncoderSuite) TestEncoders_GetEncoderWithOptions_ShouldApplyQuality() {
+	opts := processor.EncodeOptions{Quality: 80}
+	jpegEncoder := s.encoders.GetEncoderWithOptions(s.opaqueImage, "jpg", opts)
+	assert.Equal(s.T(), &JpegEncoder{Option: &jpeg.Options{Quality: 80}}, jpegEncoder)
+	webPEncoder := s.encoders.GetEncoderWithOptions(s.opaqueImage, "webp", opts)
+	assert.Equal(s.T(), &WebPEncoder{Option: &webp.Options{Quality: 80}}, webPEncoder)
+	// Opaque PNG is downgraded to JPEG with the given quality
+	assert.Equal(s.T(), jpegEncoder, s.encoders.GetEncoderWithOptions(s.opaqueImage, "png", opts))
+	// Quality 100 keeps the opaque PNG as PNG
+	opts.Quality = 100
+	assert.IsType(s.T(), &PngEncoder{}, s.encoders.GetEncoderWithOptions(s.opaqueImage, "png", opts))
+
+	// Only the quality of the configured encoders is overridden
+	e := NewEncoders(WithWebPEncoder(&WebPEncoder{Option: &webp.Options{Quality: 60, Exact: true}}),
+		WithJpegEncoder(&JpegEncoder{Option: &jpeg.Options{Quality: 60}, Background: color.Black}))
+	assert.Equal(s.T(), &WebPEncoder{Option: &webp.Options{Quality: 80, Exact: true}},
+		e.GetEncoderWithOptions(s.opaqueImage, "webp", processor.EncodeOptions{Quality: 80}))
+	assert.Equal(s.T(), &JpegEncoder{Option: &jpeg.Options{Quality: 80}, Background: color.Black},
+		e.GetEncoderWithOptions(s.opaqueImage, "jpg", processor.EncodeOptions{Quality: 80}))
+	assert.Equal(s.T(), &webp.Options{Quality: 60, Exact: true}, e.webPEncoder.Option)
+}
+
+func (s *EncoderSuite) TestEncoders_GetEncoderWithOptions_ShouldApplyCompression() {
+	enc := s.encoders.GetEncoderWithOptions(s.transparentImage, "png", processor.EncodeOptions{Compression: processor.CompressionSpeed})
+	assert.Equal(s.T(), png.BestSpeed, enc.(*PngEncoder).Encoder.CompressionLevel)
+	enc = s.encoders.GetEncoderWithOptions(s.transparentImage, "png", processor.EncodeOptions{Compression: processor.CompressionBest})
+	assert.Equal(s.T(), png.BestCompression, enc.(*PngEncoder).Encoder.CompressionLevel)
+}
+
 func (s *EncoderSuite) TestJpgEncoder_Encode_ShouldEncodeToJpeg() {
 	encoder := JpegEncoder{Option: nil}
 	data, err := encoder.Encode(s.srcImage)
@@ -140,3 +249,71 @@ func (s *EncoderSuite) TestWebPEncoder_Encode_ShouldEncodeToWebP() {
 	assert.Nil(s.T(), err)
 	assert.Equal(s.T(), "webp", f)
 }
+
+func (s *EncoderSuite) TestBildProcessor_EncodeWithDefaultQualities() {
+	bp := NewBildProcessor(WithDefaultQualities(map[string]int{"JPG": 30, "webp": 40, "avif": 50, "png": 101}))
+	assert.Equal(s.T(), map[string]int{"jpeg": 30, "webp": 40, "avif": 50}, bp.qualities)
+	expected := func(ext string, q int) []byte {
+		data, err := NewBildProcessor().EncodeWithOptions(s.srcImage, ext, processor.EncodeOptions{Quality: q})
+		s.NoError(err)
+		return data
+	}
+	encode := func(ext string, opts processor.EncodeOptions) []byte {
+		data, err := bp.EncodeWithOptions(s.srcImage, ext, opts)
+		s.NoError(err)
+		return data
+	}
+
+	data, err := bp.Encode(s.srcImage, processor.ExtensionJPEG)
+	s.NoError(err)
+	assert.Equal(s.T(), expected(processor.ExtensionJPEG, 30), data)
+	assert.Equal(s.T(), expected(processor.ExtensionWebP, 40), encode(processor.ExtensionWebP, processor.EncodeOptions{}))
+	// An explicit quality takes precedence
+	assert.Equal(s.T(), expected(processor.ExtensionJPEG, 90), encode(processor.ExtensionJPG, processor.EncodeOptions{Quality: 90}))
+	// An opaque PNG is downgraded to a JPEG of the default quality
+	data, err = bp.Encode(s.opaqueImage, processor.ExtensionPNG)
+	s.NoError(err)
+	downgraded, err := NewBildProcessor().EncodeWithOptions(s.opaqueImage, processor.ExtensionJPEG, processor.EncodeOptions{Quality: 30})
+	s.NoError(err)
+	assert.Equal(s.T(), downgraded, data)
+	assert.Equal(s.T(), 0, NewBildProcessor().getDefaultQuality(processor.ExtensionJPEG))
+}
+
+func (s *EncoderSuite) TestBildProcessor_EncodeFlattensOntoBackground() {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	at := func(data []byte) color.RGBA {
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		s.NoError(err)
+		r, g, b, _ := decoded.At(4, 4).RGBA()
+		return color.RGBA{R: uint8(r >> 12 << 4), G: uint8(g >> 12 << 4), B: uint8(b >> 12 << 4), A: 0xff}
+	}
+	white, black, red := color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}, color.RGBA{A: 0xff}, color.RGBA{R: 0xf0, A: 0xff}
+
+	data, err := NewBildProcessor().Encode(img, "jpg")
+	s.NoError(err)
+	s.Equal(black, at(data))
+
+	bp := NewBildProcessor(WithEncoders(NewEncoders(WithFlattenBackground(color.White))))
+	data, err = bp.Encode(img, "jpg")
+	s.NoError(err)
+	s.Equal(white, at(data))
+
+	bp = NewBildProcessor(WithEncoders(NewEncoders(WithFlattenBackground(color.RGBA{R: 0xff, A: 0xff}))))
+	data, err = bp.Encode(img, "jpg")
+	s.NoError(err)
+	s.Equal(red, at(data))
+
+	data, err = bp.EncodeWithOptions(img, "jpg", processor.EncodeOptions{Quality: 90, Background: color.Black})
+	s.NoError(err)
+	s.Equal(black, at(data))
+
+	bp = NewBildProcessor(WithEncoders(NewEncoders(WithFlattenBackground(nil))))
+	data, err = bp.Encode(img, "jpg")
+	s.NoError(err)
+	s.Equal(black, at(data))
+
+	bp = NewBildProcessor(WithEncoders(NewEncoders(WithJpegEncoder(&JpegEncoder{Background: color.RGBA{R: 0xff, A: 0xff}}))))
+	data, err = bp.Encode(img, "jpg")
+	s.NoError(err)
+	s.Equal(red, at(data))
+}
@@ -0,0 +1,44 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+// maxHistogramPixels is the largest number of pixels counted for a histogram, larger images are sampled
+const maxHistogramPixels = 1000 * 1000
+
+// Histogram takes an input image and returns the 256 bin histograms of its red, green, blue and Rec. 601 luma
+// values, images larger than a megapixel are sampled on an evenly spaced grid
+func (bp *BildProcessor) Histogram(img image.Image) processor.Histogram {
+	var h processor.Histogram
+	b := img.Bounds()
+	step := getHistogramStep(b.Dx(), b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			h.R[c.R]++
+			h.G[c.G]++
+			h.B[c.B]++
+			h.Luma[uint8(getLuma(c.R, c.G, c.B)+0.5)]++
+			h.Total++
+		}
+	}
+	return h
+}
+
+// getHistogramStep returns the distance between the sampled pixels of a w x h image so that at most
+// maxHistogramPixels are sampled, sampling instead of downscaling keeps the actual pixel values
+func getHistogramStep(w, h int) int {
+	area := float64(w) * float64(h)
+	if area <= maxHistogramPixels {
+		return 1
+	}
+	return int(math.Ceil(math.Sqrt(area / maxHistogramPixels)))
+}
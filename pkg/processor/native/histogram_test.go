@@ -0,0 +1,55 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBildProcessor_Histogram(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	img.Set(2, 0, color.NRGBA{R: 10, G: 20, B: 30, A: 128})
+	img.Set(3, 0, color.Transparent)
+
+	h := NewBildProcessor().Histogram(img)
+
+	assert.Equal(t, 3, h.Total)
+	assert.Equal(t, 2, h.R[255])
+	assert.Equal(t, 1, h.G[0])
+	assert.Equal(t, 1, h.G[255])
+	assert.Equal(t, 1, h.B[255])
+	assert.Equal(t, 1, h.Luma[255])
+	// 0.299 * 255 = 76.2
+	assert.Equal(t, 1, h.Luma[76])
+	// Straight colors are counted for the semi-transparent pixel
+	assert.InDelta(t, 10, indexOf(h.R[:]), 1)
+	assert.InDelta(t, 18, indexOf(h.Luma[:]), 1)
+}
+
+func TestBildProcessor_HistogramSamplesLargeImages(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 3000, 2000))
+	h := NewBildProcessor().Histogram(img)
+	assert.Equal(t, 1000*667, h.Total)
+	assert.Equal(t, h.Total, h.Luma[0])
+}
+
+func Test_getHistogramStep(t *testing.T) {
+	assert.Equal(t, 1, getHistogramStep(1000, 1000))
+	assert.Equal(t, 2, getHistogramStep(1001, 1000))
+	assert.Equal(t, 3, getHistogramStep(3000, 2000))
+	assert.Equal(t, 1, getHistogramStep(0, 0))
+}
+
+// indexOf returns the first bin of hist that is set and is neither 0 nor 255
+func indexOf(hist []int) int {
+	for i := 1; i < 255; i++ {
+		if hist[i] > 0 {
+			return i
+		}
+	}
+	return -1
+}
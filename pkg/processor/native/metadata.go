@@ -0,0 +1,265 @@
+package native
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	markerPrefix = 0xff
+	markerSOI    = 0xd8
+	markerSOS    = 0xda
+	markerAPP0   = 0xe0 // JFIF
+	markerAPP1   = 0xe1 // EXIF and XMP
+	markerAPP2   = 0xe2 // ICC profile
+	markerAPP13  = 0xed // IPTC
+)
+
+// GetJPEGMetadata returns the raw metadata segments (EXIF, XMP, ICC profile and IPTC) of a JPEG image
+// including their markers, in the order they appear. It returns nil if data is not a JPEG image.
+func GetJPEGMetadata(data []byte) [][]byte {
+	if len(data) < 2 || data[0] != markerPrefix || data[1] != markerSOI {
+		return nil
+	}
+	var segments [][]byte
+	for i := 2; i+4 <= len(data) && data[i] == markerPrefix; {
+		marker := data[i+1]
+		if marker == markerSOS {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) {
+			break
+		}
+		switch marker {
+		case markerAPP1, markerAPP2, markerAPP13:
+			segments = append(segments, data[i:end])
+		}
+		i = end
+	}
+	return segments
+}
+
+// SetJPEGMetadata takes JPEG image bytes and raw metadata segments (see GetJPEGMetadata) and returns
+// the image bytes with the segments inserted right after the start of image marker, or after the JFIF
+// segment which has to come first
+func SetJPEGMetadata(data []byte, segments [][]byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != markerPrefix || data[1] != markerSOI {
+		return nil, errors.New("metadata can only be set on a JPEG image")
+	}
+	if len(segments) == 0 {
+		return data, nil
+	}
+	i := 2
+	if jfif := getJFIFSegment(data); jfif != nil {
+		i += len(jfif)
+	}
+	buff := &bytes.Buffer{}
+	buff.Write(data[:i])
+	for _, s := range segments {
+		buff.Write(s)
+	}
+	buff.Write(data[i:])
+	return buff.Bytes(), nil
+}
+
+// getJFIFSegment returns the JFIF APP0 segment following the start of image marker of a JPEG, or nil
+func getJFIFSegment(data []byte) []byte {
+	if len(data) < 6 || data[2] != markerPrefix || data[3] != markerAPP0 {
+		return nil
+	}
+	end := 4 + int(binary.BigEndian.Uint16(data[4:6]))
+	// The identifier, version, units and densities take 12 bytes after the length
+	if end > len(data) || end < 18 || !bytes.Equal(data[6:11], []byte("JFIF\x00")) {
+		return nil
+	}
+	return data[2:end]
+}
+
+// setDensity returns the JPEG or PNG image bytes with their pixel density set to dpi dots per inch, the JFIF
+// segment of a JPEG and the pHYs chunk of a PNG are replaced or added. Other formats are returned unchanged.
+func setDensity(data []byte, dpi int) ([]byte, error) {
+	if dpi <= 0 || dpi > math.MaxUint16 {
+		return nil, errors.New("dpi must be between 1 and 65535")
+	}
+	switch {
+	case len(data) >= 2 && data[0] == markerPrefix && data[1] == markerSOI:
+		return setJPEGDensity(data, uint16(dpi)), nil
+	case bytes.HasPrefix(data, []byte(apngSignature)):
+		return setPNGDensity(data, dpi)
+	}
+	return data, nil
+}
+
+func setJPEGDensity(data []byte, dpi uint16) []byte {
+	out := make([]byte, 0, len(data)+18)
+	out = append(out, data[:2]...)
+	rest := data[2:]
+	var jfif []byte
+	if existing := getJFIFSegment(data); existing != nil {
+		jfif = append(jfif, existing...)
+		rest = data[2+len(existing):]
+	} else {
+		// JFIF 1.02 without a thumbnail
+		jfif = []byte{markerPrefix, markerAPP0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, 0, 0, 0, 0, 0, 0, 0}
+	}
+	// The units are dots per inch, followed by the horizontal and vertical density
+	jfif[11] = 1
+	binary.BigEndian.PutUint16(jfif[12:14], dpi)
+	binary.BigEndian.PutUint16(jfif[14:16], dpi)
+	out = append(out, jfif...)
+	return append(out, rest...)
+}
+
+func setPNGDensity(data []byte, dpi int) ([]byte, error) {
+	// pHYs holds pixels per metre
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+	phys := make([]byte, 9)
+	binary.BigEndian.PutUint32(phys[0:4], ppm)
+	binary.BigEndian.PutUint32(phys[4:8], ppm)
+	phys[8] = 1
+
+	b := bytes.NewBufferString(apngSignature)
+	for rest := data[len(apngSignature):]; len(rest) > 0; {
+		typ, _, next, err := readPNGChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		raw := rest[:len(rest)-len(next)]
+		rest = next
+		switch typ {
+		case "pHYs":
+			// Replaced by the chunk written after IHDR
+		case "IHDR":
+			b.Write(raw)
+			writePNGChunk(b, "pHYs", phys)
+		default:
+			b.Write(raw)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// pngColorChunks are the chunks of a PNG describing the color space of its pixels, image/png ignores them on
+// decode and doesn't write them on encode
+var pngColorChunks = map[string]bool{"gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true}
+
+// GetPNGColorChunks returns the raw color space chunks (gAMA, cHRM, sRGB and iCCP) of a PNG image including their
+// length, type and checksum, in the order they appear. It returns nil if data is not a PNG image.
+func GetPNGColorChunks(data []byte) [][]byte {
+	if !bytes.HasPrefix(data, []byte(apngSignature)) {
+		return nil
+	}
+	var chunks [][]byte
+	for rest := data[len(apngSignature):]; len(rest) > 0; {
+		typ, _, next, err := readPNGChunk(rest)
+		if err != nil || typ == "PLTE" || typ == "IDAT" {
+			// The color space chunks have to come before the palette and the image data
+			break
+		}
+		if pngColorChunks[typ] {
+			chunks = append(chunks, rest[:len(rest)-len(next)])
+		}
+		rest = next
+	}
+	return chunks
+}
+
+// SetPNGColorChunks takes PNG image bytes and raw color space chunks (see GetPNGColorChunks) and returns the
+// image bytes with the chunks inserted right after the IHDR chunk, the color space chunks the image already has
+// are replaced. An iCCP chunk whose profile doesn't match the color type of the image, e.g. an RGB profile of a
+// grayscale source on an RGB image, is dropped as PNG requires a gray profile for grayscale images and an RGB
+// profile otherwise.
+func SetPNGColorChunks(data []byte, chunks [][]byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(apngSignature)) {
+		return nil, errors.New("color chunks can only be set on a PNG image")
+	}
+	if len(chunks) == 0 {
+		return data, nil
+	}
+	b := bytes.NewBufferString(apngSignature)
+	for rest := data[len(apngSignature):]; len(rest) > 0; {
+		typ, body, next, err := readPNGChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		raw := rest[:len(rest)-len(next)]
+		rest = next
+		switch {
+		case pngColorChunks[typ]:
+			// Replaced by the chunks written after IHDR
+		case typ == "IHDR":
+			b.Write(raw)
+			for _, c := range chunks {
+				if string(c[4:8]) == "iCCP" && !isICCPOfColorType(c[8:len(c)-4], body) {
+					continue
+				}
+				b.Write(c)
+			}
+		default:
+			b.Write(raw)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// isICCPOfColorType returns true if the ICC profile of the iCCP chunk body iccp has the color space the color type
+// of the IHDR chunk body ihdr requires, GRAY for grayscale and RGB otherwise. A profile that can't be read is
+// reported not to match.
+func isICCPOfColorType(iccp, ihdr []byte) bool {
+	// The profile name is followed by a NUL, the compression method and the zlib stream of the profile
+	i := bytes.IndexByte(iccp, 0)
+	if i < 0 || i+2 > len(iccp) || len(ihdr) < 10 {
+		return false
+	}
+	r, err := zlib.NewReader(bytes.NewReader(iccp[i+2:]))
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	// The color space is stored at offset 16 of the profile header
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return false
+	}
+	// Color types 0 and 4 are grayscale without and with alpha
+	if colorType := ihdr[9]; colorType == 0 || colorType == 4 {
+		return string(header[16:20]) == "GRAY"
+	}
+	return string(header[16:20]) == "RGB "
+}
+
+// pngMetadataChunks are the chunks of a PNG holding metadata which image/png doesn't write on encode, the color
+// space chunks are kept with SetPNGColorChunks
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true, "pHYs": true}
+
+// HasMetadata returns true if the JPEG, PNG or WebP image data holds metadata that is lost when the image is decoded
+// and encoded again, i.e. the segments returned by GetJPEGMetadata, the text, EXIF, time and density chunks of a PNG
+// and the ICC profile, EXIF and XMP chunks of a WebP. Image data that can't be parsed is reported to have metadata.
+func HasMetadata(data []byte) bool {
+	switch {
+	case len(data) >= 2 && data[0] == markerPrefix && data[1] == markerSOI:
+		return len(GetJPEGMetadata(data)) > 0
+	case bytes.HasPrefix(data, []byte(apngSignature)):
+		for rest := data[len(apngSignature):]; len(rest) > 0; {
+			typ, _, next, err := readPNGChunk(rest)
+			if err != nil || pngMetadataChunks[typ] {
+				return true
+			}
+			if typ == "IEND" {
+				break
+			}
+			rest = next
+		}
+	case processor.DetectContentType(data) == processor.ContentTypeWebP:
+		// The ICC profile, EXIF and XMP flags of the extended header
+		return len(data) >= 21 && bytes.Equal(data[12:16], []byte("VP8X")) && data[20]&0x2c != 0
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package native
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJPEGMetadata(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/exif_orientation/f6t.jpg")
+	segments := GetJPEGMetadata(data)
+	assert.Len(t, segments, 1)
+	assert.Equal(t, []byte{0xff, 0xe1}, segments[0][:2])
+	assert.Equal(t, []byte("Exif"), segments[0][4:8])
+
+	data, _ = ioutil.ReadFile("_testdata/test.jpg")
+	assert.Nil(t, GetJPEGMetadata(data))
+
+	data, _ = ioutil.ReadFile("_testdata/test.png")
+	assert.Nil(t, GetJPEGMetadata(data))
+}
+
+func TestSetJPEGMetadata(t *testing.T) {
+	src, _ := ioutil.ReadFile("_testdata/exif_orientation/f6t.jpg")
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+
+	out, err := SetJPEGMetadata(data, GetJPEGMetadata(src))
+	assert.Nil(t, err)
+	assert.Equal(t, GetJPEGMetadata(src), GetJPEGMetadata(out))
+	orientation, _ := GetOrientation(bytes.NewReader(out))
+	assert.Equal(t, 6, orientation)
+	_, f, err := NewBildProcessor().Decode(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg", f)
+
+	out, err = SetJPEGMetadata(data, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+
+	png, _ := ioutil.ReadFile("_testdata/test.png")
+	_, err = SetJPEGMetadata(png, GetJPEGMetadata(src))
+	assert.Error(t, err)
+}
+
+func TestSetJPEGMetadataAfterJFIF(t *testing.T) {
+	src, _ := ioutil.ReadFile("_testdata/exif_orientation/f6t.jpg")
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	data, err := setDensity(data, 300)
+	assert.Nil(t, err)
+
+	out, err := SetJPEGMetadata(data, GetJPEGMetadata(src))
+	assert.Nil(t, err)
+	assert.Equal(t, data[:20], out[:20])
+	assert.Equal(t, []byte{0xff, 0xe1}, out[20:22])
+}
+
+func TestSetDensity(t *testing.T) {
+	bp := NewBildProcessor()
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	out, err := setDensity(data, 300)
+	assert.Nil(t, err)
+	jfif := getJFIFSegment(out)
+	assert.NotNil(t, jfif)
+	assert.Equal(t, []byte{1, 0x01, 0x2c, 0x01, 0x2c}, jfif[11:16])
+	_, f, err := bp.Decode(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg", f)
+
+	again, err := setDensity(out, 72)
+	assert.Nil(t, err)
+	assert.Equal(t, len(out), len(again))
+	assert.Equal(t, []byte{1, 0, 72, 0, 72}, getJFIFSegment(again)[11:16])
+
+	data, _ = ioutil.ReadFile("_testdata/test.png")
+	out, err = setDensity(data, 300)
+	assert.Nil(t, err)
+	// 300 dpi are 11811 pixels per metre
+	phys := []byte{'p', 'H', 'Y', 's', 0, 0, 0x2e, 0x23, 0, 0, 0x2e, 0x23, 1}
+	assert.Equal(t, 1, bytes.Count(out, phys))
+	_, f, err = bp.Decode(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "png", f)
+
+	again, err = setDensity(out, 300)
+	assert.Nil(t, err)
+	assert.Equal(t, out, again)
+
+	data, _ = ioutil.ReadFile("_testdata/test.webp")
+	out, err = setDensity(data, 300)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+
+	_, err = setDensity(data, 0)
+	assert.Error(t, err)
+}
+
+func TestSetPNGColorChunks(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/test.png")
+	assert.Nil(t, GetPNGColorChunks(data))
+
+	// A gamma of 1/2.2 and the sRGB perceptual rendering intent
+	gama, srgb := &bytes.Buffer{}, &bytes.Buffer{}
+	writePNGChunk(gama, "gAMA", []byte{0, 0, 0xb1, 0x8f})
+	writePNGChunk(srgb, "sRGB", []byte{0})
+	chunks := [][]byte{gama.Bytes(), srgb.Bytes()}
+
+	out, err := SetPNGColorChunks(data, chunks)
+	assert.Nil(t, err)
+	assert.Equal(t, chunks, GetPNGColorChunks(out))
+	src, _, err := NewBildProcessor().Decode(data)
+	assert.Nil(t, err)
+	img, f, err := NewBildProcessor().Decode(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "png", f)
+	assert.Equal(t, src, img)
+
+	// The chunks replace the ones of the image
+	out, err = SetPNGColorChunks(out, chunks[:1])
+	assert.Nil(t, err)
+	assert.Equal(t, chunks[:1], GetPNGColorChunks(out))
+
+	out, err = SetPNGColorChunks(data, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+
+	jpg, _ := ioutil.ReadFile("_testdata/test.jpg")
+	assert.Nil(t, GetPNGColorChunks(jpg))
+	_, err = SetPNGColorChunks(jpg, chunks)
+	assert.Error(t, err)
+}
+
+func TestSetPNGColorChunks_DropsICCPOfOtherColorType(t *testing.T) {
+	iccp := func(colorSpace string) []byte {
+		profile := make([]byte, 128)
+		copy(profile[16:], colorSpace)
+		body := &bytes.Buffer{}
+		body.WriteString("icc\x00\x00")
+		zw := zlib.NewWriter(body)
+		_, _ = zw.Write(profile)
+		_ = zw.Close()
+		chunk := &bytes.Buffer{}
+		writePNGChunk(chunk, "iCCP", body.Bytes())
+		return chunk.Bytes()
+	}
+	rgb, gray := &bytes.Buffer{}, &bytes.Buffer{}
+	_ = png.Encode(rgb, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	_ = png.Encode(gray, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	out, err := SetPNGColorChunks(rgb.Bytes(), [][]byte{iccp("RGB ")})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{iccp("RGB ")}, GetPNGColorChunks(out))
+
+	// A grayscale source converted to RGB, or the other way round, loses its profile
+	out, err = SetPNGColorChunks(rgb.Bytes(), [][]byte{iccp("GRAY")})
+	assert.Nil(t, err)
+	assert.Nil(t, GetPNGColorChunks(out))
+	out, err = SetPNGColorChunks(gray.Bytes(), [][]byte{iccp("RGB ")})
+	assert.Nil(t, err)
+	assert.Nil(t, GetPNGColorChunks(out))
+	out, err = SetPNGColorChunks(gray.Bytes(), [][]byte{iccp("GRAY")})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{iccp("GRAY")}, GetPNGColorChunks(out))
+}
+
+func TestHasMetadata(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/exif_orientation/f6t.jpg")
+	assert.True(t, HasMetadata(data))
+	data, _ = ioutil.ReadFile("_testdata/test.jpg")
+	assert.False(t, HasMetadata(data))
+	data, _ = ioutil.ReadFile("_testdata/test.webp")
+	assert.False(t, HasMetadata(data))
+
+	png, _ := ioutil.ReadFile("_testdata/test.png")
+	assert.False(t, HasMetadata(png))
+	// The color space chunks are kept on encode
+	gama, text := &bytes.Buffer{}, &bytes.Buffer{}
+	writePNGChunk(gama, "gAMA", []byte{0, 0, 0xb1, 0x8f})
+	writePNGChunk(text, "tEXt", []byte("Author\x00darkroom"))
+	out, _ := SetPNGColorChunks(png, [][]byte{gama.Bytes()})
+	assert.False(t, HasMetadata(out))
+	out, _ = SetPNGColorChunks(png, [][]byte{text.Bytes()})
+	assert.True(t, HasMetadata(out))
+	assert.True(t, HasMetadata(png[:len(png)/2]))
+
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBPVP8X"), 10, 0, 0, 0, 0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	assert.True(t, HasMetadata(webp))
+}
@@ -0,0 +1,80 @@
+package native
+
+import (
+	"image"
+	"math"
+)
+
+// MaxPerspectivePixels is the largest number of pixels of the output of Perspective, e.g. 5000x5000, corners
+// spanning a larger area leave the image as is
+const MaxPerspectivePixels = 5000 * 5000
+
+// homography is a 3x3 projective transformation matrix in row-major order
+type homography [9]float64
+
+// getSquareToQuad returns the homography mapping the unit square (0,0), (1,0), (1,1), (0,1) to the
+// quadrilateral q, the bool is false if q is degenerate (e.g. three of its corners are collinear)
+func getSquareToQuad(q [4]image.Point) (homography, bool) {
+	x0, y0 := float64(q[0].X), float64(q[0].Y)
+	x1, y1 := float64(q[1].X), float64(q[1].Y)
+	x2, y2 := float64(q[2].X), float64(q[2].Y)
+	x3, y3 := float64(q[3].X), float64(q[3].Y)
+
+	dx1, dx2, dx3 := x1-x2, x3-x2, x0-x1+x2-x3
+	dy1, dy2, dy3 := y1-y2, y3-y2, y0-y1+y2-y3
+	det := dx1*dy2 - dx2*dy1
+	if det == 0 {
+		return homography{}, false
+	}
+	g := (dx3*dy2 - dx2*dy3) / det
+	h := (dx1*dy3 - dx3*dy1) / det
+
+	m := homography{
+		x1 - x0 + g*x1, x3 - x0 + h*x3, x0,
+		y1 - y0 + g*y1, y3 - y0 + h*y3, y0,
+		g, h, 1,
+	}
+	return m, m.det() != 0
+}
+
+func (m homography) det() float64 {
+	return m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+}
+
+// inverse returns the inverse of m, m must not be singular
+func (m homography) inverse() homography {
+	d := m.det()
+	return homography{
+		(m[4]*m[8] - m[5]*m[7]) / d, (m[2]*m[7] - m[1]*m[8]) / d, (m[1]*m[5] - m[2]*m[4]) / d,
+		(m[5]*m[6] - m[3]*m[8]) / d, (m[0]*m[8] - m[2]*m[6]) / d, (m[2]*m[3] - m[0]*m[5]) / d,
+		(m[3]*m[7] - m[4]*m[6]) / d, (m[1]*m[6] - m[0]*m[7]) / d, (m[0]*m[4] - m[1]*m[3]) / d,
+	}
+}
+
+// apply maps the point (x, y) with m
+func (m homography) apply(x, y float64) (float64, float64) {
+	w := m[6]*x + m[7]*y + m[8]
+	return (m[0]*x + m[1]*y + m[2]) / w, (m[3]*x + m[4]*y + m[5]) / w
+}
+
+// sampleBilinear returns the bilinear interpolation of the premultiplied pixels of img around (x, y),
+// coordinates outside of the image are clamped to its edges
+func sampleBilinear(img *image.RGBA, x, y float64) [4]uint8 {
+	b := img.Bounds()
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix0 := clamp(int(x0), b.Min.X, b.Max.X-1)
+	iy0 := clamp(int(y0), b.Min.Y, b.Max.Y-1)
+	ix1 := clamp(int(x0)+1, b.Min.X, b.Max.X-1)
+	iy1 := clamp(int(y0)+1, b.Min.Y, b.Max.Y-1)
+
+	p00, p10 := img.PixOffset(ix0, iy0), img.PixOffset(ix1, iy0)
+	p01, p11 := img.PixOffset(ix0, iy1), img.PixOffset(ix1, iy1)
+	var c [4]uint8
+	for i := 0; i < 4; i++ {
+		top := float64(img.Pix[p00+i])*(1-fx) + float64(img.Pix[p10+i])*fx
+		bottom := float64(img.Pix[p01+i])*(1-fx) + float64(img.Pix[p11+i])*fx
+		c[i] = uint8(top*(1-fy) + bottom*fy + 0.5)
+	}
+	return c
+}
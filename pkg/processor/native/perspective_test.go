@@ -0,0 +1,45 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSquareToQuad(t *testing.T) {
+	quad := [4]image.Point{{X: 10, Y: 20}, {X: 90, Y: 0}, {X: 100, Y: 100}, {X: 0, Y: 80}}
+	m, ok := getSquareToQuad(quad)
+	assert.True(t, ok)
+	for i, p := range [][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}} {
+		x, y := m.apply(p[0], p[1])
+		assert.InDelta(t, float64(quad[i].X), x, 1e-9)
+		assert.InDelta(t, float64(quad[i].Y), y, 1e-9)
+	}
+
+	u, v := m.inverse().apply(m.apply(0.25, 0.75))
+	assert.InDelta(t, 0.25, u, 1e-9)
+	assert.InDelta(t, 0.75, v, 1e-9)
+
+	// Parallelograms are affine
+	m, ok = getSquareToQuad([4]image.Point{{X: 0, Y: 0}, {X: 100, Y: 0}, {X: 100, Y: 50}, {X: 0, Y: 50}})
+	assert.True(t, ok)
+	assert.Equal(t, homography{100, 0, 0, 0, 50, 0, 0, 0, 1}, m)
+
+	_, ok = getSquareToQuad([4]image.Point{{X: 0, Y: 0}, {X: 50, Y: 50}, {X: 100, Y: 100}, {X: 0, Y: 100}})
+	assert.False(t, ok)
+	_, ok = getSquareToQuad([4]image.Point{})
+	assert.False(t, ok)
+}
+
+func TestSampleBilinear(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{A: 255})
+	img.Set(1, 0, color.RGBA{R: 200, A: 255})
+
+	assert.Equal(t, [4]uint8{0, 0, 0, 255}, sampleBilinear(img, 0, 0))
+	assert.Equal(t, [4]uint8{100, 0, 0, 255}, sampleBilinear(img, 0.5, 0))
+	// Out of bounds coordinates are clamped to the edges
+	assert.Equal(t, [4]uint8{200, 0, 0, 255}, sampleBilinear(img, 5, -3))
+}
@@ -0,0 +1,75 @@
+package native
+
+import (
+	"image"
+	"math/bits"
+	"sync"
+)
+
+// maxPoolBucket is the largest bucket of the rgbaPool, buffers above 1 << maxPoolBucket bytes (256 MiB) are
+// allocated and released as usual
+const maxPoolBucket = 28
+
+// rgbaPool reuses the pixel buffers of RGBA images, the buffers are bucketed by their capacity rounded up to a
+// power of two so that images of similar sizes can share them. A pooled buffer is always larger than the pixels
+// it holds, which is how put tells the images of the pool apart without keeping a reference to them: the buffers
+// the image decoders and image.NewRGBA allocate are exactly as large as their pixels. A nil *rgbaPool allocates
+// every buffer.
+type rgbaPool struct {
+	buckets [maxPoolBucket + 1]sync.Pool
+}
+
+func newRGBAPool() *rgbaPool {
+	return &rgbaPool{}
+}
+
+// get returns a transparent RGBA image with bounds r, backed by a pooled buffer if one of its bucket is free
+func (p *rgbaPool) get(r image.Rectangle) *image.RGBA {
+	n := 4 * r.Dx() * r.Dy()
+	b := getPoolBucket(n + 1)
+	if p == nil || n == 0 || b > maxPoolBucket {
+		return image.NewRGBA(r)
+	}
+	var pix []uint8
+	if buf, ok := p.buckets[b].Get().(*[]uint8); ok {
+		pix = (*buf)[:n]
+		for i := range pix {
+			pix[i] = 0
+		}
+	} else {
+		pix = make([]uint8, n, 1<<b)
+	}
+	return &image.RGBA{Pix: pix, Stride: 4 * r.Dx(), Rect: r}
+}
+
+// put hands the pixel buffer of img back to the pool, img must not be used afterwards. Only the images returned
+// by get are taken, any other image is left as it is, and the Pix of a taken image is cleared so that a stale
+// reference fails instead of reading the pixels of another image.
+func (p *rgbaPool) put(img image.Image) {
+	rgba, ok := img.(*image.RGBA)
+	if p == nil || !ok || !isPooledRGBA(rgba) {
+		return
+	}
+	c := cap(rgba.Pix)
+	b := getPoolBucket(c)
+	pix := rgba.Pix[:c]
+	rgba.Pix = nil
+	p.buckets[b].Put(&pix)
+}
+
+// isPooledRGBA returns true if img was returned by get, i.e. its pixels fill the rows of its bounds and sit in a
+// buffer of a power of two capacity above their length. Sub images, whose pixels don't start at the buffer, and
+// the buffers of the other images, which are as large as their pixels, don't match.
+func isPooledRGBA(img *image.RGBA) bool {
+	n, c := len(img.Pix), cap(img.Pix)
+	return n > 0 && n < c && c&(c-1) == 0 && getPoolBucket(c) <= maxPoolBucket &&
+		img.Stride == 4*img.Rect.Dx() && n == img.Stride*img.Rect.Dy()
+}
+
+// getPoolBucket returns the exponent of the smallest power of two holding n bytes
+func getPoolBucket(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return bits.Len(uint(n - 1))
+}
@@ -0,0 +1,112 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRGBAPool(t *testing.T) {
+	p := newRGBAPool()
+	r := image.Rect(2, 3, 12, 8)
+	img := p.get(r)
+	assert.Equal(t, r, img.Bounds())
+	assert.Equal(t, 4*10, img.Stride)
+	assert.Len(t, img.Pix, 4*10*5)
+	assert.Equal(t, 256, cap(img.Pix))
+
+	// A released buffer is cleared before it is handed out again
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	p.put(img)
+	assert.Nil(t, img.Pix)
+	img = p.get(image.Rect(0, 0, 8, 8))
+	assert.Equal(t, make([]uint8, 4*8*8), img.Pix)
+	// A buffer is always larger than its pixels, even if they are a power of two
+	assert.Equal(t, 512, cap(img.Pix))
+
+	// Sub images and buffers that aren't a power of two are not taken
+	sub := img.SubImage(image.Rect(0, 0, 4, 4)).(*image.RGBA)
+	p.put(sub)
+	assert.NotNil(t, sub.Pix)
+	odd := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	p.put(odd)
+	assert.NotNil(t, odd.Pix)
+	p.put(image.NewGray(r))
+
+	// Images the pool didn't hand out are never taken, even with a buffer of a power of two
+	foreign := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	p.put(foreign)
+	assert.NotNil(t, foreign.Pix)
+	// An image is only taken once
+	pooled := p.get(image.Rect(0, 0, 8, 8))
+	p.put(pooled)
+	pooled.Pix = make([]uint8, 4*8*8)
+	p.put(pooled)
+	assert.NotNil(t, pooled.Pix)
+
+	var nilPool *rgbaPool
+	assert.Equal(t, image.NewRGBA(r), nilPool.get(r))
+	nilPool.put(img)
+	assert.NotNil(t, img.Pix)
+}
+
+func Test_getPoolBucket(t *testing.T) {
+	assert.Equal(t, 0, getPoolBucket(1))
+	assert.Equal(t, 2, getPoolBucket(4))
+	assert.Equal(t, 3, getPoolBucket(5))
+	assert.Equal(t, 20, getPoolBucket(1<<20))
+}
+
+func TestBildProcessor_WithBufferPool(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 31, 17))
+	for x := 0; x < 31; x++ {
+		for y := 0; y < 17; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 8), G: uint8(y * 15), B: uint8(x * y), A: uint8(255 - x)})
+		}
+	}
+	bp := NewBildProcessor(WithBufferPool(true))
+	assert.Equal(t, NewBildProcessor().GrayScale(img), bp.GrayScale(img))
+	assert.Nil(t, NewBildProcessor(WithBufferPool(true), WithBufferPool(false)).pool)
+
+	// Encoding leaves the image as it is, so it can be encoded again, only Release hands its buffer back
+	out := bp.SwapChannels(bp.GrayScale(img), "bgr")
+	data, err := bp.Encode(out, processor.ExtensionPNG)
+	assert.NoError(t, err)
+	assert.NotNil(t, out.(*image.RGBA).Pix)
+	_, err = bp.EncodeWithOptions(out, processor.ExtensionJPEG, processor.EncodeOptions{Quality: 50})
+	assert.NoError(t, err)
+	bp.Release(out)
+	assert.Nil(t, out.(*image.RGBA).Pix)
+	assert.Equal(t, image.Rect(0, 0, 31, 17), out.Bounds())
+	decoded, _, err := bp.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Bounds(), decoded.Bounds())
+
+	// Decoded images are never taken
+	bp.Release(decoded)
+	assert.NotNil(t, decoded.(*image.NRGBA).Pix)
+}
+
+func BenchmarkBildProcessor_WithBufferPool(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 1024, 1024))
+	for _, enabled := range []bool{false, true} {
+		bp := NewBildProcessor(WithBufferPool(enabled))
+		name := "Disabled"
+		if enabled {
+			name = "Enabled"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				out := bp.SwapChannels(img, "bgr")
+				bp.pool.put(bp.Pad(out, 1100, 1100, processor.PointCenter, color.White))
+				bp.pool.put(out)
+			}
+		})
+	}
+}
@@ -2,12 +2,16 @@ package native
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"math"
 	"strings"
+	"time"
 
+	"github.com/anthonynsimon/bild/adjust"
 	"github.com/anthonynsimon/bild/blur"
 	"github.com/anthonynsimon/bild/clone"
 	"github.com/anthonynsimon/bild/effect"
@@ -15,6 +19,36 @@ import (
 	"github.com/gojek/darkroom/pkg/processor"
 )
 
+const (
+	// defaultMaxOverlayPixels is the largest area of an overlay that is decoded, e.g. 4096x4096
+	defaultMaxOverlayPixels = 4096 * 4096
+	// defaultMaxDecodePixels is the largest area of an image that is decoded, a gigapixel map of 32768x32768
+	defaultMaxDecodePixels = 32768 * 32768
+	// padBlurRadiusPerStep is the blur radius kept after downscaling the backdrop of PadWithOptions
+	padBlurRadiusPerStep = 4
+	// autoContrastDark and autoContrastLight bound the mean luma of the area below a watermark considered
+	// dark or light by WatermarkOptions.AutoContrast, an area in between keeps the color of the watermark
+	autoContrastDark  = 96
+	autoContrastLight = 160
+	// splashMinChroma is the smallest chroma of a color whose hue is considered by Splash, grayer colors are
+	// grayscaled as their hue is mostly noise
+	splashMinChroma = 24
+)
+
+var (
+	errOverlayTooLarge = errors.New("overlay exceeds the maximum number of pixels")
+	errOverlayTimeout  = errors.New("overlay decode timed out")
+	errOverlayOversize = errors.New("overlay is larger than the base")
+)
+
+// ErrDecodeTimeout is returned by Decode and DecodeAnimation when decoding takes longer than the timeout set
+// WithDecodeTimeout
+var ErrDecodeTimeout = errors.New("image decode timed out")
+
+// ErrImageTooLarge is returned by Decode when the header of the image declares more pixels than set
+// WithMaxDecodePixels
+var ErrImageTooLarge = errors.New("image exceeds the maximum number of pixels")
+
 var resizeBoundOption = &transform.RotationOptions{
 	ResizeBounds: true,
 }
@@ -22,6 +56,24 @@ var resizeBoundOption = &transform.RotationOptions{
 // BildProcessor uses bild library to process images using native Golang image.Image interface
 type BildProcessor struct {
 	encoders *Encoders
+	// maxOverlayPixels is the largest area of an overlay that is decoded, 0 disables the check
+	maxOverlayPixels int
+	// maxDecodePixels is the largest area of an image that is decoded, 0 disables the check
+	maxDecodePixels int
+	// overlayTimeout is how long decoding and resizing the overlays may take, 0 waits indefinitely
+	overlayTimeout time.Duration
+	// decodeTimeout is how long Decode and DecodeAnimation may take, 0 waits indefinitely
+	decodeTimeout time.Duration
+	// pool holds the reusable pixel buffers, nil allocates every buffer
+	pool *rgbaPool
+	// qualities holds the default encode quality by extension, jpg is stored as jpeg
+	qualities map[string]int
+	// tiledResizePixels is the area from which images are downscaled in strips, 0 disables it
+	tiledResizePixels int
+	// ycbcrResize resizes YCbCr images without converting them to RGBA
+	ycbcrResize bool
+	// maxParallelism is the largest number of goroutines of a parallel loop, 0 uses GOMAXPROCS
+	maxParallelism int
 }
 
 // ProcessorOption represents builder function for BildProcessor
@@ -29,6 +81,40 @@ type ProcessorOption func(*BildProcessor)
 
 // Crop takes an input image, width, height and a Point and returns the cropped image
 func (bp *BildProcessor) Crop(img image.Image, width, height int, point processor.Point) image.Image {
+	return bp.CropWithOptions(img, width, height, point, processor.CropOptions{})
+}
+
+// CropWithOptions takes an input image, width, height, a Point and CropOptions and returns the cropped image, the
+// crop window is anchored at the Point, moved by opts.Offset and clamped to stay inside the resized image
+func (bp *BildProcessor) CropWithOptions(img image.Image, width, height int, point processor.Point,
+	opts processor.CropOptions) image.Image {
+	return bp.crop(img, width, height, getResizeWidthAndHeightForCrop, func(w, h int) (int, int) {
+		x, y := getStartingPointForCrop(w, h, width, height, point)
+		return clamp(x+opts.Offset.X, 0, w-width), clamp(y+opts.Offset.Y, 0, h-height)
+	})
+}
+
+// Cover takes an input image, width, height and a Point and returns the image scaled by the minimal factor
+// covering width and height, with the overflow cropped from the Point. Crop uses the same scale but truncates
+// the overflowing dimension, Cover rounds it instead which keeps the aspect ratio distortion within half a pixel
+func (bp *BildProcessor) Cover(img image.Image, width, height int, point processor.Point) image.Image {
+	return bp.crop(img, width, height, getResizeWidthAndHeightForCover, func(w, h int) (int, int) {
+		return getStartingPointForCrop(w, h, width, height, point)
+	})
+}
+
+// FocalCrop takes an input image, width, height and a FocalPoint and returns the cropped image
+// with the crop window centered on the focal point, clamped to stay inside the image
+func (bp *BildProcessor) FocalCrop(img image.Image, width, height int, point processor.FocalPoint) image.Image {
+	return bp.crop(img, width, height, getResizeWidthAndHeightForCrop, func(w, h int) (int, int) {
+		return getStartingPointForFocalCrop(w, h, width, height, point)
+	})
+}
+
+// crop resizes the image to the dimensions returned by resizeDimensions and crops it from the starting point
+// returned by startingPoint for the resized width and height
+func (bp *BildProcessor) crop(img image.Image, width, height int, resizeDimensions func(rw, rh, aw, ah int) (int, int),
+	startingPoint func(w, h int) (int, int)) image.Image {
 	if width == 0 || height == 0 {
 		if width == 0 && height == 0 {
 			return img
@@ -36,15 +122,92 @@ func (bp *BildProcessor) Crop(img image.Image, width, height int, point processo
 		return bp.Resize(img, width, height)
 	}
 
-	w, h := getResizeWidthAndHeightForCrop(width, height, img.Bounds().Dx(), img.Bounds().Dy())
-	img = transform.Resize(img, w, h, transform.Linear)
-	x0, y0 := getStartingPointForCrop(w, h, width, height, point)
+	w, h := resizeDimensions(width, height, img.Bounds().Dx(), img.Bounds().Dy())
+	img = bp.resize(img, w, h)
+	x0, y0 := startingPoint(w, h)
 	rect := image.Rect(x0, y0, width+x0, height+y0)
 	img = (clone.AsRGBA(img)).SubImage(rect)
 
 	return img
 }
 
+// ComputeCropRect takes the width, height and Point of a Crop and the dimensions of the source image and returns
+// the area of the source that Crop keeps, e.g. for a client to draw the crop box on a preview before the image is
+// processed. The rectangle is in the pixels of the source, Crop resizes it to width x height. With a width or height
+// of 0 Crop only resizes, so the whole source is returned.
+func ComputeCropRect(width, height int, point processor.Point, srcW, srcH int) image.Rectangle {
+	if srcW <= 0 || srcH <= 0 {
+		return image.Rectangle{}
+	}
+	if width <= 0 || height <= 0 {
+		return image.Rect(0, 0, srcW, srcH)
+	}
+	w, h := getResizeWidthAndHeightForCrop(width, height, srcW, srcH)
+	x0, y0 := getStartingPointForCrop(w, h, width, height, point)
+	// The crop window is in the pixels of the resized image, scaling it back by the resize factors maps it onto the
+	// source
+	toSrc := func(v, scaled, src int) int {
+		return clamp(int(math.Round(float64(v)*float64(src)/float64(scaled))), 0, src)
+	}
+	return image.Rect(toSrc(x0, w, srcW), toSrc(y0, h, srcH), toSrc(x0+width, w, srcW), toSrc(y0+height, h, srcH))
+}
+
+// Pad takes an input image, width, height, a Point and a background color and returns the image placed
+// on a width x height canvas filled with the background color, the Point is the anchor of the input image
+// on the canvas in the same way it is the anchor of the crop window in Crop
+func (bp *BildProcessor) Pad(img image.Image, width, height int, point processor.Point, background color.Color) image.Image {
+	return bp.PadWithOptions(img, width, height, point, background, processor.PadOptions{})
+}
+
+// PadWithOptions takes an input image, width, height, a Point, a background color and PadOptions and returns
+// the padded image. With opts.Blur the padding shows a blurred copy of the image scaled to cover the canvas,
+// drawn over the background so that it only shows through transparent pixels.
+func (bp *BildProcessor) PadWithOptions(img image.Image, width, height int, point processor.Point, background color.Color,
+	opts processor.PadOptions) image.Image {
+	if width == 0 || height == 0 {
+		return img
+	}
+
+	canvas := bp.pool.get(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.ZP, draw.Src)
+	if opts.Blur > 0 {
+		draw.Draw(canvas, canvas.Bounds(), bp.blurredCover(img, width, height, opts.Blur), image.ZP, draw.Over)
+	}
+	x, y := getStartingPointForCrop(width, height, img.Bounds().Dx(), img.Bounds().Dy(), point)
+	r := image.Rect(x, y, x+img.Bounds().Dx(), y+img.Bounds().Dy())
+	draw.Draw(canvas, r, img, img.Bounds().Min, draw.Over)
+
+	return canvas
+}
+
+// blurredCover returns img scaled to cover width x height and blurred by radius. The copy is blurred at a
+// fraction of the size and scaled back up, for large radii that looks the same as blurring it at full size
+// while the cost of the blur no longer grows with the radius.
+func (bp *BildProcessor) blurredCover(img image.Image, width, height int, radius float64) image.Image {
+	f := math.Max(1, radius/padBlurRadiusPerStep)
+	sw, sh := int(math.Max(1, math.Round(float64(width)/f))), int(math.Max(1, math.Round(float64(height)/f)))
+	small := bp.Cover(img, sw, sh, processor.PointCenter)
+	opaque := isOpaque(small)
+	blurred := blur.Gaussian(small, radius/f)
+	if opaque {
+		// The rounding of the blur kernel leaves an alpha of 254, which would let the background show through
+		setOpaque(blurred)
+	}
+	return transform.Resize(blurred, width, height, transform.Linear)
+}
+
+// setOpaque sets the alpha of every pixel of img to 255, un-premultiplying its color
+func setOpaque(img *image.RGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		if a := uint32(img.Pix[i+3]); a > 0 && a < 0xff {
+			img.Pix[i] = uint8(math.Min(0xff, float64(uint32(img.Pix[i])*0xff/a)))
+			img.Pix[i+1] = uint8(math.Min(0xff, float64(uint32(img.Pix[i+1])*0xff/a)))
+			img.Pix[i+2] = uint8(math.Min(0xff, float64(uint32(img.Pix[i+2])*0xff/a)))
+		}
+		img.Pix[i+3] = 0xff
+	}
+}
+
 // Resize takes an input image, width and height and returns the re-sized image
 func (bp *BildProcessor) Resize(img image.Image, width, height int) image.Image {
 
@@ -53,7 +216,7 @@ func (bp *BildProcessor) Resize(img image.Image, width, height int) image.Image
 
 	w, h := getResizeWidthAndHeight(width, height, initW, initH)
 	if w != initW || h != initH {
-		img = transform.Resize(img, w, h, transform.Linear)
+		img = bp.resize(img, w, h)
 	}
 
 	return img
@@ -62,20 +225,342 @@ func (bp *BildProcessor) Resize(img image.Image, width, height int) image.Image
 // Scale takes an input image, width and height and returns the re-sized
 // image without maintaining the original aspect ratio
 func (bp *BildProcessor) Scale(img image.Image, width, height int) image.Image {
-	return transform.Resize(img, width, height, transform.Linear)
+	return bp.resize(img, width, height)
 }
 
 // GrayScale takes an input image and returns the grayscaled image
 func (bp *BildProcessor) GrayScale(img image.Image) image.Image {
+	if bp.pool != nil || bp.maxParallelism > 0 {
+		return bp.pooledGrayScale(img)
+	}
 	// Rec. 601 Luma formula (https://en.wikipedia.org/wiki/Luma_%28video%29#Rec._601_luma_versus_Rec._709_luma_coefficients)
 	return effect.GrayscaleWithWeights(img, 0.299, 0.587, 0.114)
 }
 
+// pooledGrayScale computes the same Rec. 601 luma as effect.GrayscaleWithWeights into a pooled buffer,
+// without the copy of the input bild makes and on at most the goroutines set WithMaxParallelism
+func (bp *BildProcessor) pooledGrayScale(img image.Image) image.Image {
+	src := clone.AsShallowRGBA(img)
+	rect := src.Bounds()
+	if rect.Empty() {
+		return &image.RGBA{}
+	}
+	dst := bp.pool.get(rect)
+	bp.parallelLine(rect.Dy(), func(start, end int) {
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				i, j := src.PixOffset(x, y), dst.PixOffset(x, y)
+				k := uint8(0.299*float64(src.Pix[i]) + 0.587*float64(src.Pix[i+1]) + 0.114*float64(src.Pix[i+2]) + 0.5)
+				dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] = k, k, k, src.Pix[i+3]
+			}
+		}
+	})
+	return dst
+}
+
+// GrayScaleWithOptions takes an input image and returns the grayscaled image, with opts.SingleChannel
+// it is an *image.Gray holding the alpha-premultiplied luma, i.e. composited over black
+func (bp *BildProcessor) GrayScaleWithOptions(img image.Image, opts processor.GrayScaleOptions) image.Image {
+	rgba := bp.GrayScale(img).(*image.RGBA)
+	if !opts.SingleChannel {
+		return rgba
+	}
+	gray := image.NewGray(rgba.Bounds())
+	for y := rgba.Rect.Min.Y; y < rgba.Rect.Max.Y; y++ {
+		for x := rgba.Rect.Min.X; x < rgba.Rect.Max.X; x++ {
+			gray.Pix[gray.PixOffset(x, y)] = rgba.Pix[rgba.PixOffset(x, y)]
+		}
+	}
+	bp.pool.put(rgba)
+	return gray
+}
+
+// Desaturate takes an input image and an amount and returns the image blended with its GrayScale result, each
+// channel moves amount of the way from the original to the luma, e.g. 0.5 for a half desaturated image. An
+// amount of 0 or less returns the input image, 1 or more the grayscaled image.
+func (bp *BildProcessor) Desaturate(img image.Image, amount float64) image.Image {
+	if amount <= 0 {
+		return img
+	}
+	gray := bp.GrayScale(img)
+	if amount >= 1 {
+		return gray
+	}
+	src, dst := clone.AsShallowRGBA(img), gray.(*image.RGBA)
+	rect := src.Bounds()
+	offset := dst.Rect.Min.Sub(rect.Min)
+	bp.parallelLine(rect.Dy(), func(start, end int) {
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				i, j := src.PixOffset(x, y), dst.PixOffset(x+offset.X, y+offset.Y)
+				// Both colors are premultiplied by the same alpha, so their blend is too
+				for c := 0; c < 3; c++ {
+					v := float64(src.Pix[i+c])
+					dst.Pix[j+c] = uint8(v + (float64(dst.Pix[j+c])-v)*amount + 0.5)
+				}
+			}
+		}
+	})
+	return dst
+}
+
+// ExtractChannel takes an input image and a channel ("r", "g", "b" or "a") and returns an *image.Gray holding
+// the values of that channel, the color channels are alpha-premultiplied, i.e. composited over black.
+// An unknown channel returns the input image.
+func (bp *BildProcessor) ExtractChannel(img image.Image, channel string) image.Image {
+	offset := strings.Index("rgba", strings.ToLower(channel))
+	if len(channel) != 1 || offset < 0 {
+		return img
+	}
+	src := clone.AsShallowRGBA(img)
+	rect := src.Bounds()
+	gray := image.NewGray(rect)
+	bp.parallelLine(rect.Dy(), func(start, end int) {
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				gray.Pix[gray.PixOffset(x, y)] = src.Pix[src.PixOffset(x, y)+offset]
+			}
+		}
+	})
+	return gray
+}
+
+// SwapChannels takes an input image and an order of the "r", "g" and "b" channels like "bgr" and returns the
+// image with its color channels rearranged in that order, e.g. "bgr" swaps the red and blue channels.
+// The alpha channel is kept, an order not holding each of the color channels exactly once returns the input image.
+func (bp *BildProcessor) SwapChannels(img image.Image, order string) image.Image {
+	var offsets [3]int
+	seen := make(map[int]bool)
+	for i, c := range strings.ToLower(order) {
+		offset := strings.IndexRune("rgb", c)
+		if i >= len(offsets) || offset < 0 || seen[offset] {
+			return img
+		}
+		offsets[i] = offset
+		seen[offset] = true
+	}
+	if len(seen) != len(offsets) {
+		return img
+	}
+	src := clone.AsShallowRGBA(img)
+	rect := src.Bounds()
+	dst := bp.pool.get(rect)
+	bp.parallelLine(rect.Dy(), func(start, end int) {
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				i, j := src.PixOffset(x, y), dst.PixOffset(x, y)
+				// Colors are alpha-premultiplied by the same alpha, so they can be moved between channels as is
+				dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2] = src.Pix[i+offsets[0]], src.Pix[i+offsets[1]], src.Pix[i+offsets[2]]
+				dst.Pix[j+3] = src.Pix[i+3]
+			}
+		}
+	})
+	return dst
+}
+
 // Blur takes an input image and blur radius and returns the Gausian blurred image
 func (bp *BildProcessor) Blur(img image.Image, radius float64) image.Image {
 	return blur.Gaussian(img, radius)
 }
 
+// Denoise takes an input image and radius and returns the median filtered image.
+// Every pixel is replaced by the median of its neighbourhood, so the processing time grows with
+// the square of the radius, small values (1-3) are usually enough to remove sensor noise.
+func (bp *BildProcessor) Denoise(img image.Image, radius int) image.Image {
+	if radius <= 0 {
+		return img
+	}
+	return effect.Median(img, float64(radius))
+}
+
+// Sharpen takes an input image and an amount and returns the image with an unsharp mask applied, each color
+// channel is pushed away from a blurred copy of the image by amount times their difference. The copy is blurred
+// with a 3x3 binomial kernel, so only the finest details softened by downscaling are amplified. The alpha
+// channel is kept, so the edges of transparent areas don't get halos.
+func (bp *BildProcessor) Sharpen(img image.Image, amount float64) image.Image {
+	if amount <= 0 {
+		return img
+	}
+	src := clone.AsShallowRGBA(img)
+	rect := src.Bounds()
+	if rect.Empty() {
+		return img
+	}
+	weights := [3]float64{1, 2, 1}
+	dst := bp.pool.get(rect)
+	bp.parallelLine(rect.Dy(), func(start, end int) {
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				// The blur is summed in floats, truncating it to 8 bits would shift flat areas too
+				var blurred [3]float64
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						// Pixels outside of the image repeat the edge
+						k := src.PixOffset(clamp(x+dx, rect.Min.X, rect.Max.X-1), clamp(y+dy, rect.Min.Y, rect.Max.Y-1))
+						w := weights[dx+1] * weights[dy+1] / 16
+						for c := range blurred {
+							blurred[c] += float64(src.Pix[k+c]) * w
+						}
+					}
+				}
+				i, j := src.PixOffset(x, y), dst.PixOffset(x, y)
+				a := float64(src.Pix[i+3])
+				for c := range blurred {
+					v := float64(src.Pix[i+c])
+					// The colors are alpha-premultiplied, so they can't exceed the alpha of the pixel
+					dst.Pix[j+c] = uint8(math.Max(0, math.Min(a, v+(v-blurred[c])*amount)) + 0.5)
+				}
+				dst.Pix[j+3] = src.Pix[i+3]
+			}
+		}
+	})
+	return dst
+}
+
+// Duotone takes an input image, a dark and a light color and returns the image with
+// its tonal range mapped from the dark color (shadows) to the light color (highlights)
+func (bp *BildProcessor) Duotone(img image.Image, dark, light color.Color) image.Image {
+	d := color.NRGBAModel.Convert(dark).(color.NRGBA)
+	l := color.NRGBAModel.Convert(light).(color.NRGBA)
+	return adjust.Apply(bp.GrayScale(img), func(c color.RGBA) color.RGBA {
+		if c.A == 0 {
+			return c
+		}
+		// Pixels are alpha-premultiplied, so the luminance is relative to the alpha
+		t := float64(c.R) / float64(c.A)
+		a := float64(c.A) / 255
+		return color.RGBA{
+			R: uint8((float64(d.R) + t*(float64(l.R)-float64(d.R))) * a),
+			G: uint8((float64(d.G) + t*(float64(l.G)-float64(d.G))) * a),
+			B: uint8((float64(d.B) + t*(float64(l.B)-float64(d.B))) * a),
+			A: c.A,
+		}
+	})
+}
+
+// Recolor takes an input image, the color to replace, the replacement color and a tolerance and returns
+// the image with the pixels within tolerance of from (on every channel) mapped to to, shifting them by
+// their difference in luminance to from so that shading and anti-aliasing are kept
+func (bp *BildProcessor) Recolor(img image.Image, from, to color.Color, tolerance uint8) image.Image {
+	f := color.NRGBAModel.Convert(from).(color.NRGBA)
+	t := color.NRGBAModel.Convert(to).(color.NRGBA)
+	fromLuma := getLuma(f.R, f.G, f.B)
+	return adjust.Apply(img, func(c color.RGBA) color.RGBA {
+		if c.A == 0 {
+			return c
+		}
+		// Pixels are alpha-premultiplied, the comparison is done on the straight color
+		p := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if absDiff(p.R, f.R) > tolerance || absDiff(p.G, f.G) > tolerance || absDiff(p.B, f.B) > tolerance {
+			return c
+		}
+		shift := getLuma(p.R, p.G, p.B) - fromLuma
+		a := float64(c.A) / 255
+		return color.RGBA{
+			R: uint8(math.Max(0, math.Min(255, float64(t.R)+shift))*a + 0.5),
+			G: uint8(math.Max(0, math.Min(255, float64(t.G)+shift))*a + 0.5),
+			B: uint8(math.Max(0, math.Min(255, float64(t.B)+shift))*a + 0.5),
+			A: c.A,
+		}
+	})
+}
+
+// Solarize takes an input image and a threshold and returns the image with the pixels whose Rec. 601 luma is
+// above the threshold inverted, the alpha channel is kept
+func (bp *BildProcessor) Solarize(img image.Image, threshold uint8) image.Image {
+	return adjust.Apply(img, func(c color.RGBA) color.RGBA {
+		if c.A == 0 {
+			return c
+		}
+		// Pixels are alpha-premultiplied, the luma and the inversion are computed on the straight color
+		p := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if getLuma(p.R, p.G, p.B) <= float64(threshold) {
+			return c
+		}
+		return color.RGBAModel.Convert(color.NRGBA{R: 255 - p.R, G: 255 - p.G, B: 255 - p.B, A: p.A}).(color.RGBA)
+	})
+}
+
+// ColorWash takes an input image, a color and an opacity value and returns the image with the color blended over
+// every pixel at that opacity. The color is weighted by the alpha of each pixel so that the alpha channel is kept
+// and transparent pixels stay transparent.
+func (bp *BildProcessor) ColorWash(img image.Image, c color.Color, opacity uint8) image.Image {
+	wash := color.NRGBAModel.Convert(c).(color.NRGBA)
+	o := uint32(opacity)
+	blend := func(v, w, a uint8) uint8 {
+		return uint8((uint32(v)*(255-o) + uint32(w)*uint32(a)*o/255 + 127) / 255)
+	}
+	return adjust.Apply(img, func(p color.RGBA) color.RGBA {
+		return color.RGBA{R: blend(p.R, wash.R, p.A), G: blend(p.G, wash.G, p.A), B: blend(p.B, wash.B, p.A), A: p.A}
+	})
+}
+
+// Splash takes an input image, the color to keep and a tolerance and returns the image grayscaled like GrayScale
+// except for the pixels whose hue is within tolerance degrees of the hue of keep, which keep their color. Pixels
+// within twice the tolerance are desaturated proportionally to soften the edges. Pixels too close to gray to have
+// a reliable hue are grayscaled, as is every pixel if keep is a gray itself.
+func (bp *BildProcessor) Splash(img image.Image, keep color.Color, tolerance uint8) image.Image {
+	k := color.NRGBAModel.Convert(keep).(color.NRGBA)
+	hue, chroma := getHue(k.R, k.G, k.B)
+	band := math.Min(float64(tolerance), 180)
+	return adjust.Apply(img, func(c color.RGBA) color.RGBA {
+		// Like GrayScale the luma is computed from the alpha-premultiplied channels
+		l := getLuma(c.R, c.G, c.B)
+		gray := uint8(l + 0.5)
+		if c.A == 0 || chroma < splashMinChroma {
+			return color.RGBA{R: gray, G: gray, B: gray, A: c.A}
+		}
+		p := color.NRGBAModel.Convert(c).(color.NRGBA)
+		h, pc := getHue(p.R, p.G, p.B)
+		d := math.Abs(h - hue)
+		if d > 180 {
+			d = 360 - d
+		}
+		if pc >= splashMinChroma && d <= band {
+			return c
+		}
+		if pc < splashMinChroma || d >= 2*band {
+			return color.RGBA{R: gray, G: gray, B: gray, A: c.A}
+		}
+		f := (d - band) / band
+		return color.RGBA{
+			R: uint8(float64(c.R)*(1-f) + l*f + 0.5),
+			G: uint8(float64(c.G)*(1-f) + l*f + 0.5),
+			B: uint8(float64(c.B)*(1-f) + l*f + 0.5),
+			A: c.A,
+		}
+	})
+}
+
+// ChromaKey takes an input image, a key color and a tolerance and returns the image with the pixels within
+// tolerance of the key color (on every channel) made transparent, pixels within twice the tolerance are faded
+// out proportionally to soften anti-aliased edges
+func (bp *BildProcessor) ChromaKey(img image.Image, key color.Color, tolerance uint8) image.Image {
+	k := color.NRGBAModel.Convert(key).(color.NRGBA)
+	band := float64(tolerance)
+	return adjust.Apply(img, func(c color.RGBA) color.RGBA {
+		if c.A == 0 {
+			return c
+		}
+		p := color.NRGBAModel.Convert(c).(color.NRGBA)
+		d := float64(maxUint8(absDiff(p.R, k.R), absDiff(p.G, k.G), absDiff(p.B, k.B)))
+		if d <= float64(tolerance) {
+			return color.RGBA{}
+		}
+		if d >= float64(tolerance)+band {
+			return c
+		}
+		// Colors are alpha-premultiplied, so fading out scales every channel
+		f := (d - float64(tolerance)) / band
+		return color.RGBA{
+			R: uint8(float64(c.R)*f + 0.5),
+			G: uint8(float64(c.G)*f + 0.5),
+			B: uint8(float64(c.B)*f + 0.5),
+			A: uint8(float64(c.A)*f + 0.5),
+		}
+	})
+}
+
 // Flip takes an input image and returns the image flipped. The direction of flip
 // is determined by the specified mode - 'v' for a vertical flip, 'h' for a
 // horizontal flip and 'vh'(or 'hv') for both.
@@ -98,20 +583,183 @@ func (bp *BildProcessor) Rotate(img image.Image, angle float64) image.Image {
 	return transform.Rotate(img, angle, nil)
 }
 
-// Decode takes a byte array and returns the decoded image, format, or the error
+// RotateWithOptions takes an input image and returns a image rotated by the specified degrees.
+// With opts.Expand the bounds grow to fit the rotated image, and the area it does not cover
+// is filled with opts.Background when set.
+func (bp *BildProcessor) RotateWithOptions(img image.Image, angle float64, opts processor.RotateOptions) image.Image {
+	img = transform.Rotate(img, angle, &transform.RotationOptions{ResizeBounds: opts.Expand})
+	if opts.Background == nil {
+		return img
+	}
+
+	canvas := bp.pool.get(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(opts.Background), image.ZP, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Over)
+	return canvas
+}
+
+// Perspective takes an input image and the corners of a quadrilateral in the order top-left, top-right,
+// bottom-right, bottom-left and returns the image with its corners mapped onto the quadrilateral.
+// The output spans from the origin to the furthest corner and the area outside of the quadrilateral is
+// transparent, a degenerate quadrilateral or an output above MaxPerspectivePixels returns the input image.
+func (bp *BildProcessor) Perspective(img image.Image, corners [4]image.Point) image.Image {
+	var maxX, maxY int
+	for _, c := range corners {
+		if c.X > maxX {
+			maxX = c.X
+		}
+		if c.Y > maxY {
+			maxY = c.Y
+		}
+	}
+	// Both sides are checked first so that the product can't overflow
+	if maxX > MaxPerspectivePixels || maxY > MaxPerspectivePixels || maxX*maxY > MaxPerspectivePixels {
+		return img
+	}
+	m, ok := getSquareToQuad(corners)
+	if !ok {
+		return img
+	}
+	inv := m.inverse()
+
+	src := clone.AsShallowRGBA(img)
+	sw, sh := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	dst := bp.pool.get(image.Rect(0, 0, maxX, maxY))
+
+	bp.parallelLine(maxY, func(start, end int) {
+		for y := start; y < end; y++ {
+			for x := 0; x < maxX; x++ {
+				u, v := inv.apply(float64(x)+0.5, float64(y)+0.5)
+				if u < 0 || u >= 1 || v < 0 || v >= 1 {
+					continue
+				}
+				sx := float64(src.Bounds().Min.X) + u*sw - 0.5
+				sy := float64(src.Bounds().Min.Y) + v*sh - 0.5
+				c := sampleBilinear(src, sx, sy)
+				copy(dst.Pix[dst.PixOffset(x, y):], c[:])
+			}
+		}
+	})
+
+	return dst
+}
+
+// Decode takes a byte array and returns the decoded image, format, or the error.
+// SVG documents are rasterized at the size of their viewBox and reported as "png". The dimensions are read from
+// the header first, so that an image larger than set WithMaxDecodePixels returns ErrImageTooLarge before its pixels
+// are allocated.
 func (bp *BildProcessor) Decode(data []byte) (image.Image, string, error) {
-	img, f, err := image.Decode(bytes.NewReader(data))
+	if bp.maxDecodePixels > 0 && processor.DetectContentType(data) != processor.ContentTypeSVG {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		if int64(cfg.Width)*int64(cfg.Height) > int64(bp.maxDecodePixels) {
+			return nil, "", ErrImageTooLarge
+		}
+	}
+	var img image.Image
+	var f string
+	var err error
+	if timeoutErr := bp.awaitDecode(func() {
+		if processor.DetectContentType(data) == processor.ContentTypeSVG {
+			img, err = rasterizeSVG(data, 0, 0)
+			f = processor.ExtensionPNG
+			return
+		}
+		img, f, err = image.Decode(bytes.NewReader(data))
+	}); timeoutErr != nil {
+		return nil, "", timeoutErr
+	}
 	return img, f, err
 }
 
+// awaitDecode runs decode and waits for it to return, or returns ErrDecodeTimeout once the timeout set
+// WithDecodeTimeout has passed. A decode that timed out can't be stopped, it keeps running in the background
+// until it returns and its results are discarded.
+func (bp *BildProcessor) awaitDecode(decode func()) error {
+	if bp.decodeTimeout <= 0 {
+		decode()
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		decode()
+	}()
+	timer := time.NewTimer(bp.decodeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrDecodeTimeout
+	}
+}
+
+// Rasterize takes a byte array of an SVG document and returns it rendered at the smallest size
+// covering width and height while preserving its aspect ratio, or the error. A dimension of 0 is
+// derived from the other one, so the following resize or crop operations only have to downscale.
+func (bp *BildProcessor) Rasterize(data []byte, width, height int) (image.Image, error) {
+	return rasterizeSVG(data, width, height)
+}
+
 // Encode takes an image and the preferred format (extension) of the output
 // Current supported format are "png", "jpg" and "jpeg"
 func (bp *BildProcessor) Encode(img image.Image, fmt string) ([]byte, error) {
-	enc := bp.encoders.GetEncoder(img, fmt)
-	data, err := enc.Encode(img)
+	opts := bp.withDefaultQuality(fmt, processor.EncodeOptions{})
+	return bp.encode(img, bp.encoders.GetEncoderWithOptions(img, fmt, opts), opts)
+}
+
+// EncodeWithOptions takes an image, the preferred format (extension) of the output and EncodeOptions
+// which override the options of the configured encoders for this call only
+func (bp *BildProcessor) EncodeWithOptions(img image.Image, fmt string, opts processor.EncodeOptions) ([]byte, error) {
+	opts = bp.withDefaultQuality(fmt, opts)
+	return bp.encode(img, bp.encoders.GetEncoderWithOptions(img, fmt, opts), opts)
+}
+
+// encode encodes img with enc and writes the DPI of opts, img is left as it is so that the caller can encode it
+// again, e.g. at another quality
+func (bp *BildProcessor) encode(img image.Image, enc Encoder, opts processor.EncodeOptions) ([]byte, error) {
+	data, err := bp.encoders.encodeWithOptions(img, enc, opts)
+	if err == nil && opts.DPI > 0 {
+		return setDensity(data, opts.DPI)
+	}
 	return data, err
 }
 
+// Convert takes an input byte array of any supported format, the target format (extension) and EncodeOptions
+// and returns the image re-encoded to exactly the target format, or the error. Only the pixels are carried
+// over, the EXIF orientation is applied to them as all metadata is dropped.
+func (bp *BildProcessor) Convert(input []byte, format string, opts processor.EncodeOptions) ([]byte, error) {
+	img, _, err := bp.Decode(input)
+	if err != nil {
+		return nil, err
+	}
+	orientation, _ := GetOrientation(bytes.NewReader(input))
+	img = bp.FixOrientation(img, orientation)
+	opts = bp.withDefaultQuality(format, opts)
+	return bp.encode(img, bp.encoders.getEncoderForFormat(format, opts), opts)
+}
+
+// withDefaultQuality returns opts with the quality set WithDefaultQualities for format if opts has none. A PNG
+// takes the quality of JPEG as it only applies once the PNG is downgraded to JPEG.
+func (bp *BildProcessor) withDefaultQuality(format string, opts processor.EncodeOptions) processor.EncodeOptions {
+	if opts.Quality == 0 {
+		opts.Quality = bp.getDefaultQuality(format)
+	}
+	return opts
+}
+
+// getDefaultQuality returns the quality set WithDefaultQualities for format, 0 if there is none
+func (bp *BildProcessor) getDefaultQuality(format string) int {
+	switch format = strings.ToLower(format); format {
+	case processor.ExtensionJPG, processor.ExtensionPNG:
+		format = processor.ExtensionJPEG
+	}
+	return bp.qualities[format]
+}
+
 // FixOrientation takes an image and it's EXIF orientation
 // To get the orientation of the image see GetOrientation (exif.go)
 func (bp *BildProcessor) FixOrientation(img image.Image, orientation int) image.Image {
@@ -145,24 +793,61 @@ type overlayResult struct {
 	err        error
 }
 
-func (bp *BildProcessor) transformOverlay(i, w, h int, oa *processor.OverlayAttrs, c *chan overlayResult) {
-	overlayImg, _, err := bp.Decode(oa.Img)
+// decodeOverlay decodes an overlay, the dimensions are read from the header first so that overlays larger
+// than maxOverlayPixels are rejected before their pixels are allocated. SVGs have no header to check, they
+// are rasterized within the limits of rasterizeSVG and checked afterwards.
+func (bp *BildProcessor) decodeOverlay(data []byte) (image.Image, error) {
+	if bp.maxOverlayPixels > 0 && processor.DetectContentType(data) != processor.ContentTypeSVG {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Width*cfg.Height > bp.maxOverlayPixels {
+			return nil, errOverlayTooLarge
+		}
+	}
+	img, _, err := bp.Decode(data)
 	if err != nil {
-		*c <- overlayResult{index: i, err: err}
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("overlay byte cannot be decoded into image")
 	}
-	if overlayImg == nil {
-		*c <- overlayResult{index: i, err: fmt.Errorf("overlay byte cannot be decoded into image")}
+	if bp.maxOverlayPixels > 0 && img.Bounds().Dx()*img.Bounds().Dy() > bp.maxOverlayPixels {
+		return nil, errOverlayTooLarge
 	}
+	return img, nil
+}
 
-	ratio := float64(overlayImg.Bounds().Dy()) / float64(overlayImg.Bounds().Dx())
-	dWidth := float64(w) * (oa.WidthPercentage / 100.0)
+// awaitOverlays receives up to n results of transformOverlay from c, it stops early once the overlay
+// timeout has passed. c must be buffered for n results so that the late senders don't block.
+func (bp *BildProcessor) awaitOverlays(c chan overlayResult, n int) []overlayResult {
+	var timeout <-chan time.Time
+	if bp.overlayTimeout > 0 {
+		timer := time.NewTimer(bp.overlayTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	results := make([]overlayResult, 0, n)
+	for len(results) < n {
+		select {
+		case cr := <-c:
+			results = append(results, cr)
+		case <-timeout:
+			return results
+		}
+	}
+	return results
+}
 
-	// Resizing overlay image according to base image
-	overlayImg = transform.Resize(overlayImg, int(dWidth), int(dWidth*ratio), transform.Linear)
+func (bp *BildProcessor) transformOverlay(i, w, h int, oa *processor.OverlayAttrs, filter transform.ResampleFilter, c *chan overlayResult) {
+	overlayImg, err := bp.decodeOverlay(oa.Img)
+	if err != nil {
+		*c <- overlayResult{index: i, err: err}
+		return
+	}
 
-	// Anchor point for overlaying
-	x, y := getStartingPointForCrop(w, h, overlayImg.Bounds().Dx(), overlayImg.Bounds().Dy(), oa.Point)
-	offset := image.Pt(x, y)
+	overlayImg, offset := resizeOverlay(overlayImg, float64(w)*(oa.WidthPercentage/100.0), w, h, oa, filter)
 	*c <- overlayResult{
 		overlayImg: overlayImg,
 		offset:     offset,
@@ -171,40 +856,247 @@ func (bp *BildProcessor) transformOverlay(i, w, h int, oa *processor.OverlayAttr
 	}
 }
 
+// resizeOverlay returns the overlay resized to width keeping its aspect ratio, with the point of a w x h base it is
+// drawn at
+func resizeOverlay(overlay image.Image, width float64, w, h int, oa *processor.OverlayAttrs,
+	filter transform.ResampleFilter) (image.Image, image.Point) {
+	ratio := float64(overlay.Bounds().Dy()) / float64(overlay.Bounds().Dx())
+
+	// Resizing overlay image according to base image
+	overlay = transform.Resize(overlay, int(width), int(width*ratio), filter)
+	return overlay, getOverlayOffset(w, h, overlay, oa)
+}
+
+// getOverlayArea returns the size of the area of a w x h base an overlay anchored to the Point of oa is placed in,
+// i.e. the base without the Margin of oa. It is at least a pixel in each dimension.
+func getOverlayArea(w, h int, oa *processor.OverlayAttrs) (int, int) {
+	if oa.Position != nil || oa.Margin <= 0 {
+		return w, h
+	}
+	return clamp(w-2*oa.Margin, 1, w), clamp(h-2*oa.Margin, 1, h)
+}
+
+// getOverlayOffset returns the point of a w x h base the overlay is drawn at, the anchor point for overlaying
+func getOverlayOffset(w, h int, overlay image.Image, oa *processor.OverlayAttrs) image.Point {
+	ow, oh := overlay.Bounds().Dx(), overlay.Bounds().Dy()
+	if oa.Position != nil {
+		return image.Pt(getStartingPointForFocalCrop(w, h, ow, oh, *oa.Position))
+	}
+	if oa.Margin <= 0 {
+		return image.Pt(getStartingPointForCrop(w, h, ow, oh, oa.Point))
+	}
+	// The overlay is anchored within the area inside the margins, an overlay larger than that area is moved
+	// into the margins as needed to stay within the base
+	aw, ah := getOverlayArea(w, h, oa)
+	x, y := getStartingPointForCrop(aw, ah, ow, oh, oa.Point)
+	return image.Pt(clamp(x+(w-aw)/2, 0, w-ow), clamp(y+(h-ah)/2, 0, h-oh))
+}
+
+// fitOverlay returns the overlay made to fit within the area of a w x h base inside the Margin of oa as set by
+// mode, with the point of the base it is drawn at, or errOverlayOversize for OversizeError. An overlay that already
+// fits is returned as is.
+func fitOverlay(overlay image.Image, offset image.Point, w, h int, oa *processor.OverlayAttrs, mode processor.Oversize,
+	filter transform.ResampleFilter) (image.Image, image.Point, error) {
+	ow, oh := overlay.Bounds().Dx(), overlay.Bounds().Dy()
+	aw, ah := getOverlayArea(w, h, oa)
+	if ow <= aw && oh <= ah {
+		return overlay, offset, nil
+	}
+	switch mode {
+	case processor.OversizeError:
+		return nil, image.ZP, errOverlayOversize
+	case processor.OversizeCrop:
+		cw, ch := ow, oh
+		if cw > aw {
+			cw = aw
+		}
+		if ch > ah {
+			ch = ah
+		}
+		// The crop is copied to the origin, as the overlay is drawn and sampled from its bounds
+		cropped := image.NewRGBA(image.Rect(0, 0, cw, ch))
+		draw.Draw(cropped, cropped.Bounds(), overlay, overlay.Bounds().Min.Add(image.Pt((ow-cw)/2, (oh-ch)/2)), draw.Src)
+		overlay = cropped
+	default:
+		fw, fh := getResizeWidthAndHeight(aw, ah, ow, oh)
+		overlay = transform.Resize(overlay, clamp(fw, 1, aw), clamp(fh, 1, ah), filter)
+	}
+	return overlay, getOverlayOffset(w, h, overlay, oa), nil
+}
+
 // Watermark takes an input byte array, overlay byte array and opacity value
-// and returns the watermarked image bytes or error
+// and returns the watermarked image bytes or error, an opacity of 0 returns the input unchanged
 func (bp *BildProcessor) Watermark(base []byte, overlay []byte, opacity uint8) ([]byte, error) {
+	return bp.WatermarkWithOptions(base, overlay, opacity, processor.WatermarkOptions{})
+}
+
+// WatermarkWithOptions takes an input byte array, overlay byte array, opacity value and WatermarkOptions
+// and returns the watermarked image bytes or error. The base and overlay are decoded and composited by WatermarkImage,
+// the overlay within the limits set WithMaxOverlayPixels and WithOverlayDecodeTimeout.
+func (bp *BildProcessor) WatermarkWithOptions(base []byte, overlay []byte, opacity uint8, opts processor.WatermarkOptions) ([]byte, error) {
+	if opacity == 0 || opts.MinSize > 0 {
+		// A fully transparent overlay has no visual effect and small bases are skipped, the base is only
+		// checked to be a valid image and returned verbatim without decoding the overlay or compositing
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(base))
+		if err != nil {
+			return nil, err
+		}
+		if opacity == 0 || cfg.Width < opts.MinSize || cfg.Height < opts.MinSize {
+			return base, nil
+		}
+	}
+
 	baseImg, f, err := bp.Decode(base)
 	if err != nil {
 		return nil, err
 	}
-	if f != processor.ExtensionPNG {
-		baseImg = clone.AsRGBA(baseImg)
+
+	c := make(chan overlayResult, 1)
+	go func() {
+		img, err := bp.decodeOverlay(overlay)
+		c <- overlayResult{overlayImg: img, err: err}
+	}()
+	results := bp.awaitOverlays(c, 1)
+	if len(results) == 0 {
+		return nil, errOverlayTimeout
+	}
+	if results[0].err != nil {
+		return nil, results[0].err
 	}
 
+	img, err := bp.WatermarkImage(baseImg, results[0].overlayImg, opacity, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bp.Encode(img, f)
+}
+
+// WatermarkImage takes a base image, an overlay image, opacity value and WatermarkOptions and returns a copy of the
+// base with the overlay composited like WatermarkWithOptions does, or error. It lets callers chaining operations on
+// decoded images watermark them without encoding and decoding them again. An opacity of 0 and bases smaller than
+// opts.MinSize return the base as is.
+func (bp *BildProcessor) WatermarkImage(base, overlay image.Image, opacity uint8, opts processor.WatermarkOptions) (image.Image, error) {
+	w := base.Bounds().Dx()
+	h := base.Bounds().Dy()
+	if opacity == 0 || w < opts.MinSize || h < opts.MinSize {
+		return base, nil
+	}
+	// The base is always normalized to premultiplied RGBA, drawing onto the decoded image directly
+	// would quantize the overlay for paletted or grayscale PNGs
+	baseImg := clone.AsRGBA(base)
+
 	oa := processor.OverlayAttrs{
-		Img:              overlay,
 		Point:            processor.PointCenter,
 		WidthPercentage:  50.0,
 		HeightPercentage: 50.0,
+		Position:         opts.Position,
+		Margin:           opts.Margin,
 	}
-	c := make(chan overlayResult)
-	w := baseImg.Bounds().Dx()
-	h := baseImg.Bounds().Dy()
-	go bp.transformOverlay(0, w, h, &oa, &c)
-	cr := <-c
-
-	if cr.err != nil {
-		return nil, cr.err
+	if opts.Anchor != 0 {
+		oa.Point = opts.Anchor
+	}
+	filter := getResampleFilter(opts.Filter)
+	overlayImg, offset := resizeOverlay(overlay, getWatermarkWidth(w, opts), w, h, &oa, filter)
+	overlayImg, offset, err := fitOverlay(overlayImg, offset, w, h, &oa, opts.Oversize, filter)
+	if err != nil {
+		return nil, err
+	}
+	tint := opts.Color
+	if opts.AutoContrast {
+		if c, ok := getContrastColor(baseImg, overlayImg, offset); ok {
+			tint = c
+		}
+	}
+	if tint != nil {
+		// Every pixel is within the maximum tolerance of white, so the whole overlay is shifted to the color
+		overlayImg = bp.Recolor(overlayImg, color.White, tint, math.MaxUint8)
 	}
 
 	// Mask image (that is just a solid light gray image)
 	mask := image.NewUniform(color.Alpha{A: opacity})
 
+	if opts.Shadow != nil && opts.Shadow.Opacity > 0 {
+		shadow, origin := getWatermarkShadow(overlayImg, *opts.Shadow)
+		r := image.Rectangle{Min: origin, Max: origin.Add(shadow.Bounds().Size())}.Add(offset)
+		draw.DrawMask(baseImg, r, shadow, shadow.Bounds().Min, mask, image.ZP, draw.Over)
+	}
+
 	// Performing overlay
-	draw.DrawMask(baseImg.(draw.Image), cr.overlayImg.Bounds().Add(cr.offset), cr.overlayImg, image.ZP, mask, image.ZP, draw.Over)
+	draw.DrawMask(baseImg, overlayImg.Bounds().Add(offset), overlayImg, overlayImg.Bounds().Min, mask, image.ZP, draw.Over)
+
+	return baseImg, nil
+}
+
+// getWatermarkWidth returns the width in pixels of the overlay of a watermark on a base of width w, the fixed Width
+// of opts or half of w, limited to the MaxWidth of opts
+func getWatermarkWidth(w int, opts processor.WatermarkOptions) float64 {
+	width := float64(w) * 0.5
+	if opts.Width > 0 {
+		width = float64(opts.Width)
+	}
+	if opts.MaxWidth > 0 && width > float64(opts.MaxWidth) {
+		width = float64(opts.MaxWidth)
+	}
+	return width
+}
+
+// getWatermarkShadow returns the shadow of overlay and the point of the overlay coordinates it is drawn at, the
+// alpha of the overlay is filled with the color of the shadow and blurred. The shadow is padded by three times the
+// blur radius so that the blur can fade out beyond the edges of the overlay.
+func getWatermarkShadow(overlay image.Image, shadow processor.WatermarkShadow) (image.Image, image.Point) {
+	var c color.Color = color.Black
+	if shadow.Color != nil {
+		c = shadow.Color
+	}
+	nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+	padding := 0
+	if shadow.Blur > 0 {
+		padding = int(math.Ceil(3 * shadow.Blur))
+	}
+	ob := overlay.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, ob.Dx()+2*padding, ob.Dy()+2*padding))
+	for y := ob.Min.Y; y < ob.Max.Y; y++ {
+		for x := ob.Min.X; x < ob.Max.X; x++ {
+			_, _, _, a := overlay.At(x, y).RGBA()
+			img.SetNRGBA(x-ob.Min.X+padding, y-ob.Min.Y+padding,
+				color.NRGBA{R: nc.R, G: nc.G, B: nc.B, A: uint8((a >> 8) * uint32(shadow.Opacity) / math.MaxUint8)})
+		}
+	}
+	origin := ob.Min.Add(shadow.Offset).Sub(image.Pt(padding, padding))
+	if shadow.Blur > 0 {
+		return blur.Gaussian(img, shadow.Blur), origin
+	}
+	return img, origin
+}
 
-	return bp.Encode(baseImg, f)
+// getContrastColor returns black if the area of base below the visible pixels of overlay drawn at offset is light
+// and white if it is dark, the returned bool is false for an area of medium brightness or one without pixels
+func getContrastColor(base, overlay image.Image, offset image.Point) (color.Color, bool) {
+	var sum float64
+	var n int
+	ob := overlay.Bounds()
+	for y := ob.Min.Y; y < ob.Max.Y; y++ {
+		for x := ob.Min.X; x < ob.Max.X; x++ {
+			p := image.Pt(x, y).Add(offset)
+			if _, _, _, a := overlay.At(x, y).RGBA(); a == 0 || !p.In(base.Bounds()) {
+				continue
+			}
+			c := color.NRGBAModel.Convert(base.At(p.X, p.Y)).(color.NRGBA)
+			sum += getLuma(c.R, c.G, c.B)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, false
+	}
+	switch mean := sum / float64(n); {
+	case mean >= autoContrastLight:
+		return color.Black, true
+	case mean <= autoContrastDark:
+		return color.White, true
+	default:
+		return nil, false
+	}
 }
 
 // Overlay takes a base image and array of overlay images and returns the final overlayed image bytes or error
@@ -213,23 +1105,23 @@ func (bp *BildProcessor) Overlay(base []byte, overlays []*processor.OverlayAttrs
 		return base, nil
 	}
 
-	baseImg, f, err := bp.Decode(base)
+	baseImg, _, err := bp.Decode(base)
 	if err != nil {
 		return nil, err
 	}
-	if f != processor.ExtensionPNG {
-		baseImg = clone.AsRGBA(baseImg)
-	}
+	// The base is always normalized to premultiplied RGBA, drawing onto the decoded image directly
+	// would quantize the overlay for paletted or grayscale PNGs
+	baseImg = clone.AsRGBA(baseImg)
 
 	c := make(chan overlayResult, len(overlays))
 	w := baseImg.Bounds().Dx()
 	h := baseImg.Bounds().Dy()
 	for i, overlay := range overlays {
-		go bp.transformOverlay(i, w, h, overlay, &c)
+		go bp.transformOverlay(i, w, h, overlay, transform.Linear, &c)
 	}
 
-	for i := 0; i < len(overlays); i++ {
-		cr := <-c
+	// Overlays that can't be decoded, are too large or time out are skipped
+	for _, cr := range bp.awaitOverlays(c, len(overlays)) {
 		if cr.err == nil {
 			// Performing overlay
 			draw.DrawMask(baseImg.(draw.Image), cr.overlayImg.Bounds().Add(cr.offset), cr.overlayImg, image.ZP, nil, image.ZP, draw.Over)
@@ -246,9 +1138,128 @@ func WithEncoders(encoders *Encoders) ProcessorOption {
 	}
 }
 
+// WithMaxOverlayPixels is a builder function to set the largest area (width x height) of the overlays
+// decoded by Watermark and Overlay, guarding against decode bombs. The default is 4096x4096, 0 disables it.
+func WithMaxOverlayPixels(n int) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.maxOverlayPixels = n
+	}
+}
+
+// WithOverlayDecodeTimeout is a builder function to limit how long Watermark waits for its overlay to be
+// decoded and resized before failing, Overlay skips the overlays that aren't ready in time instead.
+// A decode can't be interrupted, so it still runs to completion in the background, WithMaxOverlayPixels
+// bounds how long that takes. By default there is no timeout.
+func WithOverlayDecodeTimeout(d time.Duration) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.overlayTimeout = d
+	}
+}
+
+// WithDecodeTimeout is a builder function to set how long Decode and DecodeAnimation may take before they return
+// ErrDecodeTimeout, e.g. 2*time.Second so that a crafted image which takes excessively long to decode doesn't hold
+// up the request. The decode itself isn't interrupted and keeps a core busy until it finishes, so the timeout should
+// be combined with a limit on the size of the inputs. The default 0 waits indefinitely.
+func WithDecodeTimeout(d time.Duration) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.decodeTimeout = d
+	}
+}
+
+// WithBufferPool is a builder function to reuse the pixel buffers of the images created by GrayScale, Pad,
+// RotateWithOptions, Perspective and SwapChannels, which reduces the allocations for large images at a high rate.
+// The buffer of an image is handed back to the pool by Release, once the caller doesn't use the image anymore.
+// It is disabled by default.
+func WithBufferPool(enabled bool) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.pool = nil
+		if enabled {
+			bp.pool = newRGBAPool()
+		}
+	}
+}
+
+// WithDefaultQualities is a builder function to set the default encode quality (1 to 100) of each output
+// format, keyed by extension like jpeg or webp, e.g. {"jpeg": 82, "webp": 78}. The quality applies when no
+// EncodeOptions.Quality is given, formats without a quality keep the options of their encoder and qualities
+// of formats without an encoder are ignored. PNGs downgraded to JPEG use the quality of jpeg.
+func WithDefaultQualities(qualities map[string]int) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.qualities = make(map[string]int, len(qualities))
+		for format, q := range qualities {
+			if format = strings.ToLower(format); format == processor.ExtensionJPG {
+				format = processor.ExtensionJPEG
+			}
+			if q > 0 && q <= 100 {
+				bp.qualities[format] = q
+			}
+		}
+	}
+}
+
+// WithMaxDecodePixels is a builder function to set the largest area (width x height) of the images Decode decodes,
+// larger ones are rejected with ErrImageTooLarge from their header, before the decode allocates their pixels.
+// Strips bound the memory of downscaling WithTiledResize, but the source is still decoded as a whole. The default
+// is 32768x32768, 0 disables the check.
+func WithMaxDecodePixels(maxPixels int) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.maxDecodePixels = maxPixels
+	}
+}
+
+// WithTiledResize is a builder function to set the smallest area (width x height) of the images Resize, Scale,
+// Crop and Cover downscale in horizontal strips. Only a strip at a time is converted to RGBA and resampled to the
+// output width, so an image like a gigapixel map no longer needs several times its decoded size on top of it.
+// The output is the same as without strips. The default is 8192x8192, 0 disables it.
+func WithTiledResize(minPixels int) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.tiledResizePixels = minPixels
+	}
+}
+
+// WithYCbCrResize is a builder function to resize images decoded from JPEGs in their YCbCr color space, each plane
+// at its subsampled size, instead of converting them to RGBA first. Resize, Scale, Crop and Cover then return an
+// *image.YCbCr the JPEG encoder takes as is, which saves the conversions to RGBA and back for a plain resize from
+// JPEG to JPEG, the other operations convert it as before. The output differs from the RGBA resize by the rounding
+// of the color conversion and the smoother chroma of the subsampled planes. It is disabled by default.
+func WithYCbCrResize(enabled bool) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.ycbcrResize = enabled
+	}
+}
+
+// WithMaxParallelism is a builder function to set the largest number of goroutines a single operation of
+// BildProcessor splits its rows over, e.g. 2 so that a large image takes at most 2 cores of a request while the
+// other requests take the rest. It applies to the loops of darkroom itself, i.e. GrayScale, Desaturate,
+// ExtractChannel, SwapChannels, Sharpen, Perspective and the resize WithYCbCrResize. The operations of bild like
+// Resize and Blur and the encoders are not bounded by it and use as many cores as they do without a limit, so it
+// doesn't bound the cores of a request, it only keeps the loops of darkroom from adding to them. The default 0
+// uses GOMAXPROCS goroutines.
+func WithMaxParallelism(n int) ProcessorOption {
+	return func(bp *BildProcessor) {
+		bp.maxParallelism = n
+	}
+}
+
+// Release hands the pixel buffer of img back to the pool set WithBufferPool, img must not be used afterwards. Only
+// the images created with a pooled buffer are taken, other images, like decoded ones, are left as they are.
+func (bp *BildProcessor) Release(img image.Image) {
+	bp.pool.put(img)
+}
+
+// MaxParallelism returns the largest number of goroutines a single operation uses set WithMaxParallelism,
+// 0 if it is not limited
+func (bp *BildProcessor) MaxParallelism() int {
+	if bp.maxParallelism < 0 {
+		return 0
+	}
+	return bp.maxParallelism
+}
+
 // NewBildProcessor creates a new BildProcessor, if called without parameters encoders will be default
 func NewBildProcessor(opts ...ProcessorOption) *BildProcessor {
-	bp := &BildProcessor{encoders: NewEncoders()}
+	bp := &BildProcessor{encoders: NewEncoders(), maxOverlayPixels: defaultMaxOverlayPixels,
+		maxDecodePixels: defaultMaxDecodePixels, tiledResizePixels: defaultTiledResizePixels}
 	for _, opt := range opts {
 		opt(bp)
 	}
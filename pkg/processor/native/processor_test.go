@@ -2,9 +2,15 @@ package native
 
 import (
 	"bytes"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/gojek/darkroom/pkg/processor"
 	"github.com/stretchr/testify/assert"
@@ -102,6 +108,108 @@ func (s *BildProcessorSuite) TestBildProcessor_Crop() {
 	}
 }
 
+func (s *BildProcessorSuite) TestBildProcessor_CropWithOptions() {
+	// The source is 500x375, scaled to 500x500 it is 666x500 with 166 pixels to crop
+	out := s.processor.CropWithOptions(s.srcImage, 500, 500, processor.PointLeft, processor.CropOptions{Offset: image.Pt(20, 0)})
+	assert.Equal(s.T(), image.Rect(20, 0, 520, 500), out.Bounds())
+
+	out = s.processor.CropWithOptions(s.srcImage, 500, 500, processor.PointRight, processor.CropOptions{Offset: image.Pt(-20, 5)})
+	assert.Equal(s.T(), image.Rect(146, 0, 646, 500), out.Bounds())
+
+	// The window is clamped to the image
+	out = s.processor.CropWithOptions(s.srcImage, 500, 500, processor.PointCenter, processor.CropOptions{Offset: image.Pt(1000, 0)})
+	assert.Equal(s.T(), image.Rect(166, 0, 666, 500), out.Bounds())
+
+	out = s.processor.CropWithOptions(s.srcImage, 500, 500, processor.PointCenter, processor.CropOptions{})
+	assert.Equal(s.T(), s.processor.Crop(s.srcImage, 500, 500, processor.PointCenter).Bounds(), out.Bounds())
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Cover() {
+	out := s.processor.Cover(s.srcImage, 300, 100, processor.PointTop)
+	assert.Equal(s.T(), 300, out.Bounds().Dx())
+	assert.Equal(s.T(), 100, out.Bounds().Dy())
+
+	out = s.processor.Cover(s.srcImage, 100, 300, processor.PointCenter)
+	assert.Equal(s.T(), 100, out.Bounds().Dx())
+	assert.Equal(s.T(), 300, out.Bounds().Dy())
+
+	out = s.processor.Cover(s.srcImage, 250, 0, processor.PointCenter)
+	assert.Equal(s.T(), 250, out.Bounds().Dx())
+	assert.Equal(s.T(), 187, out.Bounds().Dy())
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_FocalCrop() {
+	out := s.processor.FocalCrop(s.srcImage, 200, 375, processor.FocalPoint{X: 0.25, Y: 0.5})
+	assert.Equal(s.T(), 200, out.Bounds().Dx())
+	assert.Equal(s.T(), 375, out.Bounds().Dy())
+	// 25% of 500 is 125, so the 200px window starts at 25
+	assert.Equal(s.T(), 25, out.Bounds().Min.X)
+
+	out = s.processor.FocalCrop(s.srcImage, 500, 0, processor.FocalPoint{X: 0.25, Y: 0.5})
+	assert.Equal(s.T(), 500, out.Bounds().Dx())
+	assert.Equal(s.T(), 375, out.Bounds().Dy())
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Pad() {
+	bg := color.RGBA{R: 255, A: 255}
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	draw.Draw(src, src.Bounds(), image.White, image.ZP, draw.Src)
+
+	out := s.processor.Pad(src, 200, 100, processor.PointCenter, bg)
+	assert.Equal(s.T(), image.Rect(0, 0, 200, 100), out.Bounds())
+	assert.Equal(s.T(), bg, color.RGBAModel.Convert(out.At(10, 10)))
+	assert.Equal(s.T(), color.RGBA{R: 255, G: 255, B: 255, A: 255}, color.RGBAModel.Convert(out.At(100, 50)))
+
+	out = s.processor.Pad(src, 200, 100, processor.PointTopLeft, bg)
+	assert.Equal(s.T(), color.RGBA{R: 255, G: 255, B: 255, A: 255}, color.RGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(s.T(), bg, color.RGBAModel.Convert(out.At(100, 50)))
+
+	out = s.processor.Pad(src, 200, 100, processor.PointBottomRight, color.Transparent)
+	assert.Equal(s.T(), color.RGBA{}, color.RGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(s.T(), color.RGBA{R: 255, G: 255, B: 255, A: 255}, color.RGBAModel.Convert(out.At(199, 99)))
+
+	// Sub images keep their own origin, like the output of Crop
+	sub := src.SubImage(image.Rect(50, 25, 100, 50))
+	out = s.processor.Pad(sub, 60, 30, processor.PointTopLeft, bg)
+	assert.Equal(s.T(), color.RGBA{R: 255, G: 255, B: 255, A: 255}, color.RGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(s.T(), bg, color.RGBAModel.Convert(out.At(55, 0)))
+
+	assert.Equal(s.T(), src, s.processor.Pad(src, 0, 100, processor.PointCenter, bg))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_PadWithBlur() {
+	bg := color.RGBA{R: 255, A: 255}
+	// Blue on the left half and green on the right half
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	draw.Draw(src, image.Rect(0, 0, 50, 50), image.NewUniform(color.RGBA{B: 255, A: 255}), image.ZP, draw.Src)
+	draw.Draw(src, image.Rect(50, 0, 100, 50), image.NewUniform(color.RGBA{G: 255, A: 255}), image.ZP, draw.Src)
+
+	assert.Equal(s.T(), s.processor.Pad(src, 100, 100, processor.PointCenter, bg),
+		s.processor.PadWithOptions(src, 100, 100, processor.PointCenter, bg, processor.PadOptions{}))
+
+	out := s.processor.PadWithOptions(src, 100, 100, processor.PointCenter, bg, processor.PadOptions{Blur: 20})
+	assert.Equal(s.T(), image.Rect(0, 0, 100, 100), out.Bounds())
+	assert.True(s.T(), isOpaque(out))
+	// The contained copy stays sharp
+	assert.Equal(s.T(), color.RGBA{B: 255, A: 255}, color.RGBAModel.Convert(out.At(49, 50)))
+	assert.Equal(s.T(), color.RGBA{G: 255, A: 255}, color.RGBAModel.Convert(out.At(50, 50)))
+	// The padding shows the cover scaled copy, blurred into a mix of both halves near the center
+	for _, p := range []image.Point{{10, 5}, {90, 95}, {50, 5}} {
+		c := color.RGBAModel.Convert(out.At(p.X, p.Y)).(color.RGBA)
+		assert.Equal(s.T(), uint8(0), c.R, p)
+		assert.Equal(s.T(), uint8(255), c.A, p)
+	}
+	top := color.RGBAModel.Convert(out.At(10, 5)).(color.RGBA)
+	assert.Greater(s.T(), top.B, top.G)
+	center := color.RGBAModel.Convert(out.At(50, 5)).(color.RGBA)
+	assert.InDelta(s.T(), 128, int(center.G), 40)
+	assert.InDelta(s.T(), 128, int(center.B), 40)
+
+	// The background only shows through transparent pixels
+	out = s.processor.PadWithOptions(image.NewRGBA(image.Rect(0, 0, 10, 5)), 10, 10, processor.PointCenter, bg, processor.PadOptions{Blur: 2})
+	assert.Equal(s.T(), bg, color.RGBAModel.Convert(out.At(0, 0)))
+}
+
 func (s *BildProcessorSuite) TestBildProcessor_Grayscale() {
 	var actual, expected []byte
 	var err error
@@ -116,6 +224,98 @@ func (s *BildProcessorSuite) TestBildProcessor_Grayscale() {
 	assert.EqualValues(s.T(), actual, expected)
 }
 
+func (s *BildProcessorSuite) TestBildProcessor_GrayscaleAcrossColorModels() {
+	r := image.Rect(0, 0, 16, 8)
+	gray := image.NewGray(r)
+	cmyk := image.NewCMYK(r)
+	nrgba := image.NewNRGBA(r)
+	paletted := image.NewPaletted(r, color.Palette{color.Black, color.RGBA{R: 255, A: 255}, color.Transparent})
+	for x := 0; x < r.Dx(); x++ {
+		for y := 0; y < r.Dy(); y++ {
+			c := color.NRGBA{R: uint8(x * 16), G: uint8(y * 32), B: 100, A: 255}
+			gray.Set(x, y, c)
+			cmyk.Set(x, y, c)
+			nrgba.Set(x, y, color.NRGBA{R: c.R, G: c.G, B: c.B, A: uint8(x * 16)})
+			paletted.SetColorIndex(x, y, uint8((x+y)%3))
+		}
+	}
+	buff := &bytes.Buffer{}
+	assert.Nil(s.T(), jpeg.Encode(buff, gray, nil))
+	grayJPEG, _, err := s.processor.Decode(buff.Bytes())
+	assert.Nil(s.T(), err)
+	buff = &bytes.Buffer{}
+	assert.Nil(s.T(), png.Encode(buff, paletted))
+	palettedPNG, _, err := s.processor.Decode(buff.Bytes())
+	assert.Nil(s.T(), err)
+
+	cases := map[string]image.Image{
+		"gray":         gray,
+		"gray jpeg":    grayJPEG,
+		"cmyk":         cmyk,
+		"nrgba":        nrgba,
+		"paletted":     paletted,
+		"paletted png": palettedPNG,
+		"sub image":    nrgba.SubImage(image.Rect(4, 2, 12, 6)),
+	}
+	for name, img := range cases {
+		var out image.Image
+		assert.NotPanics(s.T(), func() { out = s.processor.GrayScale(img) }, name)
+		assert.Equal(s.T(), img.Bounds().Size(), out.Bounds().Size(), name)
+		for x := out.Bounds().Min.X; x < out.Bounds().Max.X; x++ {
+			for y := out.Bounds().Min.Y; y < out.Bounds().Max.Y; y++ {
+				c := color.RGBAModel.Convert(out.At(x, y)).(color.RGBA)
+				assert.True(s.T(), c.R == c.G && c.G == c.B, name)
+			}
+		}
+		assert.NotPanics(s.T(), func() { s.processor.Duotone(img, color.Black, color.White) }, name)
+		_, err := s.processor.Encode(out, processor.ExtensionPNG)
+		assert.Nil(s.T(), err, name)
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Desaturate() {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{R: 200, G: 100, B: 0, A: 0xff})
+	img.Set(1, 0, color.RGBA{R: 100, A: 100})
+
+	assert.Equal(s.T(), img, s.processor.Desaturate(img, 0))
+	assert.Equal(s.T(), s.processor.GrayScale(img), s.processor.Desaturate(img, 1))
+
+	out := s.processor.Desaturate(img, 0.5)
+	// Halfway between the first pixel and its luma of about 119, the blend keeps the alpha
+	assert.Equal(s.T(), color.RGBA{R: 160, G: 110, B: 60, A: 0xff}, color.RGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(s.T(), uint8(100), color.RGBAModel.Convert(out.At(1, 0)).(color.RGBA).A)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_GrayscaleWithOptions() {
+	rgba := s.processor.GrayScale(s.srcImage)
+	assert.Equal(s.T(), rgba, s.processor.GrayScaleWithOptions(s.srcImage, processor.GrayScaleOptions{}))
+
+	out := s.processor.GrayScaleWithOptions(s.srcImage, processor.GrayScaleOptions{SingleChannel: true})
+	assert.Equal(s.T(), color.GrayModel, out.ColorModel())
+	assert.Equal(s.T(), s.srcImage.Bounds().Size(), out.Bounds().Size())
+	for _, p := range []image.Point{{0, 0}, {50, 25}, {99, 49}} {
+		assert.Equal(s.T(), color.RGBAModel.Convert(rgba.At(p.X, p.Y)).(color.RGBA).R, out.At(p.X, p.Y).(color.Gray).Y)
+	}
+
+	// Transparent pixels are composited over black
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	nrgba.Set(0, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	nrgba.Set(1, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 0})
+	gray := s.processor.GrayScaleWithOptions(nrgba, processor.GrayScaleOptions{SingleChannel: true})
+	assert.Equal(s.T(), color.Gray{Y: 255}, gray.At(0, 0))
+	assert.Equal(s.T(), color.Gray{}, gray.At(1, 0))
+
+	for _, ext := range []string{processor.ExtensionPNG, processor.ExtensionJPEG} {
+		data, err := s.processor.Encode(out, ext)
+		assert.Nil(s.T(), err, ext)
+		// Opaque PNGs may still be downgraded to JPEG, which keeps the single channel too
+		decoded, _, err := s.processor.Decode(data)
+		assert.Nil(s.T(), err, ext)
+		assert.Equal(s.T(), color.GrayModel, decoded.ColorModel(), ext)
+	}
+}
+
 func (s *BildProcessorSuite) TestBildProcessor_Blur() {
 	var actual, expected []byte
 	var err error
@@ -148,6 +348,186 @@ func (s *BildProcessorSuite) TestBildProcessor_Blur() {
 	}
 }
 
+func (s *BildProcessorSuite) TestBildProcessor_ExtractChannel() {
+	img := image.NewNRGBA(image.Rect(2, 1, 4, 2))
+	img.Set(2, 1, color.NRGBA{R: 10, G: 20, B: 30, A: 255})
+	img.Set(3, 1, color.NRGBA{R: 255, G: 100, B: 0, A: 128})
+
+	for channel, want := range map[string][2]uint8{"r": {10, 128}, "g": {20, 50}, "B": {30, 0}, "a": {255, 128}} {
+		out := s.processor.ExtractChannel(img, channel)
+		assert.Equal(s.T(), color.GrayModel, out.ColorModel(), channel)
+		assert.Equal(s.T(), img.Bounds(), out.Bounds(), channel)
+		assert.Equal(s.T(), color.Gray{Y: want[0]}, out.At(2, 1), channel)
+		assert.Equal(s.T(), color.Gray{Y: want[1]}, out.At(3, 1), channel)
+	}
+
+	assert.Equal(s.T(), img, s.processor.ExtractChannel(img, "x"))
+	assert.Equal(s.T(), img, s.processor.ExtractChannel(img, "rg"))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_SwapChannels() {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{R: 10, G: 20, B: 30, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 255, A: 128})
+
+	cases := map[string]color.RGBA{"rgb": {R: 10, G: 20, B: 30, A: 255}, "bgr": {R: 30, G: 20, B: 10, A: 255},
+		"GRB": {R: 20, G: 10, B: 30, A: 255}, "brg": {R: 30, G: 10, B: 20, A: 255}}
+	for order, want := range cases {
+		out := s.processor.SwapChannels(img, order)
+		assert.Equal(s.T(), want, out.At(0, 0), order)
+	}
+	// The alpha is kept
+	assert.Equal(s.T(), color.RGBA{B: 128, A: 128}, s.processor.SwapChannels(img, "gbr").At(1, 0))
+
+	for _, order := range []string{"", "rg", "rgbr", "rrb", "rga", "xyz"} {
+		assert.Equal(s.T(), img, s.processor.SwapChannels(img, order), order)
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Solarize() {
+	gradient := image.NewGray(image.Rect(0, 0, 256, 1))
+	for x := 0; x < 256; x++ {
+		gradient.Pix[x] = uint8(x)
+	}
+	out := s.processor.Solarize(gradient, 100)
+	for x := 0; x < 256; x++ {
+		want := uint8(x)
+		if x > 100 {
+			want = 255 - uint8(x)
+		}
+		assert.Equal(s.T(), color.RGBA{R: want, G: want, B: want, A: 255}, out.At(x, 0), x)
+	}
+
+	// The color is inverted on the straight color and the alpha is kept
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{R: 255, G: 200, B: 0, A: 128})
+	img.Set(1, 0, color.NRGBA{R: 0, G: 0, B: 255, A: 255})
+	out = s.processor.Solarize(img, 128)
+	assert.Equal(s.T(), color.NRGBA{G: 55, B: 255, A: 128}, color.NRGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(s.T(), color.NRGBA{B: 255, A: 255}, color.NRGBAModel.Convert(out.At(1, 0)))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Denoise() {
+	gray := color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, 9, 9))
+	draw.Draw(img, img.Bounds(), image.NewUniform(gray), image.ZP, draw.Src)
+	img.Set(4, 4, color.White)
+
+	out := s.processor.Denoise(img, 1)
+	assert.Equal(s.T(), img.Bounds(), out.Bounds())
+	assert.Equal(s.T(), gray, color.RGBAModel.Convert(out.At(4, 4)))
+
+	out = s.processor.Denoise(img, 0)
+	assert.Equal(s.T(), img, out)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Sharpen() {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 4))
+	draw.Draw(img, image.Rect(0, 0, 5, 4), image.NewUniform(color.RGBA{R: 100, G: 100, B: 100, A: 0xff}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(5, 0, 10, 4), image.NewUniform(color.RGBA{R: 150, G: 150, B: 150, A: 0xff}), image.ZP, draw.Src)
+	img.Set(9, 3, color.RGBA{R: 50, G: 50, B: 50, A: 50})
+
+	out := s.processor.Sharpen(img, 1)
+	assert.Equal(s.T(), img.Bounds(), out.Bounds())
+	// The edge gets more contrast, flat areas away from it are kept
+	left := color.RGBAModel.Convert(out.At(4, 1)).(color.RGBA)
+	right := color.RGBAModel.Convert(out.At(5, 1)).(color.RGBA)
+	assert.Less(s.T(), left.R, uint8(100))
+	assert.Greater(s.T(), right.R, uint8(150))
+	assert.Equal(s.T(), color.RGBA{R: 100, G: 100, B: 100, A: 0xff}, color.RGBAModel.Convert(out.At(0, 1)))
+	// The alpha is kept and the colors don't exceed it
+	corner := color.RGBAModel.Convert(out.At(9, 3)).(color.RGBA)
+	assert.Equal(s.T(), uint8(50), corner.A)
+	assert.LessOrEqual(s.T(), corner.R, corner.A)
+
+	assert.Equal(s.T(), img, s.processor.Sharpen(img, 0))
+}
+
+func BenchmarkBildProcessor_Denoise(b *testing.B) {
+	bp := NewBildProcessor()
+	data, _ := ioutil.ReadFile("_testdata/test.png")
+	img, _, _ := bp.Decode(data)
+	// Median filter cost grows with the square of the radius, so larger radii are considerably slower
+	for _, radius := range []int{1, 3, 5} {
+		b.Run(fmt.Sprintf("radius=%d", radius), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bp.Denoise(img, radius)
+			}
+		})
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Duotone() {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	img.Set(0, 0, color.Black)
+	img.Set(1, 0, color.White)
+	img.Set(2, 0, color.Transparent)
+	dark := color.RGBA{R: 0x1d, G: 0x1a, B: 0x5c, A: 0xff}
+	light := color.RGBA{R: 0xff, G: 0xd1, B: 0x66, A: 0xff}
+
+	out := s.processor.Duotone(img, dark, light)
+
+	assert.Equal(s.T(), img.Bounds(), out.Bounds())
+	assert.Equal(s.T(), dark, color.RGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(s.T(), light, color.RGBAModel.Convert(out.At(1, 0)))
+	assert.Equal(s.T(), color.RGBA{}, color.RGBAModel.Convert(out.At(2, 0)))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Recolor() {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 1))
+	img.Set(0, 0, color.NRGBA{R: 200, G: 20, B: 20, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 180, G: 0, B: 0, A: 255})
+	img.Set(2, 0, color.NRGBA{R: 200, G: 20, B: 20, A: 128})
+	img.Set(3, 0, color.NRGBA{R: 20, G: 200, B: 20, A: 255})
+	img.Set(4, 0, color.Transparent)
+	from := color.RGBA{R: 200, G: 20, B: 20, A: 255}
+	to := color.RGBA{R: 20, G: 60, B: 200, A: 255}
+
+	out := s.processor.Recolor(img, from, to, 32)
+
+	nrgba := func(x int) color.NRGBA {
+		return color.NRGBAModel.Convert(out.At(x, 0)).(color.NRGBA)
+	}
+	assert.Equal(s.T(), img.Bounds(), out.Bounds())
+	assert.Equal(s.T(), color.NRGBA{R: 20, G: 60, B: 200, A: 255}, nrgba(0))
+	// The darker shade stays darker by its luminance difference of 0.299*20 + 0.587*20 + 0.114*20 = 20
+	assert.Equal(s.T(), color.NRGBA{R: 0, G: 40, B: 180, A: 255}, nrgba(1))
+	assert.Equal(s.T(), uint8(128), nrgba(2).A)
+	assert.InDelta(s.T(), 200, float64(nrgba(2).B), 2)
+	assert.Equal(s.T(), color.NRGBA{R: 20, G: 200, B: 20, A: 255}, nrgba(3))
+	assert.Equal(s.T(), color.NRGBA{}, nrgba(4))
+
+	out = s.processor.Recolor(img, from, to, 0)
+	assert.Equal(s.T(), color.NRGBA{R: 180, G: 0, B: 0, A: 255}, color.NRGBAModel.Convert(out.At(1, 0)))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_ChromaKey() {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 1))
+	img.Set(0, 0, color.NRGBA{G: 255, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 20, G: 235, B: 20, A: 255})
+	img.Set(2, 0, color.NRGBA{R: 60, G: 255, B: 60, A: 255})
+	img.Set(3, 0, color.NRGBA{R: 200, G: 40, B: 40, A: 255})
+	img.Set(4, 0, color.NRGBA{G: 255, A: 100})
+
+	out := s.processor.ChromaKey(img, color.RGBA{G: 255, A: 255}, 40)
+
+	nrgba := func(x int) color.NRGBA {
+		return color.NRGBAModel.Convert(out.At(x, 0)).(color.NRGBA)
+	}
+	assert.Equal(s.T(), img.Bounds(), out.Bounds())
+	assert.Equal(s.T(), uint8(0), nrgba(0).A)
+	assert.Equal(s.T(), uint8(0), nrgba(1).A)
+	// 60 is halfway through the soft band between 40 and 80
+	assert.InDelta(s.T(), 128, float64(nrgba(2).A), 1)
+	assert.InDelta(s.T(), 60, float64(nrgba(2).R), 2)
+	assert.Equal(s.T(), color.NRGBA{R: 200, G: 40, B: 40, A: 255}, nrgba(3))
+	assert.Equal(s.T(), uint8(0), nrgba(4).A)
+
+	out = s.processor.ChromaKey(img, color.RGBA{G: 255, A: 255}, 0)
+	assert.Equal(s.T(), uint8(0), color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA).A)
+	assert.Equal(s.T(), uint8(255), color.NRGBAModel.Convert(out.At(1, 0)).(color.NRGBA).A)
+}
+
 func (s *BildProcessorSuite) TestBildProcessor_Flip() {
 	var actual, expected []byte
 	var err error
@@ -214,6 +594,323 @@ func (s *BildProcessorSuite) TestBildProcessor_Rotate() {
 	}
 }
 
+func (s *BildProcessorSuite) TestBildProcessor_RotateWithOptions() {
+	out := s.processor.RotateWithOptions(s.srcImage, 90, processor.RotateOptions{Expand: true})
+	assert.Equal(s.T(), 375, out.Bounds().Dx())
+	assert.Equal(s.T(), 500, out.Bounds().Dy())
+
+	out = s.processor.RotateWithOptions(s.srcImage, 90, processor.RotateOptions{})
+	assert.Equal(s.T(), 500, out.Bounds().Dx())
+	assert.Equal(s.T(), 375, out.Bounds().Dy())
+	_, _, _, a := out.At(0, 0).RGBA()
+	assert.Equal(s.T(), uint32(0), a)
+
+	bg := color.RGBA{R: 255, A: 255}
+	out = s.processor.RotateWithOptions(s.srcImage, 45, processor.RotateOptions{Expand: true, Background: bg})
+	assert.Greater(s.T(), out.Bounds().Dx(), 500)
+	assert.Greater(s.T(), out.Bounds().Dy(), 375)
+	assert.Equal(s.T(), bg, color.RGBAModel.Convert(out.At(0, 0)))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Perspective() {
+	corners := [4]image.Point{{X: 100, Y: 50}, {X: 400, Y: 0}, {X: 400, Y: 375}, {X: 100, Y: 325}}
+	out := s.processor.Perspective(s.srcImage, corners)
+	assert.Equal(s.T(), image.Rect(0, 0, 400, 375), out.Bounds())
+
+	// Outside of the quadrilateral is transparent and the inside is covered by the opaque source
+	_, _, _, a := out.At(50, 200).RGBA()
+	assert.Equal(s.T(), uint32(0), a)
+	_, _, _, a = out.At(110, 10).RGBA()
+	assert.Equal(s.T(), uint32(0), a)
+	_, _, _, a = out.At(250, 200).RGBA()
+	assert.Equal(s.T(), uint32(0xffff), a)
+
+	// Mapping onto its own bounds keeps the image
+	out = s.processor.Perspective(s.srcImage, [4]image.Point{{X: 0, Y: 0}, {X: 500, Y: 0}, {X: 500, Y: 375}, {X: 0, Y: 375}})
+	assert.Equal(s.T(), s.srcImage.Bounds(), out.Bounds())
+	assert.Equal(s.T(), color.RGBAModel.Convert(s.srcImage.At(123, 45)), out.At(123, 45))
+
+	degenerate := [4]image.Point{{X: 0, Y: 0}, {X: 10, Y: 10}, {X: 20, Y: 20}, {X: 0, Y: 20}}
+	assert.Equal(s.T(), s.srcImage, s.processor.Perspective(s.srcImage, degenerate))
+
+	huge := [4]image.Point{{X: 0, Y: 0}, {X: 1 << 30, Y: 0}, {X: 1 << 30, Y: 1 << 30}, {X: 0, Y: 1 << 30}}
+	assert.Equal(s.T(), s.srcImage, s.processor.Perspective(s.srcImage, huge))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_DecodeSVG() {
+	img, f, err := s.processor.Decode([]byte(testSVG))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), processor.ExtensionPNG, f)
+	assert.Equal(s.T(), image.Rect(0, 0, 40, 20), img.Bounds())
+
+	img, err = s.processor.Rasterize([]byte(testSVG), 0, 60)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), image.Rect(0, 0, 120, 60), img.Bounds())
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Convert() {
+	cases := []struct {
+		input  []byte
+		format string
+	}{
+		{input: s.srcPNGData, format: processor.ExtensionWebP},
+		{input: s.srcJPGData, format: processor.ExtensionWebP},
+		// Opaque images are not downgraded to JPEG
+		{input: s.srcJPGData, format: processor.ExtensionPNG},
+		{input: s.srcPNGData, format: processor.ExtensionJPEG},
+	}
+	for _, c := range cases {
+		out, err := s.processor.Convert(c.input, c.format, processor.EncodeOptions{Quality: 80})
+		assert.Nil(s.T(), err)
+		img, f, err := s.processor.Decode(out)
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), c.format, f)
+		assert.Equal(s.T(), image.Rect(0, 0, 500, 375), img.Bounds())
+	}
+
+	// The EXIF orientation is applied to the pixels
+	src, _ := ioutil.ReadFile("_testdata/exif_orientation/f6t.jpg")
+	expected, _ := ioutil.ReadFile("_testdata/exif_orientation/expected.jpg")
+	expectedImg, _, _ := s.processor.Decode(expected)
+	out, err := s.processor.Convert(src, processor.ExtensionJPEG, processor.EncodeOptions{})
+	assert.Nil(s.T(), err)
+	img, _, _ := s.processor.Decode(out)
+	assert.Equal(s.T(), expectedImg.Bounds(), img.Bounds())
+	assert.Nil(s.T(), GetJPEGMetadata(out))
+
+	_, err = s.processor.Convert(s.badData, processor.ExtensionWebP, processor.EncodeOptions{})
+	assert.NotNil(s.T(), err)
+	_, err = s.processor.Convert(s.srcPNGData, "tiff", processor.EncodeOptions{})
+	assert.NotNil(s.T(), err)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithOptions() {
+	linear, err := s.processor.Watermark(s.srcPNGData, s.watermarkData, 255)
+	assert.Nil(s.T(), err)
+	output, err := s.processor.WatermarkWithOptions(s.srcPNGData, s.watermarkData, 255, processor.WatermarkOptions{})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), linear, output)
+
+	for _, f := range []processor.Filter{processor.FilterNearestNeighbor, processor.FilterCatmullRom, processor.FilterLanczos} {
+		output, err = s.processor.WatermarkWithOptions(s.srcPNGData, s.watermarkData, 255, processor.WatermarkOptions{Filter: f})
+		assert.Nil(s.T(), err)
+		assert.NotEqual(s.T(), linear, output)
+		img, _, err := s.processor.Decode(output)
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), s.srcImage.Bounds(), img.Bounds())
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkImage() {
+	overlay, _, err := s.processor.Decode(s.watermarkData)
+	assert.Nil(s.T(), err)
+	opts := processor.WatermarkOptions{Color: color.Black, Shadow: &processor.WatermarkShadow{Offset: image.Pt(2, 2), Opacity: 128}}
+
+	img, err := s.processor.WatermarkImage(s.srcImage, overlay, 200, opts)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s.srcImage.Bounds(), img.Bounds())
+	// The byte API decodes both images and encodes the result of WatermarkImage
+	expected, _ := s.processor.WatermarkWithOptions(s.srcPNGData, s.watermarkData, 200, opts)
+	output, _ := s.processor.Encode(img, processor.ExtensionPNG)
+	assert.Equal(s.T(), expected, output)
+	assert.NotEqual(s.T(), s.srcImage, img)
+
+	img, err = s.processor.WatermarkImage(s.srcImage, overlay, 0, opts)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s.srcImage, img)
+
+	small := newUniformImage(image.Rect(0, 0, 10, 10), color.White)
+	img, err = s.processor.WatermarkImage(small, overlay, 255, processor.WatermarkOptions{MinSize: 20})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), small, img)
+
+	_, err = s.processor.WatermarkImage(newUniformImage(image.Rect(0, 0, 100, 2), color.White), overlay, 255,
+		processor.WatermarkOptions{Oversize: processor.OversizeError})
+	assert.Equal(s.T(), errOverlayOversize, err)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkAtPosition() {
+	bp := NewBildProcessor(WithEncoders(NewEncoders(WithJpegEncoder(&JpegEncoder{Option: &jpeg.Options{Quality: 100}}))))
+	red := color.RGBA{R: 0xff, A: 0xff}
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+	overlay := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(overlay, overlay.Bounds(), image.NewUniform(red), image.ZP, draw.Src)
+	overlayData := &bytes.Buffer{}
+	_ = png.Encode(overlayData, overlay)
+	base := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(base, base.Bounds(), image.NewUniform(white), image.ZP, draw.Src)
+	baseData := &bytes.Buffer{}
+	_ = png.Encode(baseData, base)
+
+	cases := []struct {
+		position      *processor.FocalPoint
+		inside, outer image.Point
+	}{
+		// The overlay is resized to 50x50 and centered on the position
+		{position: nil, inside: image.Pt(50, 50), outer: image.Pt(10, 10)},
+		{position: &processor.FocalPoint{X: 0.5, Y: 0.5}, inside: image.Pt(26, 74), outer: image.Pt(24, 76)},
+		{position: &processor.FocalPoint{X: 0.4, Y: 0.6}, inside: image.Pt(16, 36), outer: image.Pt(64, 34)},
+		// Clamped to stay within the base, i.e. pinned to the top-right corner
+		{position: &processor.FocalPoint{X: 0.9, Y: 0.1}, inside: image.Pt(99, 0), outer: image.Pt(49, 50)},
+		{position: &processor.FocalPoint{X: 1, Y: 1}, inside: image.Pt(99, 99), outer: image.Pt(49, 49)},
+	}
+	for _, c := range cases {
+		output, err := bp.WatermarkWithOptions(baseData.Bytes(), overlayData.Bytes(), 0xff, processor.WatermarkOptions{Position: c.position})
+		assert.Nil(s.T(), err)
+		out, _, _ := bp.Decode(output)
+		assert.Equal(s.T(), red, color.RGBAModel.Convert(out.At(c.inside.X, c.inside.Y)), c.position)
+		assert.Equal(s.T(), white, color.RGBAModel.Convert(out.At(c.outer.X, c.outer.Y)), c.position)
+	}
+
+	output, err := bp.Overlay(baseData.Bytes(), []*processor.OverlayAttrs{
+		{Img: overlayData.Bytes(), WidthPercentage: 20, Position: &processor.FocalPoint{X: 0.1, Y: 0.9}},
+	})
+	assert.Nil(s.T(), err)
+	out, _, _ := bp.Decode(output)
+	assert.Equal(s.T(), red, color.RGBAModel.Convert(out.At(0, 99)))
+	assert.Equal(s.T(), red, color.RGBAModel.Convert(out.At(19, 80)))
+	assert.Equal(s.T(), white, color.RGBAModel.Convert(out.At(20, 79)))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithZeroOpacity() {
+	// The overlay is not decoded at all
+	output, err := s.processor.Watermark(s.srcPNGData, s.badData, 0)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s.srcPNGData, output)
+
+	output, err = s.processor.Watermark(s.badData, s.watermarkData, 0)
+	assert.NotNil(s.T(), err)
+	assert.Nil(s.T(), output)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithMinSize() {
+	smallest := s.srcImage.Bounds().Dx()
+	if h := s.srcImage.Bounds().Dy(); h < smallest {
+		smallest = h
+	}
+	// The overlay is not decoded for a base below the minimum size
+	output, err := s.processor.WatermarkWithOptions(s.srcPNGData, s.badData, 255, processor.WatermarkOptions{MinSize: smallest + 1})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s.srcPNGData, output)
+
+	output, err = s.processor.WatermarkWithOptions(s.srcPNGData, s.watermarkData, 255, processor.WatermarkOptions{MinSize: smallest})
+	assert.Nil(s.T(), err)
+	expected, _ := s.processor.Watermark(s.srcPNGData, s.watermarkData, 255)
+	assert.Equal(s.T(), expected, output)
+
+	output, err = s.processor.WatermarkWithOptions(s.badData, s.watermarkData, 255, processor.WatermarkOptions{MinSize: smallest})
+	assert.NotNil(s.T(), err)
+	assert.Nil(s.T(), output)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithColor() {
+	encode := func(img image.Image) []byte {
+		buff := &bytes.Buffer{}
+		assert.Nil(s.T(), png.Encode(buff, img))
+		return buff.Bytes()
+	}
+	base := encode(newUniformImage(image.Rect(0, 0, 40, 40), color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}))
+	logo := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(logo, image.Rect(0, 0, 20, 10), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(logo, image.Rect(0, 10, 20, 20), image.NewUniform(color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0x80}), image.ZP, draw.Src)
+
+	output, err := s.processor.WatermarkWithOptions(base, encode(logo), 255, processor.WatermarkOptions{Color: color.Black})
+	assert.Nil(s.T(), err)
+	img, _, err := s.processor.Decode(output)
+	assert.Nil(s.T(), err)
+	// The overlay covers the center 20x20 of the base, the opaque half is black and the half transparent one darkens it
+	assert.Equal(s.T(), color.RGBA{A: 0xff}, color.RGBAModel.Convert(img.At(20, 15)))
+	assert.Equal(s.T(), color.RGBA{R: 0x3f, G: 0x3f, B: 0x3f, A: 0xff}, color.RGBAModel.Convert(img.At(20, 25)))
+	assert.Equal(s.T(), color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}, color.RGBAModel.Convert(img.At(5, 5)))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithAutoContrast() {
+	encode := func(img image.Image) []byte {
+		buff := &bytes.Buffer{}
+		assert.Nil(s.T(), png.Encode(buff, img))
+		return buff.Bytes()
+	}
+	logo := encode(newUniformImage(image.Rect(0, 0, 20, 20), color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}))
+	red := color.RGBA{R: 0xff, A: 0xff}
+	cases := []struct {
+		base     color.Gray
+		expected color.Color
+	}{
+		{base: color.Gray{Y: 0xf0}, expected: color.RGBA{A: 0xff}},
+		{base: color.Gray{Y: 0x20}, expected: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		// A medium brightness falls back to the color
+		{base: color.Gray{Y: 0x80}, expected: red},
+	}
+	for _, c := range cases {
+		img := newUniformImage(image.Rect(0, 0, 40, 40), c.base)
+		// A transparent pixel keeps the output a lossless PNG
+		img.Set(0, 0, color.Transparent)
+		output, err := s.processor.WatermarkWithOptions(encode(img), logo, 255, processor.WatermarkOptions{AutoContrast: true, Color: red})
+		assert.Nil(s.T(), err)
+		decoded, _, err := s.processor.Decode(output)
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), c.expected, color.RGBAModel.Convert(decoded.At(20, 20)), c.base)
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithShadow() {
+	encode := func(img image.Image) []byte {
+		buff := &bytes.Buffer{}
+		assert.Nil(s.T(), png.Encode(buff, img))
+		return buff.Bytes()
+	}
+	logo := encode(newUniformImage(image.Rect(0, 0, 20, 20), color.White))
+	base := newUniformImage(image.Rect(0, 0, 40, 40), color.White)
+	// A transparent pixel keeps the output a lossless PNG
+	base.Set(0, 0, color.Transparent)
+	at := func(shadow processor.WatermarkShadow, x, y int) color.RGBA {
+		output, err := s.processor.WatermarkWithOptions(encode(base), logo, 255, processor.WatermarkOptions{Shadow: &shadow})
+		assert.Nil(s.T(), err)
+		decoded, _, err := s.processor.Decode(output)
+		assert.Nil(s.T(), err)
+		return color.RGBAModel.Convert(decoded.At(x, y)).(color.RGBA)
+	}
+
+	// The overlay covers 10-30 and is drawn over its shadow
+	hard := processor.WatermarkShadow{Offset: image.Pt(4, 4), Opacity: 0xff}
+	assert.Equal(s.T(), color.RGBA{A: 0xff}, at(hard, 32, 32))
+	assert.Equal(s.T(), color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, at(hard, 29, 29))
+	assert.Equal(s.T(), color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, at(hard, 35, 35))
+	red := processor.WatermarkShadow{Offset: image.Pt(4, 4), Opacity: 0x80, Color: color.RGBA{R: 0xff, A: 0xff}}
+	assert.Equal(s.T(), color.RGBA{R: 0xff, G: 0x7f, B: 0x7f, A: 0xff}, at(red, 32, 32))
+
+	// The blur fades the shadow out beyond its edge
+	soft := processor.WatermarkShadow{Offset: image.Pt(4, 4), Blur: 2, Opacity: 0xff}
+	edge, outside := at(soft, 34, 20), at(soft, 37, 20)
+	assert.Less(s.T(), edge.R, uint8(0xe0))
+	assert.Greater(s.T(), edge.R, uint8(0x20))
+	assert.Greater(s.T(), outside.R, edge.R)
+
+	shadow, origin := getWatermarkShadow(newUniformImage(image.Rect(2, 2, 6, 6), color.White), soft)
+	assert.Equal(s.T(), image.Rect(0, 0, 16, 16), shadow.Bounds())
+	assert.Equal(s.T(), image.Pt(0, 0), origin)
+}
+
+func Test_getContrastColor(t *testing.T) {
+	base := newUniformImage(image.Rect(0, 0, 10, 10), color.White)
+	draw.Draw(base, image.Rect(0, 0, 5, 10), image.Black, image.ZP, draw.Src)
+	overlay := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(overlay, image.Rect(0, 0, 4, 2), image.White, image.ZP, draw.Src)
+
+	c, ok := getContrastColor(base, overlay, image.Pt(6, 0))
+	assert.True(t, ok)
+	assert.Equal(t, color.Black, c)
+	c, ok = getContrastColor(base, overlay, image.Pt(0, 0))
+	assert.True(t, ok)
+	assert.Equal(t, color.White, c)
+	// Half of the visible overlay is on black and half on white
+	_, ok = getContrastColor(base, overlay, image.Pt(3, 0))
+	assert.False(t, ok)
+	_, ok = getContrastColor(base, image.NewNRGBA(image.Rect(0, 0, 4, 4)), image.Pt(0, 0))
+	assert.False(t, ok)
+}
+
 func (s *BildProcessorSuite) TestBildProcessor_Watermark() {
 	output, err := s.processor.Watermark(s.badData, s.watermarkData, 255)
 	assert.NotNil(s.T(), err)
@@ -236,6 +933,47 @@ func (s *BildProcessorSuite) TestBildProcessor_Watermark() {
 	assert.Equal(s.T(), expectedRes, output)
 }
 
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkBlendsSemiTransparentOverlay() {
+	// Quality 100 disables the PNG to JPEG downgrade so that the output pixels can be compared exactly
+	bp := NewBildProcessor(WithEncoders(NewEncoders(WithJpegEncoder(&JpegEncoder{Option: &jpeg.Options{Quality: 100}}))))
+	red := color.RGBA{R: 0xff, A: 0xff}
+
+	overlay := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(overlay, overlay.Bounds(), image.NewUniform(color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0x80}), image.ZP, draw.Src)
+	overlayData := &bytes.Buffer{}
+	_ = png.Encode(overlayData, overlay)
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(nrgba, nrgba.Bounds(), image.NewUniform(red), image.ZP, draw.Src)
+	paletted := image.NewPaletted(image.Rect(0, 0, 100, 100), color.Palette{red, color.Black})
+	rgba := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(rgba, rgba.Bounds(), image.NewUniform(red), image.ZP, draw.Src)
+
+	for _, base := range []image.Image{nrgba, paletted, rgba} {
+		baseData := &bytes.Buffer{}
+		_ = png.Encode(baseData, base)
+
+		output, err := bp.Watermark(baseData.Bytes(), overlayData.Bytes(), 0xff)
+		assert.Nil(s.T(), err)
+		out, _, err := bp.Decode(output)
+		assert.Nil(s.T(), err)
+
+		assert.Equal(s.T(), red, color.RGBAModel.Convert(out.At(5, 5)))
+		center := color.RGBAModel.Convert(out.At(50, 50)).(color.RGBA)
+		assert.InDelta(s.T(), 0x80, int(center.G), 1)
+		// Red and white both have a full red channel, so any correct blend (including the
+		// anti-aliased overlay edges) keeps it, a darker red channel is a premultiplication fringe
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 100; x++ {
+				c := color.RGBAModel.Convert(out.At(x, y)).(color.RGBA)
+				assert.GreaterOrEqual(s.T(), int(c.R), 0xfe)
+				assert.Equal(s.T(), c.G, c.B)
+				assert.Equal(s.T(), uint8(0xff), c.A)
+			}
+		}
+	}
+}
+
 func (s *BildProcessorSuite) TestBildProcessor_FixOrientation() {
 	var testFiles = []string{
 		"./_testdata/exif_orientation/f2t.jpg",
@@ -278,6 +1016,186 @@ func (s *BildProcessorSuite) TestBildProcessor_Decode_GivenWebPImageShouldBeAble
 	assert.Equal(s.T(), "webp", ext)
 }
 
+func (s *BildProcessorSuite) TestBildProcessor_DecodeAgreesWithDetectContentType() {
+	cases := map[string]string{
+		"_testdata/test.jpg":  processor.ExtensionJPEG,
+		"_testdata/test.png":  processor.ExtensionPNG,
+		"_testdata/test.webp": processor.ExtensionWebP,
+	}
+	for file, ext := range cases {
+		data, _ := ioutil.ReadFile(file)
+		_, f, err := s.processor.Decode(data)
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), ext, f)
+		assert.Equal(s.T(), "image/"+f, processor.DetectContentType(data))
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithOversize() {
+	// The overlay is resized to half the width of the base, which makes a square overlay taller than a wide base
+	base, _ := s.processor.Encode(newUniformImage(image.Rect(0, 0, 100, 20), color.White), processor.ExtensionPNG)
+	logo := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.Black), image.ZP, draw.Src)
+	draw.Draw(logo, image.Rect(0, 0, 40, 10), image.NewUniform(color.White), image.ZP, draw.Src)
+	overlay, _ := s.processor.Encode(logo, processor.ExtensionPNG)
+	luma := func(img image.Image, x, y int) int {
+		return int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+	}
+
+	// By default the overlay is scaled down to 20x20 in the center of the base
+	output, err := s.processor.WatermarkWithOptions(base, overlay, 255, processor.WatermarkOptions{})
+	assert.Nil(s.T(), err)
+	img, _, _ := s.processor.Decode(output)
+	assert.Equal(s.T(), image.Rect(0, 0, 100, 20), img.Bounds())
+	assert.InDelta(s.T(), 0, luma(img, 50, 15), 16)
+	assert.InDelta(s.T(), 255, luma(img, 50, 1), 16)
+	assert.InDelta(s.T(), 255, luma(img, 35, 15), 16)
+
+	// Cropping keeps the 50 pixels of width and the middle 20 rows, which are black
+	output, err = s.processor.WatermarkWithOptions(base, overlay, 255, processor.WatermarkOptions{Oversize: processor.OversizeCrop})
+	assert.Nil(s.T(), err)
+	img, _, _ = s.processor.Decode(output)
+	assert.InDelta(s.T(), 0, luma(img, 50, 1), 16)
+	assert.InDelta(s.T(), 0, luma(img, 30, 15), 16)
+	assert.InDelta(s.T(), 255, luma(img, 20, 15), 16)
+
+	output, err = s.processor.WatermarkWithOptions(base, overlay, 255, processor.WatermarkOptions{Oversize: processor.OversizeError})
+	assert.Equal(s.T(), errOverlayOversize, err)
+	assert.Nil(s.T(), output)
+
+	// Overlays that fit are not affected
+	fits, err := s.processor.WatermarkWithOptions(s.srcPNGData, s.watermarkData, 255, processor.WatermarkOptions{Oversize: processor.OversizeError})
+	assert.Nil(s.T(), err)
+	expected, _ := s.processor.Watermark(s.srcPNGData, s.watermarkData, 255)
+	assert.Equal(s.T(), expected, fits)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithAnchorAndMargin() {
+	logo := newUniformImage(image.Rect(0, 0, 10, 10), color.Black)
+	luma := func(img image.Image, x, y int) int {
+		return int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+	}
+
+	// The overlay keeps its width and its distance to the bottom-right corner on any size of the base
+	opts := processor.WatermarkOptions{Anchor: processor.PointBottomRight, Margin: 16, Width: 20}
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 100, 80), image.Rect(0, 0, 400, 300)} {
+		img, err := s.processor.WatermarkImage(newUniformImage(r, color.White), logo, 255, opts)
+		assert.Nil(s.T(), err)
+		w, h := r.Dx(), r.Dy()
+		assert.Equal(s.T(), 0, luma(img, w-17, h-17), r)
+		assert.Equal(s.T(), 0, luma(img, w-36, h-36), r)
+		assert.Equal(s.T(), 255, luma(img, w-15, h-17), r)
+		assert.Equal(s.T(), 255, luma(img, w-17, h-15), r)
+		assert.Equal(s.T(), 255, luma(img, w-37, h-20), r)
+	}
+
+	// MaxWidth limits the half of the base width on large bases only
+	opts = processor.WatermarkOptions{Anchor: processor.PointTopLeft, Margin: 8, MaxWidth: 30}
+	img, _ := s.processor.WatermarkImage(newUniformImage(image.Rect(0, 0, 400, 300), color.White), logo, 255, opts)
+	assert.Equal(s.T(), 0, luma(img, 37, 37))
+	assert.Equal(s.T(), 255, luma(img, 38, 20))
+	img, _ = s.processor.WatermarkImage(newUniformImage(image.Rect(0, 0, 40, 40), color.White), logo, 255, opts)
+	assert.Equal(s.T(), 0, luma(img, 27, 27))
+	assert.Equal(s.T(), 255, luma(img, 28, 20))
+	assert.Equal(s.T(), 255, luma(img, 7, 20))
+
+	// An overlay larger than the area inside the margins is fitted into it
+	opts = processor.WatermarkOptions{Anchor: processor.PointBottomRight, Margin: 16, Width: 40}
+	img, _ = s.processor.WatermarkImage(newUniformImage(image.Rect(0, 0, 50, 50), color.White), logo, 255, opts)
+	assert.Equal(s.T(), 0, luma(img, 16, 16))
+	assert.Equal(s.T(), 0, luma(img, 33, 33))
+	assert.Equal(s.T(), 255, luma(img, 15, 25))
+	assert.Equal(s.T(), 255, luma(img, 34, 25))
+}
+
+func Test_getOverlayOffset(t *testing.T) {
+	overlay := image.NewRGBA(image.Rect(0, 0, 30, 10))
+	for _, tc := range []struct {
+		oa       processor.OverlayAttrs
+		expected image.Point
+	}{
+		{processor.OverlayAttrs{Point: processor.PointBottomRight}, image.Pt(70, 90)},
+		{processor.OverlayAttrs{Point: processor.PointBottomRight, Margin: 16}, image.Pt(54, 74)},
+		{processor.OverlayAttrs{Point: processor.PointTopLeft, Margin: 16}, image.Pt(16, 16)},
+		{processor.OverlayAttrs{Point: processor.PointCenter, Margin: 16}, image.Pt(35, 45)},
+		{processor.OverlayAttrs{Point: processor.PointRight, Margin: 50}, image.Pt(20, 45)},
+		{processor.OverlayAttrs{Point: processor.PointBottomRight, Margin: 16,
+			Position: &processor.FocalPoint{X: 0, Y: 0}}, image.Pt(0, 0)},
+	} {
+		assert.Equal(t, tc.expected, getOverlayOffset(100, 100, overlay, &tc.oa), tc.oa)
+	}
+
+	// An overlay wider than the area inside the margins stays within the base
+	wide := image.NewRGBA(image.Rect(0, 0, 90, 10))
+	oa := processor.OverlayAttrs{Point: processor.PointBottomRight, Margin: 16}
+	assert.Equal(t, image.Pt(0, 74), getOverlayOffset(100, 100, wide, &oa))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithLargeOverlay() {
+	overlay, _, _ := s.processor.Decode(s.watermarkData)
+	area := overlay.Bounds().Dx() * overlay.Bounds().Dy()
+
+	bp := NewBildProcessor(WithMaxOverlayPixels(area - 1))
+	output, err := bp.Watermark(s.srcPNGData, s.watermarkData, 255)
+	assert.Equal(s.T(), errOverlayTooLarge, err)
+	assert.Nil(s.T(), output)
+
+	// Overlay skips the overlays that are too large
+	output, err = bp.Overlay(s.srcPNGData, []*processor.OverlayAttrs{{Img: s.watermarkData, WidthPercentage: 50}})
+	assert.Nil(s.T(), err)
+	expected, _ := bp.Overlay(s.srcPNGData, []*processor.OverlayAttrs{{Img: s.badData, WidthPercentage: 50}})
+	assert.Equal(s.T(), expected, output)
+
+	for _, bp := range []*BildProcessor{NewBildProcessor(WithMaxOverlayPixels(area)), NewBildProcessor(WithMaxOverlayPixels(0))} {
+		output, err = bp.Watermark(s.srcPNGData, s.watermarkData, 255)
+		assert.Nil(s.T(), err)
+		assert.NotNil(s.T(), output)
+	}
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_WatermarkWithOverlayDecodeTimeout() {
+	img := image.NewNRGBA(image.Rect(0, 0, 2000, 2000))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7919)
+	}
+	buff := &bytes.Buffer{}
+	_ = png.Encode(buff, img)
+
+	bp := NewBildProcessor(WithOverlayDecodeTimeout(time.Nanosecond))
+	output, err := bp.Watermark(s.srcPNGData, buff.Bytes(), 255)
+	assert.Equal(s.T(), errOverlayTimeout, err)
+	assert.Nil(s.T(), output)
+
+	output, err = NewBildProcessor(WithOverlayDecodeTimeout(time.Minute)).Watermark(s.srcPNGData, s.watermarkData, 255)
+	assert.Nil(s.T(), err)
+	expected, _ := s.processor.Watermark(s.srcPNGData, s.watermarkData, 255)
+	assert.Equal(s.T(), expected, output)
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_DecodeWithTimeout() {
+	img := image.NewNRGBA(image.Rect(0, 0, 2000, 2000))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7919)
+	}
+	buff := &bytes.Buffer{}
+	_ = png.Encode(buff, img)
+
+	bp := NewBildProcessor(WithDecodeTimeout(time.Nanosecond))
+	output, f, err := bp.Decode(buff.Bytes())
+	assert.Equal(s.T(), ErrDecodeTimeout, err)
+	assert.Nil(s.T(), output)
+	assert.Empty(s.T(), f)
+	anim, err := bp.DecodeAnimation(buff.Bytes())
+	assert.Equal(s.T(), ErrDecodeTimeout, err)
+	assert.Nil(s.T(), anim)
+
+	output, f, err = NewBildProcessor(WithDecodeTimeout(time.Minute)).Decode(s.srcPNGData)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "png", f)
+	expected, _, _ := s.processor.Decode(s.srcPNGData)
+	assert.Equal(s.T(), expected, output)
+}
+
 func (s *BildProcessorSuite) TestBildProcessor_Overlay() {
 	baseImg, _ := ioutil.ReadFile("./_testdata/test.jpg")
 	overlay, _ := ioutil.ReadFile("./_testdata/overlay.png")
@@ -417,3 +1335,70 @@ func (s *BildProcessorSuite) TestBildProcessor_Overlay() {
 		assert.Nil(s.T(), err)
 	}
 }
+
+func (s *BildProcessorSuite) TestBildProcessor_ColorWash() {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.Set(0, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 200, A: 128})
+	img.Set(2, 0, color.Transparent)
+
+	out := s.processor.ColorWash(img, color.RGBA{A: 255}, 128)
+
+	assert.Equal(s.T(), color.RGBA{R: 127, G: 127, B: 127, A: 255}, out.At(0, 0))
+	// The alpha is kept and the wash only covers the visible part of the pixel
+	assert.Equal(s.T(), uint8(128), color.NRGBAModel.Convert(out.At(1, 0)).(color.NRGBA).A)
+	assert.InDelta(s.T(), 100, int(color.NRGBAModel.Convert(out.At(1, 0)).(color.NRGBA).R), 1)
+	assert.Equal(s.T(), color.RGBA{}, out.At(2, 0))
+
+	assert.Equal(s.T(), color.RGBA{R: 255, G: 255, B: 255, A: 255}, s.processor.ColorWash(img, color.Black, 0).At(0, 0))
+}
+
+func (s *BildProcessorSuite) TestBildProcessor_Splash() {
+	img := image.NewNRGBA(image.Rect(0, 0, 6, 1))
+	img.Set(0, 0, color.NRGBA{R: 200, G: 20, B: 20, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 200, G: 20, B: 40, A: 255})
+	img.Set(2, 0, color.NRGBA{R: 20, G: 200, B: 20, A: 255})
+	img.Set(3, 0, color.NRGBA{R: 120, G: 110, B: 110, A: 255})
+	img.Set(4, 0, color.NRGBA{R: 200, G: 20, B: 20, A: 128})
+	img.Set(5, 0, color.NRGBA{R: 200, G: 100, B: 20, A: 255})
+
+	out := s.processor.Splash(img, color.RGBA{R: 255, A: 255}, 20)
+
+	// Reds within the tolerance keep their color, transparency included
+	assert.Equal(s.T(), color.RGBA{R: 200, G: 20, B: 20, A: 255}, out.At(0, 0))
+	assert.Equal(s.T(), color.RGBA{R: 200, G: 20, B: 40, A: 255}, out.At(1, 0))
+	assert.Equal(s.T(), uint8(128), color.NRGBAModel.Convert(out.At(4, 0)).(color.NRGBA).A)
+	assert.InDelta(s.T(), 200, int(color.NRGBAModel.Convert(out.At(4, 0)).(color.NRGBA).R), 1)
+	assert.InDelta(s.T(), 20, int(color.NRGBAModel.Convert(out.At(4, 0)).(color.NRGBA).G), 1)
+	// Other hues and grays with a hint of red are grayscaled
+	assert.Equal(s.T(), color.RGBA{R: 126, G: 126, B: 126, A: 255}, out.At(2, 0))
+	assert.Equal(s.T(), color.RGBA{R: 113, G: 113, B: 113, A: 255}, out.At(3, 0))
+	// An orange at 33 degrees of hue is within twice the tolerance and partly desaturated
+	c := out.At(5, 0).(color.RGBA)
+	assert.Greater(s.T(), int(c.R-c.B), 0)
+	assert.Less(s.T(), int(c.R-c.B), 180)
+
+	// A gray has no hue to keep
+	out = s.processor.Splash(img, color.Gray{Y: 128}, 255)
+	assert.Equal(s.T(), color.RGBA{R: 74, G: 74, B: 74, A: 255}, out.At(0, 0))
+}
+
+func TestComputeCropRect(t *testing.T) {
+	cases := []struct {
+		width, height, srcW, srcH int
+		point                     processor.Point
+		expected                  image.Rectangle
+	}{
+		// Resized to 400x200 and cropped from x=100
+		{width: 200, height: 200, srcW: 1000, srcH: 500, point: processor.PointCenter, expected: image.Rect(250, 0, 750, 500)},
+		{width: 200, height: 200, srcW: 1000, srcH: 500, point: processor.PointTopLeft, expected: image.Rect(0, 0, 500, 500)},
+		{width: 100, height: 100, srcW: 500, srcH: 1000, point: processor.PointBottom, expected: image.Rect(0, 500, 500, 1000)},
+		// Enlarged to 800x400 and cropped from x=200
+		{width: 400, height: 400, srcW: 100, srcH: 50, point: processor.PointCenter, expected: image.Rect(25, 0, 75, 50)},
+		{width: 300, height: 0, srcW: 1000, srcH: 500, point: processor.PointCenter, expected: image.Rect(0, 0, 1000, 500)},
+		{width: 300, height: 300, srcW: 0, srcH: 500, point: processor.PointCenter, expected: image.Rectangle{}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, ComputeCropRect(c.width, c.height, c.point, c.srcW, c.srcH), c)
+	}
+}
@@ -0,0 +1,177 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	// quantizeShift drops the low bits of each channel when counting the colors of an image, colors that only
+	// differ in these bits share a bucket of the histogram
+	quantizeShift = 3
+	// quantizeSamples is about the largest number of pixels counted for the palette, larger images are sampled
+	// on a regular grid
+	quantizeSamples = 1 << 20
+)
+
+// colorBucket holds the number of pixels of a histogram bucket and the sums of their straight channels
+type colorBucket struct {
+	key   uint32
+	count int
+	sum   [4]int
+}
+
+// mean returns the average of the channel ch (0 to 3 for red, green, blue and alpha) of the bucket
+func (b *colorBucket) mean(ch int) int {
+	return b.sum[ch] / b.count
+}
+
+// Quantize takes an input image, a number of colors (2 to 256) and QuantizeOptions and returns a paletted image
+// of at most that many colors. The palette is chosen by median cut over a histogram of the image and the pixels
+// are visited in the same order every time, so the same image always gives the same output.
+func (bp *BildProcessor) Quantize(img image.Image, colors int, opts processor.QuantizeOptions) image.Image {
+	if colors < 2 {
+		colors = 2
+	} else if colors > 256 {
+		colors = 256
+	}
+	out := image.NewPaletted(img.Bounds(), getPalette(img, colors))
+	var drawer draw.Drawer = draw.Src
+	if opts.Dither == processor.DitherFloydSteinberg {
+		drawer = draw.FloydSteinberg
+	}
+	drawer.Draw(out, out.Rect, img, img.Bounds().Min)
+	return out
+}
+
+// getPalette returns at most colors colors representing img, the histogram buckets are split along their widest
+// channel at the median pixel until there are as many boxes as colors, each box adds its average to the palette
+func getPalette(img image.Image, colors int) color.Palette {
+	buckets := getColorBuckets(img)
+	boxes := [][]colorBucket{buckets}
+	for len(boxes) < colors {
+		i, ch, widest := -1, 0, 0
+		for j, box := range boxes {
+			if c, r := getWidestChannel(box); r > widest {
+				i, ch, widest = j, c, r
+			}
+		}
+		if i < 0 {
+			// Every box holds a single color
+			break
+		}
+		box := boxes[i]
+		// The buckets start out sorted by key, a stable sort keeps ties deterministic
+		sort.SliceStable(box, func(a, b int) bool { return box[a].mean(ch) < box[b].mean(ch) })
+		split := getMedianIndex(box)
+		boxes[i] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var sum [4]int
+		n := 0
+		for _, b := range box {
+			for ch := range sum {
+				sum[ch] += b.sum[ch]
+			}
+			n += b.count
+		}
+		if n == 0 {
+			continue
+		}
+		palette = append(palette, color.NRGBA{R: uint8(sum[0] / n), G: uint8(sum[1] / n), B: uint8(sum[2] / n), A: uint8(sum[3] / n)})
+	}
+	if len(palette) == 0 {
+		palette = append(palette, color.NRGBA{})
+	}
+	return palette
+}
+
+// getColorBuckets returns the histogram of the straight colors of img sorted by bucket key, fully transparent
+// pixels share a single bucket whatever their color
+func getColorBuckets(img image.Image) []colorBucket {
+	r := img.Bounds()
+	step := 1
+	if area := float64(r.Dx()) * float64(r.Dy()); area > quantizeSamples {
+		step = int(math.Ceil(math.Sqrt(area / quantizeSamples)))
+	}
+	hist := make(map[uint32]*colorBucket)
+	for y := r.Min.Y; y < r.Max.Y; y += step {
+		for x := r.Min.X; x < r.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			key := uint32(c.R>>quantizeShift)<<24 | uint32(c.G>>quantizeShift)<<16 |
+				uint32(c.B>>quantizeShift)<<8 | uint32(c.A>>quantizeShift)
+			b, ok := hist[key]
+			if !ok {
+				b = &colorBucket{key: key}
+				hist[key] = b
+			}
+			b.count++
+			b.sum[0] += int(c.R)
+			b.sum[1] += int(c.G)
+			b.sum[2] += int(c.B)
+			b.sum[3] += int(c.A)
+		}
+	}
+	buckets := make([]colorBucket, 0, len(hist))
+	for _, b := range hist {
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].key < buckets[j].key })
+	return buckets
+}
+
+// getWidestChannel returns the channel with the largest range of bucket means in box and that range, 0 for a
+// box that can't be split
+func getWidestChannel(box []colorBucket) (int, int) {
+	if len(box) < 2 {
+		return 0, 0
+	}
+	widest, width := 0, 0
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := math.MaxInt32, 0
+		for i := range box {
+			m := box[i].mean(ch)
+			if m < lo {
+				lo = m
+			}
+			if m > hi {
+				hi = m
+			}
+		}
+		if hi-lo > width {
+			widest, width = ch, hi-lo
+		}
+	}
+	return widest, width
+}
+
+// getMedianIndex returns the index splitting the sorted box into two halves of about the same number of pixels,
+// both halves hold at least one bucket
+func getMedianIndex(box []colorBucket) int {
+	total := 0
+	for _, b := range box {
+		total += b.count
+	}
+	n := 0
+	for i, b := range box {
+		n += b.count
+		if n*2 >= total {
+			if i+1 >= len(box) {
+				return len(box) - 1
+			}
+			return i + 1
+		}
+	}
+	return len(box) - 1
+}
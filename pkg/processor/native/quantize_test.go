@@ -0,0 +1,60 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGradient(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 0x60, A: 0xff})
+		}
+	}
+	return img
+}
+
+func TestBildProcessor_Quantize(t *testing.T) {
+	bp := NewBildProcessor()
+	img := newGradient(64, 32)
+	// The transparent pixels get a palette color of their own
+	for x := 0; x < 8; x++ {
+		img.Set(x, 0, color.NRGBA{R: 0xff, A: 0})
+	}
+
+	for _, d := range []processor.Dither{processor.DitherNone, processor.DitherFloydSteinberg} {
+		out := bp.Quantize(img, 16, processor.QuantizeOptions{Dither: d})
+		p, ok := out.(*image.Paletted)
+		assert.True(t, ok)
+		assert.Equal(t, img.Bounds(), p.Bounds())
+		assert.LessOrEqual(t, len(p.Palette), 16)
+		assert.Equal(t, color.RGBA{}, color.RGBAModel.Convert(p.At(0, 0)))
+		// The same image always gives the same output
+		assert.Equal(t, p, bp.Quantize(img, 16, processor.QuantizeOptions{Dither: d}))
+	}
+
+	plain := bp.Quantize(img, 16, processor.QuantizeOptions{}).(*image.Paletted)
+	dithered := bp.Quantize(img, 16, processor.QuantizeOptions{Dither: processor.DitherFloydSteinberg}).(*image.Paletted)
+	assert.Equal(t, plain.Palette, dithered.Palette)
+	assert.NotEqual(t, plain.Pix, dithered.Pix)
+
+	// An image with fewer colors keeps them exactly
+	two := newUniformImage(image.Rect(0, 0, 4, 4), color.White)
+	two.Set(0, 0, color.Black)
+	out := bp.Quantize(two, 256, processor.QuantizeOptions{}).(*image.Paletted)
+	assert.Len(t, out.Palette, 2)
+	assert.Equal(t, color.RGBA{A: 0xff}, color.RGBAModel.Convert(out.At(0, 0)))
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, color.RGBAModel.Convert(out.At(3, 3)))
+	assert.Len(t, bp.Quantize(img, 1, processor.QuantizeOptions{}).(*image.Paletted).Palette, 2)
+}
+
+func Test_getMedianIndex(t *testing.T) {
+	assert.Equal(t, 1, getMedianIndex([]colorBucket{{count: 10}, {count: 1}}))
+	assert.Equal(t, 2, getMedianIndex([]colorBucket{{count: 1}, {count: 1}, {count: 1}, {count: 1}}))
+	assert.Equal(t, 2, getMedianIndex([]colorBucket{{count: 1}, {count: 1}, {count: 10}}))
+}
@@ -0,0 +1,137 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	// smartCropSamples is the number of pixels sampled along the longer side of an image for its entropy
+	smartCropSamples = 256
+	// smartCropSteps is the number of positions of the crop window compared along the overflowing dimension
+	smartCropSteps = 32
+	// smartCropBins is the number of luma bins of the histogram the entropy of a crop window is computed from
+	smartCropBins = 64
+)
+
+// SmartCrop takes an input image, width, height and SmartCropOptions and returns the image cropped to width x height
+// with the crop window picked from its content. With opts.Faces the window is centered on the faces grown by
+// opts.FacePadding and zoomed in on them as long as the window stays larger than the output, so small faces are not
+// upscaled. Without faces the window covers the image like Crop and is placed where the luma entropy is highest.
+func (bp *BildProcessor) SmartCrop(img image.Image, width, height int, opts processor.SmartCropOptions) image.Image {
+	b := img.Bounds()
+	if width == 0 || height == 0 || b.Empty() {
+		return bp.FocalCrop(img, width, height, processor.FocalPoint{X: 0.5, Y: 0.5})
+	}
+	rect, ok := getFaceWindow(b, width, height, opts)
+	if !ok {
+		rect = getEntropyWindow(img, width, height)
+	}
+	window := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(window, window.Bounds(), img, rect.Min, draw.Src)
+	return bp.resize(window, width, height)
+}
+
+// getCoverWindow returns the size of the largest window with the aspect ratio of width x height inside a w x h image
+func getCoverWindow(w, h, width, height int) (int, int) {
+	if w*height > h*width {
+		return int(math.Max(1, float64(h*width)/float64(height))), h
+	}
+	return w, int(math.Max(1, float64(w*height)/float64(width)))
+}
+
+// getFaceWindow returns the crop window of the faces of opts within b, the returned bool is false if none of the
+// faces is inside b
+func getFaceWindow(b image.Rectangle, width, height int, opts processor.SmartCropOptions) (image.Rectangle, bool) {
+	var faces image.Rectangle
+	for _, f := range opts.Faces {
+		faces = faces.Union(f.Intersect(b))
+	}
+	if faces.Empty() {
+		return image.Rectangle{}, false
+	}
+	px := int(float64(faces.Dx()) * math.Max(0, opts.FacePadding))
+	py := int(float64(faces.Dy()) * math.Max(0, opts.FacePadding))
+	faces = image.Rect(faces.Min.X-px, faces.Min.Y-py, faces.Max.X+px, faces.Max.Y+py).Intersect(b)
+
+	cw, ch := getCoverWindow(b.Dx(), b.Dy(), width, height)
+	// The smallest window of the aspect ratio containing the faces, but never smaller than the output
+	ww := int(math.Max(float64(faces.Dx()), math.Ceil(float64(faces.Dy()*width)/float64(height))))
+	if ww < width {
+		ww = width
+	}
+	wh := int(math.Round(float64(ww*height) / float64(width)))
+	if ww > cw || wh > ch {
+		ww, wh = cw, ch
+	}
+	cx, cy := (faces.Min.X+faces.Max.X)/2, (faces.Min.Y+faces.Max.Y)/2
+	x := clamp(cx-ww/2, b.Min.X, b.Max.X-ww)
+	y := clamp(cy-wh/2, b.Min.Y, b.Max.Y-wh)
+	return image.Rect(x, y, x+ww, y+wh), true
+}
+
+// getEntropyWindow returns the window of img covering width x height with the highest entropy of the luma of its
+// pixels, which are sampled on an evenly spaced grid. Windows of the same entropy, e.g. on a flat image, are
+// resolved in favor of the one closest to the center.
+func getEntropyWindow(img image.Image, width, height int) image.Rectangle {
+	b := img.Bounds()
+	cw, ch := getCoverWindow(b.Dx(), b.Dy(), width, height)
+	step := int(math.Ceil(math.Max(float64(b.Dx()), float64(b.Dy())) / smartCropSamples))
+	gw, gh := (b.Dx()+step-1)/step, (b.Dy()+step-1)/step
+	grid := make([]uint8, gw*gh)
+	for gy := 0; gy < gh; gy++ {
+		for gx := 0; gx < gw; gx++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+gx*step, b.Min.Y+gy*step)).(color.NRGBA)
+			grid[gy*gw+gx] = uint8(getLuma(c.R, c.G, c.B) + 0.5)
+		}
+	}
+
+	overflowX, overflowY := b.Dx()-cw, b.Dy()-ch
+	overflow := overflowX
+	if overflowY > overflow {
+		overflow = overflowY
+	}
+	best, bestEntropy, bestDist := 0, -1.0, math.MaxFloat64
+	for i := 0; i <= smartCropSteps; i++ {
+		offset := overflow * i / smartCropSteps
+		x, y := 0, 0
+		if overflowX > 0 {
+			x = offset
+		} else {
+			y = offset
+		}
+		r := image.Rect(x/step, y/step, (x+cw+step-1)/step, (y+ch+step-1)/step).Intersect(image.Rect(0, 0, gw, gh))
+		e := getGridEntropy(grid, gw, r)
+		dist := math.Abs(float64(offset) - float64(overflow)/2)
+		if e > bestEntropy+1e-9 || (e > bestEntropy-1e-9 && dist < bestDist) {
+			best, bestEntropy, bestDist = offset, e, dist
+		}
+	}
+	if overflowX > 0 {
+		return image.Rect(b.Min.X+best, b.Min.Y, b.Min.X+best+cw, b.Min.Y+ch)
+	}
+	return image.Rect(b.Min.X, b.Min.Y+best, b.Min.X+cw, b.Min.Y+best+ch)
+}
+
+// getGridEntropy returns the Shannon entropy in bits of the binned luma values of the rectangle r of the grid
+func getGridEntropy(grid []uint8, stride int, r image.Rectangle) float64 {
+	var bins [smartCropBins]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			bins[int(grid[y*stride+x])*smartCropBins/256]++
+		}
+	}
+	total := float64(r.Dx() * r.Dy())
+	var e float64
+	for _, n := range bins {
+		if n > 0 {
+			p := float64(n) / total
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
@@ -0,0 +1,91 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	smartCropRed   = color.RGBA{R: 255, A: 255}
+	smartCropWhite = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+)
+
+func newFaceImage() *image.RGBA {
+	img := newUniformImage(image.Rect(0, 0, 400, 200), smartCropWhite)
+	draw.Draw(img, image.Rect(40, 40, 80, 80), image.NewUniform(smartCropRed), image.ZP, draw.Src)
+	return img
+}
+
+func TestBildProcessor_SmartCropWithFaces(t *testing.T) {
+	faces := []image.Rectangle{image.Rect(40, 40, 80, 80)}
+
+	out := NewBildProcessor().SmartCrop(newFaceImage(), 40, 40, processor.SmartCropOptions{Faces: faces})
+
+	assert.Equal(t, image.Pt(40, 40), out.Bounds().Size())
+	assert.Equal(t, smartCropRed, color.RGBAModel.Convert(out.At(out.Bounds().Min.X, out.Bounds().Min.Y)))
+	assert.Equal(t, smartCropRed, color.RGBAModel.Convert(out.At(out.Bounds().Max.X-1, out.Bounds().Max.Y-1)))
+}
+
+func TestBildProcessor_SmartCropWithFacePadding(t *testing.T) {
+	faces := []image.Rectangle{image.Rect(40, 40, 80, 80)}
+
+	out := NewBildProcessor().SmartCrop(newFaceImage(), 40, 40, processor.SmartCropOptions{Faces: faces, FacePadding: 0.5})
+
+	// The 80x80 window around the face is scaled down to 40x40, leaving a 10 pixel border around it
+	b := out.Bounds()
+	assert.Equal(t, smartCropWhite, color.RGBAModel.Convert(out.At(b.Min.X+2, b.Min.Y+2)))
+	assert.Equal(t, smartCropRed, color.RGBAModel.Convert(out.At(b.Min.X+20, b.Min.Y+20)))
+}
+
+func TestBildProcessor_SmartCropNeverUpscalesFaces(t *testing.T) {
+	faces := []image.Rectangle{image.Rect(40, 40, 80, 80)}
+
+	out := NewBildProcessor().SmartCrop(newFaceImage(), 100, 100, processor.SmartCropOptions{Faces: faces})
+
+	// The window is the 100x100 output, centered on the face as far as the image allows
+	b := out.Bounds()
+	assert.Equal(t, image.Pt(100, 100), b.Size())
+	assert.Equal(t, smartCropRed, color.RGBAModel.Convert(out.At(b.Min.X+60, b.Min.Y+60)))
+	assert.Equal(t, smartCropWhite, color.RGBAModel.Convert(out.At(b.Min.X+95, b.Min.Y+95)))
+}
+
+func TestBildProcessor_SmartCropWithoutFaces(t *testing.T) {
+	img := newUniformImage(image.Rect(0, 0, 400, 100), smartCropWhite)
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < 100; y++ {
+		for x := 300; x < 400; x++ {
+			v := uint8(r.Intn(256))
+			img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+
+	out := NewBildProcessor().SmartCrop(img, 100, 100, processor.SmartCropOptions{})
+
+	// The window is placed over the noisy right end of the image
+	b := out.Bounds()
+	assert.Equal(t, image.Pt(100, 100), b.Size())
+	var white int
+	for x := b.Min.X; x < b.Max.X; x++ {
+		if out.At(x, b.Min.Y) == color.Color(smartCropWhite) {
+			white++
+		}
+	}
+	assert.Less(t, white, 10)
+}
+
+func TestBildProcessor_SmartCropCentersFlatImages(t *testing.T) {
+	img := newUniformImage(image.Rect(0, 0, 400, 100), smartCropWhite)
+	assert.Equal(t, image.Rect(150, 0, 250, 100), getEntropyWindow(img, 50, 50))
+}
+
+func TestBildProcessor_SmartCropIgnoresFacesOutsideTheImage(t *testing.T) {
+	faces := []image.Rectangle{image.Rect(500, 500, 550, 550)}
+	_, ok := getFaceWindow(image.Rect(0, 0, 400, 200), 40, 40, processor.SmartCropOptions{Faces: faces})
+	assert.False(t, ok)
+}
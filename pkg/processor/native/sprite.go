@@ -0,0 +1,69 @@
+package native
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+// maxSpriteSheetPixels is the largest area of a sprite sheet, e.g. 100 frames of 700x700
+const maxSpriteSheetPixels = 50 * 1000 * 1000
+
+var (
+	errSpriteSheetNoFrames = errors.New("sprite sheet needs at least one frame")
+	errSpriteSheetColumns  = errors.New("sprite sheet needs at least one column")
+	errSpriteSheetTooLarge = errors.New("sprite sheet exceeds the maximum number of pixels")
+)
+
+// SpriteSheet takes the encoded frames of an image sequence and the number of columns and returns the frames
+// packed into a grid, left to right and top to bottom, encoded as PNG (downgraded to JPEG if opaque, like
+// Overlay) and its SpriteLayout. Every frame must have the same dimensions as the first one.
+func (bp *BildProcessor) SpriteSheet(frames [][]byte, cols int) ([]byte, processor.SpriteLayout, error) {
+	if len(frames) == 0 {
+		return nil, processor.SpriteLayout{}, errSpriteSheetNoFrames
+	}
+	if cols <= 0 {
+		return nil, processor.SpriteLayout{}, errSpriteSheetColumns
+	}
+	if cols > len(frames) {
+		cols = len(frames)
+	}
+
+	var sheet *image.RGBA
+	var layout processor.SpriteLayout
+	for i, data := range frames {
+		frame, _, err := bp.Decode(data)
+		if err != nil {
+			return nil, processor.SpriteLayout{}, fmt.Errorf("sprite sheet frame %d: %w", i, err)
+		}
+		size := frame.Bounds().Size()
+		if i == 0 {
+			layout = processor.SpriteLayout{
+				Columns:     cols,
+				Rows:        (len(frames) + cols - 1) / cols,
+				FrameWidth:  size.X,
+				FrameHeight: size.Y,
+			}
+			w, h := cols*size.X, layout.Rows*size.Y
+			if w*h > maxSpriteSheetPixels {
+				return nil, processor.SpriteLayout{}, errSpriteSheetTooLarge
+			}
+			sheet = image.NewRGBA(image.Rect(0, 0, w, h))
+		} else if size.X != layout.FrameWidth || size.Y != layout.FrameHeight {
+			return nil, processor.SpriteLayout{}, fmt.Errorf("sprite sheet frame %d is %dx%d, expected %dx%d",
+				i, size.X, size.Y, layout.FrameWidth, layout.FrameHeight)
+		}
+		r := image.Rect(0, 0, size.X, size.Y).Add(image.Pt(i%cols*size.X, i/cols*size.Y))
+		draw.Draw(sheet, r, frame, frame.Bounds().Min, draw.Src)
+		layout.Frames = append(layout.Frames, r)
+	}
+
+	data, err := bp.Encode(sheet, processor.ExtensionPNG)
+	if err != nil {
+		return nil, processor.SpriteLayout{}, err
+	}
+	return data, layout, nil
+}
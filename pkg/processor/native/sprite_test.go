@@ -0,0 +1,80 @@
+package native
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeUniformPNG(t *testing.T, w, h int, c color.Color) []byte {
+	buff := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buff, newUniformImage(image.Rect(0, 0, w, h), c)))
+	return buff.Bytes()
+}
+
+func TestBildProcessor_SpriteSheet(t *testing.T) {
+	bp := NewBildProcessor()
+	colors := []color.RGBA{
+		{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff},
+		{R: 0xff, G: 0xff, A: 0xff}, {R: 0x80, G: 0x80, B: 0x80, A: 0x80},
+	}
+	var frames [][]byte
+	for _, c := range colors {
+		frames = append(frames, encodeUniformPNG(t, 4, 3, c))
+	}
+
+	data, layout, err := bp.SpriteSheet(frames, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, layout.Columns)
+	assert.Equal(t, 3, layout.Rows)
+	assert.Equal(t, 4, layout.FrameWidth)
+	assert.Equal(t, 3, layout.FrameHeight)
+	assert.Equal(t, []image.Rectangle{
+		image.Rect(0, 0, 4, 3), image.Rect(4, 0, 8, 3),
+		image.Rect(0, 3, 4, 6), image.Rect(4, 3, 8, 6),
+		image.Rect(0, 6, 4, 9),
+	}, layout.Frames)
+
+	sheet, f, err := bp.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionPNG, f)
+	assert.Equal(t, image.Rect(0, 0, 8, 9), sheet.Bounds())
+	for i, r := range layout.Frames {
+		assert.Equal(t, colors[i], color.RGBAModel.Convert(sheet.At(r.Max.X-1, r.Max.Y-1)), i)
+	}
+	// The cell after the last frame stays transparent
+	assert.Equal(t, color.RGBA{}, color.RGBAModel.Convert(sheet.At(7, 8)))
+
+	// More columns than frames
+	_, layout, err = bp.SpriteSheet(frames[:2], 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, layout.Columns)
+	assert.Equal(t, 1, layout.Rows)
+}
+
+func TestBildProcessor_SpriteSheetWithInvalidFrames(t *testing.T) {
+	bp := NewBildProcessor()
+	frame := encodeUniformPNG(t, 4, 3, color.White)
+
+	_, _, err := bp.SpriteSheet(nil, 2)
+	assert.Equal(t, errSpriteSheetNoFrames, err)
+	_, _, err = bp.SpriteSheet([][]byte{frame}, 0)
+	assert.Equal(t, errSpriteSheetColumns, err)
+	_, _, err = bp.SpriteSheet([][]byte{frame, encodeUniformPNG(t, 3, 4, color.White)}, 2)
+	assert.EqualError(t, err, "sprite sheet frame 1 is 3x4, expected 4x3")
+	_, _, err = bp.SpriteSheet([][]byte{frame, []byte("badImage.ext")}, 2)
+	assert.Error(t, err)
+
+	// The size of the sheet is checked before the other frames are decoded
+	large := [][]byte{encodeUniformPNG(t, 1000, 1000, color.White)}
+	for len(large) <= maxSpriteSheetPixels/(1000*1000) {
+		large = append(large, []byte("badImage.ext"))
+	}
+	_, _, err = bp.SpriteSheet(large, 10)
+	assert.Equal(t, errSpriteSheetTooLarge, err)
+}
@@ -0,0 +1,91 @@
+package native
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+const (
+	// maxSVGSize is the largest SVG document in bytes that is parsed
+	maxSVGSize = 2 << 20
+	// maxSVGDimension is the largest width or height in pixels an SVG is rasterized at
+	maxSVGDimension = 8192
+)
+
+var (
+	errSVGTooLarge   = errors.New("svg document exceeds the maximum size")
+	errSVGEntity     = errors.New("svg documents with doctype or entity declarations are not supported")
+	errSVGNoViewBox  = errors.New("svg document has no viewBox or width and height")
+	doctypeDirective = []byte("<!DOCTYPE")
+	entityDirective  = []byte("<!ENTITY")
+)
+
+// rasterizeSVG renders the SVG document data at the smallest size covering width x height while
+// preserving the aspect ratio of its viewBox, a dimension of 0 is derived from the other one and
+// both being 0 renders the SVG at the size of its viewBox. The size is capped to maxSVGDimension.
+//
+// The document is parsed without network or file access: entities and doctypes are rejected before
+// parsing and references (e.g. <use href>) only resolve to definitions within the same document.
+func rasterizeSVG(data []byte, width, height int) (image.Image, error) {
+	icon, err := parseSVG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := getSVGRasterSize(width, height, icon.ViewBox.W, icon.ViewBox.H)
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	icon.Draw(rasterx.NewDasher(w, h, rasterx.NewScannerGV(w, h, img, img.Bounds())), 1)
+	return img, nil
+}
+
+// DecodeSVGConfig returns the dimensions an SVG document is rasterized at by Decode, i.e. the size of its
+// viewBox capped to 8192 pixels per side, without rendering it
+func DecodeSVGConfig(data []byte) (image.Config, error) {
+	icon, err := parseSVG(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	w, h := getSVGRasterSize(0, 0, icon.ViewBox.W, icon.ViewBox.H)
+	return image.Config{ColorModel: color.RGBAModel, Width: w, Height: h}, nil
+}
+
+// parseSVG parses the SVG document data after checking its size and rejecting entities and doctypes
+func parseSVG(data []byte) (*oksvg.SvgIcon, error) {
+	if len(data) > maxSVGSize {
+		return nil, errSVGTooLarge
+	}
+	if bytes.Contains(data, doctypeDirective) || bytes.Contains(data, entityDirective) {
+		return nil, errSVGEntity
+	}
+
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		return nil, errSVGNoViewBox
+	}
+	return icon, nil
+}
+
+// getSVGRasterSize returns the smallest size covering rw x rh (required width x required height) with
+// the aspect ratio of the vw x vh viewBox, capped to maxSVGDimension
+func getSVGRasterSize(rw, rh int, vw, vh float64) (int, int) {
+	scale := 1.0
+	if rw > 0 || rh > 0 {
+		scale = math.Max(float64(rw)/vw, float64(rh)/vh)
+	}
+	if m := math.Max(vw, vh) * scale; m > maxSVGDimension {
+		scale *= maxSVGDimension / m
+	}
+	// The epsilon keeps floating point noise from rounding an exact fit up by a pixel
+	w, h := int(math.Ceil(vw*scale-1e-6)), int(math.Ceil(vh*scale-1e-6))
+	return clamp(w, 1, maxSVGDimension), clamp(h, 1, maxSVGDimension)
+}
@@ -0,0 +1,91 @@
+package native
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSVG = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 40 20">
+	<rect x="0" y="0" width="20" height="20" fill="#ff0000"/>
+</svg>`
+
+func TestRasterizeSVG(t *testing.T) {
+	img, err := rasterizeSVG([]byte(testSVG), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 40, img.Bounds().Dx())
+	assert.Equal(t, 20, img.Bounds().Dy())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, img.At(5, 10))
+	assert.Equal(t, color.RGBA{}, img.At(35, 10))
+
+	img, err = rasterizeSVG([]byte(testSVG), 100, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, img.Bounds().Dx())
+	assert.Equal(t, 100, img.Bounds().Dy())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, img.At(50, 50))
+}
+
+func TestRasterizeSVGWithInvalidDocuments(t *testing.T) {
+	cases := []struct {
+		data []byte
+		err  error
+	}{
+		{
+			data: []byte(`<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY a "aaaa">]><svg viewBox="0 0 10 10">&a;</svg>`),
+			err:  errSVGEntity,
+		},
+		{
+			data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`),
+			err:  errSVGNoViewBox,
+		},
+		{
+			data: append([]byte(`<svg viewBox="0 0 10 10">`), bytes.Repeat([]byte(" "), maxSVGSize)...),
+			err:  errSVGTooLarge,
+		},
+	}
+	for _, c := range cases {
+		img, err := rasterizeSVG(c.data, 0, 0)
+		assert.Nil(t, img)
+		assert.Equal(t, c.err, err)
+	}
+
+	img, err := rasterizeSVG([]byte(`<svg viewBox="0 0 10 10"><rect`), 0, 0)
+	assert.Nil(t, img)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeSVGConfig(t *testing.T) {
+	cfg, err := DecodeSVGConfig([]byte(testSVG))
+	assert.Nil(t, err)
+	assert.Equal(t, 40, cfg.Width)
+	assert.Equal(t, 20, cfg.Height)
+
+	_, err = DecodeSVGConfig([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`))
+	assert.Equal(t, errSVGNoViewBox, err)
+}
+
+func TestGetSVGRasterSize(t *testing.T) {
+	cases := []struct {
+		rw, rh         int
+		vw, vh         float64
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{rw: 0, rh: 0, vw: 40, vh: 20, expectedWidth: 40, expectedHeight: 20},
+		{rw: 100, rh: 0, vw: 40, vh: 20, expectedWidth: 100, expectedHeight: 50},
+		{rw: 0, rh: 100, vw: 40, vh: 20, expectedWidth: 200, expectedHeight: 100},
+		{rw: 100, rh: 100, vw: 40, vh: 20, expectedWidth: 200, expectedHeight: 100},
+		{rw: 300, rh: 0, vw: 7, vh: 3, expectedWidth: 300, expectedHeight: 129},
+		{rw: 0, rh: 0, vw: 20000, vh: 10000, expectedWidth: maxSVGDimension, expectedHeight: maxSVGDimension / 2},
+		{rw: 100000, rh: 0, vw: 40, vh: 20, expectedWidth: maxSVGDimension, expectedHeight: maxSVGDimension / 2},
+		{rw: 0, rh: 0, vw: 0.2, vh: 0.1, expectedWidth: 1, expectedHeight: 1},
+	}
+	for _, c := range cases {
+		w, h := getSVGRasterSize(c.rw, c.rh, c.vw, c.vh)
+		assert.Equal(t, c.expectedWidth, w)
+		assert.Equal(t, c.expectedHeight, h)
+	}
+}
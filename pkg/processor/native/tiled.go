@@ -0,0 +1,56 @@
+package native
+
+import (
+	"image"
+
+	"github.com/anthonynsimon/bild/transform"
+)
+
+const (
+	// defaultTiledResizePixels is the smallest area of an image that is downscaled in strips by default
+	defaultTiledResizePixels = 8192 * 8192
+	// tiledStripPixels is about the number of pixels of a strip converted to RGBA at once, i.e. 16MB
+	tiledStripPixels = 2048 * 2048
+)
+
+// resize returns img resampled to width x height with the linear filter, decoded JPEGs are resized with
+// resizeYCbCr if enabled WithYCbCrResize and large images are downscaled in strips with resizeTiled once their
+// area exceeds the threshold set WithTiledResize
+func (bp *BildProcessor) resize(img image.Image, width, height int) image.Image {
+	if src, ok := img.(*image.YCbCr); ok && bp.ycbcrResize {
+		if dst, ok := resizeYCbCr(src, width, height, bp.maxParallelism); ok {
+			return dst
+		}
+	}
+	r := img.Bounds()
+	if bp.tiledResizePixels > 0 && r.Dx()*r.Dy() > bp.tiledResizePixels && width < r.Dx() && height <= r.Dy() {
+		return resizeTiled(img, width, height, tiledStripPixels)
+	}
+	return transform.Resize(img, width, height, transform.Linear)
+}
+
+// resizeTiled returns the same pixels as transform.Resize with the linear filter without converting all of img to
+// RGBA at once. bild resamples the rows first, every row on its own, so strips of about stripPixels pixels are
+// converted and resampled to the target width one after another. Only the narrower result is then resampled to
+// the target height, which bounds the memory on top of the decoded image by the width of the output.
+func resizeTiled(img image.Image, width, height, stripPixels int) image.Image {
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	r := img.Bounds()
+	if !ok || width <= 0 || height <= 0 || r.Empty() {
+		return transform.Resize(img, width, height, transform.Linear)
+	}
+	rows := stripPixels / r.Dx()
+	if rows < 1 {
+		rows = 1
+	}
+	rowsResized := image.NewRGBA(image.Rect(0, 0, width, r.Dy()))
+	for y := r.Min.Y; y < r.Max.Y; y += rows {
+		strip := sub.SubImage(image.Rect(r.Min.X, y, r.Max.X, y+rows).Intersect(r))
+		// Keeping the height of the strip leaves its rows as is after the horizontal pass
+		resized := transform.Resize(strip, width, strip.Bounds().Dy(), transform.Linear)
+		copy(rowsResized.Pix[(y-r.Min.Y)*rowsResized.Stride:], resized.Pix)
+	}
+	return transform.Resize(rowsResized, width, height, transform.Linear)
+}
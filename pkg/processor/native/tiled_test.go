@@ -0,0 +1,63 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResizeTiled(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	img, _, err := NewBildProcessor().Decode(data)
+	assert.NoError(t, err)
+	// The decoded JPEG is an *image.YCbCr, the strips are converted to RGBA one at a time
+	assert.IsType(t, &image.YCbCr{}, img)
+	w := img.Bounds().Dx()
+
+	for _, rows := range []int{1, 7, img.Bounds().Dy()} {
+		assert.Equal(t, transform.Resize(img, 97, 61, transform.Linear), resizeTiled(img, 97, 61, w*rows))
+	}
+	gradient := newGradient(130, 90).SubImage(image.Rect(10, 5, 120, 85))
+	assert.Equal(t, transform.Resize(gradient, 50, 30, transform.Linear), resizeTiled(gradient, 50, 30, 110*9))
+}
+
+func TestBildProcessor_ResizeWithTiledResize(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	img, _, _ := NewBildProcessor().Decode(data)
+	bp, tiled := NewBildProcessor(WithTiledResize(0)), NewBildProcessor(WithTiledResize(1))
+
+	assert.Equal(t, bp.Resize(img, 120, 0), tiled.Resize(img, 120, 0))
+	assert.Equal(t, bp.Scale(img, 100, 100), tiled.Scale(img, 100, 100))
+	assert.Equal(t, bp.Crop(img, 80, 80, processor.PointTop), tiled.Crop(img, 80, 80, processor.PointTop))
+	// Upscales take the regular path
+	assert.Equal(t, bp.Scale(img, 2*img.Bounds().Dx(), 10), tiled.Scale(img, 2*img.Bounds().Dx(), 10))
+}
+
+func TestBildProcessor_DecodeWithMaxDecodePixels(t *testing.T) {
+	buff := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(buff, image.NewGray(image.Rect(0, 0, 16, 16)), nil))
+	data := buff.Bytes()
+
+	// A header declaring 60000x60000 pixels is rejected before the pixels are decoded
+	huge := append([]byte{}, data...)
+	sof := bytes.Index(huge, []byte{0xff, 0xc0})
+	binary.BigEndian.PutUint16(huge[sof+5:], 60000)
+	binary.BigEndian.PutUint16(huge[sof+7:], 60000)
+	_, _, err := NewBildProcessor().Decode(huge)
+	assert.Equal(t, ErrImageTooLarge, err)
+
+	_, _, err = NewBildProcessor(WithMaxDecodePixels(16 * 15)).Decode(data)
+	assert.Equal(t, ErrImageTooLarge, err)
+	img, _, err := NewBildProcessor(WithMaxDecodePixels(16 * 16)).Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 16, 16), img.Bounds())
+	_, _, err = NewBildProcessor(WithMaxDecodePixels(0)).Decode(data)
+	assert.NoError(t, err)
+}
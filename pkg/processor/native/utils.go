@@ -2,8 +2,13 @@ package native
 
 import (
 	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
 
 	"github.com/anthonynsimon/bild/parallel"
+	"github.com/anthonynsimon/bild/transform"
 	"github.com/gojek/darkroom/pkg/config"
 	"github.com/gojek/darkroom/pkg/processor"
 )
@@ -49,6 +54,129 @@ func isOpaque(im image.Image) bool {
 	return isOpaque
 }
 
+// getPartialAlphaFraction returns the fraction of pixels in im which are neither fully opaque nor fully transparent
+func getPartialAlphaFraction(im image.Image) float64 {
+	rect := im.Bounds()
+	if rect.Empty() || hasFastIsOpaque(im) {
+		return 0
+	}
+	var mu sync.Mutex
+	partial := 0
+	f := func(start, end int) {
+		n := 0
+		for y := rect.Min.Y + start; y < rect.Min.Y+end; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if _, _, _, a := im.At(x, y).RGBA(); a != 0 && a != 0xffff {
+					n++
+				}
+			}
+		}
+		mu.Lock()
+		partial += n
+		mu.Unlock()
+	}
+	if config.ConcurrentOpacityCheckingEnabled() {
+		parallel.Line(rect.Dy(), f)
+	} else {
+		f(0, rect.Dy())
+	}
+	return float64(partial) / float64(rect.Dx()*rect.Dy())
+}
+
+const (
+	// graphicSamples is about the largest number of pixels sampled by isGraphic
+	graphicSamples = 256 * 1024
+	// graphicSoftEdge is the largest channel difference of neighbouring pixels counted as a soft edge, larger
+	// differences are hard edges
+	graphicSoftEdge = 0x20
+	// graphicTile is the side of the tiles of sampled pixels isGraphic tells flat, edged and textured areas apart in
+	graphicTile = 8
+	// graphicSoftEdges is the largest fraction of soft edges between the sampled neighbours of a tile that isn't
+	// textured, i.e. it holds hard edges like the outlines of shapes or text rather than the gradients of a photo
+	graphicSoftEdges = 0.25
+	// graphicTexturedTiles is the largest fraction of textured tiles among the tiles that aren't flat of a graphic
+	graphicTexturedTiles = 0.05
+)
+
+// isGraphic returns true if img looks like a graphic, e.g. a logo or a screenshot, rather than a photo. That is
+// an image with at most maxColors distinct colors or one made of flat areas and hard edges, in which hardly any
+// neighbouring pixels differ slightly like in the gradients and noise of photos. The image is split into tiles and
+// only the tiles that aren't flat are weighed, so a photo on a flat background, whose background outweighs the
+// photo pixel wise, is still a photo. Large images are sampled.
+func isGraphic(im image.Image, maxColors int) bool {
+	rect := im.Bounds()
+	if rect.Empty() {
+		return false
+	}
+	step := int(math.Ceil(math.Sqrt(float64(rect.Dx()) * float64(rect.Dy()) / graphicSamples)))
+	tilesX := ((rect.Dx()+step-1)/step + graphicTile - 1) / graphicTile
+	tilesY := ((rect.Dy()+step-1)/step + graphicTile - 1) / graphicTile
+	pairs, soft, changed := make([]int, tilesX*tilesY), make([]int, tilesX*tilesY), make([]bool, tilesX*tilesY)
+	colors := make(map[uint32]struct{})
+	for y := rect.Min.Y; y < rect.Max.Y; y += step {
+		var prev color.NRGBA
+		row := (y - rect.Min.Y) / step / graphicTile * tilesX
+		for x := rect.Min.X; x < rect.Max.X; x += step {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			if len(colors) <= maxColors {
+				colors[uint32(c.R)<<24|uint32(c.G)<<16|uint32(c.B)<<8|uint32(c.A)] = struct{}{}
+			}
+			if x > rect.Min.X {
+				i := row + (x-rect.Min.X)/step/graphicTile
+				pairs[i]++
+				if d := getChannelDiff(prev, c); d > 0 {
+					changed[i] = true
+					if d <= graphicSoftEdge {
+						soft[i]++
+					}
+				}
+			}
+			prev = c
+		}
+	}
+	if len(colors) <= maxColors {
+		return true
+	}
+	edged, textured := 0, 0
+	for i := range pairs {
+		if !changed[i] {
+			continue
+		}
+		edged++
+		if float64(soft[i])/float64(pairs[i]) > graphicSoftEdges {
+			textured++
+		}
+	}
+	return edged > 0 && float64(textured)/float64(edged) <= graphicTexturedTiles
+}
+
+// getChannelDiff returns the largest difference between the channels of a and b
+func getChannelDiff(a, b color.NRGBA) int {
+	d := 0
+	for _, v := range []int{int(a.R) - int(b.R), int(a.G) - int(b.G), int(a.B) - int(b.B), int(a.A) - int(b.A)} {
+		if v < 0 {
+			v = -v
+		}
+		if v > d {
+			d = v
+		}
+	}
+	return d
+}
+
+func getResampleFilter(f processor.Filter) transform.ResampleFilter {
+	switch f {
+	case processor.FilterNearestNeighbor:
+		return transform.NearestNeighbor
+	case processor.FilterCatmullRom:
+		return transform.CatmullRom
+	case processor.FilterLanczos:
+		return transform.Lanczos
+	default:
+		return transform.Linear
+	}
+}
+
 // rw: required width, rh: required height, aw: actual width, ah: actual height
 func getResizeWidthAndHeight(rw, rh, aw, ah int) (int, int) {
 	if rh == 0 {
@@ -77,6 +205,20 @@ func getResizeWidthAndHeightForCrop(rw, rh, aw, ah int) (int, int) {
 	return w, rh
 }
 
+// rw: required width, rh: required height, aw: actual width, ah: actual height
+func getResizeWidthAndHeightForCover(rw, rh, aw, ah int) (int, int) {
+	scale := math.Max(float64(rw)/float64(aw), float64(rh)/float64(ah))
+	w := int(math.Round(float64(aw) * scale))
+	h := int(math.Round(float64(ah) * scale))
+	if w < rw {
+		w = rw
+	}
+	if h < rh {
+		h = rh
+	}
+	return w, h
+}
+
 // w: scaled width, h: scaled height, rw: required width, rh: required height
 func getStartingPointForCrop(w, h, rw, rh int, cropPoint processor.Point) (int, int) {
 	x := (w - rw) / 2
@@ -106,3 +248,99 @@ func getStartingPointForCrop(w, h, rw, rh int, cropPoint processor.Point) (int,
 	}
 	return x, y
 }
+
+// w: scaled width, h: scaled height, rw: required width, rh: required height
+func getStartingPointForFocalCrop(w, h, rw, rh int, fp processor.FocalPoint) (int, int) {
+	x := clamp(int(fp.X*float64(w))-rw/2, 0, w-rw)
+	y := clamp(int(fp.Y*float64(h))-rh/2, 0, h-rh)
+	return x, y
+}
+
+func clamp(v, min, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+// parallelLine runs fn over the rows 0 to n like parallel.Line, split into at most workers blocks of consecutive
+// rows each processed by a goroutine, workers of 0 or less leave the split to parallel.Line which uses GOMAXPROCS
+func parallelLine(workers, n int, fn func(start, end int)) {
+	if workers <= 0 {
+		parallel.Line(n, fn)
+		return
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			fn(start, end)
+		}(i*n/workers, (i+1)*n/workers)
+	}
+	wg.Wait()
+}
+
+// parallelLine runs fn over the rows 0 to n on at most the goroutines set WithMaxParallelism
+func (bp *BildProcessor) parallelLine(n int, fn func(start, end int)) {
+	parallelLine(bp.maxParallelism, n, fn)
+}
+
+// getLuma returns the Rec. 601 luma of the straight (not alpha-premultiplied) color r, g, b
+func getLuma(r, g, b uint8) float64 {
+	return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+}
+
+// getHue returns the hue in degrees (0 to 360) and the chroma of a straight color, the hue of a gray is 0
+func getHue(r, g, b uint8) (float64, uint8) {
+	hi, lo := maxUint8(r, g, b), 255-maxUint8(255-r, 255-g, 255-b)
+	c := float64(hi - lo)
+	if c == 0 {
+		return 0, 0
+	}
+	var h float64
+	switch hi {
+	case r:
+		h = math.Mod((float64(g)-float64(b))/c+6, 6)
+	case g:
+		h = (float64(b)-float64(r))/c + 2
+	default:
+		h = (float64(r)-float64(g))/c + 4
+	}
+	return h * 60, hi - lo
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func maxUint8(values ...uint8) uint8 {
+	var m uint8
+	for _, v := range values {
+		if v > m {
+			m = v
+		}
+	}
+	return m
+}
+
+// flatten returns img drawn over an opaque canvas of the background color
+func flatten(img image.Image, background color.Color) image.Image {
+	canvas := image.NewRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, canvas.Bounds().Min, draw.Over)
+	return canvas
+}
@@ -4,8 +4,10 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
+	"sync"
 	"testing"
 
+	"github.com/anthonynsimon/bild/transform"
 	"github.com/gojek/darkroom/pkg/config"
 	"github.com/gojek/darkroom/pkg/processor"
 	"github.com/stretchr/testify/assert"
@@ -55,6 +57,29 @@ func TestGetResizeWidthAndHeightForFitCrop(t *testing.T) {
 	assert.Equal(t, 300, h)
 }
 
+func TestGetResizeWidthAndHeightForCover(t *testing.T) {
+	cases := []struct {
+		rw, rh, aw, ah int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{rw: 800, rh: 400, aw: actualWidth, ah: actualHeight, expectedWidth: 800, expectedHeight: 400},
+		{rw: 200, rh: 300, aw: actualWidth, ah: actualHeight, expectedWidth: 600, expectedHeight: 300},
+		{rw: 2000, rh: 100, aw: actualWidth, ah: actualHeight, expectedWidth: 2000, expectedHeight: 1000},
+		// 200 * 100 / 300 is 66.67, crop truncates it to 66 while cover rounds it to 67
+		{rw: 100, rh: 50, aw: 300, ah: 200, expectedWidth: 100, expectedHeight: 67},
+	}
+	for _, c := range cases {
+		w, h := getResizeWidthAndHeightForCover(c.rw, c.rh, c.aw, c.ah)
+		assert.Equal(t, c.expectedWidth, w)
+		assert.Equal(t, c.expectedHeight, h)
+	}
+
+	w, h := getResizeWidthAndHeightForCrop(100, 50, 300, 200)
+	assert.Equal(t, 100, w)
+	assert.Equal(t, 66, h)
+}
+
 func TestGetStartingPointForCrop(t *testing.T) {
 	//center
 	x, y := getStartingPointForCrop(500, 500, 300, 500, processor.PointCenter)
@@ -102,6 +127,47 @@ func TestGetStartingPointForCrop(t *testing.T) {
 	assert.Equal(t, 0, y)
 }
 
+func TestGetStartingPointForFocalCrop(t *testing.T) {
+	cases := []struct {
+		fp        processor.FocalPoint
+		expectedX int
+		expectedY int
+		point     processor.Point
+	}{
+		{fp: processor.FocalPoint{X: 0.5, Y: 0.5}, expectedX: 100, expectedY: 150, point: processor.PointCenter},
+		{fp: processor.FocalPoint{X: 0, Y: 0}, expectedX: 0, expectedY: 0, point: processor.PointTopLeft},
+		{fp: processor.FocalPoint{X: 1, Y: 1}, expectedX: 200, expectedY: 300, point: processor.PointBottomRight},
+		{fp: processor.FocalPoint{X: 1, Y: 0}, expectedX: 200, expectedY: 0, point: processor.PointTopRight},
+	}
+	for _, c := range cases {
+		// Focal points on the edges and the center match the named crop points
+		x, y := getStartingPointForFocalCrop(500, 500, 300, 200, c.fp)
+		assert.Equal(t, c.expectedX, x)
+		assert.Equal(t, c.expectedY, y)
+		nx, ny := getStartingPointForCrop(500, 500, 300, 200, c.point)
+		assert.Equal(t, nx, x)
+		assert.Equal(t, ny, y)
+	}
+
+	// Window is centered on the focal point when it fits
+	x, y := getStartingPointForFocalCrop(1000, 500, 200, 100, processor.FocalPoint{X: 0.25, Y: 0.75})
+	assert.Equal(t, 150, x)
+	assert.Equal(t, 325, y)
+
+	// Window is clamped to the image bounds
+	x, y = getStartingPointForFocalCrop(1000, 500, 200, 100, processor.FocalPoint{X: 0.05, Y: 0.95})
+	assert.Equal(t, 0, x)
+	assert.Equal(t, 400, y)
+}
+
+func Test_getResampleFilter(t *testing.T) {
+	assert.Equal(t, transform.Linear.Support, getResampleFilter(processor.FilterLinear).Support)
+	assert.Equal(t, transform.NearestNeighbor.Support, getResampleFilter(processor.FilterNearestNeighbor).Support)
+	assert.Equal(t, transform.CatmullRom.Support, getResampleFilter(processor.FilterCatmullRom).Support)
+	assert.Equal(t, transform.Lanczos.Support, getResampleFilter(processor.FilterLanczos).Support)
+	assert.Equal(t, transform.Linear.Support, getResampleFilter(processor.Filter(42)).Support)
+}
+
 func Test_isOpaqueWithFastOpaqueMethod(t *testing.T) {
 	r := image.Rect(0, 0, 640, 480)
 	gray, gray16, cmyk := image.NewGray(r), image.NewGray16(r), image.NewCMYK(r)
@@ -155,6 +221,34 @@ func Test_isOpaqueWithoutFastOpaqueMethodShouldReturnFalse(t *testing.T) {
 	isOpaqueShouldReturnFalse()
 }
 
+func Test_getPartialAlphaFraction(t *testing.T) {
+	getPartialAlphaFractionShouldCountPartialPixels := func() {
+		img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(img, img.Bounds(), image.Opaque, image.ZP, draw.Src)
+		assert.Equal(t, 0.0, getPartialAlphaFraction(img))
+
+		// Fully transparent pixels are not counted
+		draw.Draw(img, image.Rect(0, 0, 10, 5), image.Transparent, image.ZP, draw.Src)
+		assert.Equal(t, 0.0, getPartialAlphaFraction(img))
+
+		draw.Draw(img, image.Rect(0, 0, 10, 2), image.NewUniform(color.NRGBA{A: 128}), image.ZP, draw.Src)
+		assert.Equal(t, 0.2, getPartialAlphaFraction(img))
+
+		sub := img.SubImage(image.Rect(0, 1, 10, 3))
+		assert.Equal(t, 0.5, getPartialAlphaFraction(sub))
+	}
+	v := config.Viper()
+	v.Set("enableConcurrentOpacityChecking", true)
+	config.Update()
+	getPartialAlphaFractionShouldCountPartialPixels()
+	v.Set("enableConcurrentOpacityChecking", false)
+	config.Update()
+	getPartialAlphaFractionShouldCountPartialPixels()
+
+	assert.Equal(t, 0.0, getPartialAlphaFraction(image.NewGray(image.Rect(0, 0, 10, 10))))
+	assert.Equal(t, 0.0, getPartialAlphaFraction(image.NewRGBA(image.Rectangle{})))
+}
+
 type MockImage struct {
 	rect   image.Rectangle
 	points [][]color.Color
@@ -187,3 +281,55 @@ func (im *MockImage) At(x, y int) color.Color {
 func (im *MockImage) Set(x, y int, c color.Color) {
 	im.points[y][x] = c
 }
+
+func Test_parallelLine(t *testing.T) {
+	for _, workers := range []int{-1, 0, 1, 3, 100} {
+		var mu sync.Mutex
+		rows := make([]int, 10)
+		blocks := 0
+		parallelLine(workers, len(rows), func(start, end int) {
+			mu.Lock()
+			defer mu.Unlock()
+			blocks++
+			for y := start; y < end; y++ {
+				rows[y]++
+			}
+		})
+		assert.Equal(t, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, rows, workers)
+		if workers > 0 {
+			assert.LessOrEqual(t, blocks, workers, workers)
+		}
+	}
+}
+
+func TestBildProcessor_WithMaxParallelism(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	bp := NewBildProcessor(WithMaxParallelism(2))
+	assert.Equal(t, 2, bp.MaxParallelism())
+	assert.Equal(t, 0, NewBildProcessor().MaxParallelism())
+	assert.Equal(t, NewBildProcessor().GrayScale(img), bp.GrayScale(img))
+	assert.Equal(t, NewBildProcessor().Desaturate(img, 0.5), bp.Desaturate(img, 0.5))
+}
+
+func TestGetHue(t *testing.T) {
+	cases := []struct {
+		r, g, b uint8
+		hue     float64
+		chroma  uint8
+	}{
+		{r: 255, hue: 0, chroma: 255},
+		{r: 255, g: 255, hue: 60, chroma: 255},
+		{g: 200, hue: 120, chroma: 200},
+		{r: 10, g: 10, b: 110, hue: 240, chroma: 100},
+		{r: 255, b: 128, hue: 329.9, chroma: 255},
+		{r: 128, g: 128, b: 128, hue: 0, chroma: 0},
+	}
+	for _, c := range cases {
+		h, chroma := getHue(c.r, c.g, c.b)
+		assert.InDelta(t, c.hue, h, 0.1)
+		assert.Equal(t, c.chroma, chroma)
+	}
+}
@@ -0,0 +1,120 @@
+package native
+
+import (
+	"image"
+	"math"
+
+	"github.com/anthonynsimon/bild/transform"
+)
+
+// planeWeights holds the first source sample and the normalized weights of the samples contributing to each
+// output sample of a resampled plane
+type planeWeights struct {
+	start   []int
+	weights [][]float64
+}
+
+// resizeYCbCr returns src resampled to width x height with the linear filter of transform.Resize. The Y, Cb and Cr
+// planes are resampled one by one at their own subsampled size, so src is never converted to RGBA and the JPEG
+// encoder takes the output without converting it back. The returned bool is false if src can't be resized this way,
+// i.e. it doesn't start at the origin or has an unknown subsample ratio. The planes are resampled on at most
+// workers goroutines, 0 uses GOMAXPROCS.
+func resizeYCbCr(src *image.YCbCr, width, height, workers int) (*image.YCbCr, bool) {
+	r := src.Bounds()
+	if width <= 0 || height <= 0 || r.Empty() || r.Min != image.ZP {
+		return nil, false
+	}
+	scw, sch, ok := getChromaSize(src.SubsampleRatio, r.Dx(), r.Dy())
+	if !ok {
+		return nil, false
+	}
+	dst := image.NewYCbCr(image.Rect(0, 0, width, height), src.SubsampleRatio)
+	dcw, dch, _ := getChromaSize(src.SubsampleRatio, width, height)
+	resamplePlane(src.Y, src.YStride, r.Dx(), r.Dy(), dst.Y, dst.YStride, width, height, workers)
+	resamplePlane(src.Cb, src.CStride, scw, sch, dst.Cb, dst.CStride, dcw, dch, workers)
+	resamplePlane(src.Cr, src.CStride, scw, sch, dst.Cr, dst.CStride, dcw, dch, workers)
+	return dst, true
+}
+
+// getChromaSize returns the size of the Cb and Cr planes of a w x h image with the subsample ratio, the
+// returned bool is false for an unknown ratio
+func getChromaSize(ratio image.YCbCrSubsampleRatio, w, h int) (int, int, bool) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+		return w, h, true
+	case image.YCbCrSubsampleRatio422:
+		return (w + 1) / 2, h, true
+	case image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2, (h + 1) / 2, true
+	case image.YCbCrSubsampleRatio440:
+		return w, (h + 1) / 2, true
+	case image.YCbCrSubsampleRatio411:
+		return (w + 3) / 4, h, true
+	case image.YCbCrSubsampleRatio410:
+		return (w + 3) / 4, (h + 1) / 2, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// resamplePlane resamples the sw x sh plane src into the dw x dh plane dst, first along the rows and then along the
+// columns like transform.Resize does for each channel of an RGBA image
+func resamplePlane(src []uint8, srcStride, sw, sh int, dst []uint8, dstStride, dw, dh, workers int) {
+	tmp := make([]uint8, dw*sh)
+	hw := getPlaneWeights(sw, dw)
+	parallelLine(workers, sh, func(start, end int) {
+		for y := start; y < end; y++ {
+			row := src[y*srcStride:]
+			for x := 0; x < dw; x++ {
+				var v float64
+				for i, w := range hw.weights[x] {
+					v += float64(row[hw.start[x]+i]) * w
+				}
+				tmp[y*dw+x] = uint8(math.Max(0, math.Min(255, v+0.5)))
+			}
+		}
+	})
+	vw := getPlaneWeights(sh, dh)
+	parallelLine(workers, dh, func(start, end int) {
+		for y := start; y < end; y++ {
+			row := dst[y*dstStride:]
+			for x := 0; x < dw; x++ {
+				var v float64
+				for i, w := range vw.weights[y] {
+					v += float64(tmp[(vw.start[y]+i)*dw+x]) * w
+				}
+				row[x] = uint8(math.Max(0, math.Min(255, v+0.5)))
+			}
+		}
+	})
+}
+
+// getPlaneWeights returns the weights of the linear filter resampling n samples to m samples, the same window and
+// weights transform.Resize computes for every pixel, normalized to sum up to 1
+func getPlaneWeights(n, m int) planeWeights {
+	delta := float64(n) / float64(m)
+	scale := math.Max(delta, 1)
+	radius := math.Ceil(scale * transform.Linear.Support)
+	pw := planeWeights{start: make([]int, m), weights: make([][]float64, m)}
+	for i := 0; i < m; i++ {
+		center := (float64(i)+0.5)*delta - 0.5
+		start, end := int(center-radius+0.5), int(center+radius)
+		if start < 0 {
+			start = 0
+		}
+		if end >= n {
+			end = n - 1
+		}
+		weights := make([]float64, end-start+1)
+		var sum float64
+		for k := start; k <= end; k++ {
+			weights[k-start] = transform.Linear.Fn((float64(k) - center) / scale)
+			sum += weights[k-start]
+		}
+		for k := range weights {
+			weights[k] /= sum
+		}
+		pw.start[i], pw.weights[i] = start, weights
+	}
+	return pw
+}
@@ -0,0 +1,88 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResizeYCbCr(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	img, _, _ := NewBildProcessor().Decode(data)
+	src := img.(*image.YCbCr)
+
+	for _, size := range []image.Point{{97, 61}, {250, 187}, {1000, 750}} {
+		out, ok := resizeYCbCr(src, size.X, size.Y, 0)
+		assert.True(t, ok)
+		assert.Equal(t, image.Rect(0, 0, size.X, size.Y), out.Bounds())
+		assert.Equal(t, src.SubsampleRatio, out.SubsampleRatio)
+		// Only the rounding of the color conversion and the chroma resampling differ from the RGBA resize, by a few
+		// levels on average
+		expected := transform.Resize(img, size.X, size.Y, transform.Linear)
+		var diff, n float64
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				e, a := expected.RGBAAt(x, y), color.RGBAModel.Convert(out.At(x, y)).(color.RGBA)
+				diff += float64(absDiff(e.R, a.R)) + float64(absDiff(e.G, a.G)) + float64(absDiff(e.B, a.B))
+				n += 3
+			}
+		}
+		assert.Less(t, diff/n, 4.0, size)
+	}
+
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410} {
+		out, ok := resizeYCbCr(image.NewYCbCr(image.Rect(0, 0, 33, 17), ratio), 10, 5, 0)
+		assert.True(t, ok, ratio)
+		assert.Equal(t, image.Rect(0, 0, 10, 5), out.Bounds(), ratio)
+	}
+
+	_, ok := resizeYCbCr(src.SubImage(image.Rect(10, 10, 100, 100)).(*image.YCbCr), 10, 10, 0)
+	assert.False(t, ok)
+	_, ok = resizeYCbCr(image.NewYCbCr(image.Rect(0, 0, 10, 10), image.YCbCrSubsampleRatio(-1)), 5, 5, 0)
+	assert.False(t, ok)
+	_, ok = resizeYCbCr(src, 0, 10, 0)
+	assert.False(t, ok)
+}
+
+func TestBildProcessor_ResizeWithYCbCrResize(t *testing.T) {
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	bp := NewBildProcessor(WithYCbCrResize(true))
+	img, _, _ := bp.Decode(data)
+
+	assert.IsType(t, &image.YCbCr{}, bp.Resize(img, 120, 0))
+	assert.IsType(t, &image.RGBA{}, NewBildProcessor().Resize(img, 120, 0))
+	out := bp.Crop(img, 80, 80, processor.PointTop)
+	assert.Equal(t, 80, out.Bounds().Dx())
+	assert.Equal(t, 80, out.Bounds().Dy())
+
+	encoded, err := bp.Encode(bp.Resize(img, 120, 0), processor.ExtensionJPEG)
+	assert.NoError(t, err)
+	decoded, f, err := bp.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionJPEG, f)
+	assert.Equal(t, image.Rect(0, 0, 120, 90), decoded.Bounds())
+}
+
+func BenchmarkBildProcessor_WithYCbCrResize(b *testing.B) {
+	data, _ := ioutil.ReadFile("_testdata/test.jpg")
+	for _, enabled := range []bool{false, true} {
+		bp := NewBildProcessor(WithYCbCrResize(enabled))
+		img, _, _ := bp.Decode(data)
+		name := "Disabled"
+		if enabled {
+			name = "Enabled"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = bp.Encode(bp.Resize(img, 250, 0), processor.ExtensionJPEG)
+			}
+		})
+	}
+}
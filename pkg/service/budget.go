@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+	"strconv"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+// budgetQualities are the qualities tried in turn when the output exceeds max-bytes, the lowest is kept for
+// downscaling
+var budgetQualities = []int{70, 50, 30, 15}
+
+const (
+	// maxBudgetDownscales is the largest number of times the output is downscaled to fit max-bytes
+	maxBudgetDownscales = 8
+	// budgetDownscaleMargin shrinks each downscale below the estimated fit, the encoded size doesn't drop
+	// linearly with the area
+	budgetDownscaleMargin = 0.9
+)
+
+// ErrExceedsMaxBytes is returned by Process if the output can't be encoded within max-bytes even at the lowest
+// quality and, with allow-downscale=true, the smallest dimensions
+var ErrExceedsMaxBytes = errors.New("output exceeds max-bytes")
+
+// ProcessInfo describes the output of ProcessWithInfo
+type ProcessInfo struct {
+	// Width of the output image in pixels
+	Width int
+	// Height of the output image in pixels
+	Height int
+	// Format of the output image, e.g. jpeg or png
+	Format string
+	// Quality the output was encoded with, 0 for the default of the encoder
+	Quality int
+	// Size of the output in bytes
+	Size int
+}
+
+// getMaxBytes returns the byte budget of the max-bytes param, 0 if it is not a positive integer. Unlike CleanInt
+// it isn't limited to 9999.
+func getMaxBytes(input string) int {
+	if v, err := strconv.Atoi(input); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// getPassThroughInfo returns the ProcessInfo of image data that is returned unprocessed, only the header is decoded
+func getPassThroughInfo(data []byte) ProcessInfo {
+	info := ProcessInfo{Format: metrics.GetImageFormat(data), Size: len(data)}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	return info
+}
+
+// getBudgetQualities returns the qualities fitByteBudget tries for params and src, the output encoded so far.
+// profile=fast skips the iteration and encodes once more at the lowest quality, a lossless output ignores the
+// quality, so none are tried and it goes straight to downscaling.
+func getBudgetQualities(params map[string]string, src []byte) []int {
+	if isLossless(src) {
+		return nil
+	}
+	if params[profile] == profileFast {
+		return budgetQualities[len(budgetQualities)-1:]
+	}
+	return budgetQualities
+}
+
+// isLossless returns true if data is a PNG or a lossless WebP, i.e. one holding a VP8L bitstream. The output
+// format can differ from the requested one, e.g. an opaque PNG is encoded as JPEG, so the encoded data is checked.
+func isLossless(data []byte) bool {
+	switch processor.DetectContentType(data) {
+	case processor.ContentTypePNG:
+		return true
+	case processor.ContentTypeWebP:
+		return len(data) >= 16 && string(data[12:16]) == "VP8L"
+	}
+	return false
+}
+
+// fitByteBudget takes img and src, its encoding with opts exceeding maxBytes, and encodes img with the decreasing
+// qualities until it fits. If it still doesn't fit and downscaling is allowed, img is downscaled at the lowest
+// quality until it fits. It returns the final image, its encoded bytes and the encode options used, or
+// ErrExceedsMaxBytes.
+func (m *manipulator) fitByteBudget(img image.Image, src []byte, format string, opts processor.EncodeOptions,
+	qualities []int, maxBytes int, allowDownscale bool) (image.Image, []byte, processor.EncodeOptions, error) {
+	var err error
+	for _, q := range qualities {
+		if opts.Quality != 0 && q >= opts.Quality {
+			continue
+		}
+		opts.Quality = q
+		if src, err = m.processor.EncodeWithOptions(img, format, opts); err != nil || len(src) <= maxBytes {
+			return img, src, opts, err
+		}
+	}
+	if !allowDownscale {
+		return nil, nil, opts, ErrExceedsMaxBytes
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	scale := 1.0
+	for i := 0; i < maxBudgetDownscales; i++ {
+		scale *= math.Sqrt(float64(maxBytes)/float64(len(src))) * budgetDownscaleMargin
+		sw, sh := int(math.Round(float64(w)*scale)), int(math.Round(float64(h)*scale))
+		if sw < 1 || sh < 1 {
+			break
+		}
+		// The source is scaled every time, scaling the previous attempt would blur it further
+		scaled := m.processor.Scale(img, sw, sh)
+		if src, err = m.processor.EncodeWithOptions(scaled, format, opts); err != nil || len(src) <= maxBytes {
+			return scaled, src, opts, err
+		}
+	}
+	return nil, nil, opts, ErrExceedsMaxBytes
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManipulator_ProcessWithInfo_WithMaxBytes(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	process := func(params map[string]string) ([]byte, ProcessInfo, error) {
+		return m.ProcessWithInfo(NewSpecBuilder().WithImageData(img).WithParams(params).Build())
+	}
+
+	full, info, err := process(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ProcessInfo{Width: 500, Height: 375, Format: processor.ExtensionJPEG, Size: len(full)}, info)
+	lowest, _, err := process(map[string]string{quality: "15"})
+	assert.NoError(t, err)
+
+	// A lower quality is enough to fit the budget
+	budget := (len(full) + len(lowest)) / 2
+	out, info, err := process(map[string]string{maxBytes: strconv.Itoa(budget)})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(out), budget)
+	assert.Equal(t, 500, info.Width)
+	assert.Less(t, info.Quality, 75)
+	assert.Equal(t, len(out), info.Size)
+
+	// profile=fast goes straight to the lowest quality instead of trying the ones in between
+	_, info, err = process(map[string]string{maxBytes: strconv.Itoa(budget), profile: profileFast})
+	assert.NoError(t, err)
+	assert.Equal(t, 15, info.Quality)
+
+	// Below the lowest quality the dimensions are reduced only if allowed
+	budget = len(lowest) / 3
+	_, _, err = process(map[string]string{maxBytes: strconv.Itoa(budget)})
+	assert.Equal(t, ErrExceedsMaxBytes, err)
+	out, info, err = process(map[string]string{maxBytes: strconv.Itoa(budget), downscale: "true"})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(out), budget)
+	assert.Equal(t, 15, info.Quality)
+	assert.Less(t, info.Width, 500)
+	assert.InDelta(t, 500.0/375, float64(info.Width)/float64(info.Height), 0.05)
+	decoded, _ := m.Inspect(out)
+	assert.Equal(t, info.Width, decoded.Width)
+
+	// Even a single pixel exceeds a budget of a byte
+	_, _, err = process(map[string]string{maxBytes: "1", downscale: "true"})
+	assert.Equal(t, ErrExceedsMaxBytes, err)
+
+	// Outputs within the budget are left as is
+	out, _, err = process(map[string]string{maxBytes: strconv.Itoa(len(full))})
+	assert.NoError(t, err)
+	assert.Equal(t, full, out)
+}
+
+func Test_getBudgetQualities(t *testing.T) {
+	jpg, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	png, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	assert.Equal(t, budgetQualities, getBudgetQualities(map[string]string{}, jpg))
+	assert.Equal(t, budgetQualities, getBudgetQualities(map[string]string{profile: profileBest}, jpg))
+	assert.Equal(t, []int{15}, getBudgetQualities(map[string]string{profile: profileFast}, jpg))
+
+	// Lossless outputs ignore the quality
+	assert.Empty(t, getBudgetQualities(map[string]string{}, png))
+	assert.Empty(t, getBudgetQualities(map[string]string{}, []byte("RIFF\x00\x00\x00\x00WEBPVP8L")))
+	assert.Equal(t, budgetQualities, getBudgetQualities(map[string]string{}, []byte("RIFF\x00\x00\x00\x00WEBPVP8 ")))
+}
+
+func TestManipulator_ProcessWithInfo_WithMaxBytesAndPNG(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	process := func(params map[string]string) ([]byte, ProcessInfo, error) {
+		return m.ProcessWithInfo(NewSpecBuilder().WithImageData(img).WithParams(params).Build())
+	}
+	full, info, err := process(map[string]string{outputFormat: processor.ExtensionPNG})
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionPNG, info.Format)
+
+	// A PNG goes straight to downscaling, without trying any quality
+	budget := strconv.Itoa(len(full) - 1)
+	_, _, err = process(map[string]string{outputFormat: processor.ExtensionPNG, maxBytes: budget})
+	assert.Equal(t, ErrExceedsMaxBytes, err)
+	out, info, err := process(map[string]string{outputFormat: processor.ExtensionPNG, maxBytes: budget, downscale: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionPNG, info.Format)
+	assert.Equal(t, 0, info.Quality)
+	assert.Less(t, len(out), len(full))
+}
+
+func TestManipulator_ProcessWithInfo_WithPassThrough(t *testing.T) {
+	m := NewManipulator(&mockProcessor{}, nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	out, info, err := m.ProcessWithInfo(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{minProcess: "500"}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, img, out)
+	assert.Equal(t, ProcessInfo{Width: 500, Height: 375, Format: processor.ExtensionPNG, Size: len(img)}, info)
+}
+
+func TestManipulator_ProcessWithInfo_WithMaxBytesAndBufferPool(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(native.WithBufferPool(true)), nil, metrics.NoOpMetricService{})
+	// The grayscale image comes from the pool and is encoded once per quality tried
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/overlay.png")
+	params := map[string]string{mono: blackHexCode, outputFormat: "jpg"}
+	full, _, err := m.ProcessWithInfo(NewSpecBuilder().WithImageData(img).WithParams(params).Build())
+	assert.NoError(t, err)
+
+	params[maxBytes] = strconv.Itoa(len(full) * 3 / 4)
+	out, info, err := m.ProcessWithInfo(NewSpecBuilder().WithImageData(img).WithParams(params).Build())
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(out), len(full)*3/4)
+	assert.Equal(t, 350, info.Width)
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+)
+
+// maxCanvasSize is the largest width and height of a canvas, the same bound as the w and h params
+const maxCanvasSize = 9999
+
+// Canvas takes the image data, the width and height of the canvas, a 6 digit hex background color (without the
+// leading '#') and a FitMode and returns the image encoded in its source format on a canvas of exactly width x
+// height filled with the background color, e.g. for 1200x630 social-share cards. The image is sized with the fit
+// mode like Process does with the w, h and fit params and centered on the canvas, so FitNone, FitContain and
+// FitScaleDown leave a border of the background color while FitCrop, FitCover, FitAuto and FitScale fill the canvas.
+// Transparent pixels are flattened onto the background and the EXIF orientation of the image is applied.
+func (m *manipulator) Canvas(input []byte, w, h int, bgHex string, fitMode FitMode) ([]byte, error) {
+	if w <= 0 || w > maxCanvasSize || h <= 0 || h > maxCanvasSize {
+		return nil, fmt.Errorf("invalid canvas size %dx%d, width and height must be between 1 and %d", w, h,
+			maxCanvasSize)
+	}
+	bg, ok := CleanHexColor(bgHex)
+	if !ok {
+		return nil, fmt.Errorf("invalid background color %q, must be a 6 digit hex color", bgHex)
+	}
+	if _, err := ParseFitMode(string(fitMode)); err != nil {
+		return nil, err
+	}
+	scope := m.normalizeScope("")
+	ms := m.sampledMetricService(scope)
+	if err := m.checkAnimation(input, scope, nil); err != nil {
+		return nil, err
+	}
+	t := time.Now()
+	img, f, err := m.processor.Decode(input)
+	if err != nil {
+		m.metricService.CountImageProcessErrors(getDecodeErrorKey(err), scope, metrics.GetImageFormat(input))
+		return nil, getDecodeError(input, err)
+	}
+	ms.TrackDuration(decodeDurationKey, t, input)
+	orientation, _ := native.GetOrientation(bytes.NewReader(input))
+	img = m.processor.FixOrientation(img, orientation)
+
+	params := map[string]string{width: strconv.Itoa(w), height: strconv.Itoa(h), background: bgHex}
+	img = m.applySize(img, params, fitMode, ms, input, nil)
+	// Padding to the same size still draws the image over the background, which flattens its transparency
+	t = time.Now()
+	img = m.processor.Pad(img, w, h, processor.PointCenter, bg)
+	ms.TrackDuration(padDurationKey, t, input)
+
+	t = time.Now()
+	src, err := m.processor.Encode(img, f)
+	if err != nil {
+		m.metricService.CountImageProcessErrors(encodeErrorKey, scope, f)
+		return nil, err
+	}
+	ms.TrackDuration(encodeDurationKey, t, input)
+	m.release(img)
+	return src, nil
+}
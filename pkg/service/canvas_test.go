@@ -0,0 +1,63 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManipulator_Canvas(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	// The source is 500x375, fitted to 1200x630 it is 840x630 with a 180 pixel border on each side
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	for _, fitMode := range []FitMode{FitNone, FitContain, FitScaleDown, FitCrop, FitCover, FitScale} {
+		out, err := m.Canvas(img, 1200, 630, "ff0000", fitMode)
+		assert.Nil(t, err, fitMode)
+		decoded, _, err := image.Decode(bytes.NewReader(out))
+		assert.Nil(t, err, fitMode)
+		assert.Equal(t, image.Rect(0, 0, 1200, 630), decoded.Bounds(), fitMode)
+
+		red := color.RGBA{R: 255, A: 255}
+		switch fitMode {
+		case FitNone, FitContain:
+			assertColorNear(t, red, decoded.At(10, 315), string(fitMode))
+			assertColorNear(t, red, decoded.At(1190, 315), string(fitMode))
+		case FitScaleDown:
+			// The source is never enlarged, so the border is on every side
+			assertColorNear(t, red, decoded.At(600, 10), string(fitMode))
+			assertColorNear(t, red, decoded.At(10, 315), string(fitMode))
+		default:
+			_, _, _, a := decoded.At(10, 315).RGBA()
+			assert.Equal(t, uint32(0xffff), a, fitMode)
+		}
+	}
+
+	// Transparent pixels are flattened onto the background
+	transparent, _ := ioutil.ReadFile("../processor/native/_testdata/overlay.png")
+	out, err := m.Canvas(transparent, 100, 100, "00ff00", FitScale)
+	assert.Nil(t, err)
+	decoded, _, _ := image.Decode(bytes.NewReader(out))
+	for y := 0; y < 100; y += 10 {
+		for x := 0; x < 100; x += 10 {
+			_, _, _, a := decoded.At(x, y).RGBA()
+			assert.Equal(t, uint32(0xffff), a)
+		}
+	}
+
+	_, err = m.Canvas(img, 0, 630, "ff0000", FitContain)
+	assert.Error(t, err)
+	_, err = m.Canvas(img, 1200, 10000, "ff0000", FitContain)
+	assert.Error(t, err)
+	_, err = m.Canvas(img, 1200, 630, "red", FitContain)
+	assert.Error(t, err)
+	_, err = m.Canvas(img, 1200, 630, "ff0000", FitMode("stretch"))
+	assert.Error(t, err)
+	_, err = m.Canvas([]byte("badImage.ext"), 1200, 630, "ff0000", FitContain)
+	assert.Error(t, err)
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"github.com/gojek/darkroom/pkg/metrics"
+)
+
+// DualResult holds the two encodings of an image processed by ProcessDual
+type DualResult struct {
+	// Fallback holds the output in a format every client supports
+	Fallback []byte
+	// FallbackFormat is the format of Fallback, e.g. jpeg or png
+	FallbackFormat string
+	// WebP holds the same output encoded as WebP, nil if the source was returned as is
+	WebP []byte
+	// WebPFormat is the format of WebP, webp unless WebP is nil
+	WebPFormat string
+}
+
+// ProcessDual takes ProcessSpec as an argument and processes it like Process, but decodes and processes the source
+// once and encodes the result twice: as the Fallback a client without WebP support would get and as WebP, e.g. to
+// serve both from a picture element. The Fallback ignores auto=format and fm=webp, a WebP source becomes a PNG, and
+// max-bytes only applies to it. Animations and sources below min-process-size are returned as is without a WebP.
+func (m *manipulator) ProcessDual(spec processSpec) (DualResult, error) {
+	var webp []byte
+	spec.formats = nil
+	spec.webpOutput = &webp
+	res, err := m.ProcessWithResult(spec)
+	if err != nil {
+		return DualResult{}, err
+	}
+	dr := DualResult{Fallback: res.Data, FallbackFormat: res.Info.Format}
+	if webp != nil {
+		dr.WebP, dr.WebPFormat = webp, metrics.GetImageFormat(webp)
+	}
+	return dr, nil
+}
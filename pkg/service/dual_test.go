@@ -0,0 +1,80 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestManipulator_ProcessDual(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	resized := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	mp.On("Decode", input).Return(decoded, processor.ExtensionJPEG, nil)
+	mp.On("Resize", decoded, 20, 0).Return(resized)
+	mp.On("Encode", resized, processor.ExtensionJPEG).Return([]byte("\xff\xd8\xffjpeg"), nil)
+	mp.On("Encode", resized, processor.ExtensionWebP).Return([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	ms.On("CountFormatChanges", mock.Anything, mock.Anything, mock.Anything)
+
+	// Neither auto=format nor the accepted formats turn the fallback into a WebP
+	spec := NewSpecBuilder().WithImageData(input).WithFormats([]string{"image/webp"}).
+		WithParams(map[string]string{width: "20", auto: format}).Build()
+	res, err := m.ProcessDual(spec)
+	assert.NoError(t, err)
+	assert.Equal(t, DualResult{Fallback: []byte("\xff\xd8\xffjpeg"), FallbackFormat: "jpeg",
+		WebP: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), WebPFormat: "webp"}, res)
+	mp.AssertNumberOfCalls(t, "Decode", 1)
+	mp.AssertNumberOfCalls(t, "Resize", 1)
+
+	// The quality applies to both encodings
+	opts := processor.EncodeOptions{Quality: 50}
+	mp.On("EncodeWithOptions", resized, processor.ExtensionJPEG, opts).Return([]byte("\xff\xd8\xffjpeg"), nil)
+	mp.On("EncodeWithOptions", resized, processor.ExtensionWebP, opts).Return([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), nil)
+	_, err = m.ProcessDual(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "20", quality: "50"}).Build())
+	assert.NoError(t, err)
+	mp.AssertNumberOfCalls(t, "EncodeWithOptions", 2)
+}
+
+func TestManipulator_ProcessDualWithWebPSource(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.webp")
+
+	res, err := m.ProcessDual(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{width: "100", outputFormat: "webp"}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, "png", res.FallbackFormat)
+	assert.Equal(t, "webp", res.WebPFormat)
+	fallback, _, _ := image.DecodeConfig(bytes.NewReader(res.Fallback))
+	webp, _, _ := image.DecodeConfig(bytes.NewReader(res.WebP))
+	assert.Equal(t, 100, fallback.Width)
+	assert.Equal(t, fallback.Width, webp.Width)
+	assert.Equal(t, fallback.Height, webp.Height)
+
+	// Sources returned as is have no WebP
+	res, err = m.ProcessDual(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{minProcess: "5000"}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, img, res.Fallback)
+	assert.Nil(t, res.WebP)
+}
+
+func TestManipulator_ProcessDualWithBufferPool(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(native.WithBufferPool(true)), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	// The grayscale image comes from the pool and is encoded twice
+	res, err := m.ProcessDual(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{mono: blackHexCode}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionJPEG, res.FallbackFormat)
+	assert.Equal(t, processor.ExtensionWebP, res.WebPFormat)
+	assert.NotEmpty(t, res.WebP)
+}
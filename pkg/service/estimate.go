@@ -0,0 +1,194 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+)
+
+// EstimateResult holds the approximate outcome of processing a spec
+type EstimateResult struct {
+	// Width of the output image in pixels
+	Width int
+	// Height of the output image in pixels
+	Height int
+	// Format (extension) the output image would be encoded with
+	Format string
+	// Size is the approximate size of the encoded output in bytes
+	Size int
+}
+
+// Estimate takes ProcessSpec as an argument and returns the resulting dimensions, format and an approximate
+// byte size without decoding the pixels or encoding the output. Only the image header is read, so an opaque
+// PNG is estimated as PNG even though Process may downgrade it to JPEG.
+func (m *manipulator) Estimate(spec processSpec) (EstimateResult, error) {
+	params := joinParams(spec.Params, m.defaultParams)
+	fitMode, err := ParseFitMode(params[fit])
+	if err != nil {
+		return EstimateResult{}, &ValidationError{Problems: []string{err.Error()}}
+	}
+	cfg, f, err := image.DecodeConfig(bytes.NewReader(spec.ImageData))
+	if err != nil {
+		return EstimateResult{}, err
+	}
+
+	srcFormat := f
+	w, h := getSpecDimensions(spec, params, fitMode, cfg.Width, cfg.Height)
+	if _, ok := CleanHexColor(params[chroma]); ok && f != processor.ExtensionWebP {
+		f = processor.ExtensionPNG
+	}
+	for _, a := range strings.Split(params[auto], ",") {
+		if a == format {
+			if spec.IsWebPSupported() {
+				f = processor.ExtensionWebP
+			} else if f == processor.ExtensionWebP {
+				f = processor.ExtensionPNG
+			}
+		}
+	}
+
+	res := EstimateResult{Width: w, Height: h, Format: f}
+	opts := getEncodeOptions(params)
+	srcArea, area := float64(cfg.Width*cfg.Height), float64(w*h)
+	if f == srcFormat && opts.Quality == 0 && srcArea > 0 {
+		// Same format with the default options, the source compression ratio is the best guess
+		res.Size = int(float64(len(spec.ImageData)) * area / srcArea)
+	} else {
+		res.Size = int(area * bitsPerPixel(f, opts.Quality) / 8)
+	}
+	return res, nil
+}
+
+// getRotatedDimensions returns the dimensions of the bounds fitting a w x h image rotated by angle degrees
+func getRotatedDimensions(angle float64, w, h int) (int, int) {
+	sin, cos := math.Abs(math.Sin(angle*math.Pi/180)), math.Abs(math.Cos(angle*math.Pi/180))
+	return int(float64(w)*cos + float64(h)*sin + 0.5), int(float64(w)*sin + float64(h)*cos + 0.5)
+}
+
+// getPerspectiveDimensions returns the dimensions of the image spanning from the origin to the furthest corner
+func getPerspectiveDimensions(corners [4]image.Point) (int, int) {
+	var w, h int
+	for _, c := range corners {
+		if c.X > w {
+			w = c.X
+		}
+		if c.Y > h {
+			h = c.Y
+		}
+	}
+	return w, h
+}
+
+// bitsPerPixel returns a rough figure of the encoded bits per pixel of a photographic image
+func bitsPerPixel(f string, q int) float64 {
+	if q == 0 {
+		q = jpeg.DefaultQuality
+	}
+	lossy := 0.4 + 2.6*math.Pow(float64(q)/100, 2)
+	switch f {
+	case processor.ExtensionWebP:
+		return lossy * 0.75
+	case processor.ExtensionPNG:
+		return 12
+	default:
+		return lossy
+	}
+}
+
+// ComputeDimensions takes ProcessSpec and the width and height of its source image and returns the dimensions
+// Process produces for it, without decoding the image. Only the params of the spec are applied, not the default
+// params of a manipulator, and the EXIF orientation of auto=compress is read from the ImageData if the spec has
+// one. The downscaling of max-bytes depends on the encoded size and is not included. A spec with an invalid
+// fit returns the source dimensions, Process would fail for it.
+func ComputeDimensions(spec processSpec, srcW, srcH int) (int, int) {
+	fitMode, err := ParseFitMode(spec.Params[fit])
+	if err != nil || srcW <= 0 || srcH <= 0 {
+		return srcW, srcH
+	}
+	return getSpecDimensions(spec, spec.Params, fitMode, srcW, srcH)
+}
+
+// getSpecDimensions mirrors the dimension math of Process for a source image of aw x ah, from the resize
+// operations to the even dimensions
+func getSpecDimensions(spec processSpec, params map[string]string, fitMode FitMode, aw, ah int) (int, int) {
+	if isOneOf(strings.Split(params[auto], ",")...)(compress) {
+		if orientation, _ := native.GetOrientation(bytes.NewReader(spec.ImageData)); orientation >= 5 {
+			// Orientations 5-8 are rotated by 90 or 270 degrees before the resize
+			aw, ah = ah, aw
+		}
+	}
+	w, h := getOutputDimensions(getScaledParams(params, aw), fitMode, aw, ah)
+	if angle := CleanFloat(params[rotate], 360); angle > 0 && params[rotateExpand] == "true" {
+		w, h = getRotatedDimensions(angle, w, h)
+	}
+	if spec.Perspective != nil {
+		w, h = getPerspectiveDimensions(*spec.Perspective)
+	}
+	if params[even] == "true" {
+		w, h = getEvenDimensions(w, h)
+	}
+	return w, h
+}
+
+// getOutputDimensions mirrors the dimension math of the resize operations in Process
+// for a source image of aw x ah (actual width x actual height)
+func getOutputDimensions(params map[string]string, fitMode FitMode, aw, ah int) (int, int) {
+	rw, rh := CleanInt(params[width]), CleanInt(params[height])
+	w, h := aw, ah
+	if rw == 0 && rh == 0 {
+		fitMode = FitNone
+	}
+	switch fitMode {
+	case FitCrop, FitCover, FitAuto:
+		if rw != 0 && rh != 0 {
+			w, h = rw, rh
+		} else if rw != 0 || rh != 0 {
+			w, h = getResizeDimensions(rw, rh, aw, ah)
+		}
+	case FitScale, FitFill:
+		if rw != 0 && rh != 0 {
+			w, h = rw, rh
+		} else {
+			w, h = getResizeDimensions(rw, rh, aw, ah)
+		}
+	case FitContain:
+		if rw != 0 && rh != 0 {
+			w, h = rw, rh
+		} else if rw != 0 || rh != 0 {
+			w, h = getResizeDimensions(rw, rh, aw, ah)
+		}
+	case FitScaleDown:
+		if exceedsBox(rw, rh, aw, ah) {
+			w, h = getResizeDimensions(rw, rh, aw, ah)
+		}
+	case FitNone:
+		if params[resize] == outside && rw != 0 && rh != 0 {
+			w, h = getOutsideDimensions(rw, rh, aw, ah)
+		} else if rw != 0 || rh != 0 {
+			w, h = getResizeDimensions(rw, rh, aw, ah)
+		}
+	}
+	if mp := getMaxMegapixels(params); mp > 0 {
+		w, h, _ = getMaxMegapixelsDimensions(mp, w, h)
+	}
+	return w, h
+}
+
+// getResizeDimensions fits rw x rh (required width x required height) inside the box preserving the
+// aspect ratio of aw x ah, a required dimension of 0 is derived from the other one
+func getResizeDimensions(rw, rh, aw, ah int) (int, int) {
+	if rh == 0 {
+		return rw, (rw * ah) / aw
+	} else if rw == 0 {
+		return (rh * aw) / ah, rh
+	}
+	if h := (rw * ah) / aw; h <= rh {
+		return rw, h
+	}
+	return (rh * aw) / ah, rh
+}
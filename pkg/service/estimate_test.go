@@ -0,0 +1,153 @@
+package service
+
+import (
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManipulator_Estimate(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	cases := []struct {
+		params         map[string]string
+		formats        []string
+		expectedWidth  int
+		expectedHeight int
+		expectedFormat string
+	}{
+		{params: map[string]string{}, expectedWidth: 500, expectedHeight: 375, expectedFormat: processor.ExtensionJPEG},
+		{params: map[string]string{width: "250"}, expectedWidth: 250, expectedHeight: 187, expectedFormat: processor.ExtensionJPEG},
+		{params: map[string]string{width: "100", height: "100", fit: crop}, expectedWidth: 100, expectedHeight: 100, expectedFormat: processor.ExtensionJPEG},
+		{params: map[string]string{width: "1000", fit: scaleDown}, expectedWidth: 500, expectedHeight: 375, expectedFormat: processor.ExtensionJPEG},
+		{params: map[string]string{width: "251", even: "true"}, expectedWidth: 250, expectedHeight: 188, expectedFormat: processor.ExtensionJPEG},
+		{params: map[string]string{rotate: "90", rotateExpand: "true"}, expectedWidth: 375, expectedHeight: 500, expectedFormat: processor.ExtensionJPEG},
+		{params: map[string]string{auto: format}, formats: []string{"image/webp"}, expectedWidth: 500, expectedHeight: 375, expectedFormat: processor.ExtensionWebP},
+		{params: map[string]string{chroma: "ffffff"}, expectedWidth: 500, expectedHeight: 375, expectedFormat: processor.ExtensionPNG},
+	}
+	for _, c := range cases {
+		spec := NewSpecBuilder().WithImageData(img).WithParams(c.params).WithFormats(c.formats).Build()
+		res, err := m.Estimate(spec)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expectedWidth, res.Width, c.params)
+		assert.Equal(t, c.expectedHeight, res.Height, c.params)
+		assert.Equal(t, c.expectedFormat, res.Format, c.params)
+		assert.Greater(t, res.Size, 0, c.params)
+	}
+}
+
+func TestManipulator_EstimateIsCloseToProcessedSize(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	spec := NewSpecBuilder().WithImageData(img).WithParams(map[string]string{width: "250"}).Build()
+
+	res, err := m.Estimate(spec)
+	assert.Nil(t, err)
+	out, err := m.Process(spec)
+	assert.Nil(t, err)
+	// Estimates are approximate, being within a factor of 2 is good enough for capacity planning
+	assert.InDelta(t, len(out), res.Size, float64(len(out)))
+}
+
+func TestManipulator_EstimateWithOrientation(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/exif_orientation/f6t.jpg")
+	cases := []struct {
+		params         map[string]string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{params: map[string]string{auto: compress}, expectedWidth: 48, expectedHeight: 80},
+		// The orientation is fixed before the resize, so the width applies to the image as displayed
+		{params: map[string]string{auto: compress, width: "100"}, expectedWidth: 100, expectedHeight: 166},
+		{params: map[string]string{auto: compress, width: "100", height: "50", fit: crop}, expectedWidth: 100, expectedHeight: 50},
+		{params: map[string]string{width: "100"}, expectedWidth: 100, expectedHeight: 60},
+	}
+	for _, c := range cases {
+		spec := NewSpecBuilder().WithImageData(img).WithParams(c.params).Build()
+		res, err := m.Estimate(spec)
+		assert.Nil(t, err)
+		out, _ := m.Process(spec)
+		outImg, _, _ := native.NewBildProcessor().Decode(out)
+		assert.Equal(t, []int{c.expectedWidth, c.expectedHeight}, []int{outImg.Bounds().Dx(), outImg.Bounds().Dy()}, c.params)
+		assert.Equal(t, []int{c.expectedWidth, c.expectedHeight}, []int{res.Width, res.Height}, c.params)
+	}
+}
+
+func TestManipulator_EstimateWithInvalidData(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	_, err := m.Estimate(NewSpecBuilder().WithImageData([]byte("badImage.ext")).Build())
+	assert.Error(t, err)
+}
+
+func Test_getOutputDimensions(t *testing.T) {
+	assert.Equal(t, []int{1000, 500}, dims(getOutputDimensions(map[string]string{}, FitNone, 1000, 500)))
+	assert.Equal(t, []int{200, 100}, dims(getOutputDimensions(map[string]string{width: "200", height: "300"}, FitNone, 1000, 500)))
+	assert.Equal(t, []int{200, 300}, dims(getOutputDimensions(map[string]string{width: "200", height: "300"}, FitCrop, 1000, 500)))
+	assert.Equal(t, []int{200, 100}, dims(getOutputDimensions(map[string]string{width: "200"}, FitCrop, 1000, 500)))
+	assert.Equal(t, []int{200, 300}, dims(getOutputDimensions(map[string]string{width: "200", height: "300"}, FitCover, 1000, 500)))
+	assert.Equal(t, []int{200, 300}, dims(getOutputDimensions(map[string]string{width: "200", height: "300"}, FitScale, 1000, 500)))
+	assert.Equal(t, []int{1000, 500}, dims(getOutputDimensions(map[string]string{width: "2000"}, FitScaleDown, 1000, 500)))
+	assert.Equal(t, []int{200, 300}, dims(getOutputDimensions(map[string]string{width: "200", height: "300"}, FitContain, 1000, 500)))
+	assert.Equal(t, []int{2000, 1000}, dims(getOutputDimensions(map[string]string{width: "2000"}, FitContain, 1000, 500)))
+	assert.Equal(t, []int{200, 300}, dims(getOutputDimensions(map[string]string{width: "200", height: "300"}, FitFill, 1000, 500)))
+	assert.Equal(t, []int{1414, 707}, dims(getOutputDimensions(map[string]string{maxMP: "1"}, FitNone, 2000, 1000)))
+	assert.Equal(t, []int{1000, 500}, dims(getOutputDimensions(map[string]string{}, FitCrop, 1000, 500)))
+	assert.Equal(t, []int{1000, 500}, dims(getOutputDimensions(map[string]string{}, FitScale, 1000, 500)))
+	assert.Equal(t, []int{200, 100}, dims(getOutputDimensions(map[string]string{width: "200"}, FitScale, 1000, 500)))
+}
+
+func dims(w, h int) []int {
+	return []int{w, h}
+}
+
+func Test_getRotatedDimensions(t *testing.T) {
+	assert.Equal(t, []int{500, 1000}, dims(getRotatedDimensions(90, 1000, 500)))
+	assert.Equal(t, []int{1000, 500}, dims(getRotatedDimensions(180, 1000, 500)))
+	assert.Equal(t, []int{1061, 1061}, dims(getRotatedDimensions(45, 1000, 500)))
+}
+
+func Test_getPerspectiveDimensions(t *testing.T) {
+	corners := [4]image.Point{{X: 20, Y: -10}, {X: 200, Y: 30}, {X: 180, Y: 250}, {X: -5, Y: 170}}
+	assert.Equal(t, []int{200, 250}, dims(getPerspectiveDimensions(corners)))
+}
+
+func TestComputeDimensions(t *testing.T) {
+	cases := []struct {
+		params         map[string]string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{params: nil, expectedWidth: 500, expectedHeight: 375},
+		{params: map[string]string{width: "250"}, expectedWidth: 250, expectedHeight: 187},
+		{params: map[string]string{height: "75", fit: crop}, expectedWidth: 100, expectedHeight: 75},
+		{params: map[string]string{width: "100", height: "100", fit: crop}, expectedWidth: 100, expectedHeight: 100},
+		{params: map[string]string{width: "100", height: "100", fit: contain}, expectedWidth: 100, expectedHeight: 100},
+		{params: map[string]string{width: "100", height: "100"}, expectedWidth: 100, expectedHeight: 75},
+		{params: map[string]string{width: "100", height: "100", resize: outside}, expectedWidth: 133, expectedHeight: 100},
+		{params: map[string]string{width: "1000", fit: scaleDown}, expectedWidth: 500, expectedHeight: 375},
+		{params: map[string]string{width: "251", even: "true"}, expectedWidth: 250, expectedHeight: 188},
+		{params: map[string]string{rotate: "90", rotateExpand: "true"}, expectedWidth: 375, expectedHeight: 500},
+		{params: map[string]string{fit: "stretch", width: "100"}, expectedWidth: 500, expectedHeight: 375},
+		{params: map[string]string{scale: "0.5"}, expectedWidth: 250, expectedHeight: 187},
+		{params: map[string]string{scale: "20%"}, expectedWidth: 100, expectedHeight: 75},
+		{params: map[string]string{scale: "0.5", width: "100"}, expectedWidth: 100, expectedHeight: 75},
+		{params: map[string]string{scale: "5"}, expectedWidth: 500, expectedHeight: 375},
+	}
+	for _, c := range cases {
+		w, h := ComputeDimensions(NewSpecBuilder().WithParams(c.params).Build(), 500, 375)
+		assert.Equal(t, c.expectedWidth, w, c.params)
+		assert.Equal(t, c.expectedHeight, h, c.params)
+	}
+
+	// The EXIF orientation is only read with auto=compress, the requested width applies to the rotated image
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/exif_orientation/f6t.jpg")
+	spec := NewSpecBuilder().WithImageData(img).WithParams(map[string]string{width: "100", auto: compress}).Build()
+	w, h := ComputeDimensions(spec, 400, 300)
+	assert.Equal(t, []int{100, 133}, []int{w, h})
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FitMode is the value of the fit param, it defines how the image is resized to the w x h box
+type FitMode string
+
+const (
+	// FitNone resizes the image preserving its aspect ratio so that it fits inside the box, or so that
+	// it covers the box with resize=outside
+	FitNone FitMode = ""
+	// FitCrop fills the box preserving the aspect ratio and crops the overflowing dimension
+	FitCrop FitMode = crop
+	// FitCover is like FitCrop but rounds the overflowing dimension instead of truncating it
+	FitCover FitMode = cover
+	// FitContain fits the image inside the box preserving the aspect ratio and pads it to the box
+	FitContain FitMode = contain
+	// FitScale stretches the image to the box ignoring the aspect ratio
+	FitScale FitMode = scale
+	// FitFill is an alias of FitScale
+	FitFill FitMode = fill
+	// FitScaleDown is like FitNone but never enlarges the image
+	FitScaleDown FitMode = scaleDown
+	// FitAuto fills the box like FitCrop with the crop window picked from the content of the image, the faces found
+	// by the FaceDetector set WithFaceDetector or the most detailed region of the image without faces
+	FitAuto FitMode = autoFit
+)
+
+// fitModes are the valid values of the fit param besides FitNone
+var fitModes = []FitMode{FitCrop, FitCover, FitContain, FitScale, FitFill, FitScaleDown, FitAuto}
+
+// ParseFitMode returns the FitMode for the value of the fit param, an empty value is FitNone
+// and an unknown one returns an error
+func ParseFitMode(input string) (FitMode, error) {
+	if input == "" {
+		return FitNone, nil
+	}
+	for _, m := range fitModes {
+		if FitMode(input) == m {
+			return m, nil
+		}
+	}
+	return FitNone, fmt.Errorf("unknown fit mode %q, must be %s", input, fitModeNames())
+}
+
+// fitModeNames returns the list of valid fit modes for error messages, e.g. "one of crop, cover or contain"
+func fitModeNames() string {
+	names := make([]string, len(fitModes))
+	for i, m := range fitModes {
+		names[i] = string(m)
+	}
+	return fmt.Sprintf("one of %s or %s", strings.Join(names[:len(names)-1], ", "), names[len(names)-1])
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFitMode(t *testing.T) {
+	cases := map[string]FitMode{
+		"":           FitNone,
+		"crop":       FitCrop,
+		"cover":      FitCover,
+		"contain":    FitContain,
+		"scale":      FitScale,
+		"fill":       FitFill,
+		"scale-down": FitScaleDown,
+	}
+	for input, expected := range cases {
+		m, err := ParseFitMode(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, m)
+	}
+
+	for _, input := range []string{"stretch", "Crop", "crop,cover", " "} {
+		m, err := ParseFitMode(input)
+		assert.Error(t, err, input)
+		assert.Equal(t, FitNone, m)
+	}
+	_, err := ParseFitMode("stretch")
+	assert.EqualError(t, err, `unknown fit mode "stretch", must be one of crop, cover, contain, scale, fill, scale-down or auto`)
+}
@@ -0,0 +1,118 @@
+// Package handler provides an optional http.Handler which exposes a service.Manipulator over HTTP
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/service"
+)
+
+const (
+	// ContentTypeHeader is the response header key used to set the content type of the processed image
+	ContentTypeHeader = "Content-Type"
+	// ContentLengthHeader is the response header key used to set content length
+	ContentLengthHeader = "Content-Length"
+	// AcceptHeader is the request header key used to read the formats accepted by the client
+	AcceptHeader = "Accept"
+	// DefaultMaxBodyBytes is the largest request body the ProcessHandler reads unless set WithMaxBodyBytes
+	DefaultMaxBodyBytes = 32 << 20
+)
+
+type config struct {
+	maxBodyBytes int64
+}
+
+// Option represents the ProcessHandler options
+type Option func(*config)
+
+// WithMaxBodyBytes is a builder function to set the largest request body in bytes the ProcessHandler reads,
+// larger requests are answered with 413 Request Entity Too Large, the default is DefaultMaxBodyBytes
+func WithMaxBodyBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBodyBytes = n
+	}
+}
+
+// ProcessHandler returns a http.HandlerFunc which reads the request body as the image data and the
+// query parameters as the params of the processing job, processes the image with the given
+// service.Manipulator and writes the result with the detected Content-Type
+func ProcessHandler(m service.Manipulator, opts ...Option) http.HandlerFunc {
+	c := &config{maxBodyBytes: DefaultMaxBodyBytes}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > c.maxBodyBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, c.maxBodyBytes))
+		// The reader returns the first maxBodyBytes of a larger body and then fails
+		if err != nil && int64(len(data)) >= c.maxBodyBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil || len(data) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		params := make(map[string]string)
+		values := r.URL.Query()
+		for v := range values {
+			if len(values.Get(v)) != 0 {
+				params[v] = values.Get(v)
+			}
+		}
+
+		spec := service.NewSpecBuilder().
+			WithImageData(data).
+			WithParams(params).
+			WithFormats(acceptedFormats(r)).
+			WithContext(r.Context()).
+			Build()
+		data, err = m.Process(spec)
+		if errors.Is(err, service.ErrBusy) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, service.ErrPixelBudgetExceeded) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, service.ErrParamNotAllowed) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var validationErr *service.ValidationError
+		if errors.Is(err, service.ErrEmptyInput) || errors.Is(err, service.ErrCorruptImage) ||
+			errors.As(err, &validationErr) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set(ContentTypeHeader, processor.DetectContentType(data))
+		w.Header().Set(ContentLengthHeader, fmt.Sprintf("%d", len(data)))
+		_, _ = w.Write(data)
+	}
+}
+
+func acceptedFormats(r *http.Request) []string {
+	var formats []string
+	for _, f := range strings.Split(r.Header.Get(AcceptHeader), ",") {
+		// Drop the parameters like quality factor (q=0.8) from the media range
+		if f = strings.TrimSpace(strings.Split(f, ";")[0]); f != "" {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
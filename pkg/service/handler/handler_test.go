@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProcessHandler(t *testing.T) {
+	input, _ := ioutil.ReadFile("../../processor/native/_testdata/test.png")
+	output := []byte("\x89PNG\x0D\x0A\x1A\x0Aprocessed")
+	m := &service.MockManipulator{}
+	m.On("Process", mock.AnythingOfType("service.processSpec")).Return(output, nil)
+
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100&h=&fit=crop", bytes.NewReader(input))
+	r.Header.Set(AcceptHeader, "image/webp;q=0.9, image/png")
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, output, rr.Body.Bytes())
+	assert.Equal(t, "image/png", rr.Header().Get(ContentTypeHeader))
+	assert.Equal(t, fmt.Sprintf("%d", len(output)), rr.Header().Get(ContentLengthHeader))
+	m.AssertExpectations(t)
+}
+
+func TestProcessHandlerWithEmptyBody(t *testing.T) {
+	m := &service.MockManipulator{}
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100", bytes.NewReader(nil))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	m.AssertNotCalled(t, "Process", mock.Anything)
+}
+
+func TestProcessHandlerWithTooLargeBody(t *testing.T) {
+	m := &service.MockManipulator{}
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100", bytes.NewReader([]byte("0123456789")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m, WithMaxBodyBytes(4)).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// Without a Content-Length the body is cut off while reading
+	r, _ = http.NewRequest(http.MethodPost, "/?w=100", ioutil.NopCloser(bytes.NewReader([]byte("0123456789"))))
+	r.ContentLength = -1
+	rr = httptest.NewRecorder()
+
+	ProcessHandler(m, WithMaxBodyBytes(4)).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	m.AssertNotCalled(t, "Process", mock.Anything)
+}
+
+func TestProcessHandlerWithProcessingError(t *testing.T) {
+	m := &service.MockManipulator{}
+	m.On("Process", mock.Anything).Return([]byte(nil), errors.New("error"))
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100", bytes.NewReader([]byte("data")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, "", rr.Body.String())
+}
+
+func TestProcessHandlerWhenBusy(t *testing.T) {
+	m := &service.MockManipulator{}
+	m.On("Process", mock.Anything).Return([]byte(nil), fmt.Errorf("%w: scope", service.ErrBusy))
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100", bytes.NewReader([]byte("data")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestProcessHandlerWhenPixelBudgetExceeded(t *testing.T) {
+	m := &service.MockManipulator{}
+	m.On("Process", mock.Anything).Return([]byte(nil), fmt.Errorf("%w: scope", service.ErrPixelBudgetExceeded))
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100", bytes.NewReader([]byte("data")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+}
+
+func TestProcessHandlerWhenParamNotAllowed(t *testing.T) {
+	m := &service.MockManipulator{}
+	m.On("Process", mock.Anything).Return([]byte(nil), fmt.Errorf("%w: rot", service.ErrParamNotAllowed))
+	r, _ := http.NewRequest(http.MethodPost, "/?rot=45", bytes.NewReader([]byte("data")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestProcessHandlerWhenImageIsCorrupt(t *testing.T) {
+	m := &service.MockManipulator{}
+	m.On("Process", mock.Anything).Return([]byte(nil), fmt.Errorf("%w: unexpected EOF", service.ErrCorruptImage))
+	r, _ := http.NewRequest(http.MethodPost, "/?w=100", bytes.NewReader([]byte("data")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestProcessHandlerWithInvalidParams(t *testing.T) {
+	m := &service.MockManipulator{}
+	m.On("Process", mock.Anything).Return([]byte(nil),
+		&service.ValidationError{Problems: []string{`unknown fit mode "stretch"`}})
+	r, _ := http.NewRequest(http.MethodPost, "/?fit=stretch", bytes.NewReader([]byte("data")))
+	rr := httptest.NewRecorder()
+
+	ProcessHandler(m).ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAcceptedFormats(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	assert.Nil(t, acceptedFormats(r))
+
+	r.Header.Set(AcceptHeader, "image/avif,image/webp;q=0.8, */*")
+	assert.Equal(t, []string{"image/avif", "image/webp", "*/*"}, acceptedFormats(r))
+}
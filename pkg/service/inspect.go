@@ -0,0 +1,73 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+)
+
+// ErrCorruptImage is wrapped by the error Verify returns for image data that can't be decoded completely
+var ErrCorruptImage = errors.New("corrupt image")
+
+// ErrEmptyInput is returned by Process for a spec without any image data, e.g. a zero-byte upload
+var ErrEmptyInput = errors.New("empty image data")
+
+// ImageInfo holds the properties of a source image read from its header
+type ImageInfo struct {
+	// Width of the image in pixels as it is displayed, i.e. after applying the EXIF orientation
+	Width int
+	// Height of the image in pixels as it is displayed, i.e. after applying the EXIF orientation
+	Height int
+	// Format (extension) the image is encoded with
+	Format string
+	// Orientation is the EXIF orientation tag (1-8) of the image, 0 if it has none
+	Orientation int
+}
+
+// Inspect takes the image data as an argument and returns its ImageInfo without decoding the pixels.
+// The dimensions are those of the image with the EXIF orientation applied like Process does with
+// auto=compress, i.e. the width and height of orientations 5-8 (rotated by 90 or 270 degrees) are swapped.
+//
+// Only the headers are read, up to the frame header of a JPEG (including progressive ones), the IHDR chunk
+// of a PNG and the VP8 header of a WebP, so the cost doesn't depend on the number of pixels. SVGs are parsed
+// but not rendered and report the size they are rasterized at with the "svg" format.
+func (m *manipulator) Inspect(data []byte) (ImageInfo, error) {
+	if processor.DetectContentType(data) == processor.ContentTypeSVG {
+		cfg, err := native.DecodeSVGConfig(data)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		return ImageInfo{Width: cfg.Width, Height: cfg.Height, Format: processor.ExtensionSVG}, nil
+	}
+	cfg, f, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	orientation, _ := native.GetOrientation(bytes.NewReader(data))
+	info := ImageInfo{Width: cfg.Width, Height: cfg.Height, Format: f, Orientation: orientation}
+	if orientation >= 5 {
+		info.Width, info.Height = cfg.Height, cfg.Width
+	}
+	return info, nil
+}
+
+// Verify takes the image data as an argument and decodes all of its pixels, every frame of an animated PNG or WebP,
+// and returns an error wrapping ErrCorruptImage if that fails. Unlike Inspect, which only reads the headers, it
+// catches data truncated or damaged after the headers, e.g. a derivative partially written before a crash. SVGs
+// are rendered.
+func (m *manipulator) Verify(data []byte) error {
+	var err error
+	if processor.IsAnimatedPNG(data) || processor.IsAnimatedWebP(data) {
+		_, err = m.processor.DecodeAnimation(data)
+	} else {
+		_, _, err = m.processor.Decode(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManipulator_Inspect(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	expected, _ := ioutil.ReadFile("../processor/native/_testdata/exif_orientation/expected.jpg")
+	info, err := m.Inspect(expected)
+	assert.Nil(t, err)
+	assert.Equal(t, processor.ExtensionJPEG, info.Format)
+	assert.Equal(t, 0, info.Orientation)
+
+	for orientation := 2; orientation <= 8; orientation++ {
+		img, _ := ioutil.ReadFile(fmt.Sprintf("../processor/native/_testdata/exif_orientation/f%dt.jpg", orientation))
+		res, err := m.Inspect(img)
+		assert.Nil(t, err)
+		assert.Equal(t, orientation, res.Orientation)
+		// Every sample displays like expected.jpg once its orientation is applied
+		assert.Equal(t, info.Width, res.Width, orientation)
+		assert.Equal(t, info.Height, res.Height, orientation)
+
+		out, _ := m.Process(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{auto: compress}).Build())
+		outImg, _, _ := native.NewBildProcessor().Decode(out)
+		assert.Equal(t, outImg.Bounds().Dx(), res.Width, orientation)
+		assert.Equal(t, outImg.Bounds().Dy(), res.Height, orientation)
+	}
+
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	info, err = m.Inspect(img)
+	assert.Nil(t, err)
+	assert.Equal(t, ImageInfo{Width: 500, Height: 375, Format: processor.ExtensionPNG}, info)
+
+	_, err = m.Inspect([]byte("badImage.ext"))
+	assert.Error(t, err)
+}
+
+func TestManipulator_Verify(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	for _, file := range []string{"test.jpg", "test.png", "test.webp"} {
+		img, _ := ioutil.ReadFile("../processor/native/_testdata/" + file)
+		assert.NoError(t, m.Verify(img), file)
+
+		// The headers of a truncated image are intact, so only a full decode notices
+		truncated := img[:len(img)*2/3]
+		_, err := m.Inspect(truncated)
+		assert.NoError(t, err, file)
+		err = m.Verify(truncated)
+		assert.True(t, errors.Is(err, ErrCorruptImage), file)
+	}
+
+	anim := &processor.Animation{Delays: []time.Duration{time.Second, time.Second}}
+	for i := 0; i < 2; i++ {
+		anim.Frames = append(anim.Frames, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	}
+	apng, err := native.NewBildProcessor().EncodeAnimation(anim)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Verify(apng))
+	assert.True(t, errors.Is(m.Verify(apng[:len(apng)-40]), ErrCorruptImage))
+
+	assert.True(t, errors.Is(m.Verify(nil), ErrCorruptImage))
+}
+
+// getJPEGHeaders returns the offset of the frame header (SOF0-SOF2 segment) of a JPEG and the length of its
+// headers, i.e. the segments up to and including the header of the first scan but none of its entropy coded data
+func getJPEGHeaders(t *testing.T, data []byte) (int, int) {
+	sof := 0
+	for i := 2; i+4 <= len(data); {
+		if marker := data[i+1]; marker >= 0xc0 && marker <= 0xc2 {
+			sof = i
+		} else if marker == 0xda {
+			return sof, i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		}
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+	}
+	t.Fatal("jpeg has no scan")
+	return 0, 0
+}
+
+func TestManipulator_InspectReadsOnlyHeaders(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	jpg, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	png, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	webp, _ := ioutil.ReadFile("../processor/native/_testdata/test.webp")
+	progressive, _ := ioutil.ReadFile("../processor/native/_testdata/test_progressive.jpg")
+	_, n := getJPEGHeaders(t, jpg)
+	// A progressive JPEG is marked by its frame header, its first scan only holds the DC coefficients
+	sof, pn := getJPEGHeaders(t, progressive)
+	assert.Equal(t, byte(0xc2), progressive[sof+1])
+
+	cases := []struct {
+		name   string
+		data   []byte
+		header []byte
+	}{
+		{name: "jpeg", data: jpg, header: jpg[:n]},
+		{name: "progressive jpeg", data: progressive, header: progressive[:pn]},
+		// Signature and IHDR chunk
+		{name: "png", data: png, header: png[:33]},
+		// RIFF header and the VP8 frame header
+		{name: "webp", data: webp, header: webp[:30]},
+	}
+	for _, c := range cases {
+		full, err := m.Inspect(c.data)
+		assert.Nil(t, err, c.name)
+
+		// The data cut after the header can't be decoded, but inspects the same
+		_, _, err = native.NewBildProcessor().Decode(c.header)
+		assert.Error(t, err, c.name)
+		info, err := m.Inspect(c.header)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, full, info, c.name)
+	}
+}
+
+func TestManipulator_InspectSVG(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	info, err := m.Inspect([]byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 40 20"></svg>`))
+	assert.Nil(t, err)
+	assert.Equal(t, ImageInfo{Width: 40, Height: 20, Format: processor.ExtensionSVG}, info)
+}
+
+// BenchmarkManipulator_Inspect shows that inspecting takes the same time independent of the image dimensions
+func BenchmarkManipulator_Inspect(b *testing.B) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	for _, size := range []int{100, 1000, 4000} {
+		img := image.NewRGBA(image.Rect(0, 0, size, size))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i * 7919)
+		}
+		jpg, pngData := &bytes.Buffer{}, &bytes.Buffer{}
+		_ = jpeg.Encode(jpg, img, nil)
+		_ = png.Encode(pngData, img)
+		for i, data := range [][]byte{jpg.Bytes(), pngData.Bytes()} {
+			b.Run(fmt.Sprintf("%s/%dx%d", []string{"jpeg", "png"}[i], size, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, _ = m.Inspect(data)
+				}
+			})
+		}
+	}
+}
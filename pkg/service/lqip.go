@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/color"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+)
+
+const (
+	// defaultLQIPSize is the longer side of a placeholder in pixels if LQIP is called with a maxDim of 0
+	defaultLQIPSize = 32
+	// maxLQIPSize is the largest maxDim of a placeholder, larger ones would no longer fit in a few hundred bytes
+	maxLQIPSize = 64
+	// lqipQuality is the JPEG quality of a placeholder, the blur hides the artifacts
+	lqipQuality = 30
+	// lqipDataURIPrefix is the prefix of the data URI returned by LQIP
+	lqipDataURIPrefix = "data:image/jpeg;base64,"
+)
+
+// LQIPGenerator is implemented by the Manipulator of NewManipulator, callers assert it on a Manipulator so that
+// implementations outside of darkroom don't have to create placeholders
+type LQIPGenerator interface {
+	// LQIP takes the image data and the maximum width and height of the placeholder and returns a data URI of a
+	// tiny blurred JPEG of the image to inline while the image loads
+	LQIP(input []byte, maxDim int) (string, error)
+}
+
+// LQIP takes the image data and the maximum width and height of the placeholder in pixels and returns a low
+// quality image placeholder, a data:image/jpeg;base64 URI of the image downscaled to fit maxDim x maxDim, blurred and
+// encoded at a low quality, to be inlined in HTML while the image itself loads. A maxDim of 0 uses 32 pixels, which
+// keeps the placeholder at a few hundred bytes, and at most 64 pixels are allowed. Smaller images are not upscaled,
+// transparent pixels are flattened onto white and the EXIF orientation of the image is applied.
+func (m *manipulator) LQIP(input []byte, maxDim int) (string, error) {
+	if maxDim == 0 {
+		maxDim = defaultLQIPSize
+	}
+	if maxDim < 0 || maxDim > maxLQIPSize {
+		return "", fmt.Errorf("invalid placeholder size %d, must be between 1 and %d", maxDim, maxLQIPSize)
+	}
+	if len(input) == 0 {
+		return "", ErrEmptyInput
+	}
+	scope := m.normalizeScope("")
+	ms := m.sampledMetricService(scope)
+	// A placeholder is cheap to encode, but decoding its source takes a slot and is charged like any other
+	spec := processSpec{Scope: scope, ImageData: input}
+	release, err := m.acquireSlot(spec, ms)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	charged, err := m.chargePixels(spec)
+	if err != nil {
+		return "", err
+	}
+	if err := m.checkAnimation(input, scope, nil); err != nil {
+		return "", err
+	}
+	t := time.Now()
+	img, _, err := m.processor.Decode(input)
+	if err != nil {
+		m.metricService.CountImageProcessErrors(getDecodeErrorKey(err), scope, metrics.GetImageFormat(input))
+		return "", getDecodeError(input, err)
+	}
+	ms.TrackDuration(decodeDurationKey, t, input)
+	if charged == 0 {
+		m.chargeDecodedPixels(spec, img)
+	}
+	orientation, _ := native.GetOrientation(bytes.NewReader(input))
+	img = m.processor.FixOrientation(img, orientation)
+
+	if b := img.Bounds(); b.Dx() > maxDim || b.Dy() > maxDim {
+		w, h := maxDim, 0
+		if b.Dy() > b.Dx() {
+			w, h = 0, maxDim
+		}
+		t = time.Now()
+		img = m.processor.Resize(img, w, h)
+		ms.TrackDuration(resizeDurationKey, t, input)
+	}
+	t = time.Now()
+	img = m.processor.Blur(img, float64(maxDim)/16)
+	ms.TrackDuration(blurDurationKey, t, input)
+
+	t = time.Now()
+	out, err := m.processor.EncodeWithOptions(img, processor.ExtensionJPG,
+		processor.EncodeOptions{Quality: lqipQuality, Background: color.White})
+	if err != nil {
+		m.metricService.CountImageProcessErrors(encodeErrorKey, scope, processor.ExtensionJPG)
+		return "", err
+	}
+	ms.TrackDuration(encodeDurationKey, t, input)
+	m.release(img)
+	return lqipDataURIPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
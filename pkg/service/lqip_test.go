@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestManipulator_LQIP(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{}).(LQIPGenerator)
+	// The source is 500x375
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	for maxDim, size := range map[int]image.Rectangle{
+		0:  image.Rect(0, 0, 32, 24),
+		16: image.Rect(0, 0, 16, 12),
+		64: image.Rect(0, 0, 64, 48),
+	} {
+		uri, err := m.LQIP(img, maxDim)
+		assert.Nil(t, err, maxDim)
+		assert.True(t, strings.HasPrefix(uri, "data:image/jpeg;base64,"), maxDim)
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, "data:image/jpeg;base64,"))
+		assert.Nil(t, err, maxDim)
+		decoded, f, err := image.Decode(bytes.NewReader(data))
+		assert.Nil(t, err, maxDim)
+		assert.Equal(t, "jpeg", f, maxDim)
+		assert.Equal(t, size, decoded.Bounds(), maxDim)
+	}
+
+	// The default placeholder is small enough to inline
+	uri, _ := m.LQIP(img, 0)
+	assert.Less(t, len(uri), 1024)
+
+	// Smaller images are not upscaled, the portrait ones are fitted by their height
+	for src, size := range map[image.Rectangle]image.Rectangle{
+		image.Rect(0, 0, 10, 20):  image.Rect(0, 0, 10, 20),
+		image.Rect(0, 0, 60, 120): image.Rect(0, 0, 16, 32),
+	} {
+		buf := &bytes.Buffer{}
+		_ = png.Encode(buf, image.NewNRGBA(src))
+		uri, err := m.LQIP(buf.Bytes(), 0)
+		assert.Nil(t, err, src)
+		data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, "data:image/jpeg;base64,"))
+		cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
+		assert.Equal(t, size, image.Rect(0, 0, cfg.Width, cfg.Height), src)
+	}
+
+	_, err := m.LQIP(img, -1)
+	assert.Error(t, err)
+	_, err = m.LQIP(img, 65)
+	assert.Error(t, err)
+	_, err = m.LQIP(nil, 0)
+	assert.Equal(t, ErrEmptyInput, err)
+	_, err = m.LQIP([]byte("not an image"), 0)
+	assert.Error(t, err)
+}
+
+func TestManipulator_LQIPWithSlotsAndPixelBudget(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", defaultScope, 500*375)
+	ms.On("CountImageProcessErrors", mock.Anything, mock.Anything, mock.Anything)
+
+	m := NewManipulator(native.NewBildProcessor(), nil, ms, WithMaxConcurrency(1), WithRejectWhenBusy(true)).(*manipulator)
+	m.slots <- struct{}{}
+	_, err := m.LQIP(img, 0)
+	assert.Equal(t, ErrBusy, err)
+	<-m.slots
+	_, err = m.LQIP(img, 0)
+	assert.NoError(t, err)
+	assert.Len(t, m.slots, 0)
+	ms.AssertCalled(t, "CountProcessedPixels", defaultScope, 500*375)
+
+	m = NewManipulator(native.NewBildProcessor(), nil, ms, WithPixelBudget(map[string]float64{defaultScope: 0.1})).(*manipulator)
+	_, err = m.LQIP(img, 0)
+	assert.NoError(t, err)
+	_, err = m.LQIP(img, 0)
+	assert.True(t, errors.Is(err, ErrPixelBudgetExceeded))
+}
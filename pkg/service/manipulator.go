@@ -2,10 +2,20 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"math"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gojek/darkroom/pkg/metrics"
@@ -18,115 +28,985 @@ const (
 	height       = "h"
 	fit          = "fit"
 	crop         = "crop"
+	cropOffsetX  = "crop-offset-x"
+	cropOffsetY  = "crop-offset-y"
+	facePad      = "face-pad"
 	mono         = "mono"
+	monoGray     = "mono-gray"
+	desat        = "desat"
+	pad          = "pad"
 	blackHexCode = "000000"
 	flip         = "flip"
 	rotate       = "rot"
+	rotateExpand = "rot-expand"
 	auto         = "auto"
 	blur         = "blur"
 	compress     = "compress"
 	format       = "format"
-	scale        = "scale"
+	scale        = "scale" // The scale param and the fit=scale value
+	scaleDown    = "scale-down"
+	autoFit      = "auto" // The fit=auto value, unlike auto which is the auto param
+	fill         = "fill"
+	contain      = "contain"
+	cover        = "cover"
+	resize       = "resize"
+	inside       = "inside"
+	outside      = "outside"
+	even         = "even"
+	gravity      = "gravity"
+	background   = "bg"
+	channel      = "channel"
+	duotone      = "duotone"
+	recolor      = "recolor"
+	recolorTol   = "recolor-tol"
+	solarize     = "solarize"
+	chroma       = "chroma"
+	chromaTol    = "chroma-tol"
+	splash       = "splash"
+	splashTol    = "splash-tol"
+	overlayColor = "overlay-color"
+	overlayAlpha = "overlay-opacity"
+	denoise      = "denoise"
+	autoSharpen  = "auto-sharpen"
+	sharpenAmt   = "sharpen-amount"
+	maxMP        = "max-mp"
+	minProcess   = "min-process-size"
+	maxBytes     = "max-bytes"
+	downscale    = "allow-downscale"
+	colors       = "colors"
+	dither       = "dither"
+	ditherNone   = "none"
+	ditherFS     = "floyd-steinberg"
+	profile      = "profile"
+	profileFast  = "fast"
+	profileBest  = "best"
+	quality      = "q"
+	outputFormat = "fm"
+	dpi          = "dpi"
+
+	preserveMetadata = "preserve-metadata"
+
+	// maxDimension is the largest width, height or position in pixels a param or the spec can set
+	maxDimension = 9999
+	// maxMegapixels is the largest area in megapixels max-mp can limit an image to
+	maxMegapixels = 1000
+
+	maxDenoiseRadius = 5
+	defaultSharpen   = 0.5
+	defaultFacePad   = 20
+	maxSharpenAmount = 5
+	defaultTolerance = 32
+	defaultOverlay   = 128
+	minScaleFactor   = 0.01
+	maxScaleFactor   = 4
+	padBlurDivisor   = 20
+	defaultScope     = "default"
 
 	cropDurationKey      = "cropDuration"
 	decodeDurationKey    = "decodeDuration"
 	encodeDurationKey    = "encodeDuration"
 	grayScaleDurationKey = "grayScaleDuration"
+	desatDurationKey     = "desaturateDuration"
 	blurDurationKey      = "blurDuration"
 	resizeDurationKey    = "resizeDuration"
 	flipDurationKey      = "flipDuration"
 	rotateDurationKey    = "rotateDuration"
 	fixOrientationKey    = "fixOrientation"
 	scaleDurationKey     = "scaleDuration"
+	duotoneDurationKey   = "duotoneDuration"
+	recolorDurationKey   = "recolorDuration"
+	solarizeDurationKey  = "solarizeDuration"
+	chromaKeyDurationKey = "chromaKeyDuration"
+	colorWashDurationKey = "colorWashDuration"
+	splashDurationKey    = "splashDuration"
+	denoiseDurationKey   = "denoiseDuration"
+	sharpenDurationKey   = "sharpenDuration"
+	channelDurationKey   = "channelDuration"
+	padDurationKey       = "padDuration"
+	perspectiveKey       = "perspectiveDuration"
+	quantizeDurationKey  = "quantizeDuration"
+	queueDurationKey     = "queueDuration"
+	faceDetectKey        = "faceDetectDuration"
+
+	decodeErrorKey = "decodeError"
+	// decodeTimeoutKey counts the decodes that took longer than native.WithDecodeTimeout allows
+	decodeTimeoutKey = "decodeTimeout"
+	encodeErrorKey   = "encodeError"
+	busyErrorKey     = "busyError"
+	// animationErrorKey counts the animated images whose frames after the first one were dropped or rejected
+	animationErrorKey = "animationError"
 )
 
+// ErrBusy is returned by Process when WithMaxConcurrency is set together with WithRejectWhenBusy and the
+// maximum number of images are already being processed
+var ErrBusy = errors.New("too many images are being processed")
+
+// ErrAnimationDropped is returned when WithRejectAnimated is set for an animated image that would be processed
+// as a single frame, i.e. an animated GIF or an animated image passed to Canvas or LQIP
+var ErrAnimationDropped = errors.New("animated image can't be processed without dropping its frames")
+
+// ErrParamNotAllowed is returned by Process for a spec with a param that isn't allowed WithAllowedParams, the
+// returned error wraps it with the disallowed params
+var ErrParamNotAllowed = errors.New("param not allowed")
+
 // Manipulator interface sets the contract on the implementation for common processing support in darkroom
 type Manipulator interface {
 	// Process takes ProcessSpec as an argument and returns []byte, error
 	Process(spec processSpec) ([]byte, error)
 
+	// ProcessWithInfo takes ProcessSpec as an argument and returns []byte, the ProcessInfo of the output, error
+	ProcessWithInfo(spec processSpec) ([]byte, ProcessInfo, error)
+
+	// ProcessWithResult takes ProcessSpec as an argument and returns the ProcessResult with the output and the
+	// Warnings of processing it, error
+	ProcessWithResult(spec processSpec) (ProcessResult, error)
+
+	// ProcessDual takes ProcessSpec as an argument and returns the DualResult with the output encoded both in a format
+	// every client supports and as WebP from a single decode, error
+	ProcessDual(spec processSpec) (DualResult, error)
+
+	// ProcessFromSource reads the image data of spec from source and processes it like Process
+	ProcessFromSource(ctx context.Context, source Source, spec processSpec) ([]byte, error)
+
+	// Validate takes ProcessSpec as an argument and returns a *ValidationError listing every invalid param
+	Validate(spec processSpec) error
+
+	// Estimate takes ProcessSpec as an argument and returns the approximate EstimateResult of processing it
+	Estimate(spec processSpec) (EstimateResult, error)
+
+	// Canvas takes the image data, the size of the canvas, a hex background color and a FitMode and returns the
+	// image fitted and centered on a canvas of exactly that size filled with the background color
+	Canvas(input []byte, width, height int, bgHex string, fitMode FitMode) ([]byte, error)
+
+	// Inspect takes the image data as an argument and returns its orientation corrected ImageInfo
+	Inspect(data []byte) (ImageInfo, error)
+
+	// Verify takes the image data as an argument and returns an error wrapping ErrCorruptImage if it can't be
+	// decoded completely
+	Verify(data []byte) error
+
 	// HasDefaultParams returns true if defaultParams are present, returns false otherwise
 	HasDefaultParams() bool
 }
 
 type manipulator struct {
-	processor     processor.Processor
-	defaultParams map[string]string
-	metricService metrics.MetricService
+	processor      processor.Processor
+	defaultParams  map[string]string
+	metricService  metrics.MetricService
+	sampleEvery    int
+	onFormatChange FormatChangeFunc
+	defaultScope   string
+	scopePattern   *regexp.Regexp
+	slots          chan struct{}
+	rejectWhenBusy bool
+	rejectAnimated bool
+	strictParams   bool
+	allowedParams  map[string]bool
+	tracer         Tracer
+	pngDowngrade   map[string]bool
+	faceDetector   processor.FaceDetector
+	pixelBudgets   map[string]float64
+	budgets        map[string]*pixelBudget
+	budgetsMu      sync.Mutex
+	samples        map[string]int
+	samplesMu      sync.Mutex
 }
 
+// ManipulatorOption represents builder function for Manipulator
+type ManipulatorOption func(*manipulator)
+
+// FormatChangeFunc is called with the scope and the source and output MIME types when a processed image
+// is encoded to a different format than its source
+type FormatChangeFunc func(scope, from, to string)
+
 // Process takes ProcessSpec as an argument and returns []byte, error
 // This manipulator uses bild to do the actual image manipulations
 func (m *manipulator) Process(spec processSpec) ([]byte, error) {
+	src, _, err := m.ProcessWithInfo(spec)
+	return src, err
+}
+
+// ProcessWithInfo takes ProcessSpec as an argument and processes it like Process, the returned ProcessInfo
+// describes the output
+func (m *manipulator) ProcessWithInfo(spec processSpec) ([]byte, ProcessInfo, error) {
+	res, err := m.ProcessWithResult(spec)
+	return res.Data, res.Info, err
+}
+
+// ProcessWithResult takes ProcessSpec as an argument and processes it like Process, the returned ProcessResult
+// holds the output, its ProcessInfo and the Warnings about the params that couldn't be applied as given, e.g.
+// an upscaled image or a format change, so that callers can surface them without failing the request
+func (m *manipulator) ProcessWithResult(spec processSpec) (ProcessResult, error) {
+	if len(spec.ImageData) == 0 {
+		return ProcessResult{}, ErrEmptyInput
+	}
+	if m.strictParams {
+		if problems := getUnknownParamProblems(spec.Params); len(problems) > 0 {
+			return ProcessResult{}, &ValidationError{Problems: problems}
+		}
+	}
+	if disallowed := m.getDisallowedParams(spec.Params); len(disallowed) > 0 {
+		return ProcessResult{}, fmt.Errorf("%w: %s", ErrParamNotAllowed, strings.Join(disallowed, ", "))
+	}
+	if problems := getPerspectiveProblems(spec.Perspective); len(problems) > 0 {
+		return ProcessResult{}, &ValidationError{Problems: problems}
+	}
 	params := spec.Params
 	params = joinParams(params, m.defaultParams)
-	var err error
+	fitMode, err := ParseFitMode(params[fit])
+	if err != nil {
+		return ProcessResult{}, &ValidationError{Problems: []string{err.Error()}}
+	}
+	spec.Scope = m.normalizeScope(spec.Scope)
+	span, ms := m.startSpan(spec, m.sampledMetricService(spec.Scope))
+	defer span.End()
+	release, err := m.acquireSlot(spec, ms)
+	if err != nil {
+		return ProcessResult{}, err
+	}
+	defer release()
+	// Only the images that got a slot are charged, a request rejected with ErrBusy doesn't use up the budget
+	charged, err := m.chargePixels(spec)
+	if err != nil {
+		return ProcessResult{}, err
+	}
+	// A source below min-process-size is returned as is, but like any other it waits for a slot and is charged
+	if isBelowProcessSize(spec.ImageData, CleanInt(params[minProcess])) {
+		return ProcessResult{Data: spec.ImageData, Info: getPassThroughInfo(spec.ImageData),
+			Capture: getCaptureInfo(spec.ImageData)}, nil
+	}
+	warns := new(warnings)
+	if processor.IsAnimatedPNG(spec.ImageData) || processor.IsAnimatedWebP(spec.ImageData) {
+		return m.processAnimation(spec, params, fitMode, ms, warns)
+	}
+	if err := m.checkAnimation(spec.ImageData, spec.Scope, warns); err != nil {
+		return ProcessResult{}, err
+	}
 	t := time.Now()
-	data, f, err := m.processor.Decode(spec.ImageData)
+	var data image.Image
+	var f string
+	if processor.DetectContentType(spec.ImageData) == processor.ContentTypeSVG {
+		// Rendering at the requested size keeps SVGs sharp, the raster is then processed as a PNG
+		data, err = m.processor.Rasterize(spec.ImageData, CleanInt(params[width]), CleanInt(params[height]))
+		f = processor.ExtensionPNG
+	} else {
+		data, f, err = m.processor.Decode(spec.ImageData)
+	}
 	if err != nil {
-		return nil, err
+		// Failures are never sampled out, they are rare and a spike of them is what alerting looks for
+		m.metricService.CountImageProcessErrors(getDecodeErrorKey(err), spec.Scope, metrics.GetImageFormat(spec.ImageData))
+		return ProcessResult{}, getDecodeError(spec.ImageData, err)
 	}
-	m.metricService.TrackDuration(decodeDurationKey, t, spec.ImageData)
-	if params[fit] == crop {
-		t = time.Now()
-		data = m.processor.Crop(data, CleanInt(params[width]), CleanInt(params[height]), GetCropPoint(params[crop]))
-		m.metricService.TrackDuration(cropDurationKey, t, spec.ImageData)
-	} else if params[fit] == scale {
-		t = time.Now()
-		data = m.processor.Scale(data, CleanInt(params[width]), CleanInt(params[height]))
-		m.metricService.TrackDuration(scaleDurationKey, t, spec.ImageData)
-	} else if len(params[fit]) == 0 && (CleanInt(params[width]) != 0 || CleanInt(params[height]) != 0) {
+	ms.TrackDuration(decodeDurationKey, t, spec.ImageData)
+	if charged == 0 {
+		m.chargeDecodedPixels(spec, data)
+	}
+	m.trackParallelism(spec.Scope, data.Bounds().Dy())
+	srcFormat, srcSize, srcImg := f, data.Bounds().Size(), data
+	span.SetAttribute(formatAttribute, srcFormat)
+	span.SetAttribute(widthAttribute, srcSize.X)
+	span.SetAttribute(heightAttribute, srcSize.Y)
+	autos := strings.Split(params[auto], ",")
+	orientationFixed := false
+	if isOneOf(autos...)(compress) {
+		// The orientation is fixed before resizing, so that the requested width and height and the crop
+		// anchors apply to the image as displayed rather than as stored, e.g. for rotated phone photos
+		orientation, _ := native.GetOrientation(bytes.NewReader(spec.ImageData))
 		t = time.Now()
-		data = m.processor.Resize(data, CleanInt(params[width]), CleanInt(params[height]))
-		m.metricService.TrackDuration(resizeDurationKey, t, spec.ImageData)
+		data = m.processor.FixOrientation(data, orientation)
+		orientationFixed = orientation > 1
+		ms.TrackDuration(fixOrientationKey, t, spec.ImageData)
 	}
+	params = getScaledParams(params, data.Bounds().Dx())
+	data = m.applySize(data, params, fitMode, ms, spec.ImageData, warns)
 
+	if radius := CleanInt(params[denoise]); radius > 0 && radius <= maxDenoiseRadius {
+		t = time.Now()
+		data = m.processor.Denoise(data, radius)
+		ms.TrackDuration(denoiseDurationKey, t, spec.ImageData)
+	}
+	// Sharpening after denoising keeps the noise from being amplified
+	data = m.applyAutoSharpen(data, srcSize, params, ms, spec.ImageData)
 	if params[mono] == blackHexCode {
 		t = time.Now()
-		data = m.processor.GrayScale(data)
-		m.metricService.TrackDuration(grayScaleDurationKey, t, spec.ImageData)
+		// JPEGs have no transparency to keep, a single channel JPEG holds the same pixels in fewer bytes
+		if params[monoGray] == "true" || (f == processor.ExtensionJPEG && !hasTransparentPadding(params, fitMode)) {
+			data = m.processor.GrayScaleWithOptions(data, processor.GrayScaleOptions{SingleChannel: true})
+		} else {
+			data = m.processor.GrayScale(data)
+		}
+		ms.TrackDuration(grayScaleDurationKey, t, spec.ImageData)
+	} else if keep, ok := CleanHexColor(params[splash]); ok {
+		t = time.Now()
+		data = m.processor.Splash(data, keep, getTolerance(params[splashTol]))
+		ms.TrackDuration(splashDurationKey, t, spec.ImageData)
+	} else if amount, err := strconv.ParseFloat(params[desat], 64); err == nil && amount > 0 && amount <= 1 {
+		t = time.Now()
+		data = m.processor.Desaturate(data, amount)
+		ms.TrackDuration(desatDurationKey, t, spec.ImageData)
+	}
+	if isOneOf(channelNames...)(params[channel]) {
+		t = time.Now()
+		data = m.processor.ExtractChannel(data, params[channel])
+		ms.TrackDuration(channelDurationKey, t, spec.ImageData)
+	}
+	if colors := strings.Split(params[duotone], ","); len(colors) == 2 {
+		dark, okDark := CleanHexColor(colors[0])
+		light, okLight := CleanHexColor(colors[1])
+		if okDark && okLight {
+			t = time.Now()
+			data = m.processor.Duotone(data, dark, light)
+			ms.TrackDuration(duotoneDurationKey, t, spec.ImageData)
+		}
+	}
+	if colors := strings.Split(params[recolor], ","); len(colors) == 2 {
+		from, okFrom := CleanHexColor(colors[0])
+		to, okTo := CleanHexColor(colors[1])
+		if okFrom && okTo {
+			t = time.Now()
+			data = m.processor.Recolor(data, from, to, getTolerance(params[recolorTol]))
+			ms.TrackDuration(recolorDurationKey, t, spec.ImageData)
+		}
+	}
+	if v, err := strconv.Atoi(params[solarize]); err == nil && v >= 0 && v <= math.MaxUint8 {
+		t = time.Now()
+		data = m.processor.Solarize(data, uint8(v))
+		ms.TrackDuration(solarizeDurationKey, t, spec.ImageData)
+	}
+	if key, ok := CleanHexColor(params[chroma]); ok {
+		t = time.Now()
+		data = m.processor.ChromaKey(data, key, getTolerance(params[chromaTol]))
+		ms.TrackDuration(chromaKeyDurationKey, t, spec.ImageData)
+		// The keyed out background needs a format with transparency
+		if f != processor.ExtensionWebP {
+			f = processor.ExtensionPNG
+		}
 	}
 	if radius := CleanFloat(params[blur], 1000); radius > 0 {
 		t = time.Now()
 		data = m.processor.Blur(data, radius)
-		m.metricService.TrackDuration(blurDurationKey, t, spec.ImageData)
+		ms.TrackDuration(blurDurationKey, t, spec.ImageData)
 	}
 
-	autos := strings.Split(params[auto], ",")
-	for _, a := range autos {
-		if a == compress {
-			orientation, _ := native.GetOrientation(bytes.NewReader(spec.ImageData))
+	if c, ok := CleanHexColor(params[overlayColor]); ok {
+		if opacity := getOverlayOpacity(params[overlayAlpha]); opacity > 0 {
 			t = time.Now()
-			data = m.processor.FixOrientation(data, orientation)
-			m.metricService.TrackDuration(fixOrientationKey, t, spec.ImageData)
-		} else if a == format {
-			w := spec.IsWebPSupported()
-			if w {
-				f = processor.ExtensionWebP
-			} else if f == processor.ExtensionWebP {
-				f = processor.ExtensionPNG
-			}
+			data = m.processor.ColorWash(data, c, opacity)
+			ms.TrackDuration(colorWashDurationKey, t, spec.ImageData)
 		}
 	}
 
+	if isOneOf(autos...)(format) {
+		if spec.IsWebPSupported() {
+			f = processor.ExtensionWebP
+		} else if f == processor.ExtensionWebP {
+			f = processor.ExtensionPNG
+		}
+	}
+
+	// An explicit output format takes precedence over auto=format and the formats kept for transparency,
+	// transparent pixels are flattened onto the background for JPEG
+	switch params[outputFormat] {
+	case processor.ExtensionJPG, processor.ExtensionJPEG:
+		f = processor.ExtensionJPEG
+	case processor.ExtensionPNG, processor.ExtensionWebP:
+		f = params[outputFormat]
+	}
+	if spec.webpOutput != nil && f == processor.ExtensionWebP {
+		// The WebP is encoded besides the output, which stays in a format every client supports
+		f = processor.ExtensionPNG
+	}
+
 	if len(params[flip]) != 0 {
 		t = time.Now()
 		data = m.processor.Flip(data, params[flip])
-		m.metricService.TrackDuration(flipDurationKey, t, spec.ImageData)
+		ms.TrackDuration(flipDurationKey, t, spec.ImageData)
 	}
 
 	if angle := CleanFloat(params[rotate], 360); angle > 0 {
 		t = time.Now()
-		data = m.processor.Rotate(data, angle)
-		m.metricService.TrackDuration(rotateDurationKey, t, spec.ImageData)
+		if bg, ok := CleanHexColor(params[background]); ok || params[rotateExpand] == "true" {
+			opts := processor.RotateOptions{Expand: params[rotateExpand] == "true"}
+			if ok {
+				opts.Background = bg
+			}
+			data = m.processor.RotateWithOptions(data, angle, opts)
+		} else {
+			data = m.processor.Rotate(data, angle)
+		}
+		ms.TrackDuration(rotateDurationKey, t, spec.ImageData)
+	}
+
+	if spec.Perspective != nil {
+		t = time.Now()
+		data = m.processor.Perspective(data, *spec.Perspective)
+		ms.TrackDuration(perspectiveKey, t, spec.ImageData)
+	}
+
+	// The size params already give even dimensions, only an image they don't resize or that is rotated or warped
+	// afterwards still needs to be scaled
+	if params[even] == "true" {
+		w, h := data.Bounds().Dx(), data.Bounds().Dy()
+		if ew, eh := getEvenDimensions(w, h); ew != w || eh != h {
+			t = time.Now()
+			data = m.processor.Scale(data, ew, eh)
+			ms.TrackDuration(scaleDurationKey, t, spec.ImageData)
+		}
+	}
+
+	if n, err := strconv.Atoi(params[colors]); err == nil && n >= 2 && n <= 256 && f == processor.ExtensionPNG {
+		t = time.Now()
+		opts := processor.QuantizeOptions{}
+		if params[dither] == ditherFS {
+			opts.Dither = processor.DitherFloydSteinberg
+		}
+		data = m.processor.Quantize(data, n, opts)
+		ms.TrackDuration(quantizeDurationKey, t, spec.ImageData)
 	}
 
 	t = time.Now()
-	src, err := m.processor.Encode(data, f)
-	if err == nil {
-		m.metricService.TrackDuration(encodeDurationKey, t, spec.ImageData)
+	var src []byte
+	opts := getEncodeOptions(params)
+	opts.KeepPNG = !m.allowsPNGDowngrade(spec.Scope)
+	reused := m.canReuseSource(spec, params, srcImg, data, f)
+	if reused {
+		src = spec.ImageData
+	} else if opts != (processor.EncodeOptions{}) {
+		src, err = m.processor.EncodeWithOptions(data, f, opts)
+	} else {
+		src, err = m.processor.Encode(data, f)
 	}
-	return src, err
+	// The color chunks of a PNG source are added to the encoded output below, so they count towards max-bytes
+	var colorChunks [][]byte
+	chunksSize := 0
+	if srcFormat == processor.ExtensionPNG && f == processor.ExtensionPNG {
+		colorChunks = native.GetPNGColorChunks(spec.ImageData)
+		for _, c := range colorChunks {
+			chunksSize += len(c)
+		}
+	}
+	// A reused source already has its chunks, every encode lacks them
+	if maxBytes := getMaxBytes(params[maxBytes]); err == nil && maxBytes > 0 &&
+		(len(src) > maxBytes || !reused && len(src)+chunksSize > maxBytes) {
+		size := data.Bounds().Size()
+		budget := maxBytes - chunksSize
+		if budget < 0 {
+			budget = 0
+		}
+		data, src, opts, err = m.fitByteBudget(data, src, f, opts, getBudgetQualities(params, src), budget,
+			params[downscale] == "true")
+		// The source was encoded again, so it is no longer returned as is
+		reused = false
+		if err == nil && data.Bounds().Size() != size {
+			warns.add(WarningDimensionClamped, "scaled down from %dx%d to %dx%d to fit max-bytes=%d", size.X, size.Y,
+				data.Bounds().Dx(), data.Bounds().Dy(), maxBytes)
+		}
+	}
+	if err != nil {
+		m.metricService.CountImageProcessErrors(encodeErrorKey, spec.Scope, f)
+		return ProcessResult{}, err
+	}
+	if !reused {
+		ms.TrackDuration(encodeDurationKey, t, spec.ImageData)
+	}
+	if spec.webpOutput != nil {
+		t = time.Now()
+		if webpOpts := getEncodeOptions(params); webpOpts != (processor.EncodeOptions{}) {
+			*spec.webpOutput, err = m.processor.EncodeWithOptions(data, processor.ExtensionWebP, webpOpts)
+		} else {
+			*spec.webpOutput, err = m.processor.Encode(data, processor.ExtensionWebP)
+		}
+		if err != nil {
+			m.metricService.CountImageProcessErrors(encodeErrorKey, spec.Scope, processor.ExtensionWebP)
+			return ProcessResult{}, err
+		}
+		ms.TrackDuration(encodeDurationKey, t, spec.ImageData)
+	}
+	info := ProcessInfo{
+		Width:   data.Bounds().Dx(),
+		Height:  data.Bounds().Dy(),
+		Format:  metrics.GetImageFormat(src),
+		Quality: opts.Quality,
+		Size:    len(src),
+	}
+
+	span.SetAttribute(outputFormatAttribute, info.Format)
+	span.SetAttribute(outputWidthAttribute, info.Width)
+	span.SetAttribute(outputHeightAttribute, info.Height)
+	m.trackFormatChange(spec, src, warns)
+
+	// Metadata is only carried over when the pixels are still laid out like the source, a fixed EXIF
+	// orientation or changed dimensions would make the source metadata describe a different image
+	if params[preserveMetadata] == "true" && !reused && !orientationFixed && srcFormat == processor.ExtensionJPEG &&
+		f == processor.ExtensionJPEG && data.Bounds().Size() == srcSize {
+		src, err = native.SetJPEGMetadata(src, native.GetJPEGMetadata(spec.ImageData))
+		if err != nil {
+			return ProcessResult{}, err
+		}
+		info.Size = len(src)
+	}
+	// The pixels of a PNG are decoded and encoded as they are stored, so the gamma and color space chunks of the
+	// source, which image/png drops, still describe them and keep the colors from shifting
+	if srcFormat == processor.ExtensionPNG && info.Format == processor.ExtensionPNG && !reused {
+		src, err = native.SetPNGColorChunks(src, colorChunks)
+		if err != nil {
+			return ProcessResult{}, err
+		}
+		info.Size = len(src)
+	}
+	// Every encode of the output is done, so its pixel buffer can be reused
+	m.release(data)
+	return ProcessResult{Data: src, Info: info, Warnings: *warns, Capture: getCaptureInfo(spec.ImageData)}, nil
+}
+
+// release hands the pixel buffer of img back to the processor if it is a processor.BufferReleaser, img must not be
+// used afterwards
+func (m *manipulator) release(img image.Image) {
+	if r, ok := m.processor.(processor.BufferReleaser); ok {
+		r.Release(img)
+	}
+}
+
+// trackParallelism reports the largest number of goroutines an operation of the processor can run at once on an
+// image of rows rows to the MetricService if it is a metrics.ParallelismTracker. The rows are split over at most
+// the limit of a processor.ParallelismLimiter, GOMAXPROCS and one goroutine per row, processors without a limit
+// report nothing.
+func (m *manipulator) trackParallelism(scope string, rows int) {
+	p, ok := m.processor.(processor.ParallelismLimiter)
+	if !ok || p.MaxParallelism() <= 0 {
+		return
+	}
+	t, ok := m.metricService.(metrics.ParallelismTracker)
+	if !ok {
+		return
+	}
+	workers := p.MaxParallelism()
+	if n := runtime.GOMAXPROCS(0); n < workers {
+		workers = n
+	}
+	if rows < workers {
+		workers = rows
+	}
+	if workers > 0 {
+		t.TrackParallelism(scope, workers)
+	}
+}
+
+// canReuseSource returns true if the image data of spec can be returned as is instead of encoding data, i.e. no
+// operation changed the decoded image src, it is encoded to the format of the source without any encode params and
+// the source has no metadata that encoding would strip. An encode could only lose quality or even grow the output.
+func (m *manipulator) canReuseSource(spec processSpec, params map[string]string, src, data image.Image, f string) bool {
+	// The operations return the image they were given when they don't change it
+	if !reflect.TypeOf(src).Comparable() || src != data {
+		return false
+	}
+	if getEncodeOptions(params) != (processor.EncodeOptions{}) {
+		return false
+	}
+	switch f {
+	case processor.ExtensionJPEG, processor.ExtensionWebP:
+	case processor.ExtensionPNG:
+		// Whether an opaque PNG is downgraded to JPEG is only decided by the encoder
+		if m.allowsPNGDowngrade(spec.Scope) {
+			return false
+		}
+	default:
+		return false
+	}
+	return metrics.GetImageFormat(spec.ImageData) == f && !native.HasMetadata(spec.ImageData)
+}
+
+// getCaptureInfo returns the CaptureInfo of the EXIF of the image data, nil if it has none
+func getCaptureInfo(data []byte) *processor.CaptureInfo {
+	if info, ok := native.GetCaptureInfo(data); ok {
+		return &info
+	}
+	return nil
+}
+
+// applySize applies the fit mode with the size params and the max-mp limit to the image, an enlarged image and
+// dimensions that couldn't be applied as given are added to warns
+func (m *manipulator) applySize(data image.Image, params map[string]string, fitMode FitMode, ms metrics.MetricService,
+	imageData []byte, warns *warnings) image.Image {
+	var t time.Time
+	srcSize := data.Bounds().Size()
+	warns.addWrappedDimension(params, width)
+	warns.addWrappedDimension(params, height)
+	w, h := CleanInt(params[width]), CleanInt(params[height])
+	if w == 0 && h == 0 {
+		// There is nothing to fit the image to, it is kept as is instead of e.g. being cropped or scaled to nothing
+		fitMode = FitNone
+	}
+	evenSize := params[even] == "true"
+	if evenSize && w != 0 && h != 0 && fitMode != FitNone && fitMode != FitScaleDown {
+		// The image is cropped, stretched or padded to exactly w x h
+		w, h = getEvenDimensions(w, h)
+	}
+	switch fitMode {
+	case FitCrop:
+		t = time.Now()
+		if w == 0 || h == 0 {
+			// A single dimension gives no aspect ratio to crop to, the other one is derived from the source and
+			// nothing is cropped
+			data = m.resize(data, w, h, evenSize)
+			ms.TrackDuration(resizeDurationKey, t, imageData)
+			break
+		}
+		if fp, ok := GetFocalPoint(params[crop]); ok {
+			data = m.processor.FocalCrop(data, w, h, fp)
+		} else if offset := getCropOffset(params); offset != image.ZP {
+			opts := processor.CropOptions{Offset: offset}
+			data = m.processor.CropWithOptions(data, w, h, GetCropPoint(params[crop]), opts)
+		} else {
+			data = m.processor.Crop(data, w, h, GetCropPoint(params[crop]))
+		}
+		ms.TrackDuration(cropDurationKey, t, imageData)
+	case FitAuto:
+		opts := processor.SmartCropOptions{FacePadding: getFacePadding(params)}
+		if m.faceDetector != nil && w != 0 && h != 0 {
+			t = time.Now()
+			opts.Faces = m.faceDetector.DetectFaces(data)
+			ms.TrackDuration(faceDetectKey, t, imageData)
+		}
+		t = time.Now()
+		data = m.processor.SmartCrop(data, w, h, opts)
+		ms.TrackDuration(cropDurationKey, t, imageData)
+	case FitCover:
+		t = time.Now()
+		data = m.processor.Cover(data, w, h, GetCropPoint(params[crop]))
+		ms.TrackDuration(cropDurationKey, t, imageData)
+	case FitScale, FitFill:
+		t = time.Now()
+		if w != 0 && h != 0 {
+			data = m.processor.Scale(data, w, h)
+		} else {
+			// Stretching needs both dimensions, with one of them the aspect ratio is kept
+			data = m.resize(data, w, h, evenSize)
+		}
+		ms.TrackDuration(scaleDurationKey, t, imageData)
+	case FitScaleDown:
+		if exceedsBox(w, h, data.Bounds().Dx(), data.Bounds().Dy()) {
+			t = time.Now()
+			data = m.resize(data, w, h, evenSize)
+			ms.TrackDuration(resizeDurationKey, t, imageData)
+		}
+	case FitContain:
+		t = time.Now()
+		// With both dimensions the image is padded to the even w x h
+		data = m.resize(data, w, h, evenSize && (w == 0 || h == 0))
+		ms.TrackDuration(resizeDurationKey, t, imageData)
+		// The padding is not an enlargement of the image
+		warns.addUpscaled(srcSize, data.Bounds().Size())
+		if w != 0 && h != 0 {
+			var bg color.Color = color.Transparent
+			if c, ok := CleanHexColor(params[background]); ok {
+				bg = c
+			}
+			t = time.Now()
+			if params[pad] == blur {
+				opts := processor.PadOptions{Blur: getPadBlurRadius(w, h)}
+				data = m.processor.PadWithOptions(data, w, h, GetCropPoint(params[gravity]), bg, opts)
+			} else {
+				data = m.processor.Pad(data, w, h, GetCropPoint(params[gravity]), bg)
+			}
+			ms.TrackDuration(padDurationKey, t, imageData)
+		}
+	case FitNone:
+		if w != 0 || h != 0 {
+			t = time.Now()
+			if params[resize] == outside && w != 0 && h != 0 {
+				ow, oh := getOutsideDimensions(w, h, data.Bounds().Dx(), data.Bounds().Dy())
+				if evenSize {
+					ow, oh = getEvenDimensions(ow, oh)
+				}
+				data = m.processor.Scale(data, ow, oh)
+			} else {
+				data = m.resize(data, w, h, evenSize)
+			}
+			ms.TrackDuration(resizeDurationKey, t, imageData)
+		}
+	}
+	if fitMode != FitContain {
+		warns.addUpscaled(srcSize, data.Bounds().Size())
+	}
+
+	if mp := getMaxMegapixels(params); mp > 0 {
+		size := data.Bounds().Size()
+		if mw, mh, ok := getMaxMegapixelsDimensions(mp, size.X, size.Y); ok {
+			if evenSize {
+				mw, mh = getEvenDimensions(mw, mh)
+			}
+			t = time.Now()
+			data = m.processor.Scale(data, mw, mh)
+			ms.TrackDuration(resizeDurationKey, t, imageData)
+			warns.add(WarningDimensionClamped, "scaled down from %dx%d to %dx%d to fit max-mp=%s", size.X, size.Y,
+				data.Bounds().Dx(), data.Bounds().Dy(), params[maxMP])
+		}
+	}
+	return data
+}
+
+// resize resizes data like processor.Resize, with evenSize the dimensions it would resize to are rounded down to
+// even numbers and data is scaled to them in the same pass
+func (m *manipulator) resize(data image.Image, w, h int, evenSize bool) image.Image {
+	if !evenSize {
+		return m.processor.Resize(data, w, h)
+	}
+	ew, eh := getEvenDimensions(getResizeDimensions(w, h, data.Bounds().Dx(), data.Bounds().Dy()))
+	if ew == data.Bounds().Dx() && eh == data.Bounds().Dy() {
+		return data
+	}
+	return m.processor.Scale(data, ew, eh)
+}
+
+// applyAutoSharpen applies a light unsharp mask of the sharpen-amount param (defaultSharpen without it) to data
+// with auto-sharpen=true if applySize scaled it down from srcSize, upscaled images and crops at the scale of the
+// source are returned as is
+func (m *manipulator) applyAutoSharpen(data image.Image, srcSize image.Point, params map[string]string,
+	ms metrics.MetricService, imageData []byte) image.Image {
+	if params[autoSharpen] != "true" || !isDownscaled(srcSize, data.Bounds().Size()) {
+		return data
+	}
+	amount := getSharpenAmount(params[sharpenAmt])
+	if amount == 0 {
+		return data
+	}
+	t := time.Now()
+	data = m.processor.Sharpen(data, amount)
+	ms.TrackDuration(sharpenDurationKey, t, imageData)
+	return data
+}
+
+// animationParams are the params processAnimation applies, the others are only applied to still images
+var animationParams = map[string]bool{
+	width: true, height: true, fit: true, crop: true, cropOffsetX: true, cropOffsetY: true, facePad: true,
+	pad: true, background: true, gravity: true, resize: true, even: true, maxMP: true, scale: true,
+	autoSharpen: true, sharpenAmt: true, flip: true, minProcess: true, auto: true, outputFormat: true,
+	quality: true, profile: true,
+}
+
+// processAnimation resizes and flips every frame of an animated PNG or WebP, the output keeps the delays and loop
+// count of the source and is encoded as an animated WebP or APNG with fm and auto=format, in the format of the
+// source otherwise. Every other param is reported as WarningParamIgnored, or rejected WithStrictParams.
+func (m *manipulator) processAnimation(spec processSpec, params map[string]string, fitMode FitMode,
+	ms metrics.MetricService, warns *warnings) (ProcessResult, error) {
+	ignored := getIgnoredAnimationParams(spec)
+	if m.strictParams && len(ignored) > 0 {
+		problems := make([]string, len(ignored))
+		for i, p := range ignored {
+			problems[i] = fmt.Sprintf("%s is not applied to animations", p)
+		}
+		return ProcessResult{}, &ValidationError{Problems: problems}
+	}
+	for _, p := range ignored {
+		warns.add(WarningParamIgnored, "%s is not applied to animations", p)
+	}
+	t := time.Now()
+	anim, err := m.processor.DecodeAnimation(spec.ImageData)
+	if err != nil {
+		m.metricService.CountImageProcessErrors(getDecodeErrorKey(err), spec.Scope, metrics.GetImageFormat(spec.ImageData))
+		return ProcessResult{}, getDecodeError(spec.ImageData, err)
+	}
+	ms.TrackDuration(decodeDurationKey, t, spec.ImageData)
+	if len(anim.Frames) > 0 {
+		m.trackParallelism(spec.Scope, anim.Frames[0].Bounds().Dy())
+		params = getScaledParams(params, anim.Frames[0].Bounds().Dx())
+	}
+	for i, frame := range anim.Frames {
+		size := frame.Bounds().Size()
+		// Every frame is sized the same, the warnings of the first one apply to all
+		frameWarns := warns
+		if i > 0 {
+			frameWarns = nil
+		}
+		frame = m.applySize(frame, params, fitMode, ms, spec.ImageData, frameWarns)
+		frame = m.applyAutoSharpen(frame, size, params, ms, spec.ImageData)
+		if len(params[flip]) != 0 {
+			t = time.Now()
+			frame = m.processor.Flip(frame, params[flip])
+			ms.TrackDuration(flipDurationKey, t, spec.ImageData)
+		}
+		anim.Frames[i] = frame
+	}
+
+	anim.Format = getAnimationFormat(spec, params, anim.Format)
+	anim.Quality = getEncodeOptions(params).Quality
+	t = time.Now()
+	src, err := m.processor.EncodeAnimation(anim)
+	if err != nil {
+		format := anim.Format
+		if format == "" {
+			format = processor.ExtensionPNG
+		}
+		m.metricService.CountImageProcessErrors(encodeErrorKey, spec.Scope, format)
+		return ProcessResult{}, err
+	}
+	ms.TrackDuration(encodeDurationKey, t, spec.ImageData)
+	m.trackFormatChange(spec, src, warns)
+	size := anim.Frames[0].Bounds().Size()
+	info := ProcessInfo{Width: size.X, Height: size.Y, Format: metrics.GetImageFormat(src), Size: len(src)}
+	return ProcessResult{Data: src, Info: info, Warnings: *warns}, nil
+}
+
+// getAnimationFormat returns the format an animation of format f is encoded to, like for still images fm takes
+// precedence over auto=format. Animations can't be JPEGs, so fm=jpeg keeps f.
+func getAnimationFormat(spec processSpec, params map[string]string, f string) string {
+	if isOneOf(strings.Split(params[auto], ",")...)(format) {
+		if spec.IsWebPSupported() {
+			f = processor.ExtensionWebP
+		} else if f == processor.ExtensionWebP {
+			f = processor.ExtensionPNG
+		}
+	}
+	switch params[outputFormat] {
+	case processor.ExtensionPNG, processor.ExtensionWebP:
+		f = params[outputFormat]
+	}
+	return f
+}
+
+// getIgnoredAnimationParams returns the known params of a spec that processAnimation doesn't apply, sorted by
+// name. Values that are only ignored for animations are included with the value, e.g. fm=jpeg or auto=compress.
+// Like for Validate the default params of the manipulator are not reported.
+func getIgnoredAnimationParams(spec processSpec) []string {
+	var ignored []string
+	for p, v := range spec.Params {
+		switch {
+		case !isKnownParam(p):
+		case p == outputFormat && (v == processor.ExtensionJPG || v == processor.ExtensionJPEG):
+			ignored = append(ignored, p+"="+v)
+		case p == auto:
+			for _, a := range strings.Split(v, ",") {
+				if a != "" && a != format {
+					ignored = append(ignored, p+"="+a)
+				}
+			}
+		case !animationParams[p]:
+			ignored = append(ignored, p)
+		}
+	}
+	if spec.Perspective != nil {
+		ignored = append(ignored, "perspective")
+	}
+	sort.Strings(ignored)
+	return ignored
+}
+
+// checkAnimation returns ErrAnimationDropped if data is animated and WithRejectAnimated is set, otherwise it adds a
+// WarningAnimationDropped as only the first frame is decoded. Either way it is counted as an animationError.
+func (m *manipulator) checkAnimation(data []byte, scope string, warns *warnings) error {
+	if !processor.IsAnimated(data) {
+		return nil
+	}
+	format := metrics.GetImageFormat(data)
+	m.metricService.CountImageProcessErrors(animationErrorKey, scope, format)
+	if m.rejectAnimated {
+		return ErrAnimationDropped
+	}
+	warns.add(WarningAnimationDropped, "only the first frame of the animated %s was processed", format)
+	return nil
+}
+
+// ProcessFromSource reads the image data of spec from source and processes it like Process,
+// the ImageData of spec is replaced by the data of the source
+func (m *manipulator) ProcessFromSource(ctx context.Context, source Source, spec processSpec) ([]byte, error) {
+	data, err := source.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	spec.ImageData = data
+	if spec.ctx == nil {
+		spec.ctx = ctx
+	}
+	return m.Process(spec)
+}
+
+// acquireSlot waits for one of the slots set with WithMaxConcurrency to be free, or returns ErrBusy if none is free
+// and the manipulator rejects when busy, the returned func releases the slot. Without a maximum it never blocks.
+// The wait ends with the error of the context of the spec once it is done, e.g. when the client went away.
+func (m *manipulator) acquireSlot(spec processSpec, ms metrics.MetricService) (func(), error) {
+	if m.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-m.slots }
+	select {
+	case m.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if m.rejectWhenBusy {
+		m.metricService.CountImageProcessErrors(busyErrorKey, spec.Scope, metrics.GetImageFormat(spec.ImageData))
+		return nil, ErrBusy
+	}
+	ctx := spec.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.Now()
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ms.TrackDuration(queueDurationKey, t, spec.ImageData)
+	return release, nil
+}
+
+// trackFormatChange counts and reports the output being encoded to a different format than the source, e.g. an
+// opaque PNG downgraded to JPEG or auto=format switching to WebP, as it changes the Content-Type of the response
+func (m *manipulator) trackFormatChange(spec processSpec, output []byte, warns *warnings) {
+	from, to := processor.DetectContentType(spec.ImageData), processor.DetectContentType(output)
+	if from == to {
+		return
+	}
+	warns.add(WarningFormatChanged, "encoded %s source as %s", from, to)
+	m.metricService.CountFormatChanges(spec.Scope, getContentSubtype(from), getContentSubtype(to))
+	if m.onFormatChange != nil {
+		m.onFormatChange(spec.Scope, from, to)
+	}
+}
+
+// getContentSubtype returns the subtype of a MIME type without parameters, e.g. "jpeg" for "image/jpeg"
+func getContentSubtype(contentType string) string {
+	contentType = strings.Split(contentType, ";")[0]
+	if i := strings.Index(contentType, "/"); i >= 0 {
+		return contentType[i+1:]
+	}
+	return contentType
+}
+
+// normalizeScope returns the default scope for an empty scope or one not matching the scope pattern, so that
+// every metric is tagged with a scope and arbitrary values don't blow up the cardinality of the metrics
+func (m *manipulator) normalizeScope(scope string) string {
+	if scope == "" || (m.scopePattern != nil && !m.scopePattern.MatchString(scope)) {
+		return m.defaultScope
+	}
+	return scope
+}
+
+// sampledMetricService returns the metrics.MetricService to be used for processing an image in the given scope,
+// when sampling is enabled only 1 in every sampleEvery images of a scope gets its metrics emitted
+func (m *manipulator) sampledMetricService(scope string) metrics.MetricService {
+	if m.sampleEvery <= 1 {
+		return m.metricService
+	}
+	m.samplesMu.Lock()
+	n := m.samples[scope]
+	m.samples[scope] = (n + 1) % m.sampleEvery
+	m.samplesMu.Unlock()
+	if n == 0 {
+		return m.metricService
+	}
+	return metrics.NoOpMetricService{}
+}
+
+// allowsPNGDowngrade returns false if opaque PNGs of the scope are kept as PNG WithPNGDowngradeByScope, scopes
+// without a policy are downgraded to JPEG
+func (m *manipulator) allowsPNGDowngrade(scope string) bool {
+	if downgrade, ok := m.pngDowngrade[scope]; ok {
+		return downgrade
+	}
+	return true
 }
 
 // HasDefaultParams returns true if defaultParams are present, returns false otherwise
@@ -134,6 +1014,248 @@ func (m *manipulator) HasDefaultParams() bool {
 	return len(m.defaultParams) > 0
 }
 
+// getEncodeOptions returns the processor.EncodeOptions for the profile param, an explicit quality param
+// overrides the quality of the profile
+//   - fast: quality 80 and the fastest PNG compression
+//   - best: quality 100 (which also keeps opaque PNGs as PNG) and the best PNG compression
+//
+// The dpi param sets the pixel density and with fm=jpeg the bg param is the color transparent pixels are
+// flattened onto
+func getEncodeOptions(params map[string]string) processor.EncodeOptions {
+	var opts processor.EncodeOptions
+	switch params[profile] {
+	case profileFast:
+		opts = processor.EncodeOptions{Quality: 80, Compression: processor.CompressionSpeed}
+	case profileBest:
+		opts = processor.EncodeOptions{Quality: 100, Compression: processor.CompressionBest}
+	}
+	if q := CleanInt(params[quality]); q > 0 && q <= 100 {
+		opts.Quality = q
+	}
+	opts.DPI = CleanInt(params[dpi])
+	if fm := params[outputFormat]; fm == processor.ExtensionJPG || fm == processor.ExtensionJPEG {
+		if bg, ok := CleanHexColor(params[background]); ok {
+			opts.Background = bg
+		}
+	}
+	return opts
+}
+
+// getCropOffset returns the offset of the crop-offset-x and crop-offset-y params in pixels, a param that is not an
+// integer between -9999 and 9999 is 0
+func getCropOffset(params map[string]string) image.Point {
+	parse := func(input string) int {
+		if v, err := strconv.Atoi(input); err == nil && v >= -9999 && v <= 9999 {
+			return v
+		}
+		return 0
+	}
+	return image.Pt(parse(params[cropOffsetX]), parse(params[cropOffsetY]))
+}
+
+// isDownscaled returns true if an image of size src was scaled down to size dst, an image that only got
+// smaller along one side was cropped at the scale of the source
+func isDownscaled(src, dst image.Point) bool {
+	return dst.X < src.X && dst.Y < src.Y
+}
+
+// getSharpenAmount returns the amount of the sharpen-amount param, defaultSharpen if it is not a number
+// between 0 and maxSharpenAmount
+func getSharpenAmount(input string) float64 {
+	if v, err := strconv.ParseFloat(input, 64); err == nil && v >= 0 && v <= maxSharpenAmount {
+		return v
+	}
+	return defaultSharpen
+}
+
+// getTolerance returns the tolerance of the recolor-tol, chroma-tol or splash-tol param, defaultTolerance if it is
+// not an integer between 0 and 255
+func getTolerance(input string) uint8 {
+	if v, err := strconv.Atoi(input); err == nil && v >= 0 && v <= math.MaxUint8 {
+		return uint8(v)
+	}
+	return defaultTolerance
+}
+
+// getOverlayOpacity returns the value of the overlay-opacity param clamped to 0-255, e.g. 300 is fully opaque
+// instead of wrapping around to an almost invisible 44. It is defaultOverlay for a missing or non-integer value.
+func getOverlayOpacity(input string) uint8 {
+	if v, err := strconv.Atoi(input); err == nil {
+		return clampUint8(v)
+	}
+	return defaultOverlay
+}
+
+// clampUint8 returns v clamped to the range of a uint8, so that converting it never wraps around
+func clampUint8(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(v)
+}
+
+// isBelowProcessSize returns true if neither dimension of the image exceeds size, only the header is decoded.
+// A size of 0 and images whose header can't be decoded, e.g. SVGs which are always rendered, return false.
+func isBelowProcessSize(data []byte, size int) bool {
+	if size <= 0 {
+		return false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err == nil && cfg.Width <= size && cfg.Height <= size
+}
+
+// getDecodeError returns the error of decoding the image data, wrapping ErrCorruptImage if the data ended early or
+// has a valid header but broken pixel data, e.g. on a truncated upload. Errors of data in an unknown format are
+// returned as they are.
+func getDecodeError(data []byte, err error) error {
+	if errors.Is(err, native.ErrDecodeTimeout) || errors.Is(err, native.ErrImageTooLarge) {
+		return err
+	}
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	if _, _, cfgErr := image.DecodeConfig(bytes.NewReader(data)); cfgErr == nil {
+		return fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	return err
+}
+
+// getDecodeErrorKey returns the key a decode error is counted with, decodes that timed out are counted apart
+// from the ones that failed
+func getDecodeErrorKey(err error) string {
+	if errors.Is(err, native.ErrDecodeTimeout) {
+		return decodeTimeoutKey
+	}
+	return decodeErrorKey
+}
+
+// hasTransparentPadding returns true if fit=contain pads the image with transparent pixels, i.e. without a bg
+// color or a blurred copy of the image
+func hasTransparentPadding(params map[string]string, fitMode FitMode) bool {
+	_, ok := CleanHexColor(params[background])
+	return fitMode == FitContain && CleanInt(params[width]) != 0 && CleanInt(params[height]) != 0 && !ok &&
+		params[pad] != blur
+}
+
+// exceedsBox returns true if the actual width/height (aw, ah) doesn't fit inside the required width/height (rw, rh),
+// a required dimension of 0 is unbounded
+func exceedsBox(rw, rh, aw, ah int) bool {
+	return (rw != 0 && aw > rw) || (rh != 0 && ah > rh)
+}
+
+// getOutsideDimensions returns the smallest dimensions preserving the aspect ratio of aw x ah (actual width x
+// actual height) that cover rw x rh (required width x required height), i.e. the larger of the two scales wins
+func getOutsideDimensions(rw, rh, aw, ah int) (int, int) {
+	if h := (rw * ah) / aw; h >= rh {
+		return rw, h
+	}
+	return (rh * aw) / ah, rh
+}
+
+// getEvenDimensions rounds w and h down to the nearest even number, with 2 as the smallest dimension
+func getEvenDimensions(w, h int) (int, int) {
+	roundDown := func(v int) int {
+		if v < 2 {
+			return 2
+		}
+		return v &^ 1
+	}
+	return roundDown(w), roundDown(h)
+}
+
+// getMaxMegapixels returns the max-mp param, 0 (no limit) unless it is a number above 0 and up to maxMegapixels
+func getMaxMegapixels(params map[string]string) float64 {
+	mp, err := strconv.ParseFloat(params[maxMP], 64)
+	if err != nil || !(mp > 0 && mp <= maxMegapixels) {
+		return 0
+	}
+	return mp
+}
+
+// getMaxMegapixelsDimensions returns the dimensions an image of w x h should be scaled to (preserving the aspect
+// ratio) so that its area doesn't exceed mp megapixels. Both are derived from w x h and rounded down, but never
+// below 1. The returned bool is false if the image is already within the limit.
+func getMaxMegapixelsDimensions(mp float64, w, h int) (int, int, bool) {
+	limit := mp * 1000 * 1000
+	if float64(w)*float64(h) <= limit {
+		return w, h, false
+	}
+	s := math.Sqrt(limit / (float64(w) * float64(h)))
+	mw, mh := int(float64(w)*s), int(float64(h)*s)
+	// A very narrow or flat image keeps a side of 1 pixel, the other one takes up the rest of the limit
+	if mw < 1 {
+		mw, mh = 1, clampInt(int(limit), 1, h)
+	} else if mh < 1 {
+		mw, mh = clampInt(int(limit), 1, w), 1
+	}
+	// The float math can round a dimension up to the next integer, which must not push the area over the limit
+	for float64(mw)*float64(mh) > limit && (mw > 1 || mh > 1) {
+		if mh == 1 || mw > 1 && mw*h > mh*w {
+			mw--
+		} else {
+			mh--
+		}
+	}
+	return mw, mh, true
+}
+
+// clampInt returns v bounded to min and max
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// getScaleFactor returns the factor of a scale param given as a fraction like 0.5 or a percentage like 50%, the
+// returned bool is false for an invalid value or one outside of 1% to 400%
+func getScaleFactor(input string) (float64, bool) {
+	v := strings.TrimSuffix(input, "%")
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false
+	}
+	if v != input {
+		f /= 100
+	}
+	return f, f >= minScaleFactor && f <= maxScaleFactor
+}
+
+// getScaledParams returns params with the w param set to the source width aw times the factor of the scale param,
+// so the scale feeds into the resize like a width would and the height follows from the aspect ratio. The params
+// are returned as they are if they have no valid scale or a w or h, which take precedence over the scale.
+func getScaledParams(params map[string]string, aw int) map[string]string {
+	f, ok := getScaleFactor(params[scale])
+	if !ok || params[width] != "" || params[height] != "" {
+		return params
+	}
+	scaled := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		scaled[k] = v
+	}
+	w := int(math.Round(float64(aw) * f))
+	if w < 1 {
+		w = 1
+	}
+	if w > maxDimension {
+		w = maxDimension
+	}
+	scaled[width] = strconv.Itoa(w)
+	return scaled
+}
+
+// getPadBlurRadius returns the blur radius of the pad=blur backdrop for a w x h canvas, it scales with the
+// canvas so that the backdrop looks the same at every size
+func getPadBlurRadius(w, h int) float64 {
+	return math.Max(1, float64(w+h)/2/padBlurDivisor)
+}
+
 func joinParams(params map[string]string, defaultParams map[string]string) map[string]string {
 	fp := make(map[string]string)
 	for p := range defaultParams {
@@ -167,6 +1289,19 @@ func CleanFloat(input string, bound float64) float64 {
 	return math.Mod(val, bound) // Never return value greater than bound
 }
 
+// CleanHexColor takes a 6 digit hex string (without the leading '#') and returns the color
+// it represents, the returned bool is false if the input is not a valid hex color
+func CleanHexColor(input string) (color.RGBA, bool) {
+	if len(input) != 6 {
+		return color.RGBA{}, false
+	}
+	val, err := strconv.ParseUint(input, 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{R: uint8(val >> 16), G: uint8(val >> 8), B: uint8(val), A: 0xff}, true
+}
+
 // GetCropPoint takes a string and returns the type Point
 func GetCropPoint(input string) processor.Point {
 	switch input {
@@ -191,12 +1326,167 @@ func GetCropPoint(input string) processor.Point {
 	}
 }
 
+// getFacePadding returns the face-pad param, a percentage (0-100) of the width and height of the faces, as the
+// fraction SmartCropOptions.FacePadding, defaultFacePad without a valid value
+func getFacePadding(params map[string]string) float64 {
+	p, err := strconv.Atoi(params[facePad])
+	if err != nil || p < 0 || p > 100 {
+		p = defaultFacePad
+	}
+	return float64(p) / 100
+}
+
+// GetFocalPoint takes a string of comma separated x and y percentages (0-100) like "25,75" and returns
+// the processor.FocalPoint, the returned bool is false if the input is not a valid percentage pair
+func GetFocalPoint(input string) (processor.FocalPoint, bool) {
+	p := strings.Split(input, ",")
+	if len(p) != 2 {
+		return processor.FocalPoint{}, false
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(p[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(p[1]), 64)
+	if errX != nil || errY != nil || x < 0 || x > 100 || y < 0 || y > 100 {
+		return processor.FocalPoint{}, false
+	}
+	return processor.FocalPoint{X: x / 100, Y: y / 100}, true
+}
+
+// WithMetricSampling is a builder function to emit the processing duration metrics for only 1 in every n
+// images per scope to reduce the load on the metrics backend, n <= 1 emits them for every image.
+// Error and format change metrics are never sampled.
+func WithMetricSampling(n int) ManipulatorOption {
+	return func(m *manipulator) {
+		m.sampleEvery = n
+	}
+}
+
+// WithFormatChangeCallback is a builder function to set a FormatChangeFunc called whenever a processed image is
+// encoded to a different format than its source, e.g. to log it or to adjust the caching of the response
+func WithFormatChangeCallback(f FormatChangeFunc) ManipulatorOption {
+	return func(m *manipulator) {
+		m.onFormatChange = f
+	}
+}
+
+// WithDefaultScope is a builder function to set the scope used for the metrics of specs without a scope,
+// the default is "default"
+func WithDefaultScope(scope string) ManipulatorOption {
+	return func(m *manipulator) {
+		m.defaultScope = scope
+	}
+}
+
+// WithScopePattern is a builder function to only accept the scopes matching pattern, e.g.
+// regexp.MustCompile(`^[a-z0-9_-]{1,32}$`), other scopes are replaced by the default scope. This keeps the
+// number of distinct scopes reported to the metrics backend bounded when the scope comes from a request.
+func WithScopePattern(pattern *regexp.Regexp) ManipulatorOption {
+	return func(m *manipulator) {
+		m.scopePattern = pattern
+	}
+}
+
+// WithMaxConcurrency is a builder function to limit the number of images processed at the same time to n,
+// further calls to Process wait for a free slot and the time they waited is tracked as queueDuration, or until the
+// context set with SpecBuilder.WithContext is done. n <= 0 doesn't limit the concurrency, which is the default.
+func WithMaxConcurrency(n int) ManipulatorOption {
+	return func(m *manipulator) {
+		m.slots = nil
+		if n > 0 {
+			m.slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithRejectWhenBusy is a builder function to make Process return ErrBusy instead of waiting when the maximum
+// set with WithMaxConcurrency is reached, every rejection is counted as a busyError
+func WithRejectWhenBusy(reject bool) ManipulatorOption {
+	return func(m *manipulator) {
+		m.rejectWhenBusy = reject
+	}
+}
+
+// WithRejectAnimated is a builder function to make Process, Canvas and LQIP return ErrAnimationDropped for an
+// animated image they would reduce to its first frame, e.g. an animated GIF, instead of processing the first frame
+// with a WarningAnimationDropped. Animated PNGs and WebPs are processed frame by frame by Process and aren't affected.
+func WithRejectAnimated(reject bool) ManipulatorOption {
+	return func(m *manipulator) {
+		m.rejectAnimated = reject
+	}
+}
+
+// WithStrictParams is a builder function to make Process fail with a *ValidationError listing the params of the
+// spec that darkroom doesn't know, e.g. a misspelled widht=200, instead of ignoring them. Validate reports them too.
+// The default params of the manipulator aren't checked.
+func WithStrictParams(strict bool) ManipulatorOption {
+	return func(m *manipulator) {
+		m.strictParams = strict
+	}
+}
+
+// WithAllowedParams is a builder function to restrict the params of a spec to the given ones, e.g. w, h, fit and fm
+// to expose a safe subset of the operations to untrusted clients. Process returns an error wrapping
+// ErrParamNotAllowed for a spec with any other known param and Validate reports them. The default params of the
+// manipulator are always applied, and without this option every param is allowed.
+func WithAllowedParams(params ...string) ManipulatorOption {
+	return func(m *manipulator) {
+		m.allowedParams = make(map[string]bool, len(params))
+		for _, p := range params {
+			m.allowedParams[p] = true
+		}
+	}
+}
+
+// WithTracer is a builder function to set the Tracer Process starts a span with, which has a child span for the
+// decode, each operation and the encode. The span of the context set with SpecBuilder.WithContext is the parent.
+// Without a Tracer no spans are started.
+func WithTracer(t Tracer) ManipulatorOption {
+	return func(m *manipulator) {
+		m.tracer = t
+	}
+}
+
+// WithPNGDowngradeByScope is a builder function to set per scope whether opaque PNGs are downgraded to JPEG, e.g.
+// {"design-assets": false} keeps every PNG of the design-assets scope a PNG while the other scopes are still
+// downgraded. Scopes are matched after they are normalized, so specs without a scope use the policy of the default
+// scope. Scopes without a policy are downgraded, which is the default.
+func WithPNGDowngradeByScope(scopes map[string]bool) ManipulatorOption {
+	return func(m *manipulator) {
+		m.pngDowngrade = scopes
+	}
+}
+
+// WithFaceDetector is a builder function to set the FaceDetector whose faces fit=auto crops to, without a detector
+// fit=auto always crops to the most detailed region of the image
+func WithFaceDetector(d processor.FaceDetector) ManipulatorOption {
+	return func(m *manipulator) {
+		m.faceDetector = d
+	}
+}
+
+// WithPixelBudget is a builder function to limit the megapixels per second each scope may process, e.g.
+// {"uploads": 50} for at most 50 megapixels of source images per second in the uploads scope. Process returns an
+// error wrapping ErrPixelBudgetExceeded once a scope has used up its budget, which refills continuously and holds
+// at most a second worth of megapixels, so short bursts are smoothed out. Scopes are matched after they are
+// normalized and scopes without a budget are not limited, which is the default.
+func WithPixelBudget(megapixelsPerSecond map[string]float64) ManipulatorOption {
+	return func(m *manipulator) {
+		m.pixelBudgets = megapixelsPerSecond
+	}
+}
+
 // NewManipulator takes in a Processor interface and returns a new Manipulator
 func NewManipulator(processor processor.Processor, defaultParams map[string]string,
-	metricService metrics.MetricService) Manipulator {
-	return &manipulator{
+	metricService metrics.MetricService, opts ...ManipulatorOption) Manipulator {
+	m := &manipulator{
 		processor:     processor,
 		defaultParams: defaultParams,
 		metricService: metricService,
+		defaultScope:  defaultScope,
+		samples:       make(map[string]int),
+		budgets:       make(map[string]*pixelBudget),
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
@@ -1,10 +1,20 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io/ioutil"
+	"regexp"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gojek/darkroom/pkg/metrics"
 	"github.com/gojek/darkroom/pkg/processor"
@@ -56,75 +66,1600 @@ func TestManipulator_Process_ReturnsImageAsWebPIfCallerSupportsWebP(t *testing.T
 	assert.Equal(t, expectedImg, img)
 }
 
+func TestManipulator_Process_PreservesMetadataWhenDimensionsAreUnchanged(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/exif_orientation/f6t.jpg")
+	cases := []struct {
+		params   map[string]string
+		expected int
+	}{
+		{params: map[string]string{preserveMetadata: "true", quality: "50"}, expected: 6},
+		{params: map[string]string{quality: "50"}, expected: 0},
+		// Orientation is already applied to the pixels
+		{params: map[string]string{preserveMetadata: "true", auto: compress}, expected: 0},
+		// Dimensions are changed by the resize
+		{params: map[string]string{preserveMetadata: "true", width: "20"}, expected: 0},
+	}
+	for _, c := range cases {
+		out, err := m.Process(NewSpecBuilder().WithImageData(img).WithParams(c.params).Build())
+		assert.Nil(t, err)
+		orientation, _ := native.GetOrientation(bytes.NewReader(out))
+		assert.Equal(t, c.expected, orientation, c.params)
+	}
+}
+
+func TestManipulator_Process_KeepsPNGColorChunks(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	// overlay.png has transparent pixels, so it isn't downgraded to JPEG
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/overlay.png")
+	gama := []byte("\x00\x00\x00\x04gAMA\x00\x00\xb1\x8f\x0b\xfc\x61\x05")
+	img, err := native.SetPNGColorChunks(img, [][]byte{gama})
+	assert.Nil(t, err)
+
+	out, err := m.Process(NewSpecBuilder().WithImageData(img).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{gama}, native.GetPNGColorChunks(out))
+	// The pixels are round-tripped as they are, the gamma of the source still applies to them
+	src, _, _ := native.NewBildProcessor().Decode(img)
+	dst, _, _ := native.NewBildProcessor().Decode(out)
+	assert.Equal(t, src, dst)
+
+	out, err = m.Process(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{width: "100"}).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{gama}, native.GetPNGColorChunks(out))
+
+	// The chunks count towards max-bytes
+	limit := len(out) - 1
+	out, err = m.Process(NewSpecBuilder().WithImageData(img).
+		WithParams(map[string]string{width: "100", maxBytes: strconv.Itoa(limit), downscale: "true"}).Build())
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(out), limit)
+	assert.Equal(t, [][]byte{gama}, native.GetPNGColorChunks(out))
+
+	out, err = m.Process(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{outputFormat: "jpg"}).Build())
+	assert.Nil(t, err)
+	assert.Nil(t, native.GetPNGColorChunks(out))
+}
+
+func TestManipulator_Process_ReusesUnchangedSource(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	// test.jpg is a 500x375 JPEG without metadata
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	cases := []struct {
+		params   map[string]string
+		expected bool
+	}{
+		{params: map[string]string{}, expected: true},
+		{params: map[string]string{width: "500"}, expected: true},
+		{params: map[string]string{width: "500", height: "375", fit: scaleDown}, expected: true},
+		{params: map[string]string{width: "200"}, expected: false},
+		{params: map[string]string{width: "500", quality: "80"}, expected: false},
+		{params: map[string]string{width: "500", outputFormat: "png"}, expected: false},
+		{params: map[string]string{width: "500", mono: blackHexCode}, expected: false},
+	}
+	for _, c := range cases {
+		out, err := m.Process(NewSpecBuilder().WithImageData(img).WithParams(c.params).Build())
+		assert.Nil(t, err, c.params)
+		assert.Equal(t, c.expected, bytes.Equal(img, out), c.params)
+	}
+
+	// Encoding strips the EXIF of the source
+	exif, _ := ioutil.ReadFile("../processor/native/_testdata/exif_orientation/f6t.jpg")
+	out, err := m.Process(NewSpecBuilder().WithImageData(exif).Build())
+	assert.Nil(t, err)
+	assert.NotEqual(t, exif, out)
+
+	// A PNG is only reused when it can't be downgraded to JPEG
+	png, _ := ioutil.ReadFile("../processor/native/_testdata/overlay.png")
+	out, err = m.Process(NewSpecBuilder().WithImageData(png).Build())
+	assert.Nil(t, err)
+	assert.NotEqual(t, png, out)
+	m = NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{},
+		WithPNGDowngradeByScope(map[string]bool{defaultScope: false}))
+	out, err = m.Process(NewSpecBuilder().WithImageData(png).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, png, out)
+}
+
+func TestManipulator_Process_ReusedSourceExceedingMaxBytes(t *testing.T) {
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	m := NewManipulator(native.NewBildProcessor(), nil, ms, WithPNGDowngradeByScope(map[string]bool{defaultScope: false}))
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/overlay.png")
+	gama := []byte("\x00\x00\x00\x04gAMA\x00\x00\xb1\x8f\x0b\xfc\x61\x05")
+	img, err := native.SetPNGColorChunks(img, [][]byte{gama})
+	assert.Nil(t, err)
+
+	// The unchanged source exceeds max-bytes, so it is encoded again like any other output
+	out, err := m.Process(NewSpecBuilder().WithImageData(img).
+		WithParams(map[string]string{maxBytes: strconv.Itoa(len(img) - 1), downscale: "true"}).Build())
+	assert.Nil(t, err)
+	assert.Less(t, len(out), len(img))
+	assert.Equal(t, [][]byte{gama}, native.GetPNGColorChunks(out))
+	ms.AssertCalled(t, "TrackDuration", encodeDurationKey, mock.Anything, img)
+}
+
 func TestManipulator_Process(t *testing.T) {
 	mp := &mockProcessor{}
 	ms := &metrics.MockMetricService{}
-	m := NewManipulator(mp, nil, ms)
-	params := make(map[string]string)
+	m := NewManipulator(mp, nil, ms)
+	params := make(map[string]string)
+
+	input := []byte("inputData")
+	decoded := &image.RGBA{Pix: []uint8{1, 2, 3, 4}}
+
+	// Test flow for Decode error from Processor
+	mp.On("Decode", mock.Anything).Return(nil, "", errors.New("decoding error"))
+	ms.On("CountImageProcessErrors", decodeErrorKey, defaultScope, "plain")
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	mp.AssertExpectations(t)
+	ms.AssertExpectations(t)
+
+	// Create new struct for asserting expectations
+	mp = &mockProcessor{}
+	ms = &metrics.MockMetricService{}
+	m = NewManipulator(mp, nil, ms)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Encode", decoded, "png").Return(input, nil)
+	mp.On("Crop", decoded, 100, 100, processor.PointCenter).Return(decoded, nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	params[fit] = crop
+	params[width] = "100"
+	params[height] = "100"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("FocalCrop", decoded, 100, 100, processor.FocalPoint{X: 0.25, Y: 0.75}).Return(decoded, nil)
+	params[crop] = "25,75"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Cover", decoded, 100, 100, processor.PointTop).Return(decoded, nil)
+	params[fit] = cover
+	params[crop] = "top"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Resize", decoded, 100, 100).Return(decoded, nil)
+	params = make(map[string]string)
+	params[width] = "100"
+	params[height] = "100"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Scale", decoded, 100, 100).Return(decoded, nil)
+	params = make(map[string]string)
+	params[width] = "100"
+	params[height] = "100"
+	params[fit] = scale
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	params[fit] = fill
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Denoise", decoded, 3).Return(decoded, nil)
+	params = map[string]string{denoise: "3"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	// Radius larger than the allowed maximum is ignored
+	params = map[string]string{denoise: "6"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("GrayScale", decoded).Return(decoded, nil)
+	params = make(map[string]string)
+	params[mono] = blackHexCode
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("GrayScaleWithOptions", decoded, processor.GrayScaleOptions{SingleChannel: true}).Return(decoded, nil)
+	params[monoGray] = "true"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Desaturate", decoded, 0.5).Return(decoded, nil)
+	params = map[string]string{desat: "0.5"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	// Amounts outside of 0-1 are ignored
+	params = map[string]string{desat: "1.5"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("ExtractChannel", decoded, "a").Return(decoded, nil)
+	params = map[string]string{channel: "a"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Duotone", decoded, color.RGBA{R: 0x1d, G: 0x1a, B: 0x5c, A: 0xff},
+		color.RGBA{R: 0xff, G: 0xd1, B: 0x66, A: 0xff}).Return(decoded, nil)
+	params = make(map[string]string)
+	params[duotone] = "1d1a5c,ffd166"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Recolor", decoded, color.RGBA{R: 0xff, A: 0xff}, color.RGBA{B: 0xff, A: 0xff}, uint8(defaultTolerance)).Return(decoded, nil)
+	params = map[string]string{recolor: "ff0000,0000ff"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Recolor", decoded, color.RGBA{R: 0xff, A: 0xff}, color.RGBA{B: 0xff, A: 0xff}, uint8(0)).Return(decoded, nil)
+	params = map[string]string{recolor: "ff0000,0000ff", recolorTol: "0"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Solarize", decoded, uint8(128)).Return(decoded, nil)
+	params = map[string]string{solarize: "128"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	// Thresholds outside of 0-255 are ignored
+	params = map[string]string{solarize: "256"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Splash", decoded, color.RGBA{R: 0xff, A: 0xff}, uint8(defaultTolerance)).Return(decoded, nil)
+	params = map[string]string{splash: "ff0000"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Splash", decoded, color.RGBA{B: 0xff, A: 0xff}, uint8(60)).Return(decoded, nil)
+	params = map[string]string{splash: "0000ff", splashTol: "60", desat: "0.5"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("ColorWash", decoded, color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}, uint8(defaultOverlay)).Return(decoded, nil)
+	params = map[string]string{overlayColor: "808080"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("ColorWash", decoded, color.RGBA{A: 0xff}, uint8(200)).Return(decoded, nil)
+	params = map[string]string{overlayColor: "000000", overlayAlpha: "200"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	// A transparent wash has no effect
+	params = map[string]string{overlayColor: "000000", overlayAlpha: "0"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	params = map[string]string{overlayColor: "000000", overlayAlpha: "-20"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("ColorWash", decoded, color.RGBA{A: 0xff}, uint8(255)).Return(decoded, nil)
+	params = map[string]string{overlayColor: "000000", overlayAlpha: "300"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Blur", decoded, 60.0).Return(decoded, nil)
+	params = make(map[string]string)
+	params[blur] = "60"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Flip", decoded, "v").Return(decoded, nil)
+	params = make(map[string]string)
+	params[flip] = "v"
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Rotate", decoded, 90.5).Return(decoded, nil)
+	params = map[string]string{rotate: "90.5"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("RotateWithOptions", decoded, 30.0, processor.RotateOptions{Expand: true}).Return(decoded, nil)
+	params = map[string]string{rotate: "30", rotateExpand: "true"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("RotateWithOptions", decoded, 30.0, processor.RotateOptions{Background: color.RGBA{G: 255, A: 255}}).Return(decoded, nil)
+	params = map[string]string{rotate: "30", background: "00ff00"}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("FixOrientation", decoded, 0).Return(decoded)
+	params = map[string]string{auto: compress}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("EncodeWithOptions", decoded, "png", processor.EncodeOptions{Quality: 80, Compression: processor.CompressionSpeed}).Return(input, nil)
+	params = map[string]string{profile: profileFast}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	mp.On("Decode", input).Return(decoded, processor.ExtensionWebP, nil)
+	params = map[string]string{auto: format}
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+	// Assert all expectations once here
+	mp.AssertExpectations(t)
+}
+
+func TestManipulator_Process_WithChromaKey(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	keyed := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	mp.On("Decode", input).Return(decoded, processor.ExtensionJPEG, nil)
+	mp.On("ChromaKey", decoded, color.RGBA{G: 0xff, A: 0xff}, uint8(40)).Return(keyed)
+	mp.On("Encode", keyed, processor.ExtensionPNG).Return([]byte("keyed"), nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	ms.On("CountFormatChanges", mock.Anything, mock.Anything, mock.Anything)
+
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{chroma: "00ff00", chromaTol: "40"}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("keyed"), out)
+
+	// WebP keeps the transparency, so it is not switched to PNG
+	mp.On("Encode", keyed, processor.ExtensionWebP).Return([]byte("keyed webp"), nil)
+	out, err = m.Process(NewSpecBuilder().WithImageData(input).WithFormats([]string{"image/webp"}).
+		WithParams(map[string]string{chroma: "00ff00", chromaTol: "40", auto: format}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("keyed webp"), out)
+	mp.AssertExpectations(t)
+}
+
+func TestManipulator_Process_WithFitButNoDimensions(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	mp.On("Decode", input).Return(decoded, processor.ExtensionPNG, nil)
+	mp.On("Encode", decoded, processor.ExtensionPNG).Return(input, nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+
+	for _, f := range []string{crop, cover, scale, fill, scaleDown, contain} {
+		out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{fit: f, width: "abc", height: "0"}).Build())
+		assert.NoError(t, err, f)
+		assert.Equal(t, input, out, f)
+	}
+	mp.AssertNotCalled(t, "Crop", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mp.AssertNotCalled(t, "Cover", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mp.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything)
+	mp.AssertNotCalled(t, "Resize", mock.Anything, mock.Anything, mock.Anything)
+
+	// Stretching to a single dimension keeps the aspect ratio instead of collapsing the other one
+	resized := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	mp.On("Resize", decoded, 20, 0).Return(resized)
+	mp.On("Encode", resized, processor.ExtensionPNG).Return([]byte("resized"), nil)
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{fit: scale, width: "20"}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("resized"), out)
+	mp.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestManipulator_Process_WithFitCropAndOneDimension(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	resized := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	mp.On("Decode", input).Return(decoded, processor.ExtensionPNG, nil)
+	mp.On("Resize", decoded, 20, 0).Return(resized)
+	mp.On("Resize", decoded, 0, 10).Return(resized)
+	mp.On("Encode", resized, processor.ExtensionPNG).Return([]byte("resized"), nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+
+	for _, params := range []map[string]string{
+		{fit: crop, width: "20"},
+		{fit: crop, height: "10", crop: "top,left"},
+		{fit: crop, width: "20", crop: "25,75"},
+		{fit: crop, height: "10", cropOffsetX: "5"},
+	} {
+		out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+		assert.NoError(t, err, params)
+		assert.Equal(t, []byte("resized"), out, params)
+	}
+	mp.AssertNotCalled(t, "Crop", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mp.AssertNotCalled(t, "CropWithOptions", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mp.AssertNotCalled(t, "FocalCrop", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	ms.AssertCalled(t, "TrackDuration", resizeDurationKey, mock.Anything, input)
+	ms.AssertNotCalled(t, "TrackDuration", cropDurationKey, mock.Anything, input)
+
+	// With the real processor the missing dimension keeps the 4:3 aspect ratio of the source
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	m = NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	_, info, err := m.ProcessWithInfo(NewSpecBuilder().WithImageData(img).
+		WithParams(map[string]string{fit: crop, width: "200"}).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, info.Width)
+	assert.Equal(t, 150, info.Height)
+}
+
+func TestManipulator_Process_WithAnimatedPNG(t *testing.T) {
+	bp := native.NewBildProcessor()
+	anim := &processor.Animation{LoopCount: 2}
+	for _, c := range []color.RGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff}} {
+		frame := image.NewRGBA(image.Rect(0, 0, 40, 20))
+		for i := range frame.Pix {
+			frame.Pix[i] = []uint8{c.R, c.G, c.B, c.A}[i%4]
+		}
+		anim.Frames = append(anim.Frames, frame)
+		anim.Delays = append(anim.Delays, 50*time.Millisecond)
+	}
+	input, err := bp.EncodeAnimation(anim)
+	assert.NoError(t, err)
+
+	m := NewManipulator(bp, nil, metrics.NoOpMetricService{})
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).
+		WithParams(map[string]string{width: "20", flip: "h"}).Build())
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedPNG(out))
+
+	decoded, err := bp.DecodeAnimation(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, decoded.LoopCount)
+	assert.Len(t, decoded.Frames, 3)
+	for i, frame := range decoded.Frames {
+		assert.Equal(t, image.Pt(20, 10), frame.Bounds().Size())
+		assert.Equal(t, anim.Frames[i].At(0, 0), color.RGBAModel.Convert(frame.At(10, 5)))
+	}
+}
+
+func TestManipulator_Process_WithAnimatedWebP(t *testing.T) {
+	bp := native.NewBildProcessor()
+	anim := &processor.Animation{LoopCount: 4, Format: processor.ExtensionWebP}
+	for i, c := range []color.RGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}} {
+		frame := image.NewRGBA(image.Rect(0, 0, 40, 20))
+		for j := range frame.Pix {
+			frame.Pix[j] = []uint8{c.R, c.G, c.B, c.A}[j%4]
+		}
+		anim.Frames = append(anim.Frames, frame)
+		anim.Delays = append(anim.Delays, time.Duration(i+1)*80*time.Millisecond)
+	}
+	input, err := bp.EncodeAnimation(anim)
+	assert.NoError(t, err)
+
+	m := NewManipulator(bp, nil, metrics.NoOpMetricService{})
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).
+		WithParams(map[string]string{width: "20", fit: "crop", height: "20"}).Build())
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedWebP(out))
+
+	decoded, err := bp.DecodeAnimation(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, decoded.LoopCount)
+	assert.Equal(t, anim.Delays, decoded.Delays)
+	assert.Len(t, decoded.Frames, 2)
+	for _, frame := range decoded.Frames {
+		assert.Equal(t, image.Pt(20, 20), frame.Bounds().Size())
+	}
+}
+
+func TestManipulator_ProcessWithResult_WithAnimationFormatAndIgnoredParams(t *testing.T) {
+	bp := native.NewBildProcessor()
+	anim := &processor.Animation{}
+	for _, c := range []color.RGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}} {
+		frame := image.NewRGBA(image.Rect(0, 0, 40, 20))
+		for i := range frame.Pix {
+			frame.Pix[i] = []uint8{c.R, c.G, c.B, c.A}[i%4]
+		}
+		anim.Frames = append(anim.Frames, frame)
+		anim.Delays = append(anim.Delays, 50*time.Millisecond)
+	}
+	input, err := bp.EncodeAnimation(anim)
+	assert.NoError(t, err)
+
+	m := NewManipulator(bp, nil, metrics.NoOpMetricService{})
+	res, err := m.ProcessWithResult(NewSpecBuilder().WithImageData(input).WithFormats([]string{"image/webp"}).
+		WithParams(map[string]string{width: "20", auto: "compress,format", quality: "50", mono: "000000", blur: "2"}).Build())
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedWebP(res.Data))
+	assert.Equal(t, []Warning{
+		{Code: WarningParamIgnored, Message: "auto=compress is not applied to animations"},
+		{Code: WarningParamIgnored, Message: "blur is not applied to animations"},
+		{Code: WarningParamIgnored, Message: "mono is not applied to animations"},
+		{Code: WarningFormatChanged, Message: "encoded image/png source as image/webp"},
+	}, res.Warnings)
+
+	// fm takes precedence over auto=format, a JPEG can't hold the animation
+	res, err = m.ProcessWithResult(NewSpecBuilder().WithImageData(input).WithFormats([]string{"image/webp"}).
+		WithParams(map[string]string{auto: format, outputFormat: "png"}).Build())
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedPNG(res.Data))
+	res, err = m.ProcessWithResult(NewSpecBuilder().WithImageData(input).
+		WithParams(map[string]string{outputFormat: "jpg"}).Build())
+	assert.NoError(t, err)
+	assert.True(t, processor.IsAnimatedPNG(res.Data))
+	assert.Equal(t, []Warning{{Code: WarningParamIgnored, Message: "fm=jpg is not applied to animations"}}, res.Warnings)
+
+	m = NewManipulator(bp, nil, metrics.NoOpMetricService{}, WithStrictParams(true))
+	_, err = m.ProcessWithResult(NewSpecBuilder().WithImageData(input).
+		WithParams(map[string]string{width: "20", rotate: "90"}).Build())
+	assert.EqualError(t, err, "invalid params: rot is not applied to animations")
+}
+
+func TestManipulator_Process_WithAnimatedPNGDecodeError(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x08acTL\x00\x00\x00\x02\x00\x00\x00\x00")
+	mp.On("DecodeAnimation", input).Return(nil, errors.New("decode error"))
+	ms.On("CountImageProcessErrors", mock.Anything, mock.Anything, mock.Anything)
+
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).Build())
+	assert.EqualError(t, err, "decode error")
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+	ms.AssertExpectations(t)
+}
+
+func TestManipulator_Process_WithScale(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	// The source is 500x375
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	for _, c := range []struct {
+		params map[string]string
+		size   image.Rectangle
+	}{
+		{map[string]string{scale: "0.5"}, image.Rect(0, 0, 250, 187)},
+		{map[string]string{scale: "20%"}, image.Rect(0, 0, 100, 75)},
+		{map[string]string{scale: "0.5", height: "75"}, image.Rect(0, 0, 100, 75)},
+		{map[string]string{scale: "0.2", fit: crop}, image.Rect(0, 0, 100, 75)},
+		{map[string]string{scale: "0"}, image.Rect(0, 0, 500, 375)},
+	} {
+		out, err := m.Process(NewSpecBuilder().WithImageData(img).WithParams(c.params).Build())
+		assert.Nil(t, err, c.params)
+		cfg, _, _ := image.DecodeConfig(bytes.NewReader(out))
+		assert.Equal(t, c.size, image.Rect(0, 0, cfg.Width, cfg.Height), c.params)
+	}
+}
+
+func Test_getScaleFactor(t *testing.T) {
+	for input, expected := range map[string]float64{"0.5": 0.5, "50%": 0.5, "1": 1, "400%": 4, "0.01": 0.01} {
+		f, ok := getScaleFactor(input)
+		assert.True(t, ok, input)
+		assert.InDelta(t, expected, f, 1e-9, input)
+	}
+	for _, input := range []string{"", "0", "-0.5", "4.5", "50", "0.5%", "half", "%"} {
+		_, ok := getScaleFactor(input)
+		assert.False(t, ok, input)
+	}
+}
+
+func TestManipulator_Process_WithEmptyInput(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+
+	_, err := m.Process(NewSpecBuilder().WithParams(map[string]string{width: "100"}).Build())
+	assert.Equal(t, ErrEmptyInput, err)
+	_, err = m.Process(NewSpecBuilder().WithImageData([]byte{}).Build())
+	assert.Equal(t, ErrEmptyInput, err)
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+}
+
+func TestManipulator_Process_WithTruncatedInput(t *testing.T) {
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(native.NewBildProcessor(), nil, ms)
+	ms.On("CountProcessedPixels", defaultScope, mock.Anything)
+	ms.On("CountImageProcessErrors", decodeErrorKey, defaultScope, mock.Anything)
+	for _, file := range []string{"test.png", "test.jpg", "test.webp"} {
+		img, _ := ioutil.ReadFile("../processor/native/_testdata/" + file)
+
+		_, err := m.Process(NewSpecBuilder().WithImageData(img[:len(img)/2]).Build())
+		assert.True(t, errors.Is(err, ErrCorruptImage), file)
+	}
+	ms.AssertExpectations(t)
+
+	_, err := m.Process(NewSpecBuilder().WithImageData([]byte("not an image")).Build())
+	assert.False(t, errors.Is(err, ErrCorruptImage))
+}
+
+func TestManipulator_Process_WithDecodeTimeout(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	mp.On("Decode", img).Return(nil, "", native.ErrDecodeTimeout)
+	ms.On("CountProcessedPixels", defaultScope, mock.Anything)
+	ms.On("CountImageProcessErrors", decodeTimeoutKey, defaultScope, "png")
+
+	// A timed out decode isn't taken for corrupt data, even though the header of the image is valid
+	_, err := m.Process(NewSpecBuilder().WithImageData(img).Build())
+	assert.Equal(t, native.ErrDecodeTimeout, err)
+	ms.AssertExpectations(t)
+	ms.AssertNotCalled(t, "CountImageProcessErrors", decodeErrorKey, defaultScope, "png")
+}
+
+func TestManipulator_Process_WithImageTooLarge(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	m := NewManipulator(native.NewBildProcessor(native.WithMaxDecodePixels(100)), nil, metrics.NoOpMetricService{})
+
+	// The header of the image is valid, but it isn't corrupt
+	_, err := m.Process(NewSpecBuilder().WithImageData(img).Build())
+	assert.Equal(t, native.ErrImageTooLarge, err)
+}
+
+func TestManipulator_Process_WithUnknownFitMode(t *testing.T) {
+	mp := &mockProcessor{}
+	m := NewManipulator(mp, nil, &metrics.MockMetricService{})
+
+	_, err := m.Process(NewSpecBuilder().WithImageData([]byte("input")).WithParams(map[string]string{fit: "stretch"}).Build())
+	assert.EqualError(t, err, `invalid params: unknown fit mode "stretch", must be one of crop, cover, contain, scale, fill, scale-down or auto`)
+	assert.IsType(t, &ValidationError{}, err)
+	_, err = m.Estimate(NewSpecBuilder().WithImageData([]byte("input")).WithParams(map[string]string{fit: "stretch"}).Build())
+	assert.IsType(t, &ValidationError{}, err)
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+}
+
+func TestManipulator_Process_WithMaxMegapixels(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	resized := image.NewRGBA(image.Rect(0, 0, 200, 150))
+
+	mp.On("Decode", input).Return(decoded, "jpeg", nil)
+	mp.On("Scale", decoded, 200, 150).Return(resized)
+	mp.On("Encode", resized, "jpeg").Return(input, nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{maxMP: "0.03"}).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+
+	// No-op when the image is already within the limit
+	mp = &mockProcessor{}
+	m = NewManipulator(mp, nil, ms)
+	mp.On("Decode", input).Return(decoded, "jpeg", nil)
+	mp.On("Encode", decoded, "jpeg").Return(input, nil)
+
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{maxMP: "0.12"}).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	mp.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestManipulator_Process_WithFitScaleDown(t *testing.T) {
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 500, 375))
+	resized := image.NewRGBA(image.Rect(0, 0, 250, 187))
+	cases := []struct {
+		name    string
+		w, h    string
+		resized bool
+	}{
+		{name: "image smaller than the box is not enlarged", w: "1000", h: "1000"},
+		{name: "image with exactly the box size is returned as is", w: "500", h: "375"},
+		{name: "image larger than the box is fitted inside it", w: "250", h: "250", resized: true},
+		{name: "image larger than the box width only is fitted inside it", w: "250", resized: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mp := &mockProcessor{}
+			ms := &metrics.MockMetricService{}
+			m := NewManipulator(mp, nil, ms)
+			ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+			ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+			mp.On("Decode", input).Return(decoded, "jpeg", nil)
+			if c.resized {
+				mp.On("Resize", decoded, CleanInt(c.w), CleanInt(c.h)).Return(resized)
+				mp.On("Encode", resized, "jpeg").Return(input, nil)
+			} else {
+				mp.On("Encode", decoded, "jpeg").Return(input, nil)
+			}
+
+			params := map[string]string{fit: scaleDown, width: c.w, height: c.h}
+			_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+
+			assert.Nil(t, err)
+			mp.AssertExpectations(t)
+		})
+	}
+}
+
+func TestManipulator_Process_WithFitContain(t *testing.T) {
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	resized := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	padded := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	cases := []struct {
+		params map[string]string
+		point  processor.Point
+		bg     color.Color
+	}{
+		{
+			params: map[string]string{fit: contain, width: "200", height: "200"},
+			point:  processor.PointCenter,
+			bg:     color.Transparent,
+		},
+		{
+			params: map[string]string{fit: contain, width: "200", height: "200", gravity: "top,left", background: "ff0000"},
+			point:  processor.PointTopLeft,
+			bg:     color.RGBA{R: 255, A: 255},
+		},
+		{
+			params: map[string]string{fit: contain, width: "200", height: "200", gravity: "bottom", background: "red"},
+			point:  processor.PointBottom,
+			bg:     color.Transparent,
+		},
+	}
+	for _, c := range cases {
+		mp := &mockProcessor{}
+		ms := &metrics.MockMetricService{}
+		m := NewManipulator(mp, nil, ms)
+		ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+		ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+		mp.On("Decode", input).Return(decoded, "png", nil)
+		mp.On("Resize", decoded, 200, 200).Return(resized)
+		mp.On("Pad", resized, 200, 200, c.point, c.bg).Return(padded)
+		mp.On("Encode", padded, "png").Return(input, nil)
+
+		_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(c.params).Build())
+		assert.Nil(t, err)
+		mp.AssertExpectations(t)
+	}
+
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Resize", decoded, 200, 300).Return(resized)
+	mp.On("PadWithOptions", resized, 200, 300, processor.PointCenter, color.Transparent, processor.PadOptions{Blur: 12.5}).Return(padded)
+	mp.On("Encode", padded, "png").Return(input, nil)
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{fit: contain, width: "200", height: "300", pad: blur}).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	mp.AssertNotCalled(t, "Pad", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// Without both dimensions there is no box to pad to
+	mp = &mockProcessor{}
+	ms = &metrics.MockMetricService{}
+	m = NewManipulator(mp, nil, ms)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Resize", decoded, 200, 0).Return(resized)
+	mp.On("Encode", resized, "png").Return(input, nil)
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{fit: contain, width: "200"}).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	mp.AssertNotCalled(t, "Pad", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestManipulator_Process_WithCropOffset(t *testing.T) {
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	cropped := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("CropWithOptions", decoded, 200, 200, processor.PointTop, processor.CropOptions{Offset: image.Pt(0, 20)}).Return(cropped)
+	mp.On("Encode", cropped, "png").Return(input, nil)
+
+	params := map[string]string{fit: crop, width: "200", height: "200", crop: "top", cropOffsetX: "x", cropOffsetY: "20"}
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	mp.AssertNotCalled(t, "Crop", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_getCropOffset(t *testing.T) {
+	assert.Equal(t, image.Pt(0, 0), getCropOffset(map[string]string{}))
+	assert.Equal(t, image.Pt(-15, 20), getCropOffset(map[string]string{cropOffsetX: "-15", cropOffsetY: "20"}))
+	assert.Equal(t, image.Pt(0, 0), getCropOffset(map[string]string{cropOffsetX: "10000", cropOffsetY: "1.5"}))
+}
+
+func TestManipulator_Process_TracksParallelism(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("TrackParallelism", "avatar", 2)
+	ms.On("TrackParallelism", "avatar", 1)
+	ms.On("CountProcessedPixels", "avatar", 500*375)
+	m := NewManipulator(native.NewBildProcessor(native.WithMaxParallelism(2)), nil, ms)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	spec := NewSpecBuilder().WithImageData(img).WithScope("avatar").
+		WithParams(map[string]string{mono: blackHexCode}).Build()
+	_, err := m.Process(spec)
+	assert.Nil(t, err)
+	ms.AssertCalled(t, "TrackParallelism", "avatar", 2)
+
+	// The limit can't be used beyond GOMAXPROCS
+	runtime.GOMAXPROCS(1)
+	_, err = m.Process(spec)
+	assert.Nil(t, err)
+	ms.AssertCalled(t, "TrackParallelism", "avatar", 1)
+	ms.AssertNumberOfCalls(t, "TrackParallelism", 2)
+
+	// Processors without a limit report nothing
+	ms = &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	m = NewManipulator(native.NewBildProcessor(), nil, ms)
+	_, err = m.Process(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{mono: blackHexCode}).Build())
+	assert.Nil(t, err)
+	ms.AssertNotCalled(t, "TrackParallelism", mock.Anything, mock.Anything)
+}
+
+type mockFaceDetector struct {
+	mock.Mock
+}
+
+func (m *mockFaceDetector) DetectFaces(img image.Image) []image.Rectangle {
+	args := m.Called(img)
+	return args.Get(0).([]image.Rectangle)
+}
+
+func TestManipulator_Process_WithFitAuto(t *testing.T) {
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	cropped := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	faces := []image.Rectangle{image.Rect(10, 20, 60, 80)}
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	fd := &mockFaceDetector{}
+	m := NewManipulator(mp, nil, ms, WithFaceDetector(fd))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	fd.On("DetectFaces", decoded).Return(faces)
+	mp.On("SmartCrop", decoded, 200, 200, processor.SmartCropOptions{Faces: faces, FacePadding: 0.5}).Return(cropped)
+	mp.On("Encode", cropped, "png").Return(input, nil)
+
+	params := map[string]string{fit: autoFit, width: "200", height: "200", facePad: "50"}
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	fd.AssertExpectations(t)
+	ms.AssertCalled(t, "TrackDuration", faceDetectKey, mock.Anything, mock.Anything)
+}
+
+func TestManipulator_Process_WithFitAutoWithoutFaceDetector(t *testing.T) {
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	cropped := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("SmartCrop", decoded, 200, 200, processor.SmartCropOptions{FacePadding: 0.2}).Return(cropped)
+	mp.On("Encode", cropped, "png").Return(input, nil)
+
+	params := map[string]string{fit: autoFit, width: "200", height: "200"}
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+}
+
+func Test_getFacePadding(t *testing.T) {
+	assert.Equal(t, 0.2, getFacePadding(map[string]string{}))
+	assert.Equal(t, 0.0, getFacePadding(map[string]string{facePad: "0"}))
+	assert.Equal(t, 0.35, getFacePadding(map[string]string{facePad: "35"}))
+	assert.Equal(t, 0.2, getFacePadding(map[string]string{facePad: "101"}))
+}
+
+func TestManipulator_Process_WithPerspective(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	rotated := image.NewRGBA(image.Rect(0, 0, 300, 400))
+	warped := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	corners := [4]image.Point{{X: 20, Y: 0}, {X: 200, Y: 30}, {X: 180, Y: 200}, {X: 0, Y: 170}}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Rotate", decoded, 90.0).Return(rotated)
+	mp.On("Perspective", rotated, corners).Return(warped)
+	mp.On("Encode", warped, "png").Return(input, nil)
+
+	// The perspective is applied after every param based operation
+	spec := NewSpecBuilder().WithImageData(input).WithParams(map[string]string{rotate: "90"}).WithPerspective(corners).Build()
+	_, err := m.Process(spec)
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	ms.AssertCalled(t, "TrackDuration", perspectiveKey, mock.Anything, input)
+
+	// An unbounded output is rejected before anything is decoded
+	mp = &mockProcessor{}
+	m = NewManipulator(mp, nil, ms)
+	corners[2] = image.Pt(1<<30, 1<<30)
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).WithPerspective(corners).Build())
+	var verr *ValidationError
+	assert.True(t, errors.As(err, &verr))
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+}
+
+func TestManipulator_Process_RasterizesSVGAtRequestedSize(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"/>`)
+	rasterized := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Rasterize", input, 200, 0).Return(rasterized, nil)
+	mp.On("Resize", rasterized, 200, 0).Return(rasterized)
+	mp.On("Encode", rasterized, processor.ExtensionPNG).Return([]byte("png"), nil)
+	ms.On("CountFormatChanges", defaultScope, "svg+xml", mock.Anything)
+
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "200"}).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("png"), out)
+	mp.AssertExpectations(t)
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+
+	mp = &mockProcessor{}
+	m = NewManipulator(mp, nil, ms)
+	ms.On("CountImageProcessErrors", decodeErrorKey, defaultScope, mock.Anything)
+	mp.On("Rasterize", input, 0, 0).Return(nil, errors.New("bad svg"))
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).Build())
+	assert.NotNil(t, err)
+}
+
+func TestManipulator_Process_WithResizeOutside(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	resized := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Encode", resized, "png").Return(input, nil)
+
+	mp.On("Resize", decoded, 200, 200).Return(resized)
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "200", height: "200"}).Build())
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "200", height: "200", resize: inside}).Build())
+	mp.AssertNumberOfCalls(t, "Resize", 2)
+
+	mp.On("Scale", decoded, 400, 200).Return(resized)
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "200", height: "200", resize: outside}).Build())
+	mp.AssertNumberOfCalls(t, "Scale", 1)
+
+	// With a single dimension there is nothing to choose between
+	mp.On("Resize", decoded, 200, 0).Return(resized)
+	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "200", resize: outside}).Build())
+	mp.AssertNumberOfCalls(t, "Resize", 3)
+}
+
+func Test_getOutsideDimensions(t *testing.T) {
+	assert.Equal(t, []int{400, 200}, dims(getOutsideDimensions(200, 200, 1000, 500)))
+	assert.Equal(t, []int{200, 100}, dims(getOutsideDimensions(200, 50, 1000, 500)))
+	assert.Equal(t, []int{2000, 1000}, dims(getOutsideDimensions(2000, 1000, 1000, 500)))
+	// Fitting inside picks the smaller scale for the same box
+	assert.Equal(t, []int{200, 100}, dims(getResizeDimensions(200, 200, 1000, 500)))
+}
+
+func TestManipulator_Process_TracksFormatChanges(t *testing.T) {
+	pngData, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	jpegData, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	var changes [][]string
+	m := NewManipulator(mp, nil, ms, WithFormatChangeCallback(func(scope, from, to string) {
+		changes = append(changes, []string{scope, from, to})
+	}))
+	decoded := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountFormatChanges", "catalog", "png", "jpeg")
+	ms.On("CountProcessedPixels", "catalog", mock.Anything)
+	mp.On("Decode", pngData).Return(decoded, "png", nil)
+	mp.On("Encode", decoded, "png").Return(jpegData, nil)
+	mp.On("Decode", jpegData).Return(decoded, "jpeg", nil)
+	mp.On("Encode", decoded, "jpeg").Return(jpegData, nil)
+
+	// An opaque PNG downgraded to JPEG by the encoder
+	_, err := m.Process(NewSpecBuilder().WithScope("catalog").WithImageData(pngData).Build())
+	assert.Nil(t, err)
+	_, err = m.Process(NewSpecBuilder().WithScope("catalog").WithImageData(jpegData).Build())
+	assert.Nil(t, err)
+
+	ms.AssertNumberOfCalls(t, "CountFormatChanges", 1)
+	assert.Equal(t, [][]string{{"catalog", processor.ContentTypePNG, processor.ContentTypeJPEG}}, changes)
+}
+
+func TestManipulator_Process_WithPNGDowngradeByScope(t *testing.T) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(opaque, opaque.Bounds(), image.White, image.ZP, draw.Src)
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, opaque)
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{},
+		WithPNGDowngradeByScope(map[string]bool{"design-assets": false, "catalog": true}))
+
+	for scope, expected := range map[string]string{"design-assets": "png", "catalog": "jpeg", "other": "jpeg", "": "jpeg"} {
+		out, err := m.Process(NewSpecBuilder().WithScope(scope).WithImageData(buf.Bytes()).Build())
+		assert.NoError(t, err)
+		assert.Equal(t, expected, metrics.GetImageFormat(out), scope)
+	}
+
+	// Specs without a scope follow the policy of the default scope
+	m = NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{},
+		WithPNGDowngradeByScope(map[string]bool{defaultScope: false}))
+	out, err := m.Process(NewSpecBuilder().WithImageData(buf.Bytes()).Build())
+	assert.NoError(t, err)
+	assert.Equal(t, "png", metrics.GetImageFormat(out))
+}
+
+func Test_getContentSubtype(t *testing.T) {
+	assert.Equal(t, "jpeg", getContentSubtype(processor.ContentTypeJPEG))
+	assert.Equal(t, "svg+xml", getContentSubtype(processor.ContentTypeSVG))
+	assert.Equal(t, "plain", getContentSubtype("text/plain; charset=utf-8"))
+	assert.Equal(t, "", getContentSubtype(""))
+}
+
+func TestManipulator_Process_WithEvenDimensions(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms)
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 1000, 667))
+	scaled := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	cropped := image.NewRGBA(image.Rect(0, 0, 300, 150))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	mp.On("Decode", input).Return(decoded, "jpeg", nil)
+	// 301x200 is rounded down before the single resize
+	mp.On("Scale", decoded, 300, 200).Return(scaled)
+	mp.On("Encode", scaled, "jpeg").Return(input, nil)
+
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{width: "301", even: "true"}).Build())
+	assert.Nil(t, err)
+	mp.AssertExpectations(t)
+	mp.AssertNotCalled(t, "Resize", mock.Anything, mock.Anything, mock.Anything)
+
+	// The crop box is rounded down
+	mp.On("Crop", decoded, 300, 150, processor.PointCenter).Return(cropped)
+	mp.On("Encode", cropped, "jpeg").Return(input, nil)
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).
+		WithParams(map[string]string{width: "301", height: "151", fit: crop, even: "true"}).Build())
+	assert.Nil(t, err)
+	mp.AssertNumberOfCalls(t, "Scale", 1)
+	mp.AssertNumberOfCalls(t, "Crop", 1)
+
+	// An image that isn't resized is only scaled if it has odd dimensions
+	mp = &mockProcessor{}
+	m = NewManipulator(mp, nil, ms)
+	mp.On("Decode", input).Return(scaled, "jpeg", nil)
+	mp.On("Encode", scaled, "jpeg").Return(input, nil)
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{even: "true"}).Build())
+	assert.Nil(t, err)
+	mp.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_getEvenDimensions(t *testing.T) {
+	assert.Equal(t, []int{300, 200}, dims(getEvenDimensions(301, 201)))
+	assert.Equal(t, []int{300, 200}, dims(getEvenDimensions(300, 200)))
+	assert.Equal(t, []int{2, 2}, dims(getEvenDimensions(1, 0)))
+}
+
+func Test_getTolerance(t *testing.T) {
+	assert.Equal(t, uint8(defaultTolerance), getTolerance(""))
+	assert.Equal(t, uint8(0), getTolerance("0"))
+	assert.Equal(t, uint8(255), getTolerance("255"))
+	assert.Equal(t, uint8(defaultTolerance), getTolerance("256"))
+	assert.Equal(t, uint8(defaultTolerance), getTolerance("-1"))
+}
+
+func Test_getOverlayOpacity(t *testing.T) {
+	assert.Equal(t, uint8(defaultOverlay), getOverlayOpacity(""))
+	assert.Equal(t, uint8(defaultOverlay), getOverlayOpacity("half"))
+	assert.Equal(t, uint8(0), getOverlayOpacity("0"))
+	assert.Equal(t, uint8(255), getOverlayOpacity("255"))
+	// Values out of range are clamped instead of wrapping around the uint8 conversion
+	assert.Equal(t, uint8(255), getOverlayOpacity("256"))
+	assert.Equal(t, uint8(255), getOverlayOpacity("300"))
+	assert.Equal(t, uint8(255), getOverlayOpacity("99999999999"))
+	assert.Equal(t, uint8(0), getOverlayOpacity("-1"))
+	assert.Equal(t, uint8(0), getOverlayOpacity("-300"))
+}
+
+func Test_exceedsBox(t *testing.T) {
+	assert.False(t, exceedsBox(1000, 1000, 500, 375))
+	assert.False(t, exceedsBox(500, 375, 500, 375))
+	assert.False(t, exceedsBox(0, 0, 500, 375))
+	assert.True(t, exceedsBox(250, 250, 500, 375))
+	assert.True(t, exceedsBox(0, 300, 500, 375))
+	assert.True(t, exceedsBox(499, 0, 500, 375))
+}
+
+func Test_getMaxMegapixelsDimensions(t *testing.T) {
+	cases := []struct {
+		mp         float64
+		w, h       int
+		expectedW  int
+		expectedH  int
+		exceedsMax bool
+	}{
+		{mp: 2, w: 1000, h: 1000, expectedW: 1000, expectedH: 1000},
+		{mp: 1, w: 1000, h: 1000, expectedW: 1000, expectedH: 1000},
+		{mp: 1, w: 2000, h: 2000, expectedW: 1000, expectedH: 1000, exceedsMax: true},
+		{mp: 2, w: 4032, h: 3024, expectedW: 1632, expectedH: 1224, exceedsMax: true},
+		{mp: 0.5, w: 1920, h: 1080, expectedW: 942, expectedH: 530, exceedsMax: true},
+		// Deriving the height from a truncated width of 1 would give 0
+		{mp: 0.00001, w: 1, h: 50000, expectedW: 1, expectedH: 10, exceedsMax: true},
+		{mp: 0.0000001, w: 40, h: 30, expectedW: 1, expectedH: 1, exceedsMax: true},
+	}
+	for _, c := range cases {
+		w, h, ok := getMaxMegapixelsDimensions(c.mp, c.w, c.h)
+		assert.Equal(t, c.exceedsMax, ok)
+		assert.Equal(t, []int{c.expectedW, c.expectedH}, []int{w, h}, "%v megapixels of %dx%d", c.mp, c.w, c.h)
+		if c.mp*1000*1000 >= 1 {
+			assert.LessOrEqual(t, float64(w*h), c.mp*1000*1000)
+		}
+	}
+	for w := 1; w < 300; w += 7 {
+		for h := 1; h < 300; h += 11 {
+			mw, mh, _ := getMaxMegapixelsDimensions(0.001, w, h)
+			assert.LessOrEqual(t, mw*mh, 1000, "%dx%d", w, h)
+		}
+	}
+}
+
+func Test_getMaxMegapixels(t *testing.T) {
+	assert.Equal(t, 1000.0, getMaxMegapixels(map[string]string{maxMP: "1000"}))
+	assert.Equal(t, 0.5, getMaxMegapixels(map[string]string{maxMP: "0.5"}))
+	for _, v := range []string{"", "0", "-1", "1000.5", "NaN", "Inf", "abc"} {
+		assert.Equal(t, 0.0, getMaxMegapixels(map[string]string{maxMP: v}), v)
+	}
+}
+
+func Test_getEncodeOptions(t *testing.T) {
+	cases := []struct {
+		params   map[string]string
+		expected processor.EncodeOptions
+	}{
+		{params: map[string]string{}, expected: processor.EncodeOptions{}},
+		{params: map[string]string{profile: "unknown"}, expected: processor.EncodeOptions{}},
+		{
+			params:   map[string]string{profile: profileFast},
+			expected: processor.EncodeOptions{Quality: 80, Compression: processor.CompressionSpeed},
+		},
+		{
+			params:   map[string]string{profile: profileBest},
+			expected: processor.EncodeOptions{Quality: 100, Compression: processor.CompressionBest},
+		},
+		{
+			params:   map[string]string{profile: profileFast, quality: "60"},
+			expected: processor.EncodeOptions{Quality: 60, Compression: processor.CompressionSpeed},
+		},
+		{params: map[string]string{quality: "75"}, expected: processor.EncodeOptions{Quality: 75}},
+		{params: map[string]string{quality: "101"}, expected: processor.EncodeOptions{}},
+		{params: map[string]string{dpi: "300"}, expected: processor.EncodeOptions{DPI: 300}},
+		{params: map[string]string{background: "ff0000"}, expected: processor.EncodeOptions{}},
+		{
+			params:   map[string]string{background: "ff0000", outputFormat: processor.ExtensionJPG},
+			expected: processor.EncodeOptions{Background: color.RGBA{R: 0xff, A: 0xff}},
+		},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, getEncodeOptions(c.params))
+	}
+}
+
+// BenchmarkManipulator_Process_WithProfile compares the encoding time of the profiles for a photo encoded to
+// JPEG and a transparent image encoded to PNG
+func BenchmarkManipulator_Process_WithProfile(b *testing.B) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	jpg, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	pngData, _ := ioutil.ReadFile("../processor/native/_testdata/overlay.png")
+	for _, p := range []string{"", profileFast, profileBest} {
+		for name, data := range map[string][]byte{"jpeg": jpg, "png": pngData} {
+			// Resizing keeps the source from being returned as is
+			spec := NewSpecBuilder().WithImageData(data).WithParams(map[string]string{width: "300", profile: p}).Build()
+			b.Run(fmt.Sprintf("%s/profile=%s", name, p), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, _ = m.Process(spec)
+				}
+			})
+		}
+	}
+}
+
+func TestManipulator_Process_WithMetricSampling(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms, WithMetricSampling(3))
+	input := []byte("inputData")
+	decoded := &image.RGBA{Pix: []uint8{1, 2, 3, 4}}
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Encode", decoded, "png").Return(input, nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+
+	for i := 0; i < 6; i++ {
+		_, _ = m.Process(NewSpecBuilder().WithScope("catalog").WithImageData(input).Build())
+	}
+	_, _ = m.Process(NewSpecBuilder().WithScope("avatar").WithImageData(input).Build())
+
+	// Decode and encode duration is tracked for the 1st and 4th image of catalog and the 1st of avatar
+	ms.AssertNumberOfCalls(t, "TrackDuration", 6)
+	ms.AssertCalled(t, "TrackDuration", decodeDurationKey, mock.Anything, input)
+	ms.AssertCalled(t, "TrackDuration", encodeDurationKey, mock.Anything, input)
+}
 
+func TestManipulator_Process_CountsEncodeErrors(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(mp, nil, ms, WithMetricSampling(2))
 	input := []byte("inputData")
 	decoded := &image.RGBA{Pix: []uint8{1, 2, 3, 4}}
+	mp.On("Decode", input).Return(decoded, "webp", nil)
+	mp.On("Encode", decoded, "webp").Return([]byte(nil), errors.New("encoding error"))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountImageProcessErrors", encodeErrorKey, "catalog", "webp")
 
-	// Test flow for Decode error from Processor
-	mp.On("Decode", mock.Anything).Return(nil, "", errors.New("decoding error"))
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
-	mp.AssertExpectations(t)
+	// Errors are counted for every image even when the durations are sampled
+	for i := 0; i < 2; i++ {
+		_, err := m.Process(NewSpecBuilder().WithScope("catalog").WithImageData(input).Build())
+		assert.Error(t, err)
+	}
+	ms.AssertNumberOfCalls(t, "CountImageProcessErrors", 2)
+	ms.AssertNumberOfCalls(t, "TrackDuration", 1)
+}
 
-	// Create new struct for asserting expectations
-	mp = &mockProcessor{}
-	ms = &metrics.MockMetricService{}
-	m = NewManipulator(mp, nil, ms)
+func TestManipulator_Process_WithMaxConcurrency(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	input := []byte("inputData")
+	decoded := &image.RGBA{Pix: []uint8{1, 2, 3, 4}}
 	mp.On("Decode", input).Return(decoded, "png", nil)
 	mp.On("Encode", decoded, "png").Return(input, nil)
-	mp.On("Crop", decoded, 100, 100, processor.PointCenter).Return(decoded, nil)
 	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
-	params[fit] = crop
-	params[width] = "100"
-	params[height] = "100"
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	ms.On("CountImageProcessErrors", busyErrorKey, "catalog", "plain")
+	spec := NewSpecBuilder().WithScope("catalog").WithImageData(input).Build()
 
-	mp.On("Resize", decoded, 100, 100).Return(decoded, nil)
-	params = make(map[string]string)
-	params[width] = "100"
-	params[height] = "100"
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	// The slot is released after processing
+	m := NewManipulator(mp, nil, ms, WithMaxConcurrency(1)).(*manipulator)
+	for i := 0; i < 2; i++ {
+		_, err := m.Process(spec)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, m.slots, 0)
 
-	mp.On("Scale", decoded, 100, 100).Return(decoded, nil)
-	params = make(map[string]string)
-	params[width] = "100"
-	params[height] = "100"
-	params[fit] = scale
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	// A call waits for a free slot
+	m.slots <- struct{}{}
+	done := make(chan error)
+	go func() {
+		_, err := m.Process(spec)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	<-m.slots
+	assert.NoError(t, <-done)
+	ms.AssertCalled(t, "TrackDuration", queueDurationKey, mock.Anything, input)
 
-	mp.On("GrayScale", decoded).Return(decoded, nil)
-	params = make(map[string]string)
-	params[mono] = blackHexCode
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	// Or stops waiting once the context of the spec is done
+	m.slots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, err := m.Process(NewSpecBuilder().WithScope("catalog").WithImageData(input).WithContext(ctx).Build())
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	<-m.slots
 
-	mp.On("Blur", decoded, 60.0).Return(decoded, nil)
-	params = make(map[string]string)
-	params[blur] = "60"
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	// A source below min-process-size waits for a slot too
+	m.slots <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	png, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	_, err := m.Process(NewSpecBuilder().WithImageData(png).WithParams(map[string]string{minProcess: "1000"}).
+		WithContext(ctx).Build())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	<-m.slots
 
-	mp.On("Flip", decoded, "v").Return(decoded, nil)
-	params = make(map[string]string)
-	params[flip] = "v"
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	// Or is rejected
+	m = NewManipulator(mp, nil, ms, WithMaxConcurrency(1), WithRejectWhenBusy(true)).(*manipulator)
+	m.slots <- struct{}{}
+	_, err = m.Process(spec)
+	assert.Equal(t, ErrBusy, err)
+	ms.AssertCalled(t, "CountImageProcessErrors", busyErrorKey, "catalog", "plain")
 
-	mp.On("Rotate", decoded, 90.5).Return(decoded, nil)
-	params = map[string]string{rotate: "90.5"}
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	assert.Nil(t, NewManipulator(mp, nil, ms, WithMaxConcurrency(0)).(*manipulator).slots)
+}
 
-	mp.On("FixOrientation", decoded, 0).Return(decoded)
-	params = map[string]string{auto: compress}
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+func TestManipulator_Process_WithStrictParams(t *testing.T) {
+	mp := &mockProcessor{}
+	input := []byte("inputData")
+	decoded := &image.RGBA{Pix: []uint8{1, 2, 3, 4}}
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Encode", decoded, "png").Return(input, nil)
+	spec := NewSpecBuilder().WithImageData(input).WithParams(map[string]string{"widht": "200", "hieght": "100"}).Build()
 
-	mp.On("Decode", input).Return(decoded, processor.ExtensionWebP, nil)
-	params = map[string]string{auto: format}
-	_, _ = m.Process(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+	// Unknown params are ignored by default
+	m := NewManipulator(mp, nil, metrics.NoOpMetricService{})
+	_, err := m.Process(spec)
+	assert.NoError(t, err)
 
-	// Assert all expectations once here
-	mp.AssertExpectations(t)
+	m = NewManipulator(mp, map[string]string{"unknown": "x"}, metrics.NoOpMetricService{}, WithStrictParams(true))
+	_, err = m.Process(spec)
+	assert.EqualError(t, err, "invalid params: hieght is not a known param; widht is not a known param")
+	mp.AssertNumberOfCalls(t, "Decode", 1)
+
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{even: "false"}).Build())
+	assert.NoError(t, err)
+}
+
+func TestManipulator_Process_WithAllowedParams(t *testing.T) {
+	mp := &mockProcessor{}
+	input := []byte("inputData")
+	decoded := &image.RGBA{Pix: []uint8{1, 2, 3, 4}}
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Encode", decoded, "png").Return(input, nil)
+	mp.On("Flip", decoded, "h").Return(decoded)
+	m := NewManipulator(mp, map[string]string{flip: "h"}, metrics.NoOpMetricService{},
+		WithAllowedParams(width, height, fit))
+
+	_, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{
+		rotate: "45", blur: "10", fit: "crop", "utm_source": "x"}).Build())
+	assert.True(t, errors.Is(err, ErrParamNotAllowed))
+	assert.EqualError(t, err, "param not allowed: blur, rot")
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+
+	// The default params are applied even if they aren't allowed in a spec
+	_, err = m.Process(NewSpecBuilder().WithImageData(input).Build())
+	assert.NoError(t, err)
+	mp.AssertCalled(t, "Flip", decoded, "h")
+}
+
+func TestManipulator_Process_GrayScaleJPEGWithSingleChannel(t *testing.T) {
+	input, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	bp := native.NewBildProcessor()
+	m := NewManipulator(bp, nil, metrics.NoOpMetricService{})
+
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{mono: blackHexCode}).Build())
+	assert.NoError(t, err)
+	decoded, f, err := bp.Decode(out)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.ExtensionJPEG, f)
+	assert.Equal(t, color.GrayModel, decoded.ColorModel())
+
+	// The single channel JPEG is smaller than the 3 channel one
+	src, _, _ := bp.Decode(input)
+	rgb, err := bp.Encode(bp.GrayScale(src), processor.ExtensionJPEG)
+	assert.NoError(t, err)
+	assert.Less(t, len(out), len(rgb))
+
+	// Transparent padding is kept in an RGBA image, the JPEG encoder flattens it onto black
+	assert.True(t, hasTransparentPadding(map[string]string{width: "10", height: "10"}, FitContain))
+	assert.False(t, hasTransparentPadding(map[string]string{width: "10", height: "10", background: "000000"}, FitContain))
+	assert.False(t, hasTransparentPadding(map[string]string{width: "10", height: "10", pad: blur}, FitContain))
+	assert.False(t, hasTransparentPadding(map[string]string{width: "10"}, FitContain))
+	assert.False(t, hasTransparentPadding(map[string]string{width: "10", height: "10"}, FitCrop))
+}
+
+func TestManipulator_Process_WithColors(t *testing.T) {
+	bp := native.NewBildProcessor()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 0x80, A: 0xff})
+		}
+	}
+	buff := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buff, img))
+	input := buff.Bytes()
+
+	m := NewManipulator(bp, nil, metrics.NoOpMetricService{})
+	var outputs [][]byte
+	for _, d := range []string{ditherNone, ditherFS, ditherFS} {
+		out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{colors: "8", dither: d}).Build())
+		assert.NoError(t, err)
+		decoded, f, err := bp.Decode(out)
+		assert.NoError(t, err)
+		// The opaque palette image stays a PNG
+		assert.Equal(t, processor.ExtensionPNG, f)
+		if assert.IsType(t, &image.Paletted{}, decoded) {
+			assert.LessOrEqual(t, len(decoded.(*image.Paletted).Palette), 8)
+		}
+		outputs = append(outputs, out)
+	}
+	assert.NotEqual(t, outputs[0], outputs[1])
+	assert.Equal(t, outputs[1], outputs[2])
+
+	// JPEG outputs aren't quantized
+	mp := &mockProcessor{}
+	jpg, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	decoded, _, _ := bp.Decode(jpg)
+	mp.On("Decode", jpg).Return(decoded, processor.ExtensionJPEG, nil)
+	mp.On("Encode", decoded, processor.ExtensionJPEG).Return([]byte("encoded"), nil)
+	_, err := NewManipulator(mp, nil, metrics.NoOpMetricService{}).Process(NewSpecBuilder().WithImageData(jpg).WithParams(map[string]string{colors: "8"}).Build())
+	assert.NoError(t, err)
+	mp.AssertNotCalled(t, "Quantize", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestManipulator_Process_IsDeterministic(t *testing.T) {
+	input, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	keys := []string{width, height, fit, crop, blur, rotate, flip, quality, auto, colors, even}
+	values := []string{"120", "80", crop, "top,left", "1.5", "90", "h", "70", format, "16", "true"}
+	m := NewManipulator(native.NewBildProcessor(), map[string]string{auto: compress, mono: "000000"}, metrics.NoOpMetricService{})
+
+	var expected []byte
+	var expectedInfo ProcessInfo
+	for i := 0; i < 20; i++ {
+		// Insert the params in a different order every run, the output must not depend on it
+		params := map[string]string{}
+		for j := range keys {
+			k := (i + j) % len(keys)
+			params[keys[k]] = values[k]
+		}
+		out, info, err := m.ProcessWithInfo(NewSpecBuilder().WithImageData(input).WithParams(params).Build())
+		assert.NoError(t, err)
+		if i == 0 {
+			expected, expectedInfo = out, info
+			continue
+		}
+		assert.Equal(t, expected, out)
+		assert.Equal(t, expectedInfo, info)
+	}
+	assert.Equal(t, 80, expectedInfo.Height)
+}
+
+func TestManipulator_Process_WithAutoSharpen(t *testing.T) {
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	small := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	large := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	sharpened := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	// The mocks match images by value
+	sharpened.Pix[0] = 1
+
+	mp := &mockProcessor{}
+	m := NewManipulator(mp, nil, metrics.NoOpMetricService{})
+	mp.On("Decode", input).Return(decoded, processor.ExtensionJPEG, nil)
+	mp.On("Resize", decoded, 100, 0).Return(small, nil)
+	mp.On("Resize", decoded, 400, 0).Return(large, nil)
+	mp.On("Sharpen", small, defaultSharpen).Return(sharpened, nil)
+	mp.On("Sharpen", small, 1.5).Return(sharpened, nil)
+	mp.On("Encode", sharpened, processor.ExtensionJPEG).Return([]byte("sharpened"), nil)
+	mp.On("Encode", small, processor.ExtensionJPEG).Return([]byte("small"), nil)
+	mp.On("Encode", large, processor.ExtensionJPEG).Return([]byte("large"), nil)
+
+	cases := []struct {
+		params   map[string]string
+		expected string
+	}{
+		{params: map[string]string{width: "100", autoSharpen: "true"}, expected: "sharpened"},
+		{params: map[string]string{width: "100", autoSharpen: "true", sharpenAmt: "1.5"}, expected: "sharpened"},
+		{params: map[string]string{width: "100", autoSharpen: "true", sharpenAmt: "0"}, expected: "small"},
+		{params: map[string]string{width: "100"}, expected: "small"},
+		// Upscales aren't sharpened
+		{params: map[string]string{width: "400", autoSharpen: "true"}, expected: "large"},
+	}
+	for _, c := range cases {
+		out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(c.params).Build())
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, string(out))
+	}
+	mp.AssertNumberOfCalls(t, "Sharpen", 2)
+}
+
+func Test_isDownscaled(t *testing.T) {
+	assert.True(t, isDownscaled(image.Pt(200, 100), image.Pt(100, 50)))
+	assert.False(t, isDownscaled(image.Pt(200, 100), image.Pt(400, 200)))
+	// A crop at the scale of the source keeps one side
+	assert.False(t, isDownscaled(image.Pt(200, 100), image.Pt(200, 20)))
+	assert.False(t, isDownscaled(image.Pt(200, 100), image.Pt(200, 100)))
+}
+
+func Test_getSharpenAmount(t *testing.T) {
+	assert.Equal(t, defaultSharpen, getSharpenAmount(""))
+	assert.Equal(t, defaultSharpen, getSharpenAmount("x"))
+	assert.Equal(t, defaultSharpen, getSharpenAmount("6"))
+	assert.Equal(t, 1.5, getSharpenAmount("1.5"))
+	assert.Equal(t, float64(0), getSharpenAmount("0"))
+}
+
+func TestManipulator_Process_WithOutputFormat(t *testing.T) {
+	// A transparent frame around an opaque blue center
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, image.Rect(16, 16, 48, 48), image.NewUniform(color.NRGBA{B: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	buff := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buff, img))
+	input := buff.Bytes()
+
+	cases := []struct {
+		name     string
+		opts     []native.EncodersOption
+		params   map[string]string
+		expected color.RGBA
+	}{
+		{name: "default background", params: map[string]string{outputFormat: processor.ExtensionJPEG},
+			expected: color.RGBA{A: 0xff}},
+		{name: "jpg", params: map[string]string{outputFormat: processor.ExtensionJPG},
+			expected: color.RGBA{A: 0xff}},
+		{name: "configured background", opts: []native.EncodersOption{native.WithFlattenBackground(color.RGBA{G: 0xff, A: 0xff})},
+			params: map[string]string{outputFormat: processor.ExtensionJPEG}, expected: color.RGBA{G: 0xff, A: 0xff}},
+		{name: "bg param", opts: []native.EncodersOption{native.WithFlattenBackground(color.RGBA{G: 0xff, A: 0xff})},
+			params: map[string]string{outputFormat: processor.ExtensionJPEG, background: "ff0000"}, expected: color.RGBA{R: 0xff, A: 0xff}},
+	}
+	for _, c := range cases {
+		bp := native.NewBildProcessor(native.WithEncoders(native.NewEncoders(c.opts...)))
+		m := NewManipulator(bp, nil, metrics.NoOpMetricService{})
+		out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(c.params).Build())
+		assert.NoError(t, err, c.name)
+		decoded, f, err := bp.Decode(out)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, processor.ExtensionJPEG, f, c.name)
+		assertColorNear(t, c.expected, decoded.At(4, 4), c.name)
+		assertColorNear(t, color.RGBA{B: 0xff, A: 0xff}, decoded.At(32, 32), c.name)
+	}
+
+	// An explicit format takes precedence over auto=format
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	spec := NewSpecBuilder().WithImageData(input).WithFormats([]string{"image/webp"}).
+		WithParams(map[string]string{auto: format, outputFormat: processor.ExtensionPNG}).Build()
+	out, err := m.Process(spec)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", metrics.GetImageFormat(out))
+}
+
+// assertColorNear asserts that the colors differ by at most 8 on every channel, leaving room for JPEG artifacts
+func assertColorNear(t *testing.T, expected, actual color.Color, msg string) {
+	e, a := color.RGBAModel.Convert(expected).(color.RGBA), color.RGBAModel.Convert(actual).(color.RGBA)
+	for _, d := range []int{int(e.R) - int(a.R), int(e.G) - int(a.G), int(e.B) - int(a.B), int(e.A) - int(a.A)} {
+		if d > 8 || d < -8 {
+			assert.Fail(t, fmt.Sprintf("expected %v, got %v", e, a), msg)
+			return
+		}
+	}
+}
+
+func TestManipulator_Process_WithMinProcessSize(t *testing.T) {
+	input, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	mp := &mockProcessor{}
+	m := NewManipulator(mp, nil, metrics.NoOpMetricService{})
+
+	// test.png is 500x375, it is returned without being decoded
+	for _, size := range []string{"500", "1000"} {
+		out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{minProcess: size, width: "10"}).Build())
+		assert.NoError(t, err)
+		assert.Equal(t, input, out)
+	}
+	mp.AssertNotCalled(t, "Decode", mock.Anything)
+
+	m = NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	out, err := m.Process(NewSpecBuilder().WithImageData(input).WithParams(map[string]string{minProcess: "499", width: "10"}).Build())
+	assert.NoError(t, err)
+	info, _ := m.Inspect(out)
+	assert.Equal(t, 10, info.Width)
+
+	assert.False(t, isBelowProcessSize(input, 0))
+	assert.False(t, isBelowProcessSize([]byte("badImage"), 1000))
+}
+
+func TestManipulator_WithMetricSampling(t *testing.T) {
+	ms := &metrics.MockMetricService{}
+	m := NewManipulator(nil, nil, ms, WithMetricSampling(1)).(*manipulator)
+	assert.Equal(t, ms, m.sampledMetricService(""))
+	assert.Equal(t, ms, m.sampledMetricService(""))
+
+	m = NewManipulator(nil, nil, ms, WithMetricSampling(2)).(*manipulator)
+	assert.Equal(t, ms, m.sampledMetricService("a"))
+	assert.Equal(t, metrics.NoOpMetricService{}, m.sampledMetricService("a"))
+	assert.Equal(t, ms, m.sampledMetricService("b"))
+	assert.Equal(t, ms, m.sampledMetricService("a"))
+}
+
+func TestManipulator_normalizeScope(t *testing.T) {
+	m := NewManipulator(nil, nil, nil).(*manipulator)
+	assert.Equal(t, defaultScope, m.normalizeScope(""))
+	assert.Equal(t, "any scope/123", m.normalizeScope("any scope/123"))
+
+	m = NewManipulator(nil, nil, nil, WithDefaultScope("other"), WithScopePattern(regexp.MustCompile(`^[a-z-]{1,8}$`))).(*manipulator)
+	assert.Equal(t, "other", m.normalizeScope(""))
+	assert.Equal(t, "products", m.normalizeScope("products"))
+	assert.Equal(t, "other", m.normalizeScope("products-123"))
+	assert.Equal(t, "other", m.normalizeScope("Products"))
+}
+
+func TestManipulator_Process_WithScope(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	var scopes []string
+	m := NewManipulator(mp, nil, ms, WithScopePattern(regexp.MustCompile(`^[a-z]+$`)),
+		WithFormatChangeCallback(func(scope, _, _ string) { scopes = append(scopes, scope) }))
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	mp.On("Decode", input).Return(decoded, processor.ExtensionPNG, nil)
+	mp.On("Encode", decoded, processor.ExtensionPNG).Return([]byte("\xff\xd8\xff"), nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	ms.On("CountFormatChanges", mock.Anything, mock.Anything, mock.Anything)
+
+	for _, scope := range []string{"", "products", "user/42"} {
+		_, err := m.Process(NewSpecBuilder().WithScope(scope).WithImageData(input).Build())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{defaultScope, "products", defaultScope}, scopes)
+	ms.AssertCalled(t, "CountFormatChanges", defaultScope, mock.Anything, mock.Anything)
+	ms.AssertCalled(t, "CountFormatChanges", "products", mock.Anything, mock.Anything)
+	ms.AssertNotCalled(t, "CountFormatChanges", "user/42", mock.Anything, mock.Anything)
 }
 
 func TestGetParams(t *testing.T) {
@@ -172,6 +1707,29 @@ func TestGetCropPoint(t *testing.T) {
 	assert.Equal(t, processor.PointCenter, GetCropPoint("random"))
 }
 
+func TestGetFocalPoint(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected processor.FocalPoint
+		ok       bool
+	}{
+		{input: "25,75", expected: processor.FocalPoint{X: 0.25, Y: 0.75}, ok: true},
+		{input: "0,100", expected: processor.FocalPoint{X: 0, Y: 1}, ok: true},
+		{input: "12.5, 50", expected: processor.FocalPoint{X: 0.125, Y: 0.5}, ok: true},
+		{input: "top,left"},
+		{input: "50"},
+		{input: "101,50"},
+		{input: "-1,50"},
+		{input: "10,20,30"},
+		{input: ""},
+	}
+	for _, c := range cases {
+		fp, ok := GetFocalPoint(c.input)
+		assert.Equal(t, c.ok, ok, c.input)
+		assert.Equal(t, c.expected, fp, c.input)
+	}
+}
+
 func TestCleanInt(t *testing.T) {
 	assert.Equal(t, 999, CleanInt("999"))
 	assert.Equal(t, 23, CleanInt("23"))
@@ -182,6 +1740,23 @@ func TestCleanInt(t *testing.T) {
 	assert.Equal(t, 0, CleanInt("-234"))
 }
 
+func TestCleanHexColor(t *testing.T) {
+	c, ok := CleanHexColor("ff8000")
+	assert.True(t, ok)
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0x80, B: 0x00, A: 0xff}, c)
+	c, ok = CleanHexColor("000000")
+	assert.True(t, ok)
+	assert.Equal(t, color.RGBA{A: 0xff}, c)
+	_, ok = CleanHexColor("fff")
+	assert.False(t, ok)
+	_, ok = CleanHexColor("#fffff")
+	assert.False(t, ok)
+	_, ok = CleanHexColor("gggggg")
+	assert.False(t, ok)
+	_, ok = CleanHexColor("")
+	assert.False(t, ok)
+}
+
 func TestManipulator_HasDefaultParams(t *testing.T) {
 	manipulatorWithDefaultParams := NewManipulator(nil, map[string]string{"auto": "compress"}, nil)
 	manipulatorWithoutDefaultParams := NewManipulator(nil, map[string]string{}, nil)
@@ -199,6 +1774,48 @@ func (m *mockProcessor) Crop(img image.Image, width, height int, point processor
 	return args.Get(0).(image.Image)
 }
 
+func (m *mockProcessor) CropWithOptions(img image.Image, width, height int, point processor.Point,
+	opts processor.CropOptions) image.Image {
+	args := m.Called(img, width, height, point, opts)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) FocalCrop(img image.Image, width, height int, point processor.FocalPoint) image.Image {
+	args := m.Called(img, width, height, point)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) SmartCrop(img image.Image, width, height int, opts processor.SmartCropOptions) image.Image {
+	args := m.Called(img, width, height, opts)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) ColorWash(img image.Image, c color.Color, opacity uint8) image.Image {
+	args := m.Called(img, c, opacity)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Splash(img image.Image, keep color.Color, tolerance uint8) image.Image {
+	args := m.Called(img, keep, tolerance)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) WatermarkImage(base, overlay image.Image, opacity uint8, opts processor.WatermarkOptions) (image.Image, error) {
+	args := m.Called(base, overlay, opacity, opts)
+	return args.Get(0).(image.Image), args.Error(1)
+}
+
+func (m *mockProcessor) PadWithOptions(img image.Image, width, height int, point processor.Point, background color.Color,
+	opts processor.PadOptions) image.Image {
+	args := m.Called(img, width, height, point, background, opts)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Pad(img image.Image, width, height int, point processor.Point, background color.Color) image.Image {
+	args := m.Called(img, width, height, point, background)
+	return args.Get(0).(image.Image)
+}
+
 func (m *mockProcessor) Resize(img image.Image, width, height int) image.Image {
 	args := m.Called(img, width, height)
 	return args.Get(0).(image.Image)
@@ -214,16 +1831,105 @@ func (m *mockProcessor) Watermark(base []byte, overlay []byte, opacity uint8) ([
 	return args.Get(0).([]byte), args.Get(1).(error)
 }
 
+func (m *mockProcessor) WatermarkWithOptions(base []byte, overlay []byte, opacity uint8, opts processor.WatermarkOptions) ([]byte, error) {
+	args := m.Called(base, overlay, opacity, opts)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
 func (m *mockProcessor) GrayScale(img image.Image) image.Image {
 	args := m.Called(img)
 	return args.Get(0).(image.Image)
 }
 
+func (m *mockProcessor) GrayScaleWithOptions(img image.Image, opts processor.GrayScaleOptions) image.Image {
+	args := m.Called(img, opts)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) ExtractChannel(img image.Image, channel string) image.Image {
+	args := m.Called(img, channel)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) SwapChannels(img image.Image, order string) image.Image {
+	args := m.Called(img, order)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Solarize(img image.Image, threshold uint8) image.Image {
+	args := m.Called(img, threshold)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Quantize(img image.Image, colors int, opts processor.QuantizeOptions) image.Image {
+	args := m.Called(img, colors, opts)
+	return args.Get(0).(image.Image)
+}
+
 func (m *mockProcessor) Blur(img image.Image, radius float64) image.Image {
 	args := m.Called(img, radius)
 	return args.Get(0).(image.Image)
 }
 
+func (m *mockProcessor) Denoise(img image.Image, radius int) image.Image {
+	args := m.Called(img, radius)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Desaturate(img image.Image, amount float64) image.Image {
+	args := m.Called(img, amount)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Sharpen(img image.Image, amount float64) image.Image {
+	args := m.Called(img, amount)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Duotone(img image.Image, dark, light color.Color) image.Image {
+	args := m.Called(img, dark, light)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Recolor(img image.Image, from, to color.Color, tolerance uint8) image.Image {
+	args := m.Called(img, from, to, tolerance)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) ChromaKey(img image.Image, key color.Color, tolerance uint8) image.Image {
+	args := m.Called(img, key, tolerance)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Histogram(img image.Image) processor.Histogram {
+	args := m.Called(img)
+	return args.Get(0).(processor.Histogram)
+}
+
+func (m *mockProcessor) SpriteSheet(frames [][]byte, cols int) ([]byte, processor.SpriteLayout, error) {
+	args := m.Called(frames, cols)
+	if args.Get(0) == nil {
+		return nil, processor.SpriteLayout{}, args.Error(2)
+	}
+	return args.Get(0).([]byte), args.Get(1).(processor.SpriteLayout), args.Error(2)
+}
+
+func (m *mockProcessor) DecodeAnimation(data []byte) (*processor.Animation, error) {
+	args := m.Called(data)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*processor.Animation), args.Error(1)
+}
+
+func (m *mockProcessor) EncodeAnimation(a *processor.Animation) ([]byte, error) {
+	args := m.Called(a)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
 func (m *mockProcessor) Flip(img image.Image, mode string) image.Image {
 	args := m.Called(img, mode)
 	return args.Get(0).(image.Image)
@@ -234,6 +1940,35 @@ func (m *mockProcessor) Rotate(img image.Image, angle float64) image.Image {
 	return args.Get(0).(image.Image)
 }
 
+func (m *mockProcessor) RotateWithOptions(img image.Image, angle float64, opts processor.RotateOptions) image.Image {
+	args := m.Called(img, angle, opts)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Convert(input []byte, format string, opts processor.EncodeOptions) ([]byte, error) {
+	args := m.Called(input, format, opts)
+	b := args.Get(0).([]byte)
+	return b, args.Error(1)
+}
+
+func (m *mockProcessor) Cover(img image.Image, width, height int, point processor.Point) image.Image {
+	args := m.Called(img, width, height, point)
+	return args.Get(0).(image.Image)
+}
+
+func (m *mockProcessor) Rasterize(data []byte, width, height int) (image.Image, error) {
+	args := m.Called(data, width, height)
+	if img := args.Get(0); img != nil {
+		return img.(image.Image), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockProcessor) Perspective(img image.Image, corners [4]image.Point) image.Image {
+	args := m.Called(img, corners)
+	return args.Get(0).(image.Image)
+}
+
 func (m *mockProcessor) Decode(data []byte) (image.Image, string, error) {
 	args := m.Called(data)
 	img := args.Get(0)
@@ -253,6 +1988,15 @@ func (m *mockProcessor) Encode(img image.Image, format string) ([]byte, error) {
 	return b, args.Get(1).(error)
 }
 
+func (m *mockProcessor) EncodeWithOptions(img image.Image, format string, opts processor.EncodeOptions) ([]byte, error) {
+	args := m.Called(img, format, opts)
+	b := args.Get(0).([]byte)
+	if args.Get(1) == nil {
+		return b, nil
+	}
+	return b, args.Get(1).(error)
+}
+
 func (m *mockProcessor) FixOrientation(img image.Image, orientation int) image.Image {
 	args := m.Called(img, orientation)
 	return args.Get(0).(image.Image)
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -13,6 +15,56 @@ func (m *MockManipulator) Process(spec processSpec) ([]byte, error) {
 	return args.Get(0).([]byte), args.Error(1)
 }
 
+func (m *MockManipulator) ProcessWithInfo(spec processSpec) ([]byte, ProcessInfo, error) {
+	args := m.Called(spec)
+	return args.Get(0).([]byte), args.Get(1).(ProcessInfo), args.Error(2)
+}
+
+func (m *MockManipulator) ProcessWithResult(spec processSpec) (ProcessResult, error) {
+	args := m.Called(spec)
+	return args.Get(0).(ProcessResult), args.Error(1)
+}
+
+func (m *MockManipulator) ProcessDual(spec processSpec) (DualResult, error) {
+	args := m.Called(spec)
+	return args.Get(0).(DualResult), args.Error(1)
+}
+
+func (m *MockManipulator) ProcessFromSource(ctx context.Context, source Source, spec processSpec) ([]byte, error) {
+	args := m.Called(ctx, source, spec)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockManipulator) Validate(spec processSpec) error {
+	args := m.Called(spec)
+	return args.Error(0)
+}
+
+func (m *MockManipulator) Estimate(spec processSpec) (EstimateResult, error) {
+	args := m.Called(spec)
+	return args.Get(0).(EstimateResult), args.Error(1)
+}
+
+func (m *MockManipulator) Canvas(input []byte, width, height int, bgHex string, fitMode FitMode) ([]byte, error) {
+	args := m.Called(input, width, height, bgHex, fitMode)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockManipulator) LQIP(input []byte, maxDim int) (string, error) {
+	args := m.Called(input, maxDim)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockManipulator) Inspect(data []byte) (ImageInfo, error) {
+	args := m.Called(data)
+	return args.Get(0).(ImageInfo), args.Error(1)
+}
+
+func (m *MockManipulator) Verify(data []byte) error {
+	args := m.Called(data)
+	return args.Error(0)
+}
+
 func (m *MockManipulator) HasDefaultParams() bool {
 	args := m.Called()
 	return args.Get(0).(bool)
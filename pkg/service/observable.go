@@ -0,0 +1,317 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+const (
+	watermarkDurationKey   = "watermarkDuration"
+	overlayDurationKey     = "overlayDuration"
+	histogramDurationKey   = "histogramDuration"
+	convertDurationKey     = "convertDuration"
+	spriteSheetDurationKey = "spriteSheetDuration"
+)
+
+// ObservableOption represents builder function for NewObservableProcessor
+type ObservableOption func(*observableProcessor)
+
+// WithProcessorMetrics is a builder function to set the MetricService the durations and errors of the operations
+// of an observable processor are tracked with, the default tracks nothing
+func WithProcessorMetrics(ms metrics.MetricService) ObservableOption {
+	return func(o *observableProcessor) {
+		o.metricService = ms
+	}
+}
+
+// WithProcessorScope is a builder function to set the scope the errors of an observable processor are counted for,
+// the default is the default scope
+func WithProcessorScope(scope string) ObservableOption {
+	return func(o *observableProcessor) {
+		o.scope = scope
+	}
+}
+
+// observableProcessor decorates a processor.Processor, every operation is delegated and timed
+type observableProcessor struct {
+	processor     processor.Processor
+	metricService metrics.MetricService
+	scope         string
+}
+
+// NewObservableProcessor takes a processor.Processor and ObservableOptions and returns a processor.Processor that
+// delegates every operation to p and tracks its duration with the same keys as the manipulator, e.g. resizeDuration,
+// so existing dashboards cover callers using a processor directly. Decode and encode failures are counted as
+// decodeError and encodeError. Operations on an image.Image have no source data, so they are tracked like an empty
+// one. A manipulator keeps tracking its own metrics, wrapping its processor with the same MetricService counts every
+// operation twice.
+func NewObservableProcessor(p processor.Processor, opts ...ObservableOption) processor.Processor {
+	o := &observableProcessor{processor: p, metricService: metrics.NoOpMetricService{}, scope: defaultScope}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// observe starts tracking an operation on data, the returned function ends it
+func (o *observableProcessor) observe(key string, data []byte) func() {
+	t := time.Now()
+	return func() {
+		o.metricService.TrackDuration(key, t, data)
+	}
+}
+
+// countError counts err as the error key of the format, nil errors are not counted
+func (o *observableProcessor) countError(key, format string, err error) {
+	if err != nil {
+		o.metricService.CountImageProcessErrors(key, o.scope, format)
+	}
+}
+
+func (o *observableProcessor) Crop(img image.Image, width, height int, point processor.Point) image.Image {
+	defer o.observe(cropDurationKey, nil)()
+	return o.processor.Crop(img, width, height, point)
+}
+
+func (o *observableProcessor) CropWithOptions(img image.Image, width, height int, point processor.Point,
+	opts processor.CropOptions) image.Image {
+	defer o.observe(cropDurationKey, nil)()
+	return o.processor.CropWithOptions(img, width, height, point, opts)
+}
+
+func (o *observableProcessor) Cover(img image.Image, width, height int, point processor.Point) image.Image {
+	defer o.observe(cropDurationKey, nil)()
+	return o.processor.Cover(img, width, height, point)
+}
+
+func (o *observableProcessor) FocalCrop(img image.Image, width, height int, point processor.FocalPoint) image.Image {
+	defer o.observe(cropDurationKey, nil)()
+	return o.processor.FocalCrop(img, width, height, point)
+}
+
+func (o *observableProcessor) SmartCrop(img image.Image, width, height int, opts processor.SmartCropOptions) image.Image {
+	defer o.observe(cropDurationKey, nil)()
+	return o.processor.SmartCrop(img, width, height, opts)
+}
+
+func (o *observableProcessor) Pad(img image.Image, width, height int, point processor.Point,
+	background color.Color) image.Image {
+	defer o.observe(padDurationKey, nil)()
+	return o.processor.Pad(img, width, height, point, background)
+}
+
+func (o *observableProcessor) PadWithOptions(img image.Image, width, height int, point processor.Point,
+	background color.Color, opts processor.PadOptions) image.Image {
+	defer o.observe(padDurationKey, nil)()
+	return o.processor.PadWithOptions(img, width, height, point, background, opts)
+}
+
+func (o *observableProcessor) Resize(img image.Image, width, height int) image.Image {
+	defer o.observe(resizeDurationKey, nil)()
+	return o.processor.Resize(img, width, height)
+}
+
+func (o *observableProcessor) Scale(img image.Image, width, height int) image.Image {
+	defer o.observe(scaleDurationKey, nil)()
+	return o.processor.Scale(img, width, height)
+}
+
+func (o *observableProcessor) GrayScale(img image.Image) image.Image {
+	defer o.observe(grayScaleDurationKey, nil)()
+	return o.processor.GrayScale(img)
+}
+
+func (o *observableProcessor) GrayScaleWithOptions(img image.Image, opts processor.GrayScaleOptions) image.Image {
+	defer o.observe(grayScaleDurationKey, nil)()
+	return o.processor.GrayScaleWithOptions(img, opts)
+}
+
+func (o *observableProcessor) Desaturate(img image.Image, amount float64) image.Image {
+	defer o.observe(desatDurationKey, nil)()
+	return o.processor.Desaturate(img, amount)
+}
+
+func (o *observableProcessor) ExtractChannel(img image.Image, channel string) image.Image {
+	defer o.observe(channelDurationKey, nil)()
+	return o.processor.ExtractChannel(img, channel)
+}
+
+func (o *observableProcessor) SwapChannels(img image.Image, order string) image.Image {
+	defer o.observe(channelDurationKey, nil)()
+	return o.processor.SwapChannels(img, order)
+}
+
+func (o *observableProcessor) Blur(img image.Image, radius float64) image.Image {
+	defer o.observe(blurDurationKey, nil)()
+	return o.processor.Blur(img, radius)
+}
+
+func (o *observableProcessor) Denoise(img image.Image, radius int) image.Image {
+	defer o.observe(denoiseDurationKey, nil)()
+	return o.processor.Denoise(img, radius)
+}
+
+func (o *observableProcessor) Sharpen(img image.Image, amount float64) image.Image {
+	defer o.observe(sharpenDurationKey, nil)()
+	return o.processor.Sharpen(img, amount)
+}
+
+func (o *observableProcessor) Duotone(img image.Image, dark, light color.Color) image.Image {
+	defer o.observe(duotoneDurationKey, nil)()
+	return o.processor.Duotone(img, dark, light)
+}
+
+func (o *observableProcessor) Recolor(img image.Image, from, to color.Color, tolerance uint8) image.Image {
+	defer o.observe(recolorDurationKey, nil)()
+	return o.processor.Recolor(img, from, to, tolerance)
+}
+
+func (o *observableProcessor) Solarize(img image.Image, threshold uint8) image.Image {
+	defer o.observe(solarizeDurationKey, nil)()
+	return o.processor.Solarize(img, threshold)
+}
+
+func (o *observableProcessor) ColorWash(img image.Image, c color.Color, opacity uint8) image.Image {
+	defer o.observe(colorWashDurationKey, nil)()
+	return o.processor.ColorWash(img, c, opacity)
+}
+
+func (o *observableProcessor) Splash(img image.Image, keep color.Color, tolerance uint8) image.Image {
+	defer o.observe(splashDurationKey, nil)()
+	return o.processor.Splash(img, keep, tolerance)
+}
+
+func (o *observableProcessor) Quantize(img image.Image, colors int, opts processor.QuantizeOptions) image.Image {
+	defer o.observe(quantizeDurationKey, nil)()
+	return o.processor.Quantize(img, colors, opts)
+}
+
+func (o *observableProcessor) ChromaKey(img image.Image, key color.Color, tolerance uint8) image.Image {
+	defer o.observe(chromaKeyDurationKey, nil)()
+	return o.processor.ChromaKey(img, key, tolerance)
+}
+
+func (o *observableProcessor) Watermark(base []byte, overlay []byte, opacity uint8) ([]byte, error) {
+	defer o.observe(watermarkDurationKey, base)()
+	return o.processor.Watermark(base, overlay, opacity)
+}
+
+func (o *observableProcessor) WatermarkWithOptions(base []byte, overlay []byte, opacity uint8,
+	opts processor.WatermarkOptions) ([]byte, error) {
+	defer o.observe(watermarkDurationKey, base)()
+	return o.processor.WatermarkWithOptions(base, overlay, opacity, opts)
+}
+
+func (o *observableProcessor) WatermarkImage(base, overlay image.Image, opacity uint8,
+	opts processor.WatermarkOptions) (image.Image, error) {
+	defer o.observe(watermarkDurationKey, nil)()
+	return o.processor.WatermarkImage(base, overlay, opacity, opts)
+}
+
+func (o *observableProcessor) Flip(img image.Image, mode string) image.Image {
+	defer o.observe(flipDurationKey, nil)()
+	return o.processor.Flip(img, mode)
+}
+
+func (o *observableProcessor) Rotate(img image.Image, angle float64) image.Image {
+	defer o.observe(rotateDurationKey, nil)()
+	return o.processor.Rotate(img, angle)
+}
+
+func (o *observableProcessor) RotateWithOptions(img image.Image, angle float64, opts processor.RotateOptions) image.Image {
+	defer o.observe(rotateDurationKey, nil)()
+	return o.processor.RotateWithOptions(img, angle, opts)
+}
+
+func (o *observableProcessor) Perspective(img image.Image, corners [4]image.Point) image.Image {
+	defer o.observe(perspectiveKey, nil)()
+	return o.processor.Perspective(img, corners)
+}
+
+func (o *observableProcessor) Histogram(img image.Image) processor.Histogram {
+	defer o.observe(histogramDurationKey, nil)()
+	return o.processor.Histogram(img)
+}
+
+func (o *observableProcessor) Decode(data []byte) (image.Image, string, error) {
+	defer o.observe(decodeDurationKey, data)()
+	img, f, err := o.processor.Decode(data)
+	o.countError(getDecodeErrorKey(err), metrics.GetImageFormat(data), err)
+	return img, f, err
+}
+
+func (o *observableProcessor) Rasterize(data []byte, width, height int) (image.Image, error) {
+	defer o.observe(decodeDurationKey, data)()
+	img, err := o.processor.Rasterize(data, width, height)
+	o.countError(getDecodeErrorKey(err), metrics.GetImageFormat(data), err)
+	return img, err
+}
+
+func (o *observableProcessor) DecodeAnimation(data []byte) (*processor.Animation, error) {
+	defer o.observe(decodeDurationKey, data)()
+	a, err := o.processor.DecodeAnimation(data)
+	o.countError(getDecodeErrorKey(err), metrics.GetImageFormat(data), err)
+	return a, err
+}
+
+func (o *observableProcessor) EncodeAnimation(a *processor.Animation) ([]byte, error) {
+	defer o.observe(encodeDurationKey, nil)()
+	data, err := o.processor.EncodeAnimation(a)
+	o.countError(encodeErrorKey, a.Format, err)
+	return data, err
+}
+
+func (o *observableProcessor) Encode(img image.Image, format string) ([]byte, error) {
+	defer o.observe(encodeDurationKey, nil)()
+	data, err := o.processor.Encode(img, format)
+	o.countError(encodeErrorKey, format, err)
+	return data, err
+}
+
+func (o *observableProcessor) EncodeWithOptions(img image.Image, format string,
+	opts processor.EncodeOptions) ([]byte, error) {
+	defer o.observe(encodeDurationKey, nil)()
+	data, err := o.processor.EncodeWithOptions(img, format, opts)
+	o.countError(encodeErrorKey, format, err)
+	return data, err
+}
+
+func (o *observableProcessor) Convert(input []byte, format string, opts processor.EncodeOptions) ([]byte, error) {
+	defer o.observe(convertDurationKey, input)()
+	return o.processor.Convert(input, format, opts)
+}
+
+func (o *observableProcessor) FixOrientation(img image.Image, orientation int) image.Image {
+	defer o.observe(fixOrientationKey, nil)()
+	return o.processor.FixOrientation(img, orientation)
+}
+
+func (o *observableProcessor) Overlay(base []byte, overlays []*processor.OverlayAttrs) ([]byte, error) {
+	defer o.observe(overlayDurationKey, base)()
+	return o.processor.Overlay(base, overlays)
+}
+
+func (o *observableProcessor) SpriteSheet(frames [][]byte, cols int) ([]byte, processor.SpriteLayout, error) {
+	defer o.observe(spriteSheetDurationKey, nil)()
+	return o.processor.SpriteSheet(frames, cols)
+}
+
+// MaxParallelism returns the MaxParallelism of the decorated processor if it is a processor.ParallelismLimiter,
+// otherwise 0
+func (o *observableProcessor) MaxParallelism() int {
+	if p, ok := o.processor.(processor.ParallelismLimiter); ok {
+		return p.MaxParallelism()
+	}
+	return 0
+}
+
+// Release passes img on to the decorated processor if it is a processor.BufferReleaser
+func (o *observableProcessor) Release(img image.Image) {
+	if p, ok := o.processor.(processor.BufferReleaser); ok {
+		p.Release(img)
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewObservableProcessor(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	p := NewObservableProcessor(mp, WithProcessorMetrics(ms))
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	resized := image.NewRGBA(image.Rect(0, 0, 5, 5))
+	mp.On("Decode", input).Return(decoded, "png", nil)
+	mp.On("Resize", decoded, 5, 0).Return(resized)
+	mp.On("Encode", resized, "png").Return(input, nil)
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+
+	img, f, err := p.Decode(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "png", f)
+	out, err := p.Encode(p.Resize(img, 5, 0), f)
+	assert.Nil(t, err)
+	assert.Equal(t, input, out)
+
+	ms.AssertCalled(t, "TrackDuration", decodeDurationKey, mock.Anything, input)
+	ms.AssertCalled(t, "TrackDuration", resizeDurationKey, mock.Anything, []byte(nil))
+	ms.AssertCalled(t, "TrackDuration", encodeDurationKey, mock.Anything, []byte(nil))
+	ms.AssertNotCalled(t, "CountImageProcessErrors", mock.Anything, mock.Anything, mock.Anything)
+	mp.AssertExpectations(t)
+}
+
+func TestNewObservableProcessor_CountsErrors(t *testing.T) {
+	mp := &mockProcessor{}
+	ms := &metrics.MockMetricService{}
+	p := NewObservableProcessor(mp, WithProcessorMetrics(ms), WithProcessorScope("catalog"))
+	input := []byte("inputData")
+	decoded := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	mp.On("Decode", input).Return(nil, "", errors.New("decode error"))
+	mp.On("Encode", decoded, "webp").Return([]byte(nil), errors.New("encode error"))
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountImageProcessErrors", mock.Anything, mock.Anything, mock.Anything)
+
+	_, _, err := p.Decode(input)
+	assert.EqualError(t, err, "decode error")
+	_, err = p.Encode(decoded, "webp")
+	assert.EqualError(t, err, "encode error")
+
+	ms.AssertCalled(t, "CountImageProcessErrors", decodeErrorKey, "catalog", "plain")
+	ms.AssertCalled(t, "CountImageProcessErrors", encodeErrorKey, "catalog", "webp")
+}
+
+func TestNewObservableProcessor_MaxParallelism(t *testing.T) {
+	p := NewObservableProcessor(native.NewBildProcessor(native.WithMaxParallelism(2)))
+	limiter, ok := p.(processor.ParallelismLimiter)
+	assert.True(t, ok)
+	assert.Equal(t, 2, limiter.MaxParallelism())
+
+	assert.Equal(t, 0, NewObservableProcessor(&mockProcessor{}).(processor.ParallelismLimiter).MaxParallelism())
+}
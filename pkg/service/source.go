@@ -0,0 +1,287 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxFetchSize  = 32 << 20
+	defaultFetchTimeout  = 10 * time.Second
+	maxFetchRedirects    = 5
+	fetchSchemeHTTP      = "http"
+	fetchSchemeHTTPS     = "https"
+	fetchUserAgentHeader = "User-Agent"
+	fetchUserAgent       = "darkroom"
+)
+
+var (
+	errFetchScheme      = errors.New("source url must use http or https")
+	errFetchHost        = errors.New("source url host is not allowed")
+	errFetchBlockedIP   = errors.New("source url resolves to a private or reserved address")
+	errFetchTooLarge    = errors.New("source exceeds the maximum size")
+	errFetchRedirects   = errors.New("source url redirected too many times")
+	errFetchNilFetcher  = errors.New("url source has no fetcher")
+	errFetchEmptySource = errors.New("source has no data")
+)
+
+// Source provides the image data for Manipulator.ProcessFromSource
+type Source interface {
+	// Read returns the image data of the source
+	Read(ctx context.Context) ([]byte, error)
+}
+
+// Fetcher downloads the contents of a URL, it can be implemented to fetch images with a custom client
+type Fetcher interface {
+	// Fetch returns the body of the response for rawURL
+	Fetch(ctx context.Context, rawURL string) ([]byte, error)
+}
+
+type bytesSource []byte
+
+func (s bytesSource) Read(_ context.Context) ([]byte, error) {
+	if len(s) == 0 {
+		return nil, errFetchEmptySource
+	}
+	return s, nil
+}
+
+// NewBytesSource returns a Source for image data that is already in memory
+func NewBytesSource(data []byte) Source {
+	return bytesSource(data)
+}
+
+type urlSource struct {
+	url     string
+	fetcher Fetcher
+}
+
+func (s *urlSource) Read(ctx context.Context) ([]byte, error) {
+	if s.fetcher == nil {
+		return nil, errFetchNilFetcher
+	}
+	return s.fetcher.Fetch(ctx, s.url)
+}
+
+// NewURLSource returns a Source downloading the image at rawURL with the given Fetcher, e.g. the one
+// returned by NewHTTPFetcher
+func NewURLSource(rawURL string, fetcher Fetcher) Source {
+	return &urlSource{url: rawURL, fetcher: fetcher}
+}
+
+// HTTPFetcher is a Fetcher guarding against server side request forgery: only http(s) URLs of the allowed
+// hosts are fetched, hosts resolving to private, loopback, link-local or otherwise reserved addresses are
+// rejected and every redirect is validated the same way before it is followed
+type HTTPFetcher struct {
+	client       *http.Client
+	allowedHosts map[string]bool
+	maxSize      int64
+	lookupIP     func(ctx context.Context, host string) ([]net.IP, error)
+	isBlockedIP  func(ip net.IP) bool
+}
+
+// FetcherOption represents builder function for HTTPFetcher
+type FetcherOption func(*HTTPFetcher)
+
+// WithFetcherHTTPClient is a builder function to fetch with a custom http.Client, e.g. to set the timeout or
+// the transport. The client is copied and its CheckRedirect replaced so that redirects are still validated.
+// Unlike the default client its transport doesn't re-check the address it dials, so it is the responsibility
+// of the caller to guard against DNS rebinding if that is a concern.
+func WithFetcherHTTPClient(client *http.Client) FetcherOption {
+	return func(f *HTTPFetcher) {
+		c := *client
+		f.client = &c
+	}
+}
+
+// WithAllowedHosts is a builder function to only fetch URLs of the given hosts (without the port), a host
+// starting with a '.' like ".example.com" also allows all of its subdomains. No hosts allows any public host.
+func WithAllowedHosts(hosts ...string) FetcherOption {
+	return func(f *HTTPFetcher) {
+		for _, h := range hosts {
+			f.allowedHosts[strings.ToLower(h)] = true
+		}
+	}
+}
+
+// WithMaxFetchSize is a builder function to set the largest response body in bytes that is read,
+// the default is 32 MiB
+func WithMaxFetchSize(n int64) FetcherOption {
+	return func(f *HTTPFetcher) {
+		f.maxSize = n
+	}
+}
+
+// Fetch validates rawURL and returns the body of its response, a response with a non 2xx status is an error
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.validateURL(ctx, u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fetchUserAgentHeader, fetchUserAgent)
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("fetching source failed with status %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, f.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > f.maxSize {
+		return nil, errFetchTooLarge
+	}
+	return body, nil
+}
+
+func (f *HTTPFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxFetchRedirects {
+		return errFetchRedirects
+	}
+	return f.validateURL(req.Context(), req.URL)
+}
+
+// validateURL returns an error if u is not an http(s) URL of an allowed host or if any of the addresses
+// its host resolves to is blocked
+func (f *HTTPFetcher) validateURL(ctx context.Context, u *url.URL) error {
+	if u.Scheme != fetchSchemeHTTP && u.Scheme != fetchSchemeHTTPS {
+		return errFetchScheme
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" || !f.isAllowedHost(host) {
+		return errFetchHost
+	}
+	ips, err := f.lookupIP(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if f.isBlockedIP(ip) {
+			return errFetchBlockedIP
+		}
+	}
+	return nil
+}
+
+func (f *HTTPFetcher) isAllowedHost(host string) bool {
+	if len(f.allowedHosts) == 0 || f.allowedHosts[host] {
+		return true
+	}
+	for h := range f.allowedHosts {
+		if strings.HasPrefix(h, ".") && strings.HasSuffix(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHTTPFetcher returns a new HTTPFetcher, by default it fetches with a client timing out after 10 seconds
+// that re-checks the address of every connection it dials
+func NewHTTPFetcher(opts ...FetcherOption) *HTTPFetcher {
+	f := &HTTPFetcher{
+		allowedHosts: make(map[string]bool),
+		maxSize:      defaultMaxFetchSize,
+		lookupIP:     lookupIP,
+		isBlockedIP:  isBlockedIP,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.client == nil {
+		f.client = newFetchHTTPClient(f)
+	}
+	f.client.CheckRedirect = f.checkRedirect
+	return f
+}
+
+// newFetchHTTPClient returns an http.Client whose dialer refuses blocked addresses, guarding against a host
+// resolving to a public address when validated and to a private one when connecting
+func newFetchHTTPClient(f *HTTPFetcher) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: defaultFetchTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || f.isBlockedIP(ip) {
+				return errFetchBlockedIP
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: defaultFetchTimeout, Transport: transport}
+}
+
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// blockedNetworks are the ranges that aren't publicly routable on top of the loopback, link-local,
+// multicast and unspecified ones checked with the net.IP methods
+var blockedNetworks = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 0, 0, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)},
+	{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)},
+	// NAT64 prefixes embed an IPv4 address, which may be an internal one
+	{IP: net.IP{0, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(96, 128)},
+	{IP: net.IP{0, 0x64, 0xff, 0x9b, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(48, 128)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// isBlockedIP returns true for addresses that aren't publicly routable, e.g. loopback, private networks
+// and link-local ones (which include cloud metadata endpoints like 169.254.169.254). IPv4-mapped IPv6 addresses
+// like ::ffff:10.0.0.1 are checked as the IPv4 address they map to.
+func isBlockedIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
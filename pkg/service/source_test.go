@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFetcher returns an HTTPFetcher for the httptest servers listening on loopback addresses,
+// the given blocked IP is still rejected
+func newTestFetcher(blocked net.IP, opts ...FetcherOption) *HTTPFetcher {
+	f := NewHTTPFetcher(opts...)
+	f.isBlockedIP = func(ip net.IP) bool {
+		return ip.Equal(blocked)
+	}
+	return f
+}
+
+func TestNewBytesSource(t *testing.T) {
+	data, err := NewBytesSource([]byte("image")).Read(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("image"), data)
+
+	_, err = NewBytesSource(nil).Read(context.Background())
+	assert.Equal(t, errFetchEmptySource, err)
+}
+
+func TestNewURLSource_WithoutFetcher(t *testing.T) {
+	_, err := NewURLSource("https://example.com/a.png", nil).Read(context.Background())
+	assert.Equal(t, errFetchNilFetcher, err)
+}
+
+func TestHTTPFetcher_Fetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			assert.Equal(t, fetchUserAgent, r.Header.Get(fetchUserAgentHeader))
+			_, _ = w.Write([]byte("image"))
+		case "/redirect":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/redirect-private":
+			http.Redirect(w, r, "http://10.0.0.1/image.png", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	f := newTestFetcher(net.IPv4(10, 0, 0, 1), WithMaxFetchSize(8))
+	ctx := context.Background()
+
+	data, err := f.Fetch(ctx, ts.URL+"/image.png")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("image"), data)
+
+	data, err = f.Fetch(ctx, ts.URL+"/redirect")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("image"), data)
+
+	_, err = f.Fetch(ctx, ts.URL+"/redirect-private")
+	assert.ErrorIs(t, err, errFetchBlockedIP)
+
+	_, err = f.Fetch(ctx, ts.URL+"/loop")
+	assert.ErrorIs(t, err, errFetchRedirects)
+
+	_, err = f.Fetch(ctx, ts.URL+"/missing")
+	assert.EqualError(t, err, "fetching source failed with status 404")
+
+	_, err = f.Fetch(ctx, "http://10.0.0.1/image.png")
+	assert.Equal(t, errFetchBlockedIP, err)
+
+	_, err = f.Fetch(ctx, "file:///etc/passwd")
+	assert.Equal(t, errFetchScheme, err)
+}
+
+func TestHTTPFetcher_FetchTooLarge(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("123456789"))
+	}))
+	defer ts.Close()
+
+	_, err := newTestFetcher(nil, WithMaxFetchSize(8)).Fetch(context.Background(), ts.URL)
+	assert.Equal(t, errFetchTooLarge, err)
+}
+
+func TestHTTPFetcher_FetchRejectsLoopbackByDefault(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer ts.Close()
+
+	_, err := NewHTTPFetcher().Fetch(context.Background(), ts.URL)
+	assert.Equal(t, errFetchBlockedIP, err)
+
+	// The dialer of the default client re-checks the address even if the validation before it is bypassed
+	f := NewHTTPFetcher()
+	f.lookupIP = func(context.Context, string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(93, 184, 216, 34)}, nil
+	}
+	_, err = f.Fetch(context.Background(), ts.URL)
+	assert.ErrorIs(t, err, errFetchBlockedIP)
+}
+
+func TestHTTPFetcher_isAllowedHost(t *testing.T) {
+	f := NewHTTPFetcher(WithAllowedHosts("images.example.com", ".cdn.example.com"))
+	assert.True(t, f.isAllowedHost("images.example.com"))
+	assert.True(t, f.isAllowedHost("eu.cdn.example.com"))
+	assert.False(t, f.isAllowedHost("cdn.example.com"))
+	assert.False(t, f.isAllowedHost("example.com"))
+	assert.True(t, NewHTTPFetcher().isAllowedHost("example.com"))
+
+	_, err := f.Fetch(context.Background(), "http://example.com/image.png")
+	assert.Equal(t, errFetchHost, err)
+}
+
+func Test_isBlockedIP(t *testing.T) {
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1",
+		"0.0.0.0", "224.0.0.1", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "::ffff:10.0.0.1", "192.0.0.8",
+		"198.18.0.1", "198.19.255.254", "240.0.0.1", "255.255.255.255", "64:ff9b::a00:1", "64:ff9b:1::a00:1"}
+	for _, ip := range blocked {
+		assert.True(t, isBlockedIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "8.8.8.8", "198.20.0.1", "2606:4700::1111", "::ffff:8.8.8.8"} {
+		assert.False(t, isBlockedIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestManipulator_ProcessFromSource(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(img)
+	}))
+	defer ts.Close()
+
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	spec := NewSpecBuilder().WithParams(map[string]string{width: "10"}).Build()
+
+	for _, src := range []Source{NewBytesSource(img), NewURLSource(ts.URL, newTestFetcher(nil))} {
+		out, err := m.ProcessFromSource(context.Background(), src, spec)
+		assert.NoError(t, err)
+		decoded, _, err := native.NewBildProcessor().Decode(out)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, decoded.Bounds().Dx())
+	}
+
+	_, err := m.ProcessFromSource(context.Background(), NewURLSource(ts.URL, NewHTTPFetcher()), spec)
+	assert.Equal(t, errFetchBlockedIP, err)
+}
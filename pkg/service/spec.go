@@ -1,5 +1,16 @@
 package service
 
+import (
+	"context"
+	"fmt"
+	"image"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
 type ProcessSpec interface {
 	// IsWebPSupported() will tell if WebP is supported based on the accepted formats
 	IsWebPSupported() bool
@@ -10,10 +21,19 @@ type processSpec struct {
 	Scope string
 	// ImageData holds the actual image contents to processed
 	ImageData []byte
-	// Params hold the key-value pairs for the processing job and tells the manipulator what to do with the image
+	// Params hold the key-value pairs for the processing job and tells the manipulator what to do with the image,
+	// the manipulator never depends on their iteration order so the same params always give the same output
 	Params map[string]string
+	// Perspective holds the corners (top-left, top-right, bottom-right, bottom-left) of the quadrilateral the
+	// processed image is mapped onto, nil leaves the image as is. Process and Validate return a *ValidationError
+	// for corners outside of 0 to 9999 or an output above native.MaxPerspectivePixels.
+	Perspective *[4]image.Point
 	// Formats have the information of accepted formats, whether darkroom can return the image using webp or not
 	formats []string
+	// webpOutput is set by ProcessDual to receive the processed image encoded as WebP besides the output
+	webpOutput *[]byte
+	// ctx holds the span the spans of processing the spec are children of, nil if there is none
+	ctx context.Context
 }
 
 func (ps *processSpec) IsWebPSupported() bool {
@@ -30,14 +50,20 @@ type SpecBuilder interface {
 	WithImageData(img []byte) SpecBuilder
 	WithParams(params map[string]string) SpecBuilder
 	WithFormats(formats []string) SpecBuilder
+	WithPerspective(corners [4]image.Point) SpecBuilder
+	// WithContext sets the context holding the span of the request, the spans of processing the spec are started
+	// as its children if the manipulator has a Tracer
+	WithContext(ctx context.Context) SpecBuilder
 	Build() processSpec
 }
 
 type specBuilder struct {
-	scope     string
-	imageData []byte
-	params    map[string]string
-	formats   []string
+	scope       string
+	imageData   []byte
+	params      map[string]string
+	formats     []string
+	perspective *[4]image.Point
+	ctx         context.Context
 }
 
 func (sb *specBuilder) WithScope(scope string) SpecBuilder {
@@ -60,15 +86,55 @@ func (sb *specBuilder) WithFormats(formats []string) SpecBuilder {
 	return sb
 }
 
+func (sb *specBuilder) WithPerspective(corners [4]image.Point) SpecBuilder {
+	sb.perspective = &corners
+	return sb
+}
+
+func (sb *specBuilder) WithContext(ctx context.Context) SpecBuilder {
+	sb.ctx = ctx
+	return sb
+}
+
 func (sb *specBuilder) Build() processSpec {
 	return processSpec{
-		Scope:     sb.scope,
-		ImageData: sb.imageData,
-		Params:    sb.params,
-		formats:   sb.formats,
+		Scope:       sb.scope,
+		ImageData:   sb.imageData,
+		Params:      sb.params,
+		Perspective: sb.perspective,
+		formats:     sb.formats,
+		ctx:         sb.ctx,
 	}
 }
 
 func NewSpecBuilder() SpecBuilder {
 	return &specBuilder{}
 }
+
+// CanonicalParams returns the params as a query string sorted by key with the empty values dropped, the same
+// params always give the same string whatever the order they were added in, so it can be used as a cache key
+func CanonicalParams(params map[string]string) string {
+	values := url.Values{}
+	for k, v := range params {
+		if v != "" {
+			values.Set(k, v)
+		}
+	}
+	return values.Encode()
+}
+
+// GetFormatFromFilename takes a filename like "out.webp" or a path and returns the value of the fm param for its
+// extension, so that the output can be named instead of its format given, e.g. params["fm"] = f. The extension is
+// case insensitive and must be one of the formats fm accepts, i.e. jpg, jpeg, png or webp, or an error is returned.
+func GetFormatFromFilename(name string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	switch ext {
+	case processor.ExtensionJPG, processor.ExtensionJPEG, processor.ExtensionPNG, processor.ExtensionWebP:
+		return ext, nil
+	case "":
+		return "", fmt.Errorf("filename %q has no extension to take the output format from", name)
+	default:
+		return "", fmt.Errorf("unsupported output format %q of filename %q, must be one of jpg, jpeg, png or webp",
+			ext, name)
+	}
+}
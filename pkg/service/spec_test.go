@@ -1,8 +1,10 @@
 package service
 
 import (
+	"image"
 	"testing"
 
+	"github.com/gojek/darkroom/pkg/processor"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,18 +13,23 @@ func TestSpecBuilder_Build(t *testing.T) {
 	img := []byte("imageData")
 	params := map[string]string{"foo": "bar"}
 	formats := []string{"image/webp", "image/apng"}
+	corners := [4]image.Point{{X: 10, Y: 0}, {X: 90, Y: 10}, {X: 90, Y: 90}, {X: 10, Y: 100}}
 
 	spec := NewSpecBuilder().
 		WithScope(scope).
 		WithImageData(img).
 		WithParams(params).
 		WithFormats(formats).
+		WithPerspective(corners).
 		Build()
 
 	assert.Equal(t, spec.Scope, scope)
 	assert.Equal(t, spec.ImageData, img)
 	assert.Equal(t, spec.Params, params)
 	assert.Equal(t, spec.formats, formats)
+	assert.Equal(t, &corners, spec.Perspective)
+
+	assert.Nil(t, NewSpecBuilder().Build().Perspective)
 }
 
 func TestSpec_IsWebPSupported(t *testing.T) {
@@ -34,3 +41,37 @@ func TestSpec_IsWebPSupported(t *testing.T) {
 	spec = NewSpecBuilder().WithFormats(f).Build()
 	assert.False(t, spec.IsWebPSupported())
 }
+
+func TestCanonicalParams(t *testing.T) {
+	assert.Equal(t, "", CanonicalParams(nil))
+	assert.Equal(t, "fit=crop&h=200&q=80&w=300", CanonicalParams(map[string]string{width: "300", quality: "80", height: "200", fit: crop}))
+	assert.Equal(t, "auto=compress%2Cformat&w=300", CanonicalParams(map[string]string{width: "300", blur: "", auto: "compress,format"}))
+	for i := 0; i < 50; i++ {
+		params := map[string]string{}
+		for _, k := range []string{width, height, fit, crop, blur, quality, auto, flip} {
+			params[k] = k
+		}
+		assert.Equal(t, "auto=auto&blur=blur&crop=crop&fit=fit&flip=flip&h=h&q=q&w=w", CanonicalParams(params))
+	}
+}
+
+func TestGetFormatFromFilename(t *testing.T) {
+	cases := map[string]string{
+		"out.webp":            "webp",
+		"out.JPG":             "jpg",
+		"photo.jpeg":          "jpeg",
+		"/tmp/images/a.b.png": "png",
+	}
+	for name, expected := range cases {
+		f, err := GetFormatFromFilename(name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, f, name)
+		assert.True(t, isOneOf(processor.ExtensionJPG, processor.ExtensionJPEG, processor.ExtensionPNG,
+			processor.ExtensionWebP)(f), name)
+	}
+
+	_, err := GetFormatFromFilename("out.gif")
+	assert.EqualError(t, err, `unsupported output format "gif" of filename "out.gif", must be one of jpg, jpeg, png or webp`)
+	_, err = GetFormatFromFilename("out")
+	assert.EqualError(t, err, `filename "out" has no extension to take the output format from`)
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+)
+
+const pixelBudgetErrorKey = "pixelBudgetError"
+
+// ErrPixelBudgetExceeded is returned by Process when the scope of the spec has used up the megapixels per second
+// set WithPixelBudget, the returned error wraps it with the scope and its budget
+var ErrPixelBudgetExceeded = errors.New("pixel budget exceeded")
+
+// pixelBudget is a token bucket of the pixels a scope may process, it refills at rate pixels per second and holds
+// at most a second worth of them. An image is let through as long as the bucket isn't empty and may take it below
+// zero, so images larger than the rate are still processed and only delay the next ones.
+type pixelBudget struct {
+	rate    float64
+	tokens  float64
+	updated time.Time
+}
+
+func newPixelBudget(megapixelsPerSecond float64, now time.Time) *pixelBudget {
+	rate := megapixelsPerSecond * 1000 * 1000
+	return &pixelBudget{rate: rate, tokens: rate, updated: now}
+}
+
+// take refills the bucket for the time since the last call and takes the pixels from it, the returned bool is
+// false if the bucket is empty and nothing was taken. With force the pixels are taken even from an empty bucket.
+func (b *pixelBudget) take(pixels int, force bool, now time.Time) bool {
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+	if b.tokens <= 0 && !force {
+		return false
+	}
+	b.tokens -= float64(pixels)
+	return true
+}
+
+// chargePixels counts the pixels of the source of spec, as read from its header, towards the processed pixels of
+// its scope and takes them from the budget of the scope set WithPixelBudget. It returns an error wrapping
+// ErrPixelBudgetExceeded if the budget is used up, the pixels are then neither counted nor taken. Otherwise it
+// returns the pixels charged, 0 for a source whose header can't be read, like an SVG, which has to be charged
+// with chargeDecodedPixels once it is decoded.
+func (m *manipulator) chargePixels(spec processSpec) (int, error) {
+	pixels := 0
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(spec.ImageData)); err == nil {
+		pixels = cfg.Width * cfg.Height
+	}
+	if !m.takePixels(spec.Scope, pixels, false) {
+		m.metricService.CountImageProcessErrors(pixelBudgetErrorKey, spec.Scope, metrics.GetImageFormat(spec.ImageData))
+		return 0, fmt.Errorf("%w: scope %q is limited to %g megapixels per second", ErrPixelBudgetExceeded,
+			spec.Scope, m.pixelBudgets[spec.Scope])
+	}
+	m.countPixels(spec.Scope, pixels)
+	return pixels, nil
+}
+
+// chargeDecodedPixels counts and takes the pixels of img, the decoded or rasterized source of spec whose header
+// chargePixels couldn't read. The source was let through while the budget wasn't used up, so like any other
+// image it may take the budget below zero.
+func (m *manipulator) chargeDecodedPixels(spec processSpec, img image.Image) {
+	pixels := img.Bounds().Dx() * img.Bounds().Dy()
+	m.takePixels(spec.Scope, pixels, true)
+	m.countPixels(spec.Scope, pixels)
+}
+
+// takePixels takes pixels from the budget of scope set WithPixelBudget, with force even if it is used up. It
+// returns false if the budget is used up and nothing was taken, scopes without a budget always return true.
+func (m *manipulator) takePixels(scope string, pixels int, force bool) bool {
+	mp, ok := m.pixelBudgets[scope]
+	if !ok || mp <= 0 {
+		return true
+	}
+	m.budgetsMu.Lock()
+	defer m.budgetsMu.Unlock()
+	b := m.budgets[scope]
+	if b == nil {
+		b = newPixelBudget(mp, time.Now())
+		m.budgets[scope] = b
+	}
+	return b.take(pixels, force, time.Now())
+}
+
+// countPixels counts the processed pixels of scope if the MetricService is a metrics.PixelCounter
+func (m *manipulator) countPixels(scope string, pixels int) {
+	if c, ok := m.metricService.(metrics.PixelCounter); ok && pixels > 0 {
+		c.CountProcessedPixels(scope, pixels)
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPixelBudget_Take(t *testing.T) {
+	now := time.Now()
+	b := newPixelBudget(1, now)
+
+	// A second worth of pixels may be taken at once and even exceeded by the last image
+	assert.True(t, b.take(600*1000, false, now))
+	assert.True(t, b.take(600*1000, false, now))
+	assert.False(t, b.take(1, false, now))
+
+	// The budget refills with time but never beyond a second worth of pixels
+	assert.False(t, b.take(1, false, now.Add(100*time.Millisecond)))
+	assert.True(t, b.take(1000*1000, false, now.Add(300*time.Millisecond)))
+	assert.False(t, b.take(1, false, now.Add(300*time.Millisecond)))
+	assert.True(t, b.take(0, false, now.Add(time.Hour)))
+	assert.InDelta(t, 1000*1000, b.tokens, 1e-6)
+
+	// Forced pixels are taken even from an empty bucket
+	assert.True(t, b.take(2000*1000, false, now.Add(time.Hour)))
+	assert.True(t, b.take(1, true, now.Add(time.Hour)))
+	assert.InDelta(t, -1000*1000-1, b.tokens, 1e-6)
+}
+
+func TestManipulator_Process_WithPixelBudget(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, 500*375)
+	ms.On("CountImageProcessErrors", pixelBudgetErrorKey, "uploads", "jpeg")
+	ms.On("CountImageProcessErrors", mock.Anything, mock.Anything, mock.Anything)
+	m := NewManipulator(native.NewBildProcessor(), nil, ms, WithPixelBudget(map[string]float64{"uploads": 0.1}))
+	process := func(scope string) error {
+		_, err := m.Process(NewSpecBuilder().WithImageData(img).WithScope(scope).Build())
+		return err
+	}
+
+	// The first image takes the budget of the scope below zero, so the next one is rejected
+	assert.NoError(t, process("uploads"))
+	err := process("uploads")
+	assert.True(t, errors.Is(err, ErrPixelBudgetExceeded))
+	assert.Equal(t, `pixel budget exceeded: scope "uploads" is limited to 0.1 megapixels per second`, err.Error())
+	ms.AssertCalled(t, "CountProcessedPixels", "uploads", 500*375)
+	ms.AssertNumberOfCalls(t, "CountProcessedPixels", 1)
+	ms.AssertNumberOfCalls(t, "CountImageProcessErrors", 1)
+	ms.AssertCalled(t, "CountImageProcessErrors", pixelBudgetErrorKey, "uploads", "jpeg")
+
+	// Other scopes are not limited
+	assert.NoError(t, process("avatars"))
+	assert.NoError(t, process("avatars"))
+	ms.AssertCalled(t, "CountProcessedPixels", "avatars", 500*375)
+
+	// Sources whose header can't be read don't skip a used up budget
+	_, err = m.Process(NewSpecBuilder().WithImageData([]byte("data")).WithScope("uploads").Build())
+	assert.True(t, errors.Is(err, ErrPixelBudgetExceeded))
+}
+
+func TestManipulator_Process_WithPixelBudgetAndSVG(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 4 3"><rect width="4" height="3"/></svg>`)
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", "uploads", 400*300)
+	ms.On("CountFormatChanges", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountImageProcessErrors", pixelBudgetErrorKey, "uploads", mock.Anything)
+	m := NewManipulator(native.NewBildProcessor(), nil, ms, WithPixelBudget(map[string]float64{"uploads": 0.1}))
+	spec := NewSpecBuilder().WithImageData(svg).WithParams(map[string]string{width: "400"}).WithScope("uploads").Build()
+
+	// The header of an SVG can't be read, so it is charged with the size it is rasterized at
+	_, err := m.Process(spec)
+	assert.NoError(t, err)
+	ms.AssertCalled(t, "CountProcessedPixels", "uploads", 400*300)
+	_, err = m.Process(spec)
+	assert.True(t, errors.Is(err, ErrPixelBudgetExceeded))
+}
+
+func TestManipulator_Process_WithPixelBudgetWhenBusy(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	ms.On("CountImageProcessErrors", mock.Anything, mock.Anything, mock.Anything)
+	m := NewManipulator(native.NewBildProcessor(), nil, ms, WithPixelBudget(map[string]float64{"uploads": 0.1}),
+		WithMaxConcurrency(1), WithRejectWhenBusy(true)).(*manipulator)
+	spec := NewSpecBuilder().WithImageData(img).WithScope("uploads").Build()
+
+	// A rejected request doesn't use up the budget of the scope
+	m.slots <- struct{}{}
+	_, err := m.Process(spec)
+	assert.Equal(t, ErrBusy, err)
+	<-m.slots
+	ms.AssertNotCalled(t, "CountProcessedPixels", "uploads", 500*375)
+	assert.NoError(t, func() error { _, err := m.Process(spec); return err }())
+}
+
+func TestManipulator_Process_WithoutPixelCounter(t *testing.T) {
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	// A MetricService which doesn't implement metrics.PixelCounter isn't asked to count pixels
+	ms := struct{ metrics.MetricService }{metrics.NoOpMetricService{}}
+	m := NewManipulator(native.NewBildProcessor(), nil, ms, WithPixelBudget(map[string]float64{"uploads": 0.1}))
+	_, err := m.Process(NewSpecBuilder().WithImageData(img).WithScope("uploads").Build())
+	assert.NoError(t, err)
+}
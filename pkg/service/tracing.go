@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+)
+
+const (
+	// processSpanName is the name of the span of a Process call, the spans of its steps are named after their
+	// operation like darkroom.decode or darkroom.resize
+	processSpanName = "darkroom.process"
+
+	operationAttribute    = "darkroom.operation"
+	scopeAttribute        = "darkroom.scope"
+	formatAttribute       = "image.format"
+	widthAttribute        = "image.width"
+	heightAttribute       = "image.height"
+	outputFormatAttribute = "image.output.format"
+	outputWidthAttribute  = "image.output.width"
+	outputHeightAttribute = "image.output.height"
+)
+
+// Tracer starts the spans of Process, e.g. an adapter of an OpenTelemetry trace.Tracer which passes start on as
+// trace.WithTimestamp, so that darkroom doesn't depend on a tracing library
+type Tracer interface {
+	// Start starts a span named name at start as a child of the span in ctx, if any, and returns the context
+	// holding the new span
+	Start(ctx context.Context, name string, start time.Time) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute sets the attribute key of the span, value is a string or an int
+	SetAttribute(key string, value interface{})
+	// End ends the span
+	End()
+}
+
+// noOpSpan is the Span of a manipulator without a Tracer
+type noOpSpan struct{}
+
+func (noOpSpan) SetAttribute(string, interface{}) {}
+
+func (noOpSpan) End() {}
+
+// tracingMetricService passes the metrics on to the embedded MetricService and records a span for every tracked
+// duration, the steps of Process are tracked from the time they started, so each of them becomes a child span
+// of ctx from then until now
+type tracingMetricService struct {
+	metrics.MetricService
+	tracer Tracer
+	ctx    context.Context
+}
+
+func (s tracingMetricService) TrackDuration(imageProcess string, start time.Time, imageData []byte) {
+	s.MetricService.TrackDuration(imageProcess, start, imageData)
+	operation := strings.TrimSuffix(imageProcess, "Duration")
+	_, span := s.tracer.Start(s.ctx, "darkroom."+operation, start)
+	span.SetAttribute(operationAttribute, operation)
+	span.SetAttribute(formatAttribute, metrics.GetImageFormat(imageData))
+	span.End()
+}
+
+// startSpan starts the span of processing spec and returns it with ms recording a child span for every step, the
+// context of spec is the parent. Without a Tracer the returned Span does nothing and ms is returned as is.
+func (m *manipulator) startSpan(spec processSpec, ms metrics.MetricService) (Span, metrics.MetricService) {
+	if m.tracer == nil {
+		return noOpSpan{}, ms
+	}
+	ctx := spec.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := m.tracer.Start(ctx, processSpanName, time.Now())
+	span.SetAttribute(scopeAttribute, spec.Scope)
+	return span, tracingMetricService{MetricService: ms, tracer: m.tracer, ctx: ctx}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+)
+
+type parentKey struct{}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	start  time.Time
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	parent, _ := ctx.Value(parentKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, start: start, attrs: map[string]interface{}{}}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, parentKey{}, span), span
+}
+
+func (t *recordingTracer) find(name string) *recordedSpan {
+	for _, s := range t.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestManipulator_Process_WithTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{}, WithTracer(tracer))
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	request := &recordedSpan{name: "request"}
+	ctx := context.WithValue(context.Background(), parentKey{}, request)
+
+	_, err := m.Process(NewSpecBuilder().WithContext(ctx).WithScope("catalog").WithImageData(img).
+		WithParams(map[string]string{width: "100", "fm": "png"}).Build())
+	assert.Nil(t, err)
+
+	process := tracer.find("darkroom.process")
+	if assert.NotNil(t, process) {
+		assert.Equal(t, request, process.parent)
+		assert.True(t, process.ended)
+		assert.Equal(t, map[string]interface{}{
+			scopeAttribute:        "catalog",
+			formatAttribute:       "png",
+			widthAttribute:        500,
+			heightAttribute:       375,
+			outputFormatAttribute: "png",
+			outputWidthAttribute:  100,
+			outputHeightAttribute: 75,
+		}, process.attrs)
+	}
+	for _, op := range []string{"decode", "resize", "encode"} {
+		span := tracer.find("darkroom." + op)
+		if assert.NotNil(t, span, op) {
+			assert.Equal(t, process, span.parent, op)
+			assert.True(t, span.ended, op)
+			assert.False(t, span.start.Before(process.start), op)
+			assert.Equal(t, op, span.attrs[operationAttribute], op)
+			assert.Equal(t, "png", span.attrs[formatAttribute], op)
+		}
+	}
+}
+
+func TestManipulator_Process_WithoutTracer(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{}).(*manipulator)
+	span, ms := m.startSpan(NewSpecBuilder().Build(), metrics.NoOpMetricService{})
+	assert.Equal(t, noOpSpan{}, span)
+	assert.Equal(t, metrics.NoOpMetricService{}, ms)
+
+	// Specs without a context start a root span
+	tracer := &recordingTracer{}
+	_, _ = NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{}, WithTracer(tracer)).
+		Process(NewSpecBuilder().WithImageData([]byte("not an image")).Build())
+	assert.Nil(t, tracer.find("darkroom.process").parent)
+}
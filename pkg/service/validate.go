@@ -0,0 +1,255 @@
+package service
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+)
+
+// ValidationError is returned by Validate and lists every invalid param of a spec
+type ValidationError struct {
+	// Problems holds a message for each invalid param, in the order the params are checked
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid params: %s", strings.Join(e.Problems, "; "))
+}
+
+// paramRule checks the value of a param, want describes the accepted values for the error message
+type paramRule struct {
+	param string
+	valid func(string) bool
+	want  string
+}
+
+var cropPoints = []string{"top", "top,left", "top,right", "left", "right", "bottom", "bottom,left", "bottom,right", "center"}
+
+var channelNames = []string{"r", "g", "b", "a"}
+
+var paramRules = []paramRule{
+	{width, isIntBetween(1, 9999), "an integer between 1 and 9999"},
+	{height, isIntBetween(1, 9999), "an integer between 1 and 9999"},
+	{fit, isFitMode, fitModeNames()},
+	{crop, isCrop, "a position like top,left or a focal point like 25,75"},
+	{cropOffsetX, isIntBetween(-9999, 9999), "an integer between -9999 and 9999"},
+	{cropOffsetY, isIntBetween(-9999, 9999), "an integer between -9999 and 9999"},
+	{facePad, isIntBetween(0, 100), "an integer between 0 and 100"},
+	{gravity, isOneOf(cropPoints...), "a position like top,left"},
+	{resize, isOneOf(inside, outside), "one of inside or outside"},
+	{background, isHexColor, "a 6 digit hex color"},
+	{pad, isOneOf(blur), blur},
+	{mono, isOneOf(blackHexCode), blackHexCode},
+	{monoGray, isBool, "true or false"},
+	{desat, isFloatIn(0, 1), "a number between 0 and 1"},
+	{channel, isOneOf(channelNames...), "one of r, g, b or a"},
+	{duotone, isHexColorPair, "two comma separated 6 digit hex colors"},
+	{recolor, isHexColorPair, "two comma separated 6 digit hex colors"},
+	{recolorTol, isIntBetween(0, 255), "an integer between 0 and 255"},
+	{solarize, isIntBetween(0, 255), "an integer between 0 and 255"},
+	{chroma, isHexColor, "a 6 digit hex color"},
+	{chromaTol, isIntBetween(0, 255), "an integer between 0 and 255"},
+	{splash, isHexColor, "a 6 digit hex color"},
+	{splashTol, isIntBetween(0, 180), "an integer between 0 and 180"},
+	{overlayColor, isHexColor, "a 6 digit hex color"},
+	{overlayAlpha, isIntBetween(0, 255), "an integer between 0 and 255"},
+	{blur, isFloatBelow(0, 1000), "a number from 0 to below 1000"},
+	{denoise, isIntBetween(1, maxDenoiseRadius), fmt.Sprintf("an integer between 1 and %d", maxDenoiseRadius)},
+	{autoSharpen, isBool, "true or false"},
+	{sharpenAmt, isFloatIn(0, maxSharpenAmount), fmt.Sprintf("a number between 0 and %d", maxSharpenAmount)},
+	{maxMP, isFloatIn(0, maxMegapixels), fmt.Sprintf("a number between 0 and %d", maxMegapixels)},
+	{minProcess, isIntBetween(1, 9999), "an integer between 1 and 9999"},
+	{maxBytes, isIntBetween(1, math.MaxInt32), "a positive integer"},
+	{downscale, isBool, "true or false"},
+	{colors, isIntBetween(2, 256), "an integer between 2 and 256"},
+	{dither, isOneOf(ditherNone, ditherFS), "one of none or floyd-steinberg"},
+	{rotate, isFloatIn(0, 360), "a number between 0 and 360"},
+	{flip, isFlip, "a combination of h and v"},
+	{auto, isListOf(compress, format), "a comma separated list of compress and format"},
+	{profile, isOneOf(profileFast, profileBest), "one of fast or best"},
+	{quality, isIntBetween(1, 100), "an integer between 1 and 100"},
+	{outputFormat, isOneOf(processor.ExtensionJPG, processor.ExtensionJPEG, processor.ExtensionPNG, processor.ExtensionWebP),
+		"one of jpg, jpeg, png or webp"},
+	{dpi, isIntBetween(1, 9999), "an integer between 1 and 9999"},
+	{scale, isScaleFactor, "a factor between 0.01 and 4 or a percentage between 1% and 400%"},
+	{rotateExpand, isBool, "true or false"},
+	{even, isBool, "true or false"},
+	{preserveMetadata, isBool, "true or false"},
+}
+
+// Validate takes ProcessSpec as an argument and checks its params without processing the image, it returns a
+// *ValidationError listing every param with a value Process would ignore or clamp. Only the params of the spec
+// are checked, the default params of the manipulator are trusted and params unknown to darkroom are ignored
+// unless the manipulator was created WithStrictParams. Params that aren't allowed WithAllowedParams are reported too.
+func (m *manipulator) Validate(spec processSpec) error {
+	var problems []string
+	if m.strictParams {
+		problems = getUnknownParamProblems(spec.Params)
+	}
+	for _, p := range m.getDisallowedParams(spec.Params) {
+		problems = append(problems, fmt.Sprintf("%s is not an allowed param", p))
+	}
+	for _, r := range paramRules {
+		if v, ok := spec.Params[r.param]; ok && !r.valid(v) {
+			problems = append(problems, fmt.Sprintf("%s=%q must be %s", r.param, v, r.want))
+		}
+	}
+	problems = append(problems, getPerspectiveProblems(spec.Perspective)...)
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// getPerspectiveProblems returns a problem for every corner of the perspective outside of 0 to maxDimension and
+// one if the output would be larger than native.MaxPerspectivePixels, nil corners have none
+func getPerspectiveProblems(corners *[4]image.Point) []string {
+	if corners == nil {
+		return nil
+	}
+	var problems []string
+	for i, c := range corners {
+		if c.X < 0 || c.Y < 0 || c.X > maxDimension || c.Y > maxDimension {
+			problems = append(problems, fmt.Sprintf("perspective corner %d at %v must be between 0 and %d",
+				i, c, maxDimension))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	if w, h := getPerspectiveDimensions(*corners); w*h > native.MaxPerspectivePixels {
+		problems = append(problems, fmt.Sprintf("perspective output of %dx%d must be at most %d pixels",
+			w, h, native.MaxPerspectivePixels))
+	}
+	return problems
+}
+
+// getUnknownParamProblems returns a problem for every param that isn't known to darkroom, sorted by the param
+func getUnknownParamProblems(params map[string]string) []string {
+	var problems []string
+	for p := range params {
+		if !isKnownParam(p) {
+			problems = append(problems, fmt.Sprintf("%s is not a known param", p))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// getDisallowedParams returns the known params of a spec that aren't allowed WithAllowedParams, sorted by name.
+// Unknown params are left to WithStrictParams, since they are ignored anyway.
+func (m *manipulator) getDisallowedParams(params map[string]string) []string {
+	if m.allowedParams == nil {
+		return nil
+	}
+	var disallowed []string
+	for p := range params {
+		if isKnownParam(p) && !m.allowedParams[p] {
+			disallowed = append(disallowed, p)
+		}
+	}
+	sort.Strings(disallowed)
+	return disallowed
+}
+
+func isKnownParam(p string) bool {
+	for _, r := range paramRules {
+		if r.param == p {
+			return true
+		}
+	}
+	return false
+}
+
+func isScaleFactor(v string) bool {
+	_, ok := getScaleFactor(v)
+	return ok
+}
+
+func isIntBetween(lo, hi int) func(string) bool {
+	return func(v string) bool {
+		i, err := strconv.Atoi(v)
+		return err == nil && i >= lo && i <= hi
+	}
+}
+
+// isFloatBelow accepts numbers in the half-open interval [lo, hi), CleanFloat wraps hi around to 0
+func isFloatBelow(lo, hi float64) func(string) bool {
+	return func(v string) bool {
+		f, err := strconv.ParseFloat(v, 64)
+		return err == nil && f >= lo && f < hi
+	}
+}
+
+// isFloatIn accepts numbers in the closed interval [lo, hi]
+func isFloatIn(lo, hi float64) func(string) bool {
+	return func(v string) bool {
+		f, err := strconv.ParseFloat(v, 64)
+		return err == nil && f >= lo && f <= hi
+	}
+}
+
+func isOneOf(values ...string) func(string) bool {
+	return func(v string) bool {
+		for _, value := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func isListOf(values ...string) func(string) bool {
+	one := isOneOf(values...)
+	return func(v string) bool {
+		for _, item := range strings.Split(v, ",") {
+			if !one(item) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func isFitMode(v string) bool {
+	_, err := ParseFitMode(v)
+	return err == nil
+}
+
+func isBool(v string) bool {
+	return v == "true" || v == "false"
+}
+
+func isHexColor(v string) bool {
+	_, ok := CleanHexColor(v)
+	return ok
+}
+
+func isHexColorPair(v string) bool {
+	colors := strings.Split(v, ",")
+	return len(colors) == 2 && isHexColor(colors[0]) && isHexColor(colors[1])
+}
+
+func isCrop(v string) bool {
+	_, ok := GetFocalPoint(v)
+	return ok || isOneOf(cropPoints...)(v)
+}
+
+func isFlip(v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, op := range strings.ToLower(v) {
+		if op != 'h' && op != 'v' {
+			return false
+		}
+	}
+	return true
+}
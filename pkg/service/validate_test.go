@@ -0,0 +1,166 @@
+package service
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManipulator_Validate(t *testing.T) {
+	m := NewManipulator(nil, map[string]string{width: "abc"}, nil)
+
+	cases := []struct {
+		params   map[string]string
+		problems []string
+	}{
+		{params: nil},
+		{params: map[string]string{width: "500", height: "250", fit: crop, crop: "top,left", "utm_source": "x"}},
+		{params: map[string]string{crop: "25,75", background: "ff0000", duotone: "000000,ffffff", auto: "compress,format"}},
+		{params: map[string]string{blur: "2.5", rotate: "90", flip: "hv", quality: "80", profile: profileFast, even: "true", dpi: "300"}},
+		{params: map[string]string{desat: "1", autoSharpen: "true", sharpenAmt: "0"}},
+		{params: map[string]string{crop: "top", cropOffsetX: "-20", cropOffsetY: "20"}},
+		{params: map[string]string{fit: autoFit, facePad: "0"}},
+		{params: map[string]string{overlayColor: "808080", overlayAlpha: "128"}},
+		{params: map[string]string{scale: "0.5"}},
+		{params: map[string]string{scale: "250%"}},
+		{params: map[string]string{rotate: "0", blur: "0", maxMP: "1000"}},
+		{params: map[string]string{rotate: "360", maxMP: "0.5"}},
+		{
+			params:   map[string]string{width: "0"},
+			problems: []string{`w="0" must be an integer between 1 and 9999`},
+		},
+		{
+			params: map[string]string{width: "10000", height: "x", fit: "stretch", background: "red", auto: "compress,webp",
+				rotate: "360.5", blur: "1000", flip: "x", quality: "101", outputFormat: "gif", dpi: "0", even: "yes"},
+			problems: []string{
+				`w="10000" must be an integer between 1 and 9999`,
+				`h="x" must be an integer between 1 and 9999`,
+				`fit="stretch" must be one of crop, cover, contain, scale, fill, scale-down or auto`,
+				`bg="red" must be a 6 digit hex color`,
+				`blur="1000" must be a number from 0 to below 1000`,
+				`rot="360.5" must be a number between 0 and 360`,
+				`flip="x" must be a combination of h and v`,
+				`auto="compress,webp" must be a comma separated list of compress and format`,
+				`q="101" must be an integer between 1 and 100`,
+				`fm="gif" must be one of jpg, jpeg, png or webp`,
+				`dpi="0" must be an integer between 1 and 9999`,
+				`even="yes" must be true or false`,
+			},
+		},
+		{
+			params: map[string]string{crop: "101,50", mono: "ffffff", desat: "1.5", channel: "rgb", duotone: "000000",
+				recolor: "ff0000,blue", recolorTol: "256", solarize: "-1", chroma: "green", denoise: "6", autoSharpen: "1", sharpenAmt: "10", maxMP: "-1"},
+			problems: []string{
+				`crop="101,50" must be a position like top,left or a focal point like 25,75`,
+				`mono="ffffff" must be 000000`,
+				`desat="1.5" must be a number between 0 and 1`,
+				`channel="rgb" must be one of r, g, b or a`,
+				`duotone="000000" must be two comma separated 6 digit hex colors`,
+				`recolor="ff0000,blue" must be two comma separated 6 digit hex colors`,
+				`recolor-tol="256" must be an integer between 0 and 255`,
+				`solarize="-1" must be an integer between 0 and 255`,
+				`chroma="green" must be a 6 digit hex color`,
+				`denoise="6" must be an integer between 1 and 5`,
+				`auto-sharpen="1" must be true or false`,
+				`sharpen-amount="10" must be a number between 0 and 5`,
+				`max-mp="-1" must be a number between 0 and 1000`,
+			},
+		},
+		{
+			params: map[string]string{maxBytes: "0", downscale: "yes", colors: "1", dither: "random"},
+			problems: []string{
+				`max-bytes="0" must be a positive integer`,
+				`allow-downscale="yes" must be true or false`,
+				`colors="1" must be an integer between 2 and 256`,
+				`dither="random" must be one of none or floyd-steinberg`,
+			},
+		},
+		{
+			params: map[string]string{cropOffsetX: "10000", cropOffsetY: "top"},
+			problems: []string{
+				`crop-offset-x="10000" must be an integer between -9999 and 9999`,
+				`crop-offset-y="top" must be an integer between -9999 and 9999`,
+			},
+		},
+		{
+			params: map[string]string{overlayColor: "gray", overlayAlpha: "256"},
+			problems: []string{
+				`overlay-color="gray" must be a 6 digit hex color`,
+				`overlay-opacity="256" must be an integer between 0 and 255`,
+			},
+		},
+		{
+			params: map[string]string{splash: "red", splashTol: "181"},
+			problems: []string{
+				`splash="red" must be a 6 digit hex color`,
+				`splash-tol="181" must be an integer between 0 and 180`,
+			},
+		},
+		{
+			params:   map[string]string{scale: "0"},
+			problems: []string{`scale="0" must be a factor between 0.01 and 4 or a percentage between 1% and 400%`},
+		},
+		{
+			params:   map[string]string{scale: "50"},
+			problems: []string{`scale="50" must be a factor between 0.01 and 4 or a percentage between 1% and 400%`},
+		},
+		{
+			params:   map[string]string{facePad: "150"},
+			problems: []string{`face-pad="150" must be an integer between 0 and 100`},
+		},
+	}
+
+	for _, c := range cases {
+		err := m.Validate(NewSpecBuilder().WithParams(c.params).Build())
+		if c.problems == nil {
+			assert.NoError(t, err, c.params)
+			continue
+		}
+		if assert.IsType(t, &ValidationError{}, err) {
+			assert.Equal(t, c.problems, err.(*ValidationError).Problems)
+		}
+	}
+}
+
+func TestManipulator_ValidateWithStrictParams(t *testing.T) {
+	spec := NewSpecBuilder().WithParams(map[string]string{"widht": "200", width: "0", "utm_source": "x"}).Build()
+
+	err := NewManipulator(nil, nil, nil).Validate(spec)
+	assert.Equal(t, &ValidationError{Problems: []string{`w="0" must be an integer between 1 and 9999`}}, err)
+
+	err = NewManipulator(nil, nil, nil, WithStrictParams(true)).Validate(spec)
+	assert.Equal(t, &ValidationError{Problems: []string{"utm_source is not a known param", "widht is not a known param",
+		`w="0" must be an integer between 1 and 9999`}}, err)
+}
+
+func TestManipulator_ValidateWithAllowedParams(t *testing.T) {
+	spec := NewSpecBuilder().WithParams(map[string]string{width: "200", rotate: "45", blur: "x", "utm_source": "x"}).Build()
+
+	err := NewManipulator(nil, nil, nil, WithAllowedParams(width, height)).Validate(spec)
+	assert.Equal(t, &ValidationError{Problems: []string{"blur is not an allowed param", "rot is not an allowed param",
+		`blur="x" must be a number from 0 to below 1000`}}, err)
+
+	assert.NoError(t, NewManipulator(nil, nil, nil, WithAllowedParams(width, rotate)).Validate(
+		NewSpecBuilder().WithParams(map[string]string{width: "200", rotate: "45"}).Build()))
+}
+
+func TestManipulator_ValidateWithPerspective(t *testing.T) {
+	m := NewManipulator(nil, nil, nil)
+	valid := [4]image.Point{{X: 20, Y: 0}, {X: 200, Y: 30}, {X: 180, Y: 200}, {X: 0, Y: 170}}
+	assert.NoError(t, m.Validate(NewSpecBuilder().WithPerspective(valid).Build()))
+
+	err := m.Validate(NewSpecBuilder().WithPerspective([4]image.Point{{X: -1, Y: 0}, {X: 200, Y: 0},
+		{X: 200, Y: 10000}, {X: 0, Y: 200}}).Build())
+	assert.Equal(t, &ValidationError{Problems: []string{"perspective corner 0 at (-1,0) must be between 0 and 9999",
+		"perspective corner 2 at (200,10000) must be between 0 and 9999"}}, err)
+
+	err = m.Validate(NewSpecBuilder().WithPerspective([4]image.Point{{X: 0, Y: 0}, {X: 9000, Y: 0},
+		{X: 9000, Y: 9000}, {X: 0, Y: 9000}}).Build())
+	assert.Equal(t, &ValidationError{Problems: []string{"perspective output of 9000x9000 must be at most 25000000 pixels"}}, err)
+}
+
+func TestValidationError_Error(t *testing.T) {
+	err := &ValidationError{Problems: []string{`w="0" must be positive`, `h="x" must be positive`}}
+	assert.EqualError(t, err, `invalid params: w="0" must be positive; h="x" must be positive`)
+}
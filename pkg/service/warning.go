@@ -0,0 +1,76 @@
+package service
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+
+	"github.com/gojek/darkroom/pkg/processor"
+)
+
+// WarningCode identifies the kind of a Warning
+type WarningCode string
+
+const (
+	// WarningUpscaled is reported when the image was enlarged beyond the dimensions of its source, which blurs it
+	WarningUpscaled WarningCode = "upscaled"
+	// WarningFormatChanged is reported when the output is encoded to a different format than its source, e.g. an
+	// opaque PNG downgraded to JPEG
+	WarningFormatChanged WarningCode = "format-changed"
+	// WarningDimensionClamped is reported when the output doesn't have the requested dimensions, e.g. w=12000 is
+	// taken as 2000 or max-mp and max-bytes scaled the output down
+	WarningDimensionClamped WarningCode = "dimension-clamped"
+	// WarningAnimationDropped is reported when only the first frame of an animated image was processed, e.g. of an
+	// animated GIF
+	WarningAnimationDropped WarningCode = "animation-dropped"
+	// WarningParamIgnored is reported for a param that couldn't be applied at all, e.g. a filter for an animation
+	WarningParamIgnored WarningCode = "param-ignored"
+)
+
+// Warning describes an issue of processing a spec that didn't fail it, the output is valid but may not be what
+// the params asked for
+type Warning struct {
+	Code WarningCode
+	// Message describes the issue in a human readable form, e.g. for logs or advisory response headers
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Code, w.Message)
+}
+
+// ProcessResult describes the output of ProcessWithResult
+type ProcessResult struct {
+	// Data holds the encoded output image
+	Data []byte
+	// Info describes the output image
+	Info ProcessInfo
+	// Warnings lists the issues of processing the spec in the order they occurred, nil if there were none
+	Warnings []Warning
+	// Capture holds the capture time and camera of the source read from its EXIF, nil if the source has none
+	Capture *processor.CaptureInfo
+}
+
+// warnings collects the Warnings of processing a spec, a nil *warnings discards them
+type warnings []Warning
+
+func (w *warnings) add(code WarningCode, format string, args ...interface{}) {
+	if w != nil {
+		*w = append(*w, Warning{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// addUpscaled adds a WarningUpscaled if an image of size src was enlarged to size dst along either side
+func (w *warnings) addUpscaled(src, dst image.Point) {
+	if dst.X > src.X || dst.Y > src.Y {
+		w.add(WarningUpscaled, "upscaled from %dx%d to %dx%d", src.X, src.Y, dst.X, dst.Y)
+	}
+}
+
+// addWrappedDimension adds a WarningDimensionClamped if the value of the size param p exceeds 9999, which
+// CleanInt wraps around
+func (w *warnings) addWrappedDimension(params map[string]string, p string) {
+	if v, err := strconv.Atoi(params[p]); err == nil && v > 9999 {
+		w.add(WarningDimensionClamped, "%s=%d exceeds 9999 and was taken as %d", p, v, CleanInt(params[p]))
+	}
+}
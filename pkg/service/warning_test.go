@@ -0,0 +1,134 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gojek/darkroom/pkg/metrics"
+	"github.com/gojek/darkroom/pkg/processor"
+	"github.com/gojek/darkroom/pkg/processor/native"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestManipulator_ProcessWithResult(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	// test.jpg is a 500x375 JPEG, staying a JPEG keeps format changes out of the cases
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	cases := []struct {
+		params   map[string]string
+		expected []WarningCode
+	}{
+		{params: map[string]string{width: "200"}},
+		{params: map[string]string{width: "1000"}, expected: []WarningCode{WarningUpscaled}},
+		{params: map[string]string{width: "12000"}, expected: []WarningCode{WarningDimensionClamped, WarningUpscaled}},
+		{params: map[string]string{width: "10300"}, expected: []WarningCode{WarningDimensionClamped}},
+		{params: map[string]string{fit: crop, width: "600", height: "200"}, expected: []WarningCode{WarningUpscaled}},
+		// The padding of fit=contain doesn't count as an enlargement
+		{params: map[string]string{fit: contain, width: "400", height: "400"}},
+		{params: map[string]string{maxMP: "0.1"}, expected: []WarningCode{WarningDimensionClamped}},
+	}
+	for _, c := range cases {
+		res, err := m.ProcessWithResult(NewSpecBuilder().WithImageData(img).WithParams(c.params).Build())
+		assert.Nil(t, err, c.params)
+		var codes []WarningCode
+		for _, w := range res.Warnings {
+			codes = append(codes, w.Code)
+		}
+		assert.Equal(t, c.expected, codes, c.params)
+		assert.NotEmpty(t, res.Data, c.params)
+		assert.Equal(t, len(res.Data), res.Info.Size, c.params)
+	}
+
+	res, err := m.ProcessWithResult(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{width: "12000"}).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, "dimension-clamped: w=12000 exceeds 9999 and was taken as 2000", res.Warnings[0].String())
+	assert.Equal(t, "upscaled from 500x375 to 2000x1500", res.Warnings[1].Message)
+
+	png, _ := ioutil.ReadFile("../processor/native/_testdata/test.png")
+	params := map[string]string{width: "200", outputFormat: "jpeg"}
+	res, err = m.ProcessWithResult(NewSpecBuilder().WithImageData(png).WithParams(params).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, []Warning{{Code: WarningFormatChanged, Message: "encoded image/png source as image/jpeg"}}, res.Warnings)
+
+	data, info, err := m.ProcessWithInfo(NewSpecBuilder().WithImageData(png).WithParams(params).Build())
+	assert.Nil(t, err)
+	assert.Equal(t, res.Data, data)
+	assert.Equal(t, res.Info, info)
+}
+
+func TestManipulator_ProcessWithResult_Capture(t *testing.T) {
+	m := NewManipulator(native.NewBildProcessor(), nil, metrics.NoOpMetricService{})
+	img, _ := ioutil.ReadFile("../processor/native/_testdata/test.jpg")
+	res, err := m.ProcessWithResult(NewSpecBuilder().WithImageData(img).WithParams(map[string]string{width: "200"}).Build())
+	assert.Nil(t, err)
+	assert.Nil(t, res.Capture)
+
+	// A little-endian EXIF with only the camera make "GP" in IFD0
+	exif := []byte("\xff\xe1\x00\x22Exif\x00\x00II\x2a\x00\x08\x00\x00\x00\x01\x00" +
+		"\x0f\x01\x02\x00\x03\x00\x00\x00GP\x00\x00\x00\x00\x00\x00")
+	img, _ = native.SetJPEGMetadata(img, [][]byte{exif})
+	for _, params := range []map[string]string{{width: "200"}, {minProcess: "1000"}} {
+		res, err = m.ProcessWithResult(NewSpecBuilder().WithImageData(img).WithParams(params).Build())
+		assert.Nil(t, err, params)
+		assert.Equal(t, &processor.CaptureInfo{Make: "GP"}, res.Capture, params)
+	}
+}
+
+func TestManipulator_ProcessWithResult_AnimatedGIF(t *testing.T) {
+	// Importing image/gif registers its decoder, which only returns the first of the 2 frames
+	g := &gif.GIF{Delay: []int{10, 10}}
+	for i := 0; i < 2; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 40, 30), palette.Plan9))
+	}
+	var buf bytes.Buffer
+	_ = gif.EncodeAll(&buf, g)
+	spec := NewSpecBuilder().WithImageData(buf.Bytes()).WithParams(map[string]string{width: "20", outputFormat: "png"}).Build()
+
+	ms := &metrics.MockMetricService{}
+	ms.On("TrackDuration", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountProcessedPixels", mock.Anything, mock.Anything)
+	ms.On("CountFormatChanges", mock.Anything, mock.Anything, mock.Anything)
+	ms.On("CountImageProcessErrors", animationErrorKey, "default", "gif")
+	m := NewManipulator(native.NewBildProcessor(), nil, ms)
+	res, err := m.ProcessWithResult(spec)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, res.Info.Width)
+	assert.Contains(t, res.Warnings, Warning{Code: WarningAnimationDropped,
+		Message: "only the first frame of the animated gif was processed"})
+	ms.AssertCalled(t, "CountImageProcessErrors", animationErrorKey, "default", "gif")
+
+	m = NewManipulator(native.NewBildProcessor(), nil, ms, WithRejectAnimated(true))
+	_, err = m.ProcessWithResult(spec)
+	assert.Equal(t, ErrAnimationDropped, err)
+	_, err = m.Canvas(buf.Bytes(), 50, 50, "ffffff", FitContain)
+	assert.Equal(t, ErrAnimationDropped, err)
+	_, err = m.(LQIPGenerator).LQIP(buf.Bytes(), 0)
+	assert.Equal(t, ErrAnimationDropped, err)
+	ms.AssertNumberOfCalls(t, "CountImageProcessErrors", 4)
+
+	// A single frame GIF is processed without a warning
+	g = &gif.GIF{Image: g.Image[:1], Delay: g.Delay[:1]}
+	buf.Reset()
+	_ = gif.EncodeAll(&buf, g)
+	res, err = m.ProcessWithResult(NewSpecBuilder().WithImageData(buf.Bytes()).WithParams(spec.Params).Build())
+	assert.Nil(t, err)
+	assert.NotContains(t, res.Warnings, Warning{Code: WarningAnimationDropped,
+		Message: "only the first frame of the animated gif was processed"})
+}
+
+func TestWarnings_addUpscaled(t *testing.T) {
+	w := &warnings{}
+	w.addUpscaled(image.Pt(100, 100), image.Pt(50, 100))
+	assert.Empty(t, *w)
+	w.addUpscaled(image.Pt(100, 100), image.Pt(50, 101))
+	assert.Len(t, *w, 1)
+
+	// A nil *warnings discards them
+	var discard *warnings
+	discard.addUpscaled(image.Pt(100, 100), image.Pt(200, 200))
+}